@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/health"
+	"github.com/swfrench/nginx-log-consumer/stats"
+	"github.com/swfrench/nginx-log-consumer/topk"
+)
+
+// openMetricsContentType is the Content-Type of the OpenMetrics text format.
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// newAdminHandler returns a handler serving the admin endpoints:
+//
+//   - /metrics serves the current values held by the supplied Registry, with
+//     names built using the provided Naming.
+//   - /healthz reports that the process is alive.
+//   - /readyz reports whether the consumer is making progress, according to the
+//     supplied Checker, with status 503 if not.
+//   - /topk reports the most frequent values counted by the supplied Trackers,
+//     as JSON (optionally only for that named by the name parameter).
+func newAdminHandler(n *naming.Naming, reg *stats.Registry, checker *health.Checker, trackers []*topk.Tracker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", openMetricsContentType)
+		if err := exporter.WriteOpenMetrics(w, n, stats.Specs(), reg.Snapshot()); err != nil {
+			log.Printf("Could not write metrics: %v", err)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := checker.Check(time.Now()); err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+	})
+	mux.HandleFunc("/topk", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		now := time.Now()
+		report := topkReport{Time: now.UTC(), Trackers: []topkTracker{}}
+		for _, t := range trackers {
+			if name != "" && t.Name != name {
+				continue
+			}
+			report.Trackers = append(report.Trackers, topkTracker{
+				Name:   t.Name,
+				Field:  t.Field,
+				Window: t.Window.String(),
+				Top:    t.Top(now),
+			})
+		}
+		if name != "" && len(report.Trackers) == 0 {
+			http.Error(w, fmt.Sprintf("unknown heavy hitter %q", name), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("Could not write heavy hitters: %v", err)
+		}
+	})
+	return mux
+}
+
+// topkReport is the response of the /topk admin endpoint.
+type topkReport struct {
+	Time     time.Time     `json:"time"`
+	Trackers []topkTracker `json:"heavy_hitters"`
+}
+
+// topkTracker describes the most frequent values counted by a Tracker.
+type topkTracker struct {
+	Name   string       `json:"name"`
+	Field  string       `json:"field"`
+	Window string       `json:"window"`
+	Top    []topk.Count `json:"top"`
+}
+
+// serveAdmin starts serving the admin endpoints (see newAdminHandler) on the
+// supplied address, returning once listening.
+func serveAdmin(addr string, n *naming.Naming, reg *stats.Registry, checker *health.Checker, trackers []*topk.Tracker) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(l, newAdminHandler(n, reg, checker, trackers)); err != nil {
+			log.Printf("Admin server failed: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,351 @@
+// Package alert evaluates simple threshold rules against recent log records
+// (e.g. the ratio of server errors, or latency), and notifies webhooks when
+// they start and stop firing, for deployments without a monitoring stack of
+// their own.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/window"
+)
+
+// Kind is the kind of condition tested by a Rule.
+type Kind string
+
+const (
+	// Ratio rules fire when the proportion of records matching Match
+	// exceeds Threshold.
+	Ratio Kind = "ratio"
+	// Latency rules fire when the Quantile of the latency in Field exceeds
+	// Threshold (in seconds).
+	Latency Kind = "latency"
+	// NoTraffic rules fire when there are no records.
+	NoTraffic Kind = "no_traffic"
+)
+
+const (
+	// DefaultEvaluationPeriod is the default period between evaluations
+	// of rules.
+	DefaultEvaluationPeriod = 30 * time.Second
+
+	// DefaultWindow is the default window over which rules are evaluated.
+	DefaultWindow = 5 * time.Minute
+
+	// DefaultRepeatInterval is the default interval between repeated
+	// notifications of firing rules.
+	DefaultRepeatInterval = 4 * time.Hour
+
+	// DefaultQuantile is the default quantile of Latency rules.
+	DefaultQuantile = 0.99
+
+	// DefaultLatencyField is the default record field holding the latency
+	// (in seconds) tested by Latency rules.
+	DefaultLatencyField = "request_time"
+
+	// Firing and Resolved are the statuses of Notifications.
+	Firing   = "firing"
+	Resolved = "resolved"
+
+	// steps is the number of steps into which each window is divided,
+	// determining the granularity with which it slides.
+	steps = 10
+
+	// notifyTimeout bounds the time taken to deliver each Notification.
+	notifyTimeout = 10 * time.Second
+)
+
+// DefaultMatch returns the Filter matching records by default for Ratio
+// rules: Those with a status of 500 or above.
+func DefaultMatch() *metric.Filter {
+	errors := 500.0
+	return &metric.Filter{
+		Include: []metric.Rule{{{Field: parser.StatusField, GE: &errors}}},
+	}
+}
+
+// counts holds the numbers of records matched and observed in a step.
+type counts struct {
+	matched, total int64
+}
+
+// Rule describes a condition on the records (selected by Filter) with
+// timestamps in the preceding Window, and counts those records. It is safe
+// for concurrent use.
+type Rule struct {
+	Name   string
+	Kind   Kind
+	Window time.Duration
+	// Filter, if set, selects the records considered.
+	Filter *metric.Filter
+	// Match selects the records whose proportion is tested by Ratio
+	// rules.
+	Match *metric.Filter
+	// Threshold is the proportion of records (for Ratio rules) or latency
+	// in seconds (for Latency rules) above which the rule fires.
+	Threshold float64
+	// Field and Quantile give the latency tested by Latency rules.
+	Field    string
+	Quantile float64
+
+	mu    sync.Mutex
+	steps *window.Ring[counts]
+	// start is the time of the first evaluation, before which NoTraffic
+	// rules have no records.
+	start time.Time
+}
+
+// Validate checks that the Rule is well formed.
+func (r *Rule) Validate() error {
+	if err := metric.ValidateName(r.Name); err != nil {
+		return err
+	}
+	if r.Window < steps*time.Second {
+		return fmt.Errorf("window must be at least %v", steps*time.Second)
+	}
+	switch r.Kind {
+	case Ratio:
+		if !(r.Threshold > 0 && r.Threshold < 1) {
+			return fmt.Errorf("threshold must be between 0 and 1 (exclusive)")
+		}
+	case Latency:
+		if r.Field == "" {
+			return fmt.Errorf("field must be set")
+		}
+		if r.Threshold <= 0 {
+			return fmt.Errorf("latency threshold must be positive")
+		}
+		if !(r.Quantile > 0 && r.Quantile < 1) {
+			return fmt.Errorf("quantile must be between 0 and 1 (exclusive)")
+		}
+	case NoTraffic:
+	default:
+		return fmt.Errorf("unknown rule type %q", r.Kind)
+	}
+	return nil
+}
+
+// matches returns whether the supplied record is matched by the Rule, and
+// whether it is counted at all.
+func (r *Rule) matches(rec parser.Record) (matched, ok bool) {
+	switch r.Kind {
+	case Ratio:
+		return r.Match.Matches(rec), true
+	case Latency:
+		x, err := strconv.ParseFloat(rec[r.Field], 64)
+		if err != nil {
+			return false, false
+		}
+		return x > r.Threshold, true
+	}
+	return false, true
+}
+
+// Observe counts the supplied record, with the supplied timestamp, if it is
+// selected by the Filter. Records preceding the window are ignored.
+func (r *Rule) Observe(ts time.Time, rec parser.Record) {
+	if !r.Filter.Matches(rec) {
+		return
+	}
+	matched, ok := r.matches(rec)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.steps == nil {
+		r.steps = window.New[counts](r.Window/steps, steps)
+	}
+	c := r.steps.Add(ts)
+	if c == nil {
+		return
+	}
+	c.total++
+	if matched {
+		c.matched++
+	}
+}
+
+// Evaluate returns whether the Rule fires over the window ending at the
+// supplied time, and a summary of the value tested.
+func (r *Rule) Evaluate(now time.Time) (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.start.IsZero() {
+		r.start = now
+	}
+	var matched, total int64
+	if r.steps != nil {
+		r.steps.Each(now, r.Window, func(c counts) {
+			matched += c.matched
+			total += c.total
+		})
+	}
+
+	switch r.Kind {
+	case Ratio:
+		if total == 0 {
+			return false, fmt.Sprintf("No records over the last %v", r.Window)
+		}
+		ratio := float64(matched) / float64(total)
+		return ratio > r.Threshold, fmt.Sprintf("%.2f%% of %d records matched over the last %v (threshold %.4g%%)", 100*ratio, total, r.Window, 100*r.Threshold)
+	case Latency:
+		if total == 0 {
+			return false, fmt.Sprintf("No records over the last %v", r.Window)
+		}
+		ratio := float64(matched) / float64(total)
+		// The quantile exceeds the threshold if more records than the
+		// remaining proportion do.
+		firing := ratio > 1-r.Quantile
+		cmp := "within"
+		if firing {
+			cmp = "above"
+		}
+		threshold := time.Duration(r.Threshold * float64(time.Second))
+		return firing, fmt.Sprintf("p%.4g of %s is %s %v over the last %v (%.2f%% of %d records above)", 100*r.Quantile, r.Field, cmp, threshold, r.Window, 100*ratio, total)
+	default:
+		if total == 0 && now.Sub(r.start) < r.Window {
+			// Too soon to tell.
+			return false, fmt.Sprintf("No records since %v", r.start.Format(time.RFC3339))
+		}
+		return total == 0, fmt.Sprintf("%d records over the last %v", total, r.Window)
+	}
+}
+
+// Notification describes a change in the status of a rule (or that it
+// remains firing).
+type Notification struct {
+	Rule    string `json:"rule"`
+	Status  string `json:"status"`
+	Summary string `json:"summary"`
+	// Source identifies the consumer (e.g. its host).
+	Source string `json:"source,omitempty"`
+	// StartsAt is the time at which the rule started firing.
+	StartsAt time.Time `json:"starts_at"`
+	// EndsAt, for Resolved notifications, is the time at which it stopped.
+	EndsAt *time.Time `json:"ends_at,omitempty"`
+}
+
+// Notifier delivers Notifications (e.g. a Webhook).
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// sent records the last Notification successfully delivered to a Notifier.
+type sent struct {
+	status string
+	at     time.Time
+}
+
+// state is the status of a rule, and the Notifications sent of it.
+type state struct {
+	firing bool
+	since  time.Time
+	sent   []sent
+}
+
+// Manager evaluates Rules, notifying each Notifier when a rule starts firing
+// (repeated every RepeatInterval while it remains so) and when it is
+// resolved. Notifications which cannot be delivered are retried on the next
+// evaluation.
+type Manager struct {
+	Rules     []*Rule
+	Notifiers []Notifier
+	// RepeatInterval, if positive, is the interval between repeated
+	// notifications of firing rules.
+	RepeatInterval time.Duration
+	// Source identifies the consumer in Notifications.
+	Source string
+	// EvaluationPeriod is the period between evaluations by Run.
+	EvaluationPeriod time.Duration
+
+	mu     sync.Mutex
+	states map[string]*state
+}
+
+// Observe counts the supplied record, with the supplied timestamp, for each
+// Rule.
+func (m *Manager) Observe(ts time.Time, r parser.Record) {
+	for _, rule := range m.Rules {
+		rule.Observe(ts, r)
+	}
+}
+
+// Evaluate evaluates each Rule at the supplied time, and sends any
+// Notifications due.
+func (m *Manager) Evaluate(ctx context.Context, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.states == nil {
+		m.states = make(map[string]*state)
+	}
+	for _, rule := range m.Rules {
+		firing, summary := rule.Evaluate(now)
+		st, ok := m.states[rule.Name]
+		if !ok {
+			st = &state{sent: make([]sent, len(m.Notifiers))}
+			m.states[rule.Name] = st
+		}
+		if firing && !st.firing {
+			st.since = now
+			log.Printf("Alert %s firing: %s", rule.Name, summary)
+		} else if !firing && st.firing {
+			log.Printf("Alert %s resolved: %s", rule.Name, summary)
+		}
+		st.firing = firing
+
+		n := &Notification{
+			Rule:     rule.Name,
+			Status:   Resolved,
+			Summary:  summary,
+			Source:   m.Source,
+			StartsAt: st.since,
+		}
+		if firing {
+			n.Status = Firing
+		} else {
+			end := now
+			n.EndsAt = &end
+		}
+		for i, notifier := range m.Notifiers {
+			last := st.sent[i]
+			due := last.status == Firing && !firing
+			if firing {
+				due = last.status != Firing || (m.RepeatInterval > 0 && now.Sub(last.at) >= m.RepeatInterval)
+			}
+			if !due {
+				continue
+			}
+			nctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+			err := notifier.Notify(nctx, n)
+			cancel()
+			if err != nil {
+				log.Printf("Could not send %s notification for alert %s: %v", n.Status, rule.Name, err)
+				continue
+			}
+			st.sent[i] = sent{status: n.Status, at: now}
+		}
+	}
+}
+
+// Run evaluates the Rules every EvaluationPeriod, until the supplied context
+// is done.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.EvaluationPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.Evaluate(ctx, now)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package alert_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/alert"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+// webhookServer records the bodies of requests to a test HTTP server,
+// responding with status.
+type webhookServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	bodies  []string
+	headers []http.Header
+	status  int
+}
+
+func newWebhookServer() *webhookServer {
+	s := &webhookServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.bodies = append(s.bodies, string(b))
+		s.headers = append(s.headers, r.Header)
+		w.WriteHeader(s.status)
+	}))
+	return s
+}
+
+// setStatus sets the status of subsequent responses.
+func (s *webhookServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// notifications returns the Notifications received, decoded from JSON.
+func (s *webhookServer) notifications(t *testing.T) []alert.Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ns []alert.Notification
+	for _, b := range s.bodies {
+		var n alert.Notification
+		if err := json.Unmarshal([]byte(b), &n); err != nil {
+			t.Fatalf("Could not decode notification %q: %v", b, err)
+		}
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+// observe adds n records with the supplied status and latency at ts.
+func observe(m *alert.Manager, ts time.Time, n int, status, latency string) {
+	for i := 0; i < n; i++ {
+		m.Observe(ts, parser.Record{"status": status, "request_time": latency})
+	}
+}
+
+func TestRules(t *testing.T) {
+	start := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	errors := &alert.Rule{Name: "errors", Kind: alert.Ratio, Window: 5 * time.Minute, Match: alert.DefaultMatch(), Threshold: 0.05}
+	slow := &alert.Rule{Name: "slow", Kind: alert.Latency, Window: 5 * time.Minute, Field: alert.DefaultLatencyField, Quantile: alert.DefaultQuantile, Threshold: 2}
+	idle := &alert.Rule{Name: "idle", Kind: alert.NoTraffic, Window: 10 * time.Minute}
+	rules := []*alert.Rule{errors, slow, idle}
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			t.Fatalf("Expected %s to be valid, got %v", r.Name, err)
+		}
+	}
+	m := &alert.Manager{Rules: rules}
+
+	check := func(now time.Time, want map[string]bool) {
+		t.Helper()
+		for _, r := range rules {
+			if got, summary := r.Evaluate(now); got != want[r.Name] {
+				t.Errorf("Expected %s to fire: %v at %v, got %v (%s)", r.Name, want[r.Name], now, got, summary)
+			}
+		}
+	}
+
+	// No traffic is not reported until the window has passed.
+	check(start, map[string]bool{})
+	check(start.Add(9*time.Minute), map[string]bool{})
+	check(start.Add(10*time.Minute), map[string]bool{"idle": true})
+
+	now := start.Add(20 * time.Minute)
+	observe(m, now.Add(-time.Minute), 95, "200", "0.1")
+	observe(m, now.Add(-time.Minute), 5, "503", "0.1")
+	check(now, map[string]bool{})
+
+	observe(m, now.Add(-time.Minute), 1, "200", "2.5")
+	observe(m, now.Add(-time.Minute), 1, "502", "2.5")
+	check(now, map[string]bool{"errors": true, "slow": true})
+
+	// The records leave the error and latency windows before the idle one.
+	check(now.Add(5*time.Minute), map[string]bool{})
+	check(now.Add(10*time.Minute), map[string]bool{"idle": true})
+}
+
+func TestValidate(t *testing.T) {
+	for _, r := range []*alert.Rule{
+		{Name: "Errors", Kind: alert.Ratio, Window: time.Minute, Threshold: 0.1},
+		{Name: "errors", Kind: alert.Ratio, Window: time.Second, Threshold: 0.1},
+		{Name: "errors", Kind: alert.Ratio, Window: time.Minute, Threshold: 5},
+		{Name: "slow", Kind: alert.Latency, Window: time.Minute, Threshold: 2, Quantile: 0.99},
+		{Name: "slow", Kind: alert.Latency, Window: time.Minute, Field: "request_time", Quantile: 0.99},
+		{Name: "slow", Kind: alert.Latency, Window: time.Minute, Field: "request_time", Threshold: 2, Quantile: 99},
+		{Name: "other", Kind: "rate", Window: time.Minute},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("Expected Validate to fail for %+v", r)
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	s := newWebhookServer()
+	defer s.Close()
+
+	m := &alert.Manager{
+		Rules: []*alert.Rule{
+			{Name: "errors", Kind: alert.Ratio, Window: 5 * time.Minute, Match: alert.DefaultMatch(), Threshold: 0.05},
+		},
+		Notifiers:      []alert.Notifier{&alert.Webhook{URL: s.URL, Headers: map[string]string{"Authorization": "Bearer secret"}}},
+		RepeatInterval: time.Hour,
+		Source:         "web-1",
+	}
+	ctx := context.Background()
+	start := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	m.Evaluate(ctx, start)
+	if got := s.notifications(t); len(got) != 0 {
+		t.Fatalf("Expected no notifications for a rule not firing, got %v", got)
+	}
+
+	observe(m, start, 10, "500", "0.1")
+	for i := 0; i < 3; i++ {
+		m.Evaluate(ctx, start.Add(time.Duration(i)*time.Minute))
+	}
+	got := s.notifications(t)
+	if len(got) != 1 || got[0].Status != alert.Firing || got[0].Rule != "errors" || got[0].Source != "web-1" || !got[0].StartsAt.Equal(start) {
+		t.Fatalf("Expected a single firing notification, got %+v", got)
+	}
+	if want, got := "Bearer secret", s.headers[0].Get("Authorization"); want != got {
+		t.Errorf("Expected Authorization header %q, got %q", want, got)
+	}
+
+	// A failed notification is retried on the next evaluation.
+	s.setStatus(http.StatusServiceUnavailable)
+	observe(m, start.Add(time.Hour), 10, "500", "0.1")
+	m.Evaluate(ctx, start.Add(time.Hour))
+	s.setStatus(http.StatusOK)
+	m.Evaluate(ctx, start.Add(time.Hour+time.Minute))
+	if got := s.notifications(t); len(got) != 3 || got[2].Status != alert.Firing {
+		t.Fatalf("Expected a repeated firing notification to be retried, got %+v", got)
+	}
+
+	m.Evaluate(ctx, start.Add(2*time.Hour))
+	m.Evaluate(ctx, start.Add(2*time.Hour+time.Minute))
+	got = s.notifications(t)
+	if len(got) != 4 || got[3].Status != alert.Resolved || got[3].EndsAt == nil || !got[3].EndsAt.Equal(start.Add(2*time.Hour)) {
+		t.Fatalf("Expected a single resolved notification, got %+v", got)
+	}
+}
+
+func TestSlackWebhook(t *testing.T) {
+	s := newWebhookServer()
+	defer s.Close()
+
+	w := &alert.Webhook{URL: s.URL, Format: alert.FormatSlack}
+	n := &alert.Notification{Rule: "errors", Status: alert.Firing, Summary: "10% of records matched", Source: "web-1"}
+	if err := w.Notify(context.Background(), n); err != nil {
+		t.Fatalf("Notify failed with %v", err)
+	}
+	var msg map[string]string
+	if err := json.Unmarshal([]byte(s.bodies[0]), &msg); err != nil {
+		t.Fatalf("Could not decode message %q: %v", s.bodies[0], err)
+	}
+	if want, got := "[FIRING] errors on web-1: 10% of records matched", msg["text"]; want != got {
+		t.Errorf("Expected text %q, got %q", want, got)
+	}
+
+	s.setStatus(http.StatusNotFound)
+	if err := w.Notify(context.Background(), n); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected Notify to fail with status 404, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// FormatJSON posts Notifications as JSON objects.
+	FormatJSON = "json"
+	// FormatSlack posts Notifications as Slack (or compatible, e.g.
+	// Mattermost) incoming webhook messages.
+	FormatSlack = "slack"
+)
+
+// Webhook implements Notifier, posting Notifications to a URL.
+type Webhook struct {
+	URL string
+	// Format is FormatJSON (the default) or FormatSlack.
+	Format string
+	// Headers are added to each request (e.g. Authorization).
+	Headers map[string]string
+	// Client, if set, is used in place of http.DefaultClient.
+	Client *http.Client
+}
+
+// slackMessage is the payload of a Slack incoming webhook.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// payload returns the body posted for the supplied Notification.
+func (w *Webhook) payload(n *Notification) ([]byte, error) {
+	if w.Format != FormatSlack {
+		return json.Marshal(n)
+	}
+	text := fmt.Sprintf("[%s] %s", strings.ToUpper(n.Status), n.Rule)
+	if n.Source != "" {
+		text += " on " + n.Source
+	}
+	text += ": " + n.Summary
+	return json.Marshal(&slackMessage{Text: text})
+}
+
+// Notify posts the supplied Notification, returning an error if it is not
+// accepted (with a 2xx status).
+func (w *Webhook) Notify(ctx context.Context, n *Notification) error {
+	b, err := w.payload(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so that the connection may be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Package apdex classifies requests by the satisfaction of users with their
+// response time (per the Apdex standard), per route: Satisfied within the
+// route's threshold T, tolerating within 4T, and otherwise (or on server
+// errors) frustrated. The Apdex score of a set of requests is the mean of
+// their scores: 1 if satisfied, 0.5 if tolerating and 0 if frustrated.
+package apdex
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+const (
+	// RouteField is the name of the record field to which the Scorer writes
+	// the route of the request.
+	RouteField = "apdex_route"
+
+	// LevelField is the name of the record field to which the Scorer
+	// writes the level of satisfaction (Satisfied, Tolerating or
+	// Frustrated).
+	LevelField = "apdex_level"
+
+	// ScoreField is the name of the record field to which the Scorer
+	// writes the score of the request (1, 0.5 or 0).
+	ScoreField = "apdex_score"
+
+	// Levels of satisfaction.
+	Satisfied  = "satisfied"
+	Tolerating = "tolerating"
+	Frustrated = "frustrated"
+
+	// OtherRoute is the route of requests matching no configured Route.
+	OtherRoute = "other"
+
+	// DefaultThreshold is the default threshold T.
+	DefaultThreshold = 500 * time.Millisecond
+
+	// DefaultLatencyField is the default record field holding the response
+	// time (in seconds).
+	DefaultLatencyField = "request_time"
+
+	// CountMetric and ScoreMetric name the metrics returned by Specs.
+	CountMetric = "apdex/response_count"
+	ScoreMetric = "apdex/score"
+)
+
+// Route describes requests (e.g. by path or host) sharing a threshold.
+type Route struct {
+	Name string
+	// Filter, if set, selects the requests of the Route.
+	Filter *metric.Filter
+	// Threshold is the response time T within which users are satisfied.
+	Threshold time.Duration
+}
+
+// Scorer implements parser.Enricher, writing the route, level of satisfaction
+// and score of requests to RouteField, LevelField and ScoreField. Records
+// lacking a valid LatencyField are not scored.
+type Scorer struct {
+	// Routes are matched in order; requests matching none are of
+	// OtherRoute, with the default Threshold.
+	Routes       []Route
+	Threshold    time.Duration
+	LatencyField string
+}
+
+// NewScorer returns a Scorer for the supplied Routes, with DefaultThreshold
+// and DefaultLatencyField.
+func NewScorer(routes []Route) *Scorer {
+	return &Scorer{
+		Routes:       routes,
+		Threshold:    DefaultThreshold,
+		LatencyField: DefaultLatencyField,
+	}
+}
+
+// Validate checks that the Scorer is well formed.
+func (s *Scorer) Validate() error {
+	if s.Threshold <= 0 {
+		return fmt.Errorf("threshold must be positive")
+	}
+	seen := map[string]bool{OtherRoute: true}
+	for _, r := range s.Routes {
+		if err := metric.ValidateName(r.Name); err != nil {
+			return fmt.Errorf("invalid route: %v", err)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("duplicate route %q", r.Name)
+		}
+		seen[r.Name] = true
+		if r.Threshold <= 0 {
+			return fmt.Errorf("threshold of route %s must be positive", r.Name)
+		}
+	}
+	return nil
+}
+
+// Level returns the level of satisfaction with a response of the supplied
+// status and time, given the threshold T.
+func Level(status int, responseTime, threshold time.Duration) string {
+	switch {
+	case status >= 500 || responseTime > 4*threshold:
+		return Frustrated
+	case responseTime > threshold:
+		return Tolerating
+	}
+	return Satisfied
+}
+
+// scores are the scores of each level of satisfaction.
+var scores = map[string]string{
+	Satisfied:  "1",
+	Tolerating: "0.5",
+	Frustrated: "0",
+}
+
+// Enrich sets the RouteField, LevelField and ScoreField of the supplied
+// record.
+func (s *Scorer) Enrich(r parser.Record) {
+	seconds, err := strconv.ParseFloat(r[s.LatencyField], 64)
+	if err != nil {
+		return
+	}
+	// Records lacking a valid status are not server errors.
+	status, _ := strconv.Atoi(r[parser.StatusField])
+
+	route, threshold := OtherRoute, s.Threshold
+	for _, rt := range s.Routes {
+		if rt.Filter.Matches(r) {
+			route, threshold = rt.Name, rt.Threshold
+			break
+		}
+	}
+	level := Level(status, time.Duration(seconds*float64(time.Second)), threshold)
+	r[RouteField] = route
+	r[LevelField] = level
+	r[ScoreField] = scores[level]
+}
+
+// Specs returns the Specs of metrics computed from the fields written by the
+// Scorer, for the records selected by the supplied Filter (which may be nil):
+// A counter of requests by route and level, and a gauge of the Apdex score
+// by route, per window.
+func Specs(filter *metric.Filter) []*metric.Spec {
+	route := metric.Label{
+		Name:        "route",
+		Field:       RouteField,
+		Type:        metric.StringLabel,
+		Description: "Route",
+	}
+	return []*metric.Spec{
+		{
+			Name:        CountMetric,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of HTTP responses by route and level of satisfaction (satisfied, tolerating or frustrated).",
+			Labels: []metric.Label{
+				route,
+				{
+					Name:        "level",
+					Field:       LevelField,
+					Type:        metric.StringLabel,
+					Description: "Level of satisfaction",
+				},
+			},
+			Filter: filter,
+		},
+		{
+			Name:        ScoreMetric,
+			Kind:        metric.Gauge,
+			Description: "Apdex score of HTTP responses by route, from 0 (all frustrated) to 1 (all satisfied).",
+			Field:       ScoreField,
+			Labels:      []metric.Label{route},
+			Filter:      filter,
+			Mean:        true,
+		},
+	}
+}
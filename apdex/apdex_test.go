@@ -0,0 +1,103 @@
+package apdex_test
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/apdex"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+func TestLevel(t *testing.T) {
+	for _, tc := range []struct {
+		status       int
+		responseTime time.Duration
+		want         string
+	}{
+		{200, 100 * time.Millisecond, apdex.Satisfied},
+		{200, 500 * time.Millisecond, apdex.Satisfied},
+		{404, 501 * time.Millisecond, apdex.Tolerating},
+		{200, 2 * time.Second, apdex.Tolerating},
+		{200, 2001 * time.Millisecond, apdex.Frustrated},
+		{503, 10 * time.Millisecond, apdex.Frustrated},
+	} {
+		if got := apdex.Level(tc.status, tc.responseTime, 500*time.Millisecond); got != tc.want {
+			t.Errorf("Expected level %s for status %d in %v, got %s", tc.want, tc.status, tc.responseTime, got)
+		}
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	s := apdex.NewScorer([]apdex.Route{
+		{
+			Name:      "api",
+			Filter:    &metric.Filter{Include: []metric.Rule{{{Field: "path", Pattern: regexp.MustCompile(`^/api/`)}}}},
+			Threshold: 100 * time.Millisecond,
+		},
+	})
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Expected scorer to be valid, got %v", err)
+	}
+	for _, tc := range []struct {
+		record parser.Record
+		route  string
+		level  string
+		score  string
+	}{
+		{parser.Record{"path": "/api/users", "status": "200", "request_time": "0.050"}, "api", apdex.Satisfied, "1"},
+		{parser.Record{"path": "/api/users", "status": "200", "request_time": "0.300"}, "api", apdex.Tolerating, "0.5"},
+		{parser.Record{"path": "/index.html", "status": "200", "request_time": "0.300"}, apdex.OtherRoute, apdex.Satisfied, "1"},
+		{parser.Record{"path": "/index.html", "status": "500", "request_time": "0.001"}, apdex.OtherRoute, apdex.Frustrated, "0"},
+		{parser.Record{"path": "/index.html", "status": "200", "request_time": "-"}, "", "", ""},
+	} {
+		s.Enrich(tc.record)
+		if tc.record[apdex.RouteField] != tc.route || tc.record[apdex.LevelField] != tc.level || tc.record[apdex.ScoreField] != tc.score {
+			t.Errorf("Expected route %q, level %q and score %q, got %v", tc.route, tc.level, tc.score, tc.record)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []*apdex.Scorer{
+		{Threshold: 0},
+		{Threshold: time.Second, Routes: []apdex.Route{{Name: "API", Threshold: time.Second}}},
+		{Threshold: time.Second, Routes: []apdex.Route{{Name: "other", Threshold: time.Second}}},
+		{Threshold: time.Second, Routes: []apdex.Route{{Name: "api", Threshold: time.Second}, {Name: "api", Threshold: time.Second}}},
+		{Threshold: time.Second, Routes: []apdex.Route{{Name: "api"}}},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("Expected Validate to fail for %+v", s)
+		}
+	}
+}
+
+func TestSpecs(t *testing.T) {
+	s := apdex.NewScorer(nil)
+	specs := apdex.Specs(nil)
+	for _, spec := range specs {
+		if err := spec.Validate(); err != nil {
+			t.Fatalf("Expected %s to be valid, got %v", spec.Name, err)
+		}
+	}
+	values := metric.NewValues()
+	for _, latency := range []string{"0.1", "0.2", "1.0", "5.0"} {
+		r := parser.Record{"status": "200", "request_time": latency}
+		s.Enrich(r)
+		for _, spec := range specs {
+			spec.Observe(r, values)
+		}
+	}
+
+	values.UpdateGauges()
+
+	key := metric.Key([]string{apdex.OtherRoute})
+	if want, got := int64(2), values.Counters[apdex.CountMetric][metric.Key([]string{apdex.OtherRoute, apdex.Satisfied})]; want != got {
+		t.Errorf("Expected %d satisfied responses, got %d", want, got)
+	}
+	// (2 satisfied + 1 tolerating / 2) / 4 responses.
+	if want, got := 0.625, values.Gauges[apdex.ScoreMetric][key]; want != got {
+		t.Errorf("Expected score %v, got %v", want, got)
+	}
+}
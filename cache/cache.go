@@ -0,0 +1,115 @@
+// Package cache classifies responses by the status of the nginx cache (as
+// logged in $upstream_cache_status), so that cache hit ratios, and the bytes
+// served from the cache rather than the origin, may be computed.
+package cache
+
+import (
+	"strings"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+const (
+	// StatusField is the name of the record field holding the cache status
+	// logged by nginx (e.g. HIT), which is absent (or "-") for responses not
+	// eligible for caching.
+	StatusField = "upstream_cache_status"
+
+	// CacheStatusField is the name of the record field to which the
+	// Classifier writes the normalized cache status (e.g. hit).
+	CacheStatusField = "cache_status"
+
+	// SourceField is the name of the record field to which the Classifier
+	// writes the source of the response (Cache or Origin).
+	SourceField = "cache_source"
+
+	// Sources of responses.
+	Cache  = "cache"
+	Origin = "origin"
+
+	// DefaultBytesField is the default record field holding the number of
+	// bytes sent.
+	DefaultBytesField = "body_bytes_sent"
+
+	// CountMetric and BytesMetric name the metrics returned by Specs.
+	CountMetric = "http_cache_response_count"
+	BytesMetric = "http_cache_bytes_sent"
+)
+
+// sources maps the cache statuses logged by nginx to the source of the
+// response: Stale and revalidated responses are served from the cache, even
+// if the origin is also contacted.
+var sources = map[string]string{
+	"HIT":         Cache,
+	"STALE":       Cache,
+	"UPDATING":    Cache,
+	"REVALIDATED": Cache,
+	"MISS":        Origin,
+	"EXPIRED":     Origin,
+	"BYPASS":      Origin,
+}
+
+// Source returns the source of a response with the supplied cache status, or
+// false if the status is not known.
+func Source(status string) (string, bool) {
+	s, ok := sources[strings.ToUpper(strings.TrimSpace(status))]
+	return s, ok
+}
+
+// Classifier implements parser.Enricher, writing the normalized (lower case)
+// cache status and source of responses to CacheStatusField and SourceField.
+// Records lacking a known cache status (e.g. as they were not eligible for
+// caching) are not classified.
+type Classifier struct{}
+
+// Enrich sets the CacheStatusField and SourceField of the supplied record.
+func (Classifier) Enrich(r parser.Record) {
+	status := r[StatusField]
+	source, ok := Source(status)
+	if !ok {
+		return
+	}
+	r[CacheStatusField] = strings.ToLower(strings.TrimSpace(status))
+	r[SourceField] = source
+}
+
+// Specs returns the Specs of metrics computed from the fields written by the
+// Classifier, for the records selected by the supplied Filter (which may be
+// nil): A counter of responses by cache status, and a counter of the bytes
+// (in bytesField) sent by source. Each is additionally labelled by the
+// supplied labels (e.g. host).
+func Specs(labels []metric.Label, bytesField string, filter *metric.Filter) []*metric.Spec {
+	return []*metric.Spec{
+		{
+			Name:        CountMetric,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of HTTP responses eligible for caching by cache status (hit, miss, expired, stale, updating, revalidated or bypass).",
+			Labels: append([]metric.Label{
+				{
+					Name:        CacheStatusField,
+					Field:       CacheStatusField,
+					Type:        metric.StringLabel,
+					Description: "Cache status",
+				},
+			}, labels...),
+			Filter: filter,
+		},
+		{
+			Name:        BytesMetric,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of bytes sent in HTTP responses eligible for caching by source (cache or origin).",
+			Unit:        "By",
+			Field:       bytesField,
+			Labels: append([]metric.Label{
+				{
+					Name:        "source",
+					Field:       SourceField,
+					Type:        metric.StringLabel,
+					Description: "Source of the response (cache or origin)",
+				},
+			}, labels...),
+			Filter: filter,
+		},
+	}
+}
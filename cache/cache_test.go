@@ -0,0 +1,77 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/swfrench/nginx-log-consumer/cache"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+func TestEnrich(t *testing.T) {
+	for _, tc := range []struct {
+		status string
+		want   string
+		source string
+	}{
+		{"HIT", "hit", cache.Cache},
+		{"STALE", "stale", cache.Cache},
+		{"UPDATING", "updating", cache.Cache},
+		{"REVALIDATED", "revalidated", cache.Cache},
+		{"MISS", "miss", cache.Origin},
+		{"EXPIRED", "expired", cache.Origin},
+		{"bypass", "bypass", cache.Origin},
+		{"-", "", ""},
+		{"", "", ""},
+		{"SCARCE", "", ""},
+	} {
+		r := parser.Record{cache.StatusField: tc.status}
+		cache.Classifier{}.Enrich(r)
+		if r[cache.CacheStatusField] != tc.want || r[cache.SourceField] != tc.source {
+			t.Errorf("Expected %q to be classified as %q from %q, got %v", tc.status, tc.want, tc.source, r)
+		}
+	}
+}
+
+func TestSpecs(t *testing.T) {
+	host := metric.Label{Name: "host", Field: "host", Type: metric.StringLabel}
+	specs := cache.Specs([]metric.Label{host}, cache.DefaultBytesField, nil)
+	for _, s := range specs {
+		if err := s.Validate(); err != nil {
+			t.Fatalf("Expected %s to be valid, got %v", s.Name, err)
+		}
+	}
+
+	values := metric.NewValues()
+	for _, r := range []parser.Record{
+		{"host": "a", cache.StatusField: "HIT", "body_bytes_sent": "1000"},
+		{"host": "a", cache.StatusField: "HIT", "body_bytes_sent": "500"},
+		{"host": "a", cache.StatusField: "STALE", "body_bytes_sent": "100"},
+		{"host": "a", cache.StatusField: "MISS", "body_bytes_sent": "2000"},
+		{"host": "b", cache.StatusField: "-", "body_bytes_sent": "300"},
+	} {
+		cache.Classifier{}.Enrich(r)
+		for _, s := range specs {
+			s.Observe(r, values)
+		}
+	}
+
+	for _, tc := range []struct {
+		metric string
+		labels []string
+		want   int64
+	}{
+		{cache.CountMetric, []string{"hit", "a"}, 2},
+		{cache.CountMetric, []string{"stale", "a"}, 1},
+		{cache.CountMetric, []string{"miss", "a"}, 1},
+		{cache.BytesMetric, []string{cache.Cache, "a"}, 1600},
+		{cache.BytesMetric, []string{cache.Origin, "a"}, 2000},
+	} {
+		if got := values.Counters[tc.metric][metric.Key(tc.labels)]; got != tc.want {
+			t.Errorf("Expected %s%v to be %d, got %d", tc.metric, tc.labels, tc.want, got)
+		}
+	}
+	if n := len(values.Counters[cache.CountMetric]); n != 3 {
+		t.Errorf("Expected responses not eligible for caching not to be counted, got %v", values.Counters[cache.CountMetric])
+	}
+}
@@ -0,0 +1,99 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/slo"
+	"github.com/swfrench/nginx-log-consumer/tailer"
+)
+
+// Window holds metric values aggregated over an event-time window ending at
+// End.
+type Window struct {
+	End    time.Time      `json:"end"`
+	Values *metric.Values `json:"values"`
+}
+
+// State captures everything needed to resume consumption after a restart
+// without resetting cumulative metrics or double counting log lines: The
+// cumulative metric values and their reset time, values held in event-time
+// windows not yet closed, and the log read position up to which those values
+// account for. SLOs holds the counts of each SLO (by name) over its period.
+type State struct {
+	ResetTime time.Time             `json:"reset_time"`
+	Values    *metric.Values        `json:"values"`
+	Windows   []Window              `json:"windows,omitempty"`
+	SLOs      map[string]*slo.State `json:"slos,omitempty"`
+	Position  tailer.Position       `json:"position"`
+}
+
+// Load reads State from the file at the supplied path. If the file does not
+// exist, nil State (and no error) is returned.
+func Load(path string) (*State, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &State{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save atomically replaces the file at the supplied path with the provided
+// State (see WriteJSON).
+func Save(path string, s *State) error {
+	return WriteJSON(path, s)
+}
+
+// WriteJSON atomically replaces the file at the supplied path with v, encoded
+// as JSON: It is written to a temporary file in the same directory, which is
+// synced and then renamed into place.
+func WriteJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the directory so that the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,79 @@
+package checkpoint_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/checkpoint"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/tailer"
+)
+
+func TestLoadMissing(t *testing.T) {
+	s, err := checkpoint.Load("/this/will/never/exist")
+	if err != nil {
+		t.Fatalf("Load failed with %v", err)
+	}
+	if s != nil {
+		t.Fatalf("Expected Load to return nil State for missing file, got %v", s)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	values := metric.NewValues()
+	values.AddCount(metric.StatusCountMetric, "200", 10)
+	values.AddCount(metric.StatusCountMetric, "503", 2)
+	values.AddSample("http_request_latency", "", 0.5, []float64{0.1, 1})
+
+	want := &checkpoint.State{
+		ResetTime: time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC),
+		Values:    values,
+		Position: tailer.Position{
+			Inode:  1234,
+			Offset: 5678,
+		},
+	}
+
+	// Save twice to ensure existing state is replaced.
+	for i := 0; i < 2; i++ {
+		if err := checkpoint.Save(path, want); err != nil {
+			t.Fatalf("Save failed with %v", err)
+		}
+	}
+
+	got, err := checkpoint.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed with %v", err)
+	}
+
+	if !got.ResetTime.Equal(want.ResetTime) {
+		t.Fatalf("Expected loaded ResetTime %v, got %v", want.ResetTime, got.ResetTime)
+	}
+	if !reflect.DeepEqual(got.Values, want.Values) {
+		t.Fatalf("Expected loaded Values %v, got %v", want.Values, got.Values)
+	}
+	if got.Position != want.Position {
+		t.Fatalf("Expected loaded Position %v, got %v", want.Position, got.Position)
+	}
+
+	// No temporary files should remain.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Could not list test directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected only the state file to remain, got %d files", len(files))
+	}
+}
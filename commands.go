@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+// maxLineSize bounds the length of log lines read by subcommands.
+const maxLineSize = 1024 * 1024
+
+// command is a subcommand of the binary, run in place of the consumer when its
+// name is given as the first argument.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"check-config": {
+		usage: "check-config [flags]: Validate configuration and report resolved settings.",
+		run:   checkConfig,
+	},
+	"parse-test": {
+		usage: "parse-test [flags] FILE: Parse sample log lines from FILE, reporting the fields extracted from each, parse failures, and the resulting metric deltas.",
+		run:   parseTest,
+	},
+	"replay": {
+		usage: "replay [flags] FILE...: Aggregate historical log lines from the supplied files into event-time windows, and write the resulting points to Cloud Monitoring or a file.",
+		run:   replay,
+	},
+}
+
+// runCommand runs the subcommand named by args[0], if any, returning false if
+// there is no such subcommand.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// checkConfig validates configuration and writes the resolved settings to
+// stdout.
+func checkConfig(args []string) error {
+	o, err := loadOptions(args, flag.ExitOnError)
+	if err != nil {
+		return err
+	}
+	if len(o.args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", o.args)
+	}
+	n, err := naming.New(o.metricDomain, o.metricPrefix)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if o.configFile != "" {
+		fmt.Fprintf(w, "Configuration file %s is valid.\n", o.configFile)
+	} else {
+		fmt.Fprintf(w, "Configuration is valid.\n")
+	}
+
+	fmt.Fprintf(w, "\nSettings:\n")
+	o.flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "  %s = %q\n", f.Name, f.Value.String())
+	})
+
+	p, err := o.parser()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nInput:\n")
+	fmt.Fprintf(w, "  format = %s\n", p.Format())
+	fmt.Fprintf(w, "  time_format = %q\n", p.TimeFormat())
+	for _, name := range sortedKeys(p.Fields()) {
+		fmt.Fprintf(w, "  field %s <- key %q\n", name, p.Fields()[name])
+	}
+
+	fmt.Fprintf(w, "\nMetrics:\n")
+	for _, s := range o.specs() {
+		describeSpec(w, n, s)
+	}
+	return nil
+}
+
+// openLog opens the named log file for reading, decompressing it if gzipped.
+func openLog(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	b := bufio.NewReader(f)
+	if magic, err := b.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		z, err := gzip.NewReader(b)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not decompress %s: %v", path, err)
+		}
+		return &gzipFile{Reader: z, f: f}, nil
+	}
+	return &bufferedFile{Reader: b, f: f}, nil
+}
+
+// bufferedFile reads a file via a bufio.Reader.
+type bufferedFile struct {
+	*bufio.Reader
+	f *os.File
+}
+
+func (b *bufferedFile) Close() error {
+	return b.f.Close()
+}
+
+// gzipFile reads a gzipped file.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// describeSpec writes a description of the supplied metric to w.
+func describeSpec(w io.Writer, n *naming.Naming, s *metric.Spec) {
+	fmt.Fprintf(w, "  %s (%s)\n", n.Type(s.Name), s.Kind)
+	if s.Field != "" {
+		fmt.Fprintf(w, "    field: %s\n", s.Field)
+	}
+	for _, l := range s.Labels {
+		fmt.Fprintf(w, "    label %s (%s) <- field %s\n", l.Name, l.Type, l.Field)
+	}
+	if len(s.Buckets) > 0 {
+		fmt.Fprintf(w, "    buckets: %v\n", s.Buckets)
+	}
+	if s.Unique != nil {
+		fmt.Fprintf(w, "    unique: %s (precision %d)\n", strings.Join(s.Unique.Fields, ", "), s.Unique.Precision)
+	}
+	if s.Filter != nil {
+		for _, rule := range s.Filter.Include {
+			fmt.Fprintf(w, "    include: %s\n", describeRule(rule))
+		}
+		for _, rule := range s.Filter.Exclude {
+			fmt.Fprintf(w, "    exclude: %s\n", describeRule(rule))
+		}
+	}
+}
+
+// describeRule returns a summary of the Conditions of a filter Rule.
+func describeRule(rule metric.Rule) string {
+	var conditions []string
+	for _, c := range rule {
+		var tests []string
+		for _, n := range c.Networks {
+			tests = append(tests, "in "+n.String())
+		}
+		if c.Pattern != nil {
+			tests = append(tests, fmt.Sprintf("matches %q", c.Pattern.String()))
+		}
+		if c.Equals != nil {
+			tests = append(tests, fmt.Sprintf("= %q", *c.Equals))
+		}
+		for _, cmp := range []struct {
+			op string
+			x  *float64
+		}{
+			{"<", c.LT},
+			{"<=", c.LE},
+			{">", c.GT},
+			{">=", c.GE},
+		} {
+			if cmp.x != nil {
+				tests = append(tests, fmt.Sprintf("%s %g", cmp.op, *cmp.x))
+			}
+		}
+		conditions = append(conditions, fmt.Sprintf("%s %s", c.Field, strings.Join(tests, " and ")))
+	}
+	return strings.Join(conditions, ", ")
+}
+
+// parseTest parses the log file named by the sole argument, as the consumer
+// would, and writes the results to stdout.
+func parseTest(args []string) error {
+	o, err := parseOptions(args, flag.ExitOnError)
+	if err != nil {
+		return err
+	}
+	if len(o.args) != 1 {
+		return fmt.Errorf("expected a single FILE argument, got %v", o.args)
+	}
+	o.accessLogPath = o.args[0]
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	f, err := openLog(o.accessLogPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p, err := o.parser()
+	if err != nil {
+		return err
+	}
+	specs := o.specs()
+	fields := specFields(specs)
+
+	w := os.Stdout
+	values := metric.NewValues()
+	failures := make(map[string]int)
+	lines, parsed := 0, 0
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		lines++
+		t, r, err := p.Parse(scanner.Bytes())
+		if err != nil {
+			reason := "unknown"
+			if pe, ok := err.(*parser.Error); ok {
+				reason = pe.Reason
+			}
+			failures[reason]++
+			fmt.Fprintf(w, "line %d: parse failure (%s): %v\n", lines, reason, err)
+			continue
+		}
+		parsed++
+
+		extracted := []string{fmt.Sprintf("%s=%s", parser.TimeField, t.Format(time.RFC3339Nano))}
+		for _, field := range fields {
+			if v, ok := r[field]; ok {
+				extracted = append(extracted, fmt.Sprintf("%s=%q", field, v))
+			} else {
+				extracted = append(extracted, fmt.Sprintf("%s=<missing>", field))
+			}
+		}
+		fmt.Fprintf(w, "line %d: %s\n", lines, strings.Join(extracted, " "))
+
+		for _, s := range specs {
+			if !s.Matches(r) {
+				fmt.Fprintf(w, "  excluded from %s by filter\n", s.Name)
+				continue
+			}
+			if !s.Observe(r, values) {
+				fmt.Fprintf(w, "  not recorded by %s: missing or invalid field\n", s.Name)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read %s: %v", o.accessLogPath, err)
+	}
+
+	fmt.Fprintf(w, "\nParsed %d of %d lines.\n", parsed, lines)
+	for _, reason := range sortedKeys(failures) {
+		fmt.Fprintf(w, "  %s: %d\n", reason, failures[reason])
+	}
+
+	values.UpdateGauges()
+	fmt.Fprintf(w, "\nMetric deltas:\n")
+	for _, s := range specs {
+		writeDeltas(w, s, values)
+	}
+	return nil
+}
+
+// specFields returns the sorted names of record fields used by the supplied
+// metrics (including their filters).
+func specFields(specs []*metric.Spec) []string {
+	seen := make(map[string]bool)
+	for _, s := range specs {
+		if s.Field != "" {
+			seen[s.Field] = true
+		}
+		for _, l := range s.Labels {
+			seen[l.Field] = true
+		}
+		if s.Unique != nil {
+			for _, field := range s.Unique.Fields {
+				seen[field] = true
+			}
+		}
+		for _, field := range s.Filter.Fields() {
+			seen[field] = true
+		}
+	}
+	delete(seen, parser.TimeField)
+	var fields []string
+	for field := range seen {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// writeDeltas writes the values of the supplied metric to w, one line per
+// combination of label values.
+func writeDeltas(w io.Writer, s *metric.Spec, values *metric.Values) {
+	switch s.Kind {
+	case metric.Counter:
+		counts := values.Counters[s.Name]
+		if len(counts) == 0 {
+			fmt.Fprintf(w, "  %s: none\n", s.Name)
+		}
+		for _, key := range sortedKeys(counts) {
+			fmt.Fprintf(w, "  %s%s +%d\n", s.Name, formatLabels(s, key), counts[key])
+		}
+	case metric.Distribution:
+		histograms := values.Distributions[s.Name]
+		if len(histograms) == 0 {
+			fmt.Fprintf(w, "  %s: none\n", s.Name)
+		}
+		for _, key := range sortedKeys(histograms) {
+			h := histograms[key]
+			fmt.Fprintf(w, "  %s%s count=%d sum=%g mean=%g buckets=%v\n", s.Name, formatLabels(s, key), h.Count, h.Sum, h.Mean(), h.BucketCounts)
+		}
+	case metric.Gauge:
+		gauges := values.Gauges[s.Name]
+		if len(gauges) == 0 {
+			fmt.Fprintf(w, "  %s: none\n", s.Name)
+		}
+		for _, key := range sortedKeys(gauges) {
+			fmt.Fprintf(w, "  %s%s = %g\n", s.Name, formatLabels(s, key), gauges[key])
+		}
+	}
+}
+
+// formatLabels returns the labels making up the supplied key in the form
+// {name="value",...}, or the empty string if the metric has no labels.
+func formatLabels(s *metric.Spec, key string) string {
+	if len(s.Labels) == 0 {
+		return ""
+	}
+	var labels []string
+	for i, v := range metric.SplitKey(key, len(s.Labels)) {
+		labels = append(labels, fmt.Sprintf("%s=%q", s.Labels[i].Name, v))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// sortedKeys returns the keys of the supplied map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
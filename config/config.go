@@ -0,0 +1,1144 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/alert"
+	"github.com/swfrench/nginx-log-consumer/apdex"
+	"github.com/swfrench/nginx-log-consumer/cache"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/geoip"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/resource"
+	"github.com/swfrench/nginx-log-consumer/resource/detect"
+	"github.com/swfrench/nginx-log-consumer/slo"
+	"github.com/swfrench/nginx-log-consumer/topk"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// CloudMonitoringExporter is the kind of exporter writing to Cloud
+	// Monitoring.
+	CloudMonitoringExporter = "cloud_monitoring"
+
+	// JSONExporter is the kind of exporter writing values as JSON lines to
+	// a file or stdout, for debugging. If it is the only exporter, nothing
+	// is written to Cloud Monitoring.
+	JSONExporter = "json"
+)
+
+// Config holds settings read from a YAML configuration file. Optional scalar
+// settings are pointers, nil when not set.
+type Config struct {
+	Inputs          []Input        `yaml:"inputs"`
+	Aggregation     Aggregation    `yaml:"aggregation"`
+	Metrics         []Metric       `yaml:"metrics"`
+	Exporters       []Exporter     `yaml:"exporters"`
+	Resource        Resource       `yaml:"resource"`
+	StateFile       *string        `yaml:"state_file"`
+	ShutdownTimeout *time.Duration `yaml:"shutdown_timeout"`
+	UseSyslog       *bool          `yaml:"use_syslog"`
+	// SelfMetrics enables export of metrics describing the consumer
+	// itself.
+	SelfMetrics *bool      `yaml:"self_metrics"`
+	Admin       Admin      `yaml:"admin"`
+	UserAgents  UserAgents `yaml:"user_agents"`
+	GeoIP       GeoIP      `yaml:"geoip"`
+	// HeavyHitters describe the fields whose most frequent values are
+	// tracked.
+	HeavyHitters []HeavyHitter `yaml:"heavy_hitters"`
+	// SLOs describe the service level objectives evaluated.
+	SLOs []SLO `yaml:"slos"`
+	// Alerts describe the alert rules evaluated locally.
+	Alerts Alerts `yaml:"alerts"`
+	// Apdex, if set, describes the routes whose Apdex scores are computed.
+	Apdex *Apdex `yaml:"apdex"`
+	// Cache, if set, describes the cache metrics computed.
+	Cache *Cache `yaml:"cache"`
+}
+
+// HeavyHitter describes the tracking of the most frequent values of a record
+// field (see topk.Tracker).
+type HeavyHitter struct {
+	Name     string         `yaml:"name"`
+	Field    string         `yaml:"field"`
+	Window   *time.Duration `yaml:"window"`
+	Capacity *int           `yaml:"capacity"`
+	Top      *int           `yaml:"top"`
+	Export   bool           `yaml:"export"`
+	Include  []Rule         `yaml:"include"`
+	Exclude  []Rule         `yaml:"exclude"`
+}
+
+// SLO describes a service level objective (see slo.Objective): The records
+// selected by Include and Exclude are counted, and are good if they match any
+// Good rule (by default, a status below 500) and, if LatencyThreshold is set,
+// have a latency (in LatencyField) within it.
+type SLO struct {
+	Name             string          `yaml:"name"`
+	Objective        float64         `yaml:"objective"`
+	Include          []Rule          `yaml:"include"`
+	Exclude          []Rule          `yaml:"exclude"`
+	Good             []Rule          `yaml:"good"`
+	LatencyField     string          `yaml:"latency_field"`
+	LatencyThreshold *time.Duration  `yaml:"latency_threshold"`
+	Period           *time.Duration  `yaml:"period"`
+	Windows          []time.Duration `yaml:"windows"`
+}
+
+// Alerts describes rules evaluated against recent records, and the webhooks
+// notified when they fire (see alert.Manager).
+type Alerts struct {
+	Rules            []AlertRule    `yaml:"rules"`
+	Webhooks         []Webhook      `yaml:"webhooks"`
+	EvaluationPeriod *time.Duration `yaml:"evaluation_period"`
+	RepeatInterval   *time.Duration `yaml:"repeat_interval"`
+	// Source identifies the consumer in notifications (by default, its
+	// host name).
+	Source string `yaml:"source"`
+}
+
+// AlertRule describes an alert.Rule of the given Type (ratio, latency or
+// no_traffic). Ratio rules fire when the proportion of records matching any
+// Match rule (by default, a status of 500 or above) exceeds Threshold, and
+// latency rules when the Quantile of Field exceeds LatencyThreshold.
+type AlertRule struct {
+	Name             string         `yaml:"name"`
+	Type             string         `yaml:"type"`
+	Window           *time.Duration `yaml:"window"`
+	Include          []Rule         `yaml:"include"`
+	Exclude          []Rule         `yaml:"exclude"`
+	Match            []Rule         `yaml:"match"`
+	Threshold        *float64       `yaml:"threshold"`
+	Field            string         `yaml:"field"`
+	Quantile         *float64       `yaml:"quantile"`
+	LatencyThreshold *time.Duration `yaml:"latency_threshold"`
+}
+
+// Webhook describes a URL to which alert notifications are posted, in the
+// given Format (json or slack).
+type Webhook struct {
+	URL     string            `yaml:"url"`
+	Format  string            `yaml:"format"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Apdex describes the computation of Apdex scores (see apdex.Scorer) for the
+// records selected by Include and Exclude, per route: Records are of the first
+// route with a matching rule, or else of the route other, whose threshold is
+// Threshold.
+type Apdex struct {
+	Threshold    *time.Duration `yaml:"threshold"`
+	LatencyField string         `yaml:"latency_field"`
+	Include      []Rule         `yaml:"include"`
+	Exclude      []Rule         `yaml:"exclude"`
+	Routes       []ApdexRoute   `yaml:"routes"`
+}
+
+// ApdexRoute describes a route matching records (e.g. by path or host) which
+// match any Match rule (or all records, if there are none), with its own
+// threshold (by default, that of the enclosing Apdex).
+type ApdexRoute struct {
+	Name      string         `yaml:"name"`
+	Match     []Rule         `yaml:"match"`
+	Threshold *time.Duration `yaml:"threshold"`
+}
+
+// Cache describes the computation of cache metrics (see cache.Specs) for the
+// records selected by Include and Exclude, additionally labelled by Labels
+// (e.g. host). BytesField defaults to cache.DefaultBytesField.
+type Cache struct {
+	Labels     []Label `yaml:"labels"`
+	BytesField string  `yaml:"bytes_field"`
+	Include    []Rule  `yaml:"include"`
+	Exclude    []Rule  `yaml:"exclude"`
+}
+
+// UserAgents describes how user agents are classified, when metrics use the
+// client_class field.
+type UserAgents struct {
+	Field        *string `yaml:"field"`
+	PatternsFile *string `yaml:"patterns_file"`
+}
+
+// Admin describes the local HTTP server for administration, and the limits
+// beyond which the consumer is reported unready.
+type Admin struct {
+	Address     *string        `yaml:"address"`
+	MaxReadAge  *time.Duration `yaml:"max_read_age"`
+	MaxWriteAge *time.Duration `yaml:"max_write_age"`
+}
+
+// GeoIP describes how clients are located, when metrics use the
+// client_country or client_asn fields.
+type GeoIP struct {
+	CountryDatabase *string  `yaml:"country_database"`
+	ASNDatabase     *string  `yaml:"asn_database"`
+	Countries       []string `yaml:"countries"`
+	ASNs            []string `yaml:"asns"`
+	TrustedProxies  []string `yaml:"trusted_proxies"`
+}
+
+// Input describes a log file and how its lines are parsed.
+type Input struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"`
+	// Fields maps field names to the keys in which they appear in log
+	// lines, where these differ (see parser.New).
+	Fields              map[string]string `yaml:"fields"`
+	TimeFormat          string            `yaml:"time_format"`
+	PollingPeriod       *time.Duration    `yaml:"polling_period"`
+	RotationCheckPeriod *time.Duration    `yaml:"rotation_check_period"`
+}
+
+// Aggregation describes how values are aggregated before export.
+type Aggregation struct {
+	Window      *time.Duration `yaml:"window"`
+	Lateness    *time.Duration `yaml:"lateness"`
+	FlushPeriod *time.Duration `yaml:"flush_period"`
+}
+
+// Metric describes a metric computed from log records (see metric.Spec).
+type Metric struct {
+	Name        string    `yaml:"name"`
+	Type        string    `yaml:"type"`
+	Description string    `yaml:"description"`
+	Unit        string    `yaml:"unit"`
+	Field       string    `yaml:"field"`
+	Labels      []Label   `yaml:"labels"`
+	Buckets     []float64 `yaml:"buckets"`
+	// Fields and Precision configure unique metrics (see metric.Unique),
+	// for which Field is shorthand for a single field.
+	Fields    []string `yaml:"fields"`
+	Precision *uint8   `yaml:"precision"`
+	// Include and Exclude select the records observed (see metric.Filter).
+	Include []Rule `yaml:"include"`
+	Exclude []Rule `yaml:"exclude"`
+}
+
+// Rule maps record fields to the Match which each must satisfy (see
+// metric.Rule).
+type Rule map[string]Match
+
+// Match describes tests of a record field value (see metric.Condition). A
+// scalar in place of a mapping is shorthand for Equals.
+type Match struct {
+	CIDR   []string `yaml:"cidr"`
+	Regex  *string  `yaml:"regex"`
+	Equals *string  `yaml:"equals"`
+	LT     *float64 `yaml:"lt"`
+	LE     *float64 `yaml:"le"`
+	GT     *float64 `yaml:"gt"`
+	GE     *float64 `yaml:"ge"`
+}
+
+// UnmarshalYAML decodes a Match from either a mapping or a scalar (see Match).
+func (m *Match) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		m.Equals = &n.Value
+		return nil
+	}
+	type plain Match
+	return n.Decode((*plain)(m))
+}
+
+// Label describes a metric label (see metric.Label). Field defaults to the
+// label name, and Type to string.
+type Label struct {
+	Name        string `yaml:"name"`
+	Field       string `yaml:"field"`
+	Type        string `yaml:"type"`
+	Description string `yaml:"description"`
+}
+
+// Exporter describes a metrics backend. Path applies only to the JSONExporter;
+// other settings only to the CloudMonitoringExporter.
+type Exporter struct {
+	Kind           string  `yaml:"kind"`
+	Path           *string `yaml:"path"`
+	Endpoint       *string `yaml:"endpoint"`
+	Credentials    *string `yaml:"credentials"`
+	MetricDomain   *string `yaml:"metric_domain"`
+	MetricPrefix   *string `yaml:"metric_prefix"`
+	CreateMetrics  *bool   `yaml:"create_metrics"`
+	MigrateMetrics *bool   `yaml:"migrate_metrics"`
+}
+
+// Resource describes the monitored resource to which metrics are attributed.
+type Resource struct {
+	Type               *string `yaml:"type"`
+	ProjectID          *string `yaml:"project_id"`
+	InstanceName       *string `yaml:"instance_name"`
+	Zone               *string `yaml:"zone"`
+	UseMetadataService *bool   `yaml:"use_metadata_service"`
+	// MetadataProviders lists metadata providers (see detect.Names), in
+	// order of precedence.
+	MetadataProviders []string          `yaml:"metadata_providers"`
+	MetadataTimeout   *time.Duration    `yaml:"metadata_timeout"`
+	MetadataFile      *string           `yaml:"metadata_file"`
+	MetadataCacheFile *string           `yaml:"metadata_cache_file"`
+	DownwardAPIDir    *string           `yaml:"downward_api_dir"`
+	Labels            map[string]string `yaml:"labels"`
+}
+
+// Error describes a problem with a configuration file, at a given line (if
+// known).
+type Error struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// Errors holds all problems found with a configuration file.
+type Errors []*Error
+
+func (es Errors) Error() string {
+	var msgs []string
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Load reads and validates the configuration file at the supplied path. If the
+// file is invalid, the returned error is an Errors describing each problem
+// found.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, b)
+}
+
+// typeErrorRE matches the entries of yaml.TypeError.
+var typeErrorRE = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// syntaxErrorRE matches YAML syntax errors.
+var syntaxErrorRE = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// Parse parses and validates configuration from the supplied YAML content,
+// read from the named file.
+func Parse(file string, b []byte) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		if m := syntaxErrorRE.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, Errors{{File: file, Line: line, Message: m[2]}}
+		}
+		return nil, Errors{{File: file, Message: err.Error()}}
+	}
+
+	c := &Config{}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(c); err != nil && err != io.EOF {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return nil, Errors{{File: file, Message: err.Error()}}
+		}
+		var errs Errors
+		for _, msg := range typeErr.Errors {
+			e := &Error{File: file, Message: msg}
+			if m := typeErrorRE.FindStringSubmatch(msg); m != nil {
+				e.Line, _ = strconv.Atoi(m[1])
+				e.Message = m[2]
+			}
+			errs = append(errs, e)
+		}
+		return nil, errs
+	}
+
+	v := &validator{file: file, root: &root}
+	c.validate(v)
+	if len(v.errs) > 0 {
+		return nil, v.errs
+	}
+	return c, nil
+}
+
+// validator accumulates validation errors, locating each in the document.
+type validator struct {
+	file string
+	root *yaml.Node
+	errs Errors
+}
+
+// errorf records an error concerning the setting at the supplied path (of
+// mapping keys and sequence indices, e.g. "metrics", 2, "buckets").
+func (v *validator) errorf(path []interface{}, format string, args ...interface{}) {
+	var names []string
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			names = append(names, p)
+		case int:
+			names[len(names)-1] += fmt.Sprintf("[%d]", p)
+		}
+	}
+	v.errs = append(v.errs, &Error{
+		File:    v.file,
+		Line:    v.line(path),
+		Message: fmt.Sprintf("%s: %s", strings.Join(names, "."), fmt.Sprintf(format, args...)),
+	})
+}
+
+// line returns the line of the node at the supplied path or, if absent, that
+// of its closest ancestor.
+func (v *validator) line(path []interface{}) int {
+	n := v.root
+	if n.Kind == yaml.DocumentNode {
+		if len(n.Content) == 0 {
+			return 0
+		}
+		n = n.Content[0]
+	}
+	line := n.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					if n.Content[i].Value == p {
+						next = n.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && p < len(n.Content) {
+				next = n.Content[p]
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+		line = n.Line
+	}
+	return line
+}
+
+// path returns a path of mapping keys and sequence indices.
+func path(elems ...interface{}) []interface{} {
+	return elems
+}
+
+// rules records an error for each invalid filter Rule.
+func (v *validator) rules(p []interface{}, rules []Rule) {
+	for i, rule := range rules {
+		if _, err := rule.rule(); err != nil {
+			v.errorf(path(append(append([]interface{}{}, p...), i)...), "%v", err)
+		}
+	}
+}
+
+// unique records an error for each of the supplied Specs whose name is
+// already in names (as exporters identify metrics by name), adding the rest.
+func (v *validator) unique(p []interface{}, names map[string]bool, specs []*metric.Spec) {
+	for _, s := range specs {
+		if names[s.Name] {
+			v.errorf(p, "duplicate metric %q", s.Name)
+		}
+		names[s.Name] = true
+	}
+}
+
+// positive records an error if d is set and not positive.
+func (v *validator) positive(p []interface{}, d *time.Duration) {
+	if d != nil && *d <= 0 {
+		v.errorf(p, "must be positive")
+	}
+}
+
+// nonNegative records an error if d is set and negative.
+func (v *validator) nonNegative(p []interface{}, d *time.Duration) {
+	if d != nil && *d < 0 {
+		v.errorf(p, "must not be negative")
+	}
+}
+
+func (c *Config) validate(v *validator) {
+	for i, in := range c.Inputs {
+		if i > 0 {
+			v.errorf(path("inputs", i), "only a single input is currently supported")
+			continue
+		}
+		if in.Path == "" {
+			v.errorf(path("inputs", i, "path"), "must be set")
+		}
+		if _, err := in.parser(); err != nil {
+			v.errorf(path("inputs", i), "%v", err)
+		}
+		v.positive(path("inputs", i, "polling_period"), in.PollingPeriod)
+		v.positive(path("inputs", i, "rotation_check_period"), in.RotationCheckPeriod)
+	}
+
+	v.nonNegative(path("aggregation", "window"), c.Aggregation.Window)
+	v.nonNegative(path("aggregation", "lateness"), c.Aggregation.Lateness)
+	v.positive(path("aggregation", "flush_period"), c.Aggregation.FlushPeriod)
+
+	names := make(map[string]bool)
+	for i, m := range c.Metrics {
+		if err := m.spec().Validate(); err != nil {
+			v.errorf(path("metrics", i), "%v", err)
+		}
+		if m.Type != metric.UniqueType {
+			if len(m.Fields) > 0 {
+				v.errorf(path("metrics", i, "fields"), "may only be set for %s metrics", metric.UniqueType)
+			}
+			if m.Precision != nil {
+				v.errorf(path("metrics", i, "precision"), "may only be set for %s metrics", metric.UniqueType)
+			}
+		}
+		v.rules(path("metrics", i, "include"), m.Include)
+		v.rules(path("metrics", i, "exclude"), m.Exclude)
+		if names[m.Name] {
+			v.errorf(path("metrics", i, "name"), "duplicate metric %q", m.Name)
+		}
+		names[m.Name] = true
+	}
+	if len(c.Metrics) == 0 {
+		for _, s := range metric.DefaultSpecs() {
+			names[s.Name] = true
+		}
+	}
+
+	kinds := make(map[string]bool)
+	for i, e := range c.Exporters {
+		switch e.Kind {
+		case CloudMonitoringExporter:
+			if e.Path != nil {
+				v.errorf(path("exporters", i, "path"), "not supported by the %s exporter", e.Kind)
+			}
+		case JSONExporter:
+			for _, setting := range []struct {
+				name string
+				set  bool
+			}{
+				{"endpoint", e.Endpoint != nil},
+				{"credentials", e.Credentials != nil},
+				{"metric_domain", e.MetricDomain != nil},
+				{"metric_prefix", e.MetricPrefix != nil},
+				{"create_metrics", e.CreateMetrics != nil},
+				{"migrate_metrics", e.MigrateMetrics != nil},
+			} {
+				if setting.set {
+					v.errorf(path("exporters", i, setting.name), "not supported by the %s exporter", e.Kind)
+				}
+			}
+		case "":
+			v.errorf(path("exporters", i, "kind"), "must be set")
+			continue
+		default:
+			v.errorf(path("exporters", i, "kind"), "unknown exporter kind %q", e.Kind)
+			continue
+		}
+		if kinds[e.Kind] {
+			v.errorf(path("exporters", i, "kind"), "only a single %s exporter is supported", e.Kind)
+		}
+		kinds[e.Kind] = true
+		domain, prefix := naming.CustomDomain, ""
+		if e.MetricDomain != nil {
+			domain = *e.MetricDomain
+		}
+		if e.MetricPrefix != nil {
+			prefix = *e.MetricPrefix
+		}
+		if _, err := naming.New(domain, prefix); err != nil {
+			v.errorf(path("exporters", i), "%v", err)
+		}
+	}
+
+	if t := c.Resource.Type; t != nil {
+		known := false
+		for _, rt := range resource.Types() {
+			known = known || rt == *t
+		}
+		if !known {
+			v.errorf(path("resource", "type"), "unknown resource type %q: must be one of %s", *t, strings.Join(resource.Types(), ", "))
+		}
+	}
+
+	for i, name := range c.Resource.MetadataProviders {
+		known := false
+		for _, n := range detect.Names() {
+			known = known || n == name
+		}
+		if !known {
+			v.errorf(path("resource", "metadata_providers", i), "unknown metadata provider %q: must be one of %s", name, strings.Join(detect.Names(), ", "))
+		}
+	}
+	v.positive(path("resource", "metadata_timeout"), c.Resource.MetadataTimeout)
+
+	hitters := make(map[string]bool)
+	for i, h := range c.HeavyHitters {
+		if err := h.tracker().Validate(); err != nil {
+			v.errorf(path("heavy_hitters", i), "%v", err)
+		}
+		v.rules(path("heavy_hitters", i, "include"), h.Include)
+		v.rules(path("heavy_hitters", i, "exclude"), h.Exclude)
+		if hitters[h.Name] {
+			v.errorf(path("heavy_hitters", i, "name"), "duplicate heavy hitter %q", h.Name)
+		} else if h.Export {
+			v.unique(path("heavy_hitters", i, "name"), names, []*metric.Spec{h.tracker().Spec()})
+		}
+		hitters[h.Name] = true
+	}
+
+	objectives := make(map[string]bool)
+	for i, o := range c.SLOs {
+		if err := o.objective().Validate(); err != nil {
+			v.errorf(path("slos", i), "%v", err)
+		}
+		v.rules(path("slos", i, "include"), o.Include)
+		v.rules(path("slos", i, "exclude"), o.Exclude)
+		v.rules(path("slos", i, "good"), o.Good)
+		v.positive(path("slos", i, "latency_threshold"), o.LatencyThreshold)
+		if o.LatencyField != "" && o.LatencyThreshold == nil {
+			v.errorf(path("slos", i, "latency_field"), "may only be set with latency_threshold")
+		}
+		if objectives[o.Name] {
+			v.errorf(path("slos", i, "name"), "duplicate SLO %q", o.Name)
+		} else {
+			obj := o.objective()
+			v.unique(path("slos", i, "name"), names, append(obj.Specs(), obj.GaugeSpecs()...))
+		}
+		objectives[o.Name] = true
+	}
+
+	alerts := make(map[string]bool)
+	for i, a := range c.Alerts.Rules {
+		if err := a.rule().Validate(); err != nil {
+			v.errorf(path("alerts", "rules", i), "%v", err)
+		}
+		for _, f := range []struct {
+			name string
+			set  bool
+			kind alert.Kind
+		}{
+			{"match", len(a.Match) > 0, alert.Ratio},
+			{"threshold", a.Threshold != nil, alert.Ratio},
+			{"field", a.Field != "", alert.Latency},
+			{"quantile", a.Quantile != nil, alert.Latency},
+			{"latency_threshold", a.LatencyThreshold != nil, alert.Latency},
+		} {
+			if f.set && alert.Kind(a.Type) != f.kind {
+				v.errorf(path("alerts", "rules", i, f.name), "may only be set for %s rules", f.kind)
+			}
+		}
+		v.rules(path("alerts", "rules", i, "include"), a.Include)
+		v.rules(path("alerts", "rules", i, "exclude"), a.Exclude)
+		v.rules(path("alerts", "rules", i, "match"), a.Match)
+		if alerts[a.Name] {
+			v.errorf(path("alerts", "rules", i, "name"), "duplicate alert rule %q", a.Name)
+		}
+		alerts[a.Name] = true
+	}
+	for i, w := range c.Alerts.Webhooks {
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path("alerts", "webhooks", i, "url"), "invalid webhook URL %q: must be an http or https URL", w.URL)
+		}
+		switch w.Format {
+		case "", alert.FormatJSON, alert.FormatSlack:
+		default:
+			v.errorf(path("alerts", "webhooks", i, "format"), "unknown webhook format %q: must be %s or %s", w.Format, alert.FormatJSON, alert.FormatSlack)
+		}
+	}
+	v.positive(path("alerts", "evaluation_period"), c.Alerts.EvaluationPeriod)
+	v.nonNegative(path("alerts", "repeat_interval"), c.Alerts.RepeatInterval)
+
+	if a := c.Apdex; a != nil {
+		if err := c.ApdexScorer().Validate(); err != nil {
+			v.errorf(path("apdex"), "%v", err)
+		}
+		v.rules(path("apdex", "include"), a.Include)
+		v.rules(path("apdex", "exclude"), a.Exclude)
+		v.unique(path("apdex"), names, apdex.Specs(nil))
+		for i, r := range a.Routes {
+			v.rules(path("apdex", "routes", i, "match"), r.Match)
+		}
+	}
+
+	if cc := c.Cache; cc != nil {
+		for _, s := range cc.specs() {
+			if err := s.Validate(); err != nil {
+				v.errorf(path("cache"), "%s: %v", s.Name, err)
+			}
+		}
+		v.rules(path("cache", "include"), cc.Include)
+		v.rules(path("cache", "exclude"), cc.Exclude)
+		v.unique(path("cache"), names, cc.specs())
+	}
+
+	for i, proxy := range c.GeoIP.TrustedProxies {
+		if _, err := geoip.ParseNetworks([]string{proxy}); err != nil {
+			v.errorf(path("geoip", "trusted_proxies", i), "invalid trusted proxy %q: must be a network or address", proxy)
+		}
+	}
+	for i, country := range c.GeoIP.Countries {
+		if len(country) != 2 {
+			v.errorf(path("geoip", "countries", i), "invalid country %q: must be an ISO 3166-1 alpha-2 code", country)
+		}
+	}
+	for i, asn := range c.GeoIP.ASNs {
+		if _, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32); err != nil {
+			v.errorf(path("geoip", "asns", i), "invalid autonomous system number %q", asn)
+		}
+	}
+
+	v.positive(path("shutdown_timeout"), c.ShutdownTimeout)
+	v.positive(path("admin", "max_read_age"), c.Admin.MaxReadAge)
+	v.positive(path("admin", "max_write_age"), c.Admin.MaxWriteAge)
+}
+
+// parser returns a Parser for the Input.
+func (in *Input) parser() (*parser.Parser, error) {
+	format, timeFormat := in.Format, in.TimeFormat
+	if format == "" {
+		format = parser.FormatJSON
+	}
+	if timeFormat == "" {
+		timeFormat = parser.ISO8601
+	}
+	return parser.New(format, in.Fields, timeFormat)
+}
+
+// spec returns the metric.Spec described by the Metric.
+func (m *Metric) spec() *metric.Spec {
+	kind := metric.Counter
+	if m.Type != "" {
+		kind = metric.Kind(m.Type)
+	}
+	s := &metric.Spec{
+		Name:        m.Name,
+		Kind:        kind,
+		Description: m.Description,
+		Unit:        m.Unit,
+		Field:       m.Field,
+		Buckets:     m.Buckets,
+	}
+	if m.Type == metric.UniqueType {
+		s.Kind = metric.Gauge
+		s.Field = ""
+		s.Unique = &metric.Unique{
+			Fields:    m.Fields,
+			Precision: metric.DefaultPrecision,
+		}
+		if m.Field != "" {
+			s.Unique.Fields = append([]string{m.Field}, m.Fields...)
+		}
+		if m.Precision != nil {
+			s.Unique.Precision = *m.Precision
+		}
+	}
+	s.Filter = filter(m.Include, m.Exclude)
+	s.Labels = labels(m.Labels)
+	return s
+}
+
+// specs returns the metric.Specs of the cache metrics described by the Cache.
+func (c *Cache) specs() []*metric.Spec {
+	field := c.BytesField
+	if field == "" {
+		field = cache.DefaultBytesField
+	}
+	return cache.Specs(labels(c.Labels), field, filter(c.Include, c.Exclude))
+}
+
+// labels returns the metric.Labels described by the supplied Labels.
+func labels(ls []Label) []metric.Label {
+	var out []metric.Label
+	for _, l := range ls {
+		field, t := l.Field, l.Type
+		if field == "" {
+			field = l.Name
+		}
+		if t == "" {
+			t = metric.StringLabel
+		}
+		out = append(out, metric.Label{
+			Name:        l.Name,
+			Field:       field,
+			Type:        t,
+			Description: l.Description,
+		})
+	}
+	return out
+}
+
+// filter returns the metric.Filter described by the supplied rules, or nil if
+// there are none.
+func filter(include, exclude []Rule) *metric.Filter {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+	// Validated by Parse.
+	f := &metric.Filter{}
+	for _, rule := range include {
+		r, _ := rule.rule()
+		f.Include = append(f.Include, r)
+	}
+	for _, rule := range exclude {
+		r, _ := rule.rule()
+		f.Exclude = append(f.Exclude, r)
+	}
+	return f
+}
+
+// tracker returns the topk.Tracker described by the HeavyHitter.
+func (h *HeavyHitter) tracker() *topk.Tracker {
+	t := &topk.Tracker{
+		Name:     h.Name,
+		Field:    h.Field,
+		Filter:   filter(h.Include, h.Exclude),
+		Window:   topk.DefaultWindow,
+		Capacity: topk.DefaultCapacity,
+		N:        topk.DefaultTop,
+		Export:   h.Export,
+	}
+	if h.Window != nil {
+		t.Window = *h.Window
+	}
+	if h.Capacity != nil {
+		t.Capacity = *h.Capacity
+	}
+	if h.Top != nil {
+		t.N = *h.Top
+	}
+	return t
+}
+
+// objective returns the slo.Objective described by the SLO.
+func (o *SLO) objective() *slo.Objective {
+	obj := &slo.Objective{
+		Name:    o.Name,
+		Target:  o.Objective,
+		Filter:  filter(o.Include, o.Exclude),
+		Good:    slo.DefaultGood(),
+		Windows: slo.DefaultWindows,
+		Period:  slo.DefaultPeriod,
+	}
+	if len(o.Good) > 0 {
+		obj.Good = filter(o.Good, nil)
+	}
+	if o.LatencyThreshold != nil {
+		field := o.LatencyField
+		if field == "" {
+			field = slo.DefaultLatencyField
+		}
+		obj.Good = metric.And(obj.Good, slo.LatencyFilter(field, *o.LatencyThreshold))
+	}
+	if len(o.Windows) > 0 {
+		obj.Windows = o.Windows
+	}
+	if o.Period != nil {
+		obj.Period = *o.Period
+	}
+	return obj
+}
+
+// rule returns the alert.Rule described by the AlertRule.
+func (a *AlertRule) rule() *alert.Rule {
+	r := &alert.Rule{
+		Name:   a.Name,
+		Kind:   alert.Kind(a.Type),
+		Window: alert.DefaultWindow,
+		Filter: filter(a.Include, a.Exclude),
+	}
+	if a.Window != nil {
+		r.Window = *a.Window
+	}
+	switch r.Kind {
+	case alert.Ratio:
+		r.Match = alert.DefaultMatch()
+		if len(a.Match) > 0 {
+			r.Match = filter(a.Match, nil)
+		}
+		if a.Threshold != nil {
+			r.Threshold = *a.Threshold
+		}
+	case alert.Latency:
+		r.Field = alert.DefaultLatencyField
+		if a.Field != "" {
+			r.Field = a.Field
+		}
+		r.Quantile = alert.DefaultQuantile
+		if a.Quantile != nil {
+			r.Quantile = *a.Quantile
+		}
+		if a.LatencyThreshold != nil {
+			r.Threshold = a.LatencyThreshold.Seconds()
+		}
+	}
+	return r
+}
+
+// rule returns the metric.Rule described by the Rule, with Conditions in order
+// of field name.
+func (r Rule) rule() (metric.Rule, error) {
+	if len(r) == 0 {
+		return nil, fmt.Errorf("rule has no conditions")
+	}
+	var fields []string
+	for field := range r {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var rule metric.Rule
+	for _, field := range fields {
+		m := r[field]
+		c := metric.Condition{
+			Field:  field,
+			Equals: m.Equals,
+			LT:     m.LT,
+			LE:     m.LE,
+			GT:     m.GT,
+			GE:     m.GE,
+		}
+		for _, cidr := range m.CIDR {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid CIDR %q", field, cidr)
+			}
+			c.Networks = append(c.Networks, n)
+		}
+		if m.Regex != nil {
+			re, err := regexp.Compile(*m.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid regex: %v", field, err)
+			}
+			c.Pattern = re
+		}
+		if len(c.Networks) == 0 && c.Pattern == nil && c.Equals == nil && c.LT == nil && c.LE == nil && c.GT == nil && c.GE == nil {
+			return nil, fmt.Errorf("%s: no test given (one of cidr, regex, equals, lt, le, gt or ge)", field)
+		}
+		rule = append(rule, c)
+	}
+	return rule, nil
+}
+
+// Parser returns a Parser for the configured input, or parser.Default if none
+// is configured.
+func (c *Config) Parser() *parser.Parser {
+	if len(c.Inputs) == 0 {
+		return parser.Default()
+	}
+	// Validated by Parse.
+	p, _ := c.Inputs[0].parser()
+	return p
+}
+
+// Specs returns the Specs of the configured metrics (or metric.DefaultSpecs
+// if none are configured), followed by the counters of the configured SLOs, and
+// the Apdex and cache metrics (if configured).
+func (c *Config) Specs() []*metric.Spec {
+	specs := metric.DefaultSpecs()
+	if len(c.Metrics) > 0 {
+		specs = nil
+		for i := range c.Metrics {
+			specs = append(specs, c.Metrics[i].spec())
+		}
+	}
+	for _, o := range c.Objectives() {
+		specs = append(specs, o.Specs()...)
+	}
+	if c.Apdex != nil {
+		specs = append(specs, apdex.Specs(filter(c.Apdex.Include, c.Apdex.Exclude))...)
+	}
+	if c.Cache != nil {
+		specs = append(specs, c.Cache.specs()...)
+	}
+	return specs
+}
+
+// Trackers returns Trackers for the configured heavy hitters.
+func (c *Config) Trackers() []*topk.Tracker {
+	var trackers []*topk.Tracker
+	for i := range c.HeavyHitters {
+		trackers = append(trackers, c.HeavyHitters[i].tracker())
+	}
+	return trackers
+}
+
+// Objectives returns Objectives for the configured SLOs.
+func (c *Config) Objectives() []*slo.Objective {
+	var objectives []*slo.Objective
+	for i := range c.SLOs {
+		objectives = append(objectives, c.SLOs[i].objective())
+	}
+	return objectives
+}
+
+// ApdexScorer returns an apdex.Scorer for the configured routes, or nil if
+// Apdex is not configured.
+func (c *Config) ApdexScorer() *apdex.Scorer {
+	if c.Apdex == nil {
+		return nil
+	}
+	s := apdex.NewScorer(nil)
+	if c.Apdex.Threshold != nil {
+		s.Threshold = *c.Apdex.Threshold
+	}
+	if c.Apdex.LatencyField != "" {
+		s.LatencyField = c.Apdex.LatencyField
+	}
+	for _, r := range c.Apdex.Routes {
+		route := apdex.Route{
+			Name:      r.Name,
+			Filter:    filter(r.Match, nil),
+			Threshold: s.Threshold,
+		}
+		if r.Threshold != nil {
+			route.Threshold = *r.Threshold
+		}
+		s.Routes = append(s.Routes, route)
+	}
+	return s
+}
+
+// AlertManager returns an alert.Manager for the configured alert rules, or nil
+// if there are none. Its Source is as configured, which may be empty.
+func (c *Config) AlertManager() *alert.Manager {
+	if len(c.Alerts.Rules) == 0 {
+		return nil
+	}
+	m := &alert.Manager{
+		RepeatInterval:   alert.DefaultRepeatInterval,
+		EvaluationPeriod: alert.DefaultEvaluationPeriod,
+		Source:           c.Alerts.Source,
+	}
+	for i := range c.Alerts.Rules {
+		m.Rules = append(m.Rules, c.Alerts.Rules[i].rule())
+	}
+	for _, w := range c.Alerts.Webhooks {
+		m.Notifiers = append(m.Notifiers, &alert.Webhook{
+			URL:     w.URL,
+			Format:  w.Format,
+			Headers: w.Headers,
+		})
+	}
+	if c.Alerts.RepeatInterval != nil {
+		m.RepeatInterval = *c.Alerts.RepeatInterval
+	}
+	if c.Alerts.EvaluationPeriod != nil {
+		m.EvaluationPeriod = *c.Alerts.EvaluationPeriod
+	}
+	return m
+}
+
+// exporter returns the configured exporter of the supplied kind, or nil.
+func (c *Config) exporter(kind string) *Exporter {
+	for i := range c.Exporters {
+		if c.Exporters[i].Kind == kind {
+			return &c.Exporters[i]
+		}
+	}
+	return nil
+}
+
+// Flags returns the values of command-line flags corresponding to settings
+// in the configuration, keyed by flag name. Unset settings are omitted.
+func (c *Config) Flags() map[string]string {
+	flags := make(map[string]string)
+	setString := func(name string, v *string) {
+		if v != nil {
+			flags[name] = *v
+		}
+	}
+	setBool := func(name string, v *bool) {
+		if v != nil {
+			flags[name] = strconv.FormatBool(*v)
+		}
+	}
+	setDuration := func(name string, v *time.Duration) {
+		if v != nil {
+			flags[name] = v.String()
+		}
+	}
+
+	if len(c.Inputs) > 0 {
+		in := c.Inputs[0]
+		flags["access_log_path"] = in.Path
+		setDuration("log_polling_period", in.PollingPeriod)
+		setDuration("rotation_check_period", in.RotationCheckPeriod)
+	}
+
+	setDuration("aggregation_window", c.Aggregation.Window)
+	setDuration("aggregation_lateness", c.Aggregation.Lateness)
+	setDuration("flush_period", c.Aggregation.FlushPeriod)
+
+	if e := c.exporter(CloudMonitoringExporter); e != nil {
+		setString("monitoring_endpoint", e.Endpoint)
+		setString("credentials_file", e.Credentials)
+		setString("metric_domain", e.MetricDomain)
+		setString("metric_prefix", e.MetricPrefix)
+		setBool("create_custom_metrics", e.CreateMetrics)
+		setBool("migrate_custom_metrics", e.MigrateMetrics)
+	}
+
+	if e := c.exporter(JSONExporter); e != nil {
+		flags["json_export_file"] = "-"
+		setString("json_export_file", e.Path)
+		if c.exporter(CloudMonitoringExporter) == nil {
+			flags["dry_run"] = "true"
+		}
+	}
+
+	setString("resource_type", c.Resource.Type)
+	setString("default_project_id", c.Resource.ProjectID)
+	setString("default_instance_name", c.Resource.InstanceName)
+	setString("default_zone_name", c.Resource.Zone)
+	setBool("use_metadata_service", c.Resource.UseMetadataService)
+	if c.Resource.MetadataProviders != nil {
+		flags["metadata_providers"] = strings.Join(c.Resource.MetadataProviders, ",")
+	}
+	setDuration("metadata_timeout", c.Resource.MetadataTimeout)
+	setString("metadata_file", c.Resource.MetadataFile)
+	setString("metadata_cache_file", c.Resource.MetadataCacheFile)
+	setString("downward_api_dir", c.Resource.DownwardAPIDir)
+
+	setString("state_file", c.StateFile)
+	setDuration("shutdown_timeout", c.ShutdownTimeout)
+	setBool("use_syslog", c.UseSyslog)
+	setBool("export_self_metrics", c.SelfMetrics)
+	setString("admin_address", c.Admin.Address)
+	setDuration("ready_max_read_age", c.Admin.MaxReadAge)
+	setDuration("ready_max_write_age", c.Admin.MaxWriteAge)
+	setString("user_agent_field", c.UserAgents.Field)
+	setString("user_agent_patterns_file", c.UserAgents.PatternsFile)
+	setString("geoip_country_database", c.GeoIP.CountryDatabase)
+	setString("geoip_asn_database", c.GeoIP.ASNDatabase)
+	if c.GeoIP.Countries != nil {
+		flags["geoip_countries"] = strings.Join(c.GeoIP.Countries, ",")
+	}
+	if c.GeoIP.ASNs != nil {
+		flags["geoip_asns"] = strings.Join(c.GeoIP.ASNs, ",")
+	}
+	if c.GeoIP.TrustedProxies != nil {
+		flags["trusted_proxies"] = strings.Join(c.GeoIP.TrustedProxies, ",")
+	}
+
+	return flags
+}
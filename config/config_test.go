@@ -0,0 +1,631 @@
+package config_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/alert"
+	"github.com/swfrench/nginx-log-consumer/apdex"
+	"github.com/swfrench/nginx-log-consumer/cache"
+	"github.com/swfrench/nginx-log-consumer/config"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/slo"
+	"github.com/swfrench/nginx-log-consumer/topk"
+)
+
+func TestLoadExample(t *testing.T) {
+	c, err := config.Load("../systemd/nginx_log_consumer.yaml")
+	if err != nil {
+		t.Fatalf("Load failed with %v", err)
+	}
+
+	if want, got := metric.DefaultSpecs(), c.Specs(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected example metrics to match the defaults %v, got %v", want, got)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	c, err := config.Parse("test.yaml", []byte(`
+inputs:
+  - path: /var/log/nginx/access.log
+    polling_period: 10s
+aggregation:
+  window: 0s
+exporters:
+  - kind: cloud_monitoring
+    endpoint: https://monitoring.example.com/
+    create_metrics: false
+resource:
+  type: generic_node
+  metadata_providers: [aws, file]
+  metadata_file: /etc/nginx_log_consumer/metadata.yaml
+  labels:
+    location: us-east1
+use_syslog: true
+self_metrics: true
+admin:
+  address: localhost:9145
+  max_read_age: 10m
+user_agents:
+  patterns_file: /etc/nginx_log_consumer/user_agents.yaml
+geoip:
+  country_database: /var/lib/GeoIP/GeoLite2-Country.mmdb
+  asns: ["15169", AS16509]
+  trusted_proxies: [10.0.0.0/8, 192.0.2.1]
+`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+
+	if want, got := map[string]string{
+		"access_log_path":          "/var/log/nginx/access.log",
+		"log_polling_period":       (10 * time.Second).String(),
+		"aggregation_window":       time.Duration(0).String(),
+		"monitoring_endpoint":      "https://monitoring.example.com/",
+		"create_custom_metrics":    "false",
+		"resource_type":            "generic_node",
+		"metadata_providers":       "aws,file",
+		"metadata_file":            "/etc/nginx_log_consumer/metadata.yaml",
+		"use_syslog":               "true",
+		"export_self_metrics":      "true",
+		"admin_address":            "localhost:9145",
+		"ready_max_read_age":       (10 * time.Minute).String(),
+		"user_agent_patterns_file": "/etc/nginx_log_consumer/user_agents.yaml",
+		"geoip_country_database":   "/var/lib/GeoIP/GeoLite2-Country.mmdb",
+		"geoip_asns":               "15169,AS16509",
+		"trusted_proxies":          "10.0.0.0/8,192.0.2.1",
+	}, c.Flags(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected flags %v, got %v", want, got)
+	}
+
+	if want, got := map[string]string{"location": "us-east1"}, c.Resource.Labels; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected resource labels %v, got %v", want, got)
+	}
+}
+
+func TestJSONExporterFlags(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    map[string]string
+	}{
+		{
+			content: "exporters:\n  - kind: json\n",
+			want: map[string]string{
+				"json_export_file": "-",
+				"dry_run":          "true",
+			},
+		},
+		{
+			content: "exporters:\n  - kind: cloud_monitoring\n  - kind: json\n    path: /tmp/out.json\n",
+			want: map[string]string{
+				"json_export_file": "/tmp/out.json",
+			},
+		},
+	} {
+		c, err := config.Parse("test.yaml", []byte(tc.content))
+		if err != nil {
+			t.Fatalf("Parse(%q) failed with %v", tc.content, err)
+		}
+		if got := c.Flags(); !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("Expected Parse(%q) to yield flags %v, got %v", tc.content, tc.want, got)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	c, err := config.Parse("test.yaml", []byte(`
+metrics:
+  - name: http_request_latency
+    type: distribution
+    field: request_time
+    unit: s
+    buckets: [0.1, 1]
+    labels:
+      - name: method
+  - name: unique_clients
+    type: unique
+    field: remote_addr
+    fields: [http_user_agent]
+    precision: 12
+`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+
+	want := []*metric.Spec{
+		{
+			Name:    "http_request_latency",
+			Kind:    metric.Distribution,
+			Unit:    "s",
+			Field:   "request_time",
+			Buckets: []float64{0.1, 1},
+			Labels: []metric.Label{
+				{Name: "method", Field: "method", Type: metric.StringLabel},
+			},
+		},
+		{
+			Name: "unique_clients",
+			Kind: metric.Gauge,
+			Unique: &metric.Unique{
+				Fields:    []string{"remote_addr", "http_user_agent"},
+				Precision: 12,
+			},
+		},
+	}
+	if got := c.Specs(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected specs %v, got %v", want, got)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	c, err := config.Parse("test.yaml", []byte(`
+metrics:
+  - name: http_response_count
+    exclude:
+      - remote_addr: {cidr: [35.191.0.0/16, 130.211.0.0/22]}
+        path: /healthz
+  - name: http_error_count
+    include:
+      - status: {ge: 500}
+      - request_time: {gt: 2.5}
+        http_user_agent: {regex: "^Mozilla/"}
+`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+
+	specs := c.Specs()
+	for _, tc := range []struct {
+		spec   int
+		record parser.Record
+		want   bool
+	}{
+		{0, parser.Record{"remote_addr": "35.191.0.1", "path": "/healthz"}, false},
+		{0, parser.Record{"remote_addr": "130.211.0.1", "path": "/healthz"}, false},
+		{0, parser.Record{"remote_addr": "10.0.0.1", "path": "/healthz"}, true},
+		{0, parser.Record{"remote_addr": "35.191.0.1", "path": "/"}, true},
+		{1, parser.Record{"status": "503"}, true},
+		{1, parser.Record{"status": "200", "request_time": "3", "http_user_agent": "Mozilla/5.0"}, true},
+		{1, parser.Record{"status": "200", "request_time": "3", "http_user_agent": "curl/7.0"}, false},
+		{1, parser.Record{"status": "200", "request_time": "0.1"}, false},
+	} {
+		if got := specs[tc.spec].Matches(tc.record); got != tc.want {
+			t.Errorf("Expected %s Matches(%v) to return %v, got %v", specs[tc.spec].Name, tc.record, tc.want, got)
+		}
+	}
+}
+
+func TestHeavyHitters(t *testing.T) {
+	c, err := config.Parse("test.yaml", []byte(`
+heavy_hitters:
+  - name: paths
+    field: path
+  - name: error_clients
+    field: remote_addr
+    window: 1m
+    capacity: 50
+    top: 5
+    export: true
+    include:
+      - status: {ge: 500}
+`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+
+	trackers := c.Trackers()
+	if len(trackers) != 2 {
+		t.Fatalf("Expected 2 trackers, got %d", len(trackers))
+	}
+	for i, want := range []*topk.Tracker{
+		{Name: "paths", Field: "path", Window: topk.DefaultWindow, Capacity: topk.DefaultCapacity, N: topk.DefaultTop},
+		{Name: "error_clients", Field: "remote_addr", Window: time.Minute, Capacity: 50, N: 5, Export: true},
+	} {
+		got := trackers[i]
+		if got.Name != want.Name || got.Field != want.Field || got.Window != want.Window || got.Capacity != want.Capacity || got.N != want.N || got.Export != want.Export {
+			t.Errorf("Expected tracker %+v, got %+v", want, got)
+		}
+	}
+	if trackers[0].Filter != nil {
+		t.Errorf("Expected no filter for %s, got %+v", trackers[0].Name, trackers[0].Filter)
+	}
+	if trackers[1].Filter.Matches(parser.Record{"status": "200"}) || !trackers[1].Filter.Matches(parser.Record{"status": "503"}) {
+		t.Errorf("Expected %s to count only errors", trackers[1].Name)
+	}
+}
+
+func TestSLOs(t *testing.T) {
+	c, err := config.Parse("test.yaml", []byte(`
+metrics:
+  - name: http_response_count
+slos:
+  - name: availability
+    objective: 0.999
+    exclude:
+      - path: /healthz
+    latency_threshold: 500ms
+  - name: api_success
+    objective: 0.99
+    include:
+      - path: {regex: "^/api/"}
+    good:
+      - status: {lt: 400}
+    period: 168h
+    windows: [1h, 24h]
+`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+
+	objectives := c.Objectives()
+	if len(objectives) != 2 {
+		t.Fatalf("Expected 2 objectives, got %d", len(objectives))
+	}
+	if o := objectives[0]; o.Target != 0.999 || o.Period != slo.DefaultPeriod || !reflect.DeepEqual(o.Windows, slo.DefaultWindows) {
+		t.Errorf("Expected %s to have default period and windows, got %+v", o.Name, o)
+	}
+	if o := objectives[1]; o.Period != 168*time.Hour || !reflect.DeepEqual(o.Windows, []time.Duration{time.Hour, 24 * time.Hour}) {
+		t.Errorf("Expected %s to have configured period and windows, got %+v", o.Name, o)
+	}
+
+	var names []string
+	specs := c.Specs()
+	for _, s := range specs {
+		names = append(names, s.Name)
+	}
+	if want := []string{
+		"http_response_count",
+		"slo/availability/good_count",
+		"slo/availability/total_count",
+		"slo/api_success/good_count",
+		"slo/api_success/total_count",
+	}; !reflect.DeepEqual(want, names) {
+		t.Fatalf("Expected metrics %v, got %v", want, names)
+	}
+	for _, tc := range []struct {
+		spec   int
+		record parser.Record
+		want   bool
+	}{
+		{1, parser.Record{"path": "/", "status": "200", "request_time": "0.5"}, true},
+		{1, parser.Record{"path": "/", "status": "200", "request_time": "0.501"}, false},
+		{1, parser.Record{"path": "/", "status": "503", "request_time": "0.1"}, false},
+		{2, parser.Record{"path": "/healthz", "status": "200", "request_time": "0.1"}, false},
+		{3, parser.Record{"path": "/api/users", "status": "200"}, true},
+		{3, parser.Record{"path": "/api/users", "status": "404"}, false},
+		{3, parser.Record{"path": "/", "status": "200"}, false},
+	} {
+		if got := specs[tc.spec].Matches(tc.record); got != tc.want {
+			t.Errorf("Expected %s Matches(%v) to return %v, got %v", specs[tc.spec].Name, tc.record, tc.want, got)
+		}
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	c, err := config.Parse("test.yaml", []byte(`
+alerts:
+  source: web-1
+  repeat_interval: 1h
+  webhooks:
+    - url: https://hooks.slack.com/services/T0/B0/X
+      format: slack
+    - url: http://localhost:9000/alerts
+      headers:
+        Authorization: Bearer secret
+  rules:
+    - name: server_errors
+      type: ratio
+      threshold: 0.05
+      exclude:
+        - path: /healthz
+    - name: slow_responses
+      type: latency
+      latency_threshold: 2s
+    - name: no_traffic
+      type: no_traffic
+      window: 10m
+`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+
+	m := c.AlertManager()
+	if m == nil {
+		t.Fatalf("Expected an alert manager")
+	}
+	if m.Source != "web-1" || m.RepeatInterval != time.Hour || m.EvaluationPeriod != alert.DefaultEvaluationPeriod {
+		t.Errorf("Expected configured source and repeat interval, got %+v", m)
+	}
+	if want, got := []alert.Notifier{
+		&alert.Webhook{URL: "https://hooks.slack.com/services/T0/B0/X", Format: alert.FormatSlack},
+		&alert.Webhook{URL: "http://localhost:9000/alerts", Headers: map[string]string{"Authorization": "Bearer secret"}},
+	}, m.Notifiers; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected webhooks %+v, got %+v", want, got)
+	}
+	if len(m.Rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %d", len(m.Rules))
+	}
+	for i, want := range []*alert.Rule{
+		{Name: "server_errors", Kind: alert.Ratio, Window: alert.DefaultWindow, Threshold: 0.05},
+		{Name: "slow_responses", Kind: alert.Latency, Window: alert.DefaultWindow, Threshold: 2, Field: alert.DefaultLatencyField, Quantile: alert.DefaultQuantile},
+		{Name: "no_traffic", Kind: alert.NoTraffic, Window: 10 * time.Minute},
+	} {
+		got := m.Rules[i]
+		if got.Name != want.Name || got.Kind != want.Kind || got.Window != want.Window || got.Threshold != want.Threshold || got.Field != want.Field || got.Quantile != want.Quantile {
+			t.Errorf("Expected rule %+v, got %+v", want, got)
+		}
+	}
+	if r := m.Rules[0]; r.Filter.Matches(parser.Record{"path": "/healthz"}) || !r.Match.Matches(parser.Record{"status": "502"}) {
+		t.Errorf("Expected %s to exclude health checks and match server errors", r.Name)
+	}
+
+	c, err = config.Parse("test.yaml", []byte("alerts:\n  webhooks:\n    - url: http://localhost:9000/\n"))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+	if m := c.AlertManager(); m != nil {
+		t.Errorf("Expected no alert manager without rules, got %+v", m)
+	}
+}
+
+func TestApdex(t *testing.T) {
+	c, err := config.Parse("test.yaml", []byte(`
+metrics:
+  - name: http_response_count
+apdex:
+  threshold: 300ms
+  exclude:
+    - path: /healthz
+  routes:
+    - name: api
+      match:
+        - path: {regex: "^/api/"}
+      threshold: 100ms
+    - name: static
+      match:
+        - path: {regex: "\\.(css|js)$"}
+`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+
+	s := c.ApdexScorer()
+	if s == nil {
+		t.Fatalf("Expected an Apdex scorer")
+	}
+	if s.Threshold != 300*time.Millisecond || s.LatencyField != apdex.DefaultLatencyField || len(s.Routes) != 2 {
+		t.Fatalf("Expected configured threshold and routes, got %+v", s)
+	}
+	if r := s.Routes[0]; r.Name != "api" || r.Threshold != 100*time.Millisecond {
+		t.Errorf("Expected api route with threshold 100ms, got %+v", r)
+	}
+	if r := s.Routes[1]; r.Name != "static" || r.Threshold != 300*time.Millisecond {
+		t.Errorf("Expected static route with default threshold, got %+v", r)
+	}
+	for _, tc := range []struct {
+		record parser.Record
+		want   string
+	}{
+		{parser.Record{"path": "/api/users", "request_time": "0.2"}, "api"},
+		{parser.Record{"path": "/app.js", "request_time": "0.2"}, "static"},
+		{parser.Record{"path": "/", "request_time": "0.2"}, apdex.OtherRoute},
+	} {
+		s.Enrich(tc.record)
+		if got := tc.record[apdex.RouteField]; got != tc.want {
+			t.Errorf("Expected route %s for %v, got %s", tc.want, tc.record, got)
+		}
+	}
+
+	var names []string
+	specs := c.Specs()
+	for _, s := range specs {
+		names = append(names, s.Name)
+	}
+	if want := []string{"http_response_count", apdex.CountMetric, apdex.ScoreMetric}; !reflect.DeepEqual(want, names) {
+		t.Fatalf("Expected metrics %v, got %v", want, names)
+	}
+	if specs[1].Matches(parser.Record{"path": "/healthz", apdex.RouteField: "other", apdex.LevelField: apdex.Satisfied}) {
+		t.Errorf("Expected %s to exclude health checks", specs[1].Name)
+	}
+
+	c, err = config.Parse("test.yaml", []byte("metrics:\n  - name: http_response_count\n"))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+	if s := c.ApdexScorer(); s != nil {
+		t.Errorf("Expected no Apdex scorer, got %+v", s)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c, err := config.Parse("test.yaml", []byte(`
+metrics:
+  - name: http_response_count
+cache:
+  bytes_field: bytes_sent
+  labels:
+    - name: host
+  exclude:
+    - path: /healthz
+`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+
+	specs := c.Specs()
+	var names []string
+	for _, s := range specs {
+		names = append(names, s.Name)
+	}
+	if want := []string{"http_response_count", cache.CountMetric, cache.BytesMetric}; !reflect.DeepEqual(want, names) {
+		t.Fatalf("Expected metrics %v, got %v", want, names)
+	}
+	if want, got := []metric.Label{
+		{Name: "source", Field: cache.SourceField, Type: metric.StringLabel, Description: "Source of the response (cache or origin)"},
+		{Name: "host", Field: "host", Type: metric.StringLabel},
+	}, specs[2].Labels; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected labels %+v, got %+v", want, got)
+	}
+	if specs[2].Field != "bytes_sent" {
+		t.Errorf("Expected bytes field bytes_sent, got %q", specs[2].Field)
+	}
+	if specs[1].Matches(parser.Record{"path": "/healthz"}) {
+		t.Errorf("Expected %s to exclude health checks", specs[1].Name)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    []string
+	}{
+		{
+			content: "inputs:\n  - path: [\n",
+			want:    []string{"test.yaml:2: "},
+		},
+		{
+			content: "inputs:\n  - path: /var/log/nginx/access.log\n    colour: blue\n",
+			want:    []string{"test.yaml:3: field colour not found"},
+		},
+		{
+			content: "aggregation:\n  window: soon\n",
+			want:    []string{"test.yaml:2: cannot unmarshal"},
+		},
+		{
+			content: "inputs:\n  - format: csv\n",
+			want: []string{
+				"test.yaml:2: inputs[0].path: must be set",
+				"test.yaml:2: inputs[0]: Unsupported log format",
+			},
+		},
+		{
+			content: "metrics:\n  - name: latency\n    type: distribution\n    field: request_time\n    buckets: [1, 0.5]\n  - name: latency\n",
+			want: []string{
+				"test.yaml:2: metrics[0]: buckets must be strictly increasing",
+				"test.yaml:6: metrics[1].name: duplicate metric",
+			},
+		},
+		{
+			content: "metrics:\n  - name: count\n    exclude:\n      - remote_addr: {cidr: [35.191.0.0]}\n      - path: {}\n",
+			want: []string{
+				"test.yaml:4: metrics[0].exclude[0]: remote_addr: invalid CIDR",
+				"test.yaml:5: metrics[0].exclude[1]: path: no test given",
+			},
+		},
+		{
+			content: "metrics:\n  - name: clients\n    type: unique\n  - name: count\n    fields: [remote_addr]\n    precision: 10\n",
+			want: []string{
+				"test.yaml:2: metrics[0]: unique metrics require fields",
+				"test.yaml:5: metrics[1].fields: may only be set for unique metrics",
+				"test.yaml:6: metrics[1].precision: may only be set for unique metrics",
+			},
+		},
+		{
+			content: "heavy_hitters:\n  - name: paths\n    top: 0\n  - name: paths\n    field: path\n    exclude:\n      - status: {}\n",
+			want: []string{
+				"test.yaml:2: heavy_hitters[0]: field must be set",
+				"test.yaml:7: heavy_hitters[1].exclude[0]: status: no test given",
+				"test.yaml:4: heavy_hitters[1].name: duplicate heavy hitter",
+			},
+		},
+		{
+			content: "metrics:\n  - name: heavy_hitters/paths\nheavy_hitters:\n  - name: paths\n    field: path\n    export: true\n",
+			want:    []string{"test.yaml:4: heavy_hitters[0].name: duplicate metric \"heavy_hitters/paths\""},
+		},
+		{
+			content: "slos:\n  - name: availability\n    objective: 99.9\n    latency_field: request_time\n  - name: availability\n    objective: 0.999\n    windows: [7m]\n    good:\n      - status: {}\n",
+			want: []string{
+				"test.yaml:2: slos[0]: objective must be between 0 and 1",
+				"test.yaml:4: slos[0].latency_field: may only be set with latency_threshold",
+				"test.yaml:5: slos[1]: invalid window 7m0s",
+				"test.yaml:9: slos[1].good[0]: status: no test given",
+				"test.yaml:5: slos[1].name: duplicate SLO",
+			},
+		},
+		{
+			content: "metrics:\n  - name: slo/availability/burn_rate\nslos:\n  - name: availability\n    objective: 0.999\n",
+			want:    []string{"test.yaml:4: slos[0].name: duplicate metric \"slo/availability/burn_rate\""},
+		},
+		{
+			content: "alerts:\n  webhooks:\n    - url: hooks.example.com\n      format: teams\n  rules:\n    - name: errors\n      type: ratio\n      threshold: 5\n      quantile: 0.99\n    - name: errors\n      type: no_traffic\n",
+			want: []string{
+				"test.yaml:6: alerts.rules[0]: threshold must be between 0 and 1",
+				"test.yaml:9: alerts.rules[0].quantile: may only be set for latency rules",
+				"test.yaml:10: alerts.rules[1].name: duplicate alert rule",
+				"test.yaml:3: alerts.webhooks[0].url: invalid webhook URL",
+				"test.yaml:4: alerts.webhooks[0].format: unknown webhook format",
+			},
+		},
+		{
+			content: "apdex:\n  threshold: 0s\n  routes:\n    - name: api\n      match:\n        - path: {regex: \"[\"}\n",
+			want: []string{
+				"test.yaml:2: apdex: threshold must be positive",
+				"test.yaml:6: apdex.routes[0].match[0]: path: invalid regex",
+			},
+		},
+		{
+			content: "metrics:\n  - name: apdex/score\napdex:\n  threshold: 300ms\n",
+			want:    []string{"test.yaml:4: apdex: duplicate metric \"apdex/score\""},
+		},
+		{
+			content: "cache:\n  labels:\n    - name: source\n  include:\n    - path: {regex: \"[\"}\n",
+			want: []string{
+				"test.yaml:2: cache: http_cache_bytes_sent: duplicate label \"source\"",
+				"test.yaml:5: cache.include[0]: path: invalid regex",
+			},
+		},
+		{
+			content: "metrics:\n  - name: http_cache_bytes_sent\ncache:\n  bytes_field: bytes_sent\n",
+			want:    []string{"test.yaml:4: cache: duplicate metric \"http_cache_bytes_sent\""},
+		},
+		{
+			content: "geoip:\n  trusted_proxies: [10.0.0.0/8, proxy.example.com]\n  countries: [USA]\n  asns: [google]\n",
+			want: []string{
+				"test.yaml:2: geoip.trusted_proxies[1]: invalid trusted proxy",
+				"test.yaml:3: geoip.countries[0]: invalid country",
+				"test.yaml:4: geoip.asns[0]: invalid autonomous system number",
+			},
+		},
+		{
+			content: "exporters:\n  - kind: prometheus\n  - kind: cloud_monitoring\n    metric_domain: example.com\n",
+			want: []string{
+				"test.yaml:2: exporters[0].kind: unknown exporter kind",
+				"test.yaml:3: exporters[1]: ",
+			},
+		},
+		{
+			content: "exporters:\n  - kind: json\n    endpoint: https://example.com/\n  - kind: cloud_monitoring\n    path: /tmp/out.json\n",
+			want: []string{
+				"test.yaml:3: exporters[0].endpoint: not supported by the json exporter",
+				"test.yaml:5: exporters[1].path: not supported by the cloud_monitoring exporter",
+			},
+		},
+		{
+			content: "resource:\n  type: gce_vm\n  metadata_providers: [aws, ec2]\nshutdown_timeout: -1s\n",
+			want: []string{
+				"test.yaml:2: resource.type: unknown resource type",
+				"test.yaml:3: resource.metadata_providers[1]: unknown metadata provider",
+				"test.yaml:4: shutdown_timeout: must be positive",
+			},
+		},
+	} {
+		_, err := config.Parse("test.yaml", []byte(tc.content))
+		errs, ok := err.(config.Errors)
+		if !ok {
+			t.Errorf("Expected Parse(%q) to fail with config.Errors, got %v", tc.content, err)
+			continue
+		}
+		if len(errs) != len(tc.want) {
+			t.Errorf("Expected Parse(%q) to fail with %d errors, got %v", tc.content, len(tc.want), errs)
+			continue
+		}
+		for i, want := range tc.want {
+			if got := errs[i].Error(); !strings.HasPrefix(got, want) {
+				t.Errorf("Expected Parse(%q) error %d to start with %q, got %q", tc.content, i, want, got)
+			}
+		}
+	}
+}
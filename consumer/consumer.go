@@ -3,100 +3,452 @@ package consumer
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"time"
 
+	"github.com/swfrench/nginx-log-consumer/alert"
+	"github.com/swfrench/nginx-log-consumer/checkpoint"
 	"github.com/swfrench/nginx-log-consumer/exporter"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/slo"
+	"github.com/swfrench/nginx-log-consumer/stats"
 	"github.com/swfrench/nginx-log-consumer/tailer"
+	"github.com/swfrench/nginx-log-consumer/topk"
 )
 
 const (
 	// ISO8601 contains a time.Parse reference timestamp for ISO 8601.
-	ISO8601 = "2006-01-02T15:04:05-07:00"
-)
+	ISO8601 = parser.ISO8601
 
-type logLine struct {
-	Time   string
-	Status string
-}
+	// DefaultShutdownTimeout is the default deadline for the final flush
+	// performed when Run returns.
+	DefaultShutdownTimeout = 10 * time.Second
+)
 
 // Consumer implements periodic polling of the supplied nginx access log
-// tailer, aggregation of response counts from the returned log lines, and
-// reporting of the latter via the supplied exporter (e.g. to Stackdriver).
+// tailer, computation of metrics (by default, response counts) from the
+// returned log lines, and reporting of the latter via the supplied exporter
+// (e.g. to Stackdriver). Accumulated values are flushed to the exporter
+// independently of polling, every FlushPeriod. If StatePath is set, a
+// checkpoint of cumulative values and the tailer position is saved there
+// after new content is consumed.
+//
+// By default, values are attributed to the time at which they are consumed.
+// If EnableWindows is called, they are instead aggregated into event-time
+// windows based on log timestamps.
 type Consumer struct {
-	Period   time.Duration
-	tailer   tailer.TailerT
-	exporter exporter.ExporterT
-	stop     chan bool
+	Period          time.Duration
+	FlushPeriod     time.Duration
+	ShutdownTimeout time.Duration
+	StatePath       string
+	tailer          tailer.TailerT
+	exporter        exporter.ExporterT
+	parser          *parser.Parser
+	specs           []*metric.Spec
+	windows         *windows
+	lateness        time.Duration
+	stats           *stats.Registry
+	statsExporter   exporter.ExporterT
+	trackers        []*topk.Tracker
+	objectives      []*slo.Objective
+	alerts          *alert.Manager
+	stop            chan bool
+	reconfigure     chan reconfigureRequest
+	done            chan struct{}
+}
+
+// reconfigureRequest carries a change to be applied by Run, and receives its
+// result.
+type reconfigureRequest struct {
+	f      func() error
+	result chan error
 }
 
 // NewConsumer returns a Consumer polling the supplied tailer and reporting to
-// the supplied exporter with the specified period.
+// the supplied exporter with the specified period. The FlushPeriod initially
+// matches the polling period. Log lines are initially parsed with
+// parser.Default, and the metrics described by metric.DefaultSpecs computed.
 func NewConsumer(period time.Duration, tailer tailer.TailerT, exporter exporter.ExporterT) *Consumer {
 	return &Consumer{
-		Period:   period,
-		tailer:   tailer,
-		exporter: exporter,
-		stop:     make(chan bool, 1),
+		Period:          period,
+		FlushPeriod:     period,
+		ShutdownTimeout: DefaultShutdownTimeout,
+		tailer:          tailer,
+		exporter:        exporter,
+		parser:          parser.Default(),
+		specs:           metric.DefaultSpecs(),
+		stop:            make(chan bool, 1),
+		reconfigure:     make(chan reconfigureRequest),
+		done:            make(chan struct{}),
+	}
+}
+
+// SetParser replaces the Parser used to parse log lines.
+func (c *Consumer) SetParser(p *parser.Parser) {
+	c.parser = p
+}
+
+// SetSpecs replaces the Specs of metrics computed from log records. These
+// should match the metrics known to the exporter.
+func (c *Consumer) SetSpecs(specs []*metric.Spec) {
+	c.specs = specs
+}
+
+// SetFilters replaces the Filters of the metrics computed from log records
+// (e.g. on reload), in the order of their Specs, retaining the values already
+// accumulated. Returns an error if the number of Filters does not match.
+func (c *Consumer) SetFilters(filters []*metric.Filter) error {
+	if len(filters) != len(c.specs) {
+		return fmt.Errorf("Got %d filters for %d metrics", len(filters), len(c.specs))
+	}
+	specs := make([]*metric.Spec, len(c.specs))
+	for i, s := range c.specs {
+		filtered := *s
+		filtered.Filter = filters[i]
+		specs[i] = &filtered
+	}
+	c.specs = specs
+	return nil
+}
+
+// EnableWindows configures the Consumer to aggregate values into aligned
+// event-time windows of the supplied size. A window is closed, and its values
+// exported with an end time matching that of the window, once the wall-clock
+// time passes the window end by the supplied lateness allowance. Records
+// arriving later than this are attributed to the earliest open window.
+func (c *Consumer) EnableWindows(size, lateness time.Duration) {
+	c.windows = newWindows(size)
+	c.lateness = lateness
+}
+
+// RestoreWindows restores values held in open windows (e.g. from a checkpoint
+// saved by a previous process). EnableWindows must have been called.
+func (c *Consumer) RestoreWindows(ws []checkpoint.Window) {
+	c.windows.restore(ws)
+}
+
+// SetWindowLateness changes the lateness allowance for event-time windows (see
+// EnableWindows). Has no effect if windowing is not enabled.
+func (c *Consumer) SetWindowLateness(lateness time.Duration) {
+	c.lateness = lateness
+}
+
+// SetTailer replaces the tailer polled by the Consumer (e.g. to read from a
+// new log path). Content remaining in the existing tailer is consumed first,
+// and the latter is closed if it implements io.Closer. Accumulated counts are
+// retained.
+func (c *Consumer) SetTailer(t tailer.TailerT) error {
+	if err := c.poll(); err != nil {
+		return err
+	}
+	if closer, ok := c.tailer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Could not close tailer: %v", err)
+		}
+	}
+	c.tailer = t
+	if c.StatePath != "" {
+		if err := c.saveCheckpoint(); err != nil {
+			log.Printf("Could not save checkpoint to %s: %v", c.StatePath, err)
+		}
+	}
+	return nil
+}
+
+// SetStats sets the Registry in which lines consumed, parse errors, filtered
+// lines and event lag are recorded. If e is non-nil, values collected from the
+// Registry are exported to it every FlushPeriod (and on shutdown). This should
+// be an exporter distinct from that used for log metrics, as its values are
+// attributed to the time of collection rather than to log timestamps.
+func (c *Consumer) SetStats(r *stats.Registry, e exporter.ExporterT) {
+	c.stats = r
+	c.statsExporter = e
+}
+
+// SetTrackers sets the Trackers by which the most frequent values of record
+// fields are counted. The top values of those with Export set are exported
+// alongside values from the stats Registry (see SetStats).
+func (c *Consumer) SetTrackers(trackers []*topk.Tracker) {
+	c.trackers = trackers
+}
+
+// SetObjectives sets the SLO Objectives evaluated. Their burn rates and
+// remaining error budgets are exported alongside values from the stats
+// Registry (see SetStats), and their counts saved in checkpoints.
+func (c *Consumer) SetObjectives(objectives []*slo.Objective) {
+	c.objectives = objectives
+}
+
+// SetAlerts sets the alert.Manager whose rules are evaluated against records
+// consumed (or nil, the default, for none).
+func (c *Consumer) SetAlerts(m *alert.Manager) {
+	c.alerts = m
+}
+
+// LateRecords returns the number of records which arrived after their
+// event-time window was closed.
+func (c *Consumer) LateRecords() int64 {
+	if c.windows == nil {
+		return 0
+	}
+	return c.windows.late
+}
+
+// closeWindows exports values from windows ending at or before the supplied
+// watermark. All are exported, even if some fail, in which case the first
+// error is returned.
+func (c *Consumer) closeWindows(watermark time.Time) error {
+	var firstErr error
+	for _, w := range c.windows.closeBefore(watermark) {
+		if err := c.export(w.Values, w.End); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	return firstErr
 }
 
 func (c *Consumer) consumeBytes(b []byte) error {
-	statusCounts := make(map[string]int64)
+	values := metric.NewValues()
+
+	var latest time.Time
+	late := c.LateRecords()
 
 	scanner := bufio.NewScanner(bytes.NewReader(b))
 	for scanner.Scan() {
-		lineBytes := scanner.Bytes()
+		c.stats.Add(stats.ConsumerLines, 1)
 
-		line := &logLine{}
-
-		err := json.Unmarshal(lineBytes, line)
+		t, r, err := c.parser.Parse(scanner.Bytes())
 		if err != nil {
-			log.Printf("Error parsing log line: %v", err)
+			log.Printf("%v", err)
+			if perr, ok := err.(*parser.Error); ok {
+				c.stats.Add(stats.ConsumerParseErrors, 1, perr.Reason)
+			}
 			continue
 		}
 
-		t, err := time.Parse(ISO8601, line.Time)
-		if err != nil {
-			log.Printf("Could not parse time %v: %v", line.Time, err)
+		if t.After(latest) {
+			latest = t
+		}
+
+		if !t.After(c.exporter.ResetTime()) {
+			c.stats.Add(stats.ConsumerFilteredLines, 1, stats.FilteredBeforeReset)
 			continue
 		}
 
-		if t.After(c.exporter.StatusCounterResetTime()) {
-			if tot, ok := statusCounts[line.Status]; ok {
-				statusCounts[line.Status] = 1 + tot
-			} else {
-				statusCounts[line.Status] = 1
+		for _, tr := range c.trackers {
+			tr.Observe(t, r)
+		}
+		for _, o := range c.objectives {
+			o.Observe(t, r)
+		}
+		if c.alerts != nil {
+			c.alerts.Observe(t, r)
+		}
+
+		v := values
+		if c.windows != nil {
+			v = c.windows.values(t)
+		}
+		for _, s := range c.specs {
+			if !s.Matches(r) {
+				c.stats.Add(stats.ConsumerFilterExclusions, 1, s.Name)
+				continue
 			}
+			s.Observe(r, v)
 		}
 	}
 
-	return c.exporter.IncrementStatusCounter(statusCounts)
+	c.stats.Add(stats.ConsumerLateLines, c.LateRecords()-late)
+	if !latest.IsZero() {
+		c.stats.Set(stats.ConsumerEventLag, time.Since(latest).Seconds())
+	}
+
+	if c.windows != nil {
+		return c.closeWindows(time.Now().Add(-c.lateness))
+	}
+
+	return c.export(values, time.Now())
+}
+
+// export exports the supplied complete values, once the gauges of unique and
+// mean metrics are computed from them.
+func (c *Consumer) export(values *metric.Values, end time.Time) error {
+	values.UpdateGauges()
+	return c.exporter.Export(values, end)
+}
+
+// saveCheckpoint saves the current tailer position, the exporter's cumulative
+// values and any open windows (which together account for all content up to
+// that position) to StatePath.
+func (c *Consumer) saveCheckpoint() error {
+	pos, err := c.tailer.Position()
+	if err != nil {
+		return err
+	}
+	resetTime, values := c.exporter.Snapshot()
+	state := &checkpoint.State{
+		ResetTime: resetTime,
+		Values:    values,
+		Position:  pos,
+	}
+	if c.windows != nil {
+		state.Windows = c.windows.snapshot()
+	}
+	for _, o := range c.objectives {
+		if s := o.Snapshot(); s != nil {
+			if state.SLOs == nil {
+				state.SLOs = make(map[string]*slo.State)
+			}
+			state.SLOs[o.Name] = s
+		}
+	}
+	return checkpoint.Save(c.StatePath, state)
+}
+
+// exportStats exports values collected from the stats Registry since the last
+// call, the current top values of exported Trackers and the burn rates of
+// Objectives, and flushes the stats exporter (if set).
+func (c *Consumer) exportStats(ctx context.Context) {
+	if c.statsExporter == nil {
+		return
+	}
+	now := time.Now()
+	values := c.stats.Collect()
+	for _, tr := range c.trackers {
+		if tr.Export {
+			values.Merge(tr.Values(now))
+		}
+	}
+	for _, o := range c.objectives {
+		values.Merge(o.Values(now))
+	}
+	if err := c.statsExporter.Export(values, now); err != nil {
+		log.Printf("Could not export self metrics: %v", err)
+	}
+	if err := c.statsExporter.Flush(ctx); err != nil {
+		log.Printf("Could not flush self metrics: %v", err)
+	}
+}
+
+// poll reads and consumes new log content, then saves a checkpoint (if
+// enabled).
+func (c *Consumer) poll() error {
+	b, err := c.tailer.Next()
+	if err != nil {
+		return fmt.Errorf("Could not retrieve log content: %v", err)
+	}
+	c.stats.Mark(stats.EventRead)
+	if err := c.consumeBytes(b); err != nil {
+		log.Printf("Could not export log content: %v", err)
+	}
+	if c.StatePath != "" && len(b) > 0 {
+		if err := c.saveCheckpoint(); err != nil {
+			log.Printf("Could not save checkpoint to %s: %v", c.StatePath, err)
+		}
+	}
+	return nil
 }
 
-// Run performs periodic polling and exporting. It will only return on error or
-// if Stop is called.
-func (c *Consumer) Run() error {
+// shutdown performs a final read of log content, closes all open windows,
+// flushes the exporter and the stats exporter (within ShutdownTimeout), and
+// saves a final checkpoint (if enabled).
+func (c *Consumer) shutdown() error {
+	b, err := c.tailer.Next()
+	if err != nil {
+		return fmt.Errorf("Could not retrieve log content: %v", err)
+	} else if err := c.consumeBytes(b); err != nil {
+		log.Printf("Could not export log content: %v", err)
+	}
+
+	if c.windows != nil {
+		for _, w := range c.windows.closeAll(time.Now()) {
+			if err := c.export(w.Values, w.End); err != nil {
+				log.Printf("Could not export log content: %v", err)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+
+	if err := c.exporter.Flush(ctx); err != nil {
+		log.Printf("Could not flush exported metrics: %v", err)
+	}
+
+	c.exportStats(ctx)
+
+	if c.StatePath != "" {
+		if err := c.saveCheckpoint(); err != nil {
+			log.Printf("Could not save checkpoint to %s: %v", c.StatePath, err)
+		}
+	}
+
+	return nil
+}
+
+// Run performs periodic polling and exporting. It will only return on error
+// reading logs, or if ctx is done or Stop is called, in which case a final
+// read, flush and checkpoint are performed before returning. Export failures
+// are logged, but do not cause Run to return (transient failures are retried
+// by the exporter).
+func (c *Consumer) Run(ctx context.Context) error {
+	defer close(c.done)
+
+	poll := time.NewTicker(c.Period)
+	defer poll.Stop()
+
+	flush := time.NewTicker(c.FlushPeriod)
+	defer flush.Stop()
+
 	for {
 		select {
-		case <-time.After(c.Period):
+		case <-poll.C:
+			if err := c.poll(); err != nil {
+				return err
+			}
+		case <-flush.C:
+			if err := c.exporter.Flush(ctx); err != nil {
+				log.Printf("Could not flush exported metrics: %v", err)
+			}
+			c.exportStats(ctx)
+		case r := <-c.reconfigure:
+			r.result <- r.f()
+			// Periods may have changed.
+			poll.Reset(c.Period)
+			flush.Reset(c.FlushPeriod)
+		case <-ctx.Done():
+			return c.shutdown()
 		case <-c.stop:
-			return nil
-		}
-		b, err := c.tailer.Next()
-		if err != nil {
-			return fmt.Errorf("Could not retrieve log content: %v", err)
-		} else if err := c.consumeBytes(b); err != nil {
-			return fmt.Errorf("Could not export log content: %v", err)
+			return c.shutdown()
 		}
 	}
-	return nil
 }
 
 // Stop signals that polling should cease in Run and the latter should return
-// (e.g. if Run is blocking in another goroutine).
+// following a final flush (e.g. if Run is blocking in another goroutine).
 func (c *Consumer) Stop() {
 	c.stop <- true
 }
+
+// Reconfigure calls f from the goroutine blocking in Run, between polls, and
+// returns its result. This allows f to safely modify the Consumer (e.g. using
+// SetTailer, or by changing Period or FlushPeriod, which take effect
+// immediately) and the components it uses while Run is in progress. If Run has
+// not yet been called, blocks until it is. Returns an error without calling f
+// if Run has returned.
+func (c *Consumer) Reconfigure(f func() error) error {
+	r := reconfigureRequest{
+		f:      f,
+		result: make(chan error, 1),
+	}
+	select {
+	case c.reconfigure <- r:
+		return <-r.result
+	case <-c.done:
+		return fmt.Errorf("Consumer is not running")
+	}
+}
@@ -2,30 +2,64 @@ package consumer_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/swfrench/nginx-log-consumer/alert"
+	"github.com/swfrench/nginx-log-consumer/checkpoint"
 	"github.com/swfrench/nginx-log-consumer/consumer"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/slo"
+	"github.com/swfrench/nginx-log-consumer/stats"
+	"github.com/swfrench/nginx-log-consumer/tailer"
 )
 
 type MockExporter struct {
 	callCount    int
+	flushCount   int
+	endTimes     []time.Time
 	statusCounts map[string]int64
+	values       *metric.Values
 	resetTime    time.Time
+	err          error
+	// onExport, if set, is called with the values of each export.
+	onExport func(*metric.Values)
 }
 
-func (e *MockExporter) StatusCounterResetTime() time.Time {
+func (e *MockExporter) ResetTime() time.Time {
 	return e.resetTime
 }
 
-func (e *MockExporter) IncrementStatusCounter(counts map[string]int64) error {
+func (e *MockExporter) Export(values *metric.Values, end time.Time) error {
 	e.callCount += 1
+	e.endTimes = append(e.endTimes, end)
+	e.values = values
+	if e.onExport != nil {
+		e.onExport(values)
+	}
 	e.statusCounts = make(map[string]int64)
-	for code := range counts {
-		e.statusCounts[code] = counts[code]
+	for code, count := range values.Counters[metric.StatusCountMetric] {
+		e.statusCounts[code] = count
 	}
-	return nil
+	return e.err
+}
+
+func (e *MockExporter) Snapshot() (time.Time, *metric.Values) {
+	values := metric.NewValues()
+	values.Counters[metric.StatusCountMetric] = e.statusCounts
+	return e.resetTime, values
+}
+
+func (e *MockExporter) Flush(ctx context.Context) error {
+	e.flushCount += 1
+	return e.err
 }
 
 type MockTailer struct {
@@ -38,11 +72,15 @@ func (t *MockTailer) Next() ([]byte, error) {
 	return t.content, nil
 }
 
+func (t *MockTailer) Position() (tailer.Position, error) {
+	return tailer.Position{Inode: 1, Offset: int64(t.callCount * len(t.content))}, nil
+}
+
 func testRunConsumer(t *testing.T, c *consumer.Consumer) {
 	done := make(chan bool, 1)
 	var consumerErr error
 	go func() {
-		consumerErr = c.Run()
+		consumerErr = c.Run(context.Background())
 		done <- true
 	}()
 
@@ -78,7 +116,10 @@ func TestSimple(t *testing.T) {
 		t.Fatalf("Consumer did not call MockTailer.Next()")
 	}
 	if exporter.callCount == 0 {
-		t.Fatalf("Consumer did not call MockExporter.IncrementStatusCounter()")
+		t.Fatalf("Consumer did not call MockExporter.Export()")
+	}
+	if exporter.flushCount == 0 {
+		t.Fatalf("Consumer did not call MockExporter.Flush()")
 	}
 }
 
@@ -109,7 +150,7 @@ func TestStatusCount(t *testing.T) {
 		t.Fatalf("Consumer did not call MockTailer.Next()")
 	}
 	if exporter.callCount == 0 {
-		t.Fatalf("Consumer did not call MockExporter.StatusCounts()")
+		t.Fatalf("Consumer did not call MockExporter.Export()")
 	}
 
 	// And content.
@@ -120,3 +161,524 @@ func TestStatusCount(t *testing.T) {
 		t.Fatalf("Exporter returned %v for 500 status count, wanted %v", got, want)
 	}
 }
+
+func TestExportError(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{err: fmt.Errorf("Test error")}
+	c := consumer.NewConsumer(testPeriod, tailer, exporter)
+
+	// Export errors should not cause the consumer to terminate.
+	testRunConsumer(t, c)
+
+	if exporter.callCount == 0 {
+		t.Fatalf("Consumer did not call MockExporter.Export()")
+	}
+	if exporter.flushCount == 0 {
+		t.Fatalf("Consumer did not call MockExporter.Flush()")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "consumer_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	resetTime := time.Now()
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	c := consumer.NewConsumer(testPeriod, tailer, exporter)
+	c.StatePath = filepath.Join(dir, "state.json")
+
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\"}\n", resetTime.Add(time.Minute).Format(consumer.ISO8601)))
+
+	testRunConsumer(t, c)
+
+	s, err := checkpoint.Load(c.StatePath)
+	if err != nil {
+		t.Fatalf("Could not load checkpoint: %v", err)
+	}
+	if s == nil {
+		t.Fatalf("Consumer did not save a checkpoint")
+	}
+
+	if got, want := s.Values.Counters[metric.StatusCountMetric]["200"], exporter.statusCounts["200"]; got != want {
+		t.Fatalf("Checkpoint contains %v for 200 status count, wanted %v", got, want)
+	}
+	if got, want := s.Position.Offset, int64(tailer.callCount*len(tailer.content)); got != want {
+		t.Fatalf("Checkpoint contains offset %v, wanted %v", got, want)
+	}
+}
+
+func TestWindows(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	resetTime := time.Now().Add(-time.Hour)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	c := consumer.NewConsumer(testPeriod, tailer, exporter)
+	c.EnableWindows(time.Minute, 0)
+
+	windowStart := resetTime.Add(30 * time.Minute).Truncate(time.Minute)
+
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		offset time.Duration
+		status string
+	}{
+		{10 * time.Second, "200"},
+		{20 * time.Second, "200"},
+		{90 * time.Second, "500"},
+	} {
+		buffer.WriteString(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"%s\"}\n", windowStart.Add(line.offset).Format(consumer.ISO8601), line.status))
+	}
+	tailer.content = buffer.Bytes()
+
+	testRunConsumer(t, c)
+
+	// Each window should have been exported with its end time, rather than
+	// the time of consumption.
+	if len(exporter.endTimes) < 2 {
+		t.Fatalf("Expected at least 2 calls to MockExporter.Export(), got %d", len(exporter.endTimes))
+	}
+	for i, want := range []time.Time{windowStart.Add(time.Minute), windowStart.Add(2 * time.Minute)} {
+		if got := exporter.endTimes[i]; !got.Equal(want) {
+			t.Fatalf("Expected window %d to be exported with end time %v, got %v", i, want, got)
+		}
+	}
+
+	// Subsequent polls return the same (now late) content.
+	if c.LateRecords() == 0 {
+		t.Fatalf("Expected late records to be counted")
+	}
+}
+
+func TestWindowsExportError(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	resetTime := time.Now().Add(-time.Hour)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime, err: fmt.Errorf("Test error")}
+	c := consumer.NewConsumer(testPeriod, tailer, exporter)
+	c.EnableWindows(time.Minute, 0)
+
+	windowStart := resetTime.Add(30 * time.Minute).Truncate(time.Minute)
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\"}\n{\"time\": \"%s\", \"status\": \"500\"}\n",
+		windowStart.Add(10*time.Second).Format(consumer.ISO8601), windowStart.Add(90*time.Second).Format(consumer.ISO8601)))
+
+	testRunConsumer(t, c)
+
+	// A failed export should not prevent later windows from being exported.
+	if len(exporter.endTimes) < 2 {
+		t.Fatalf("Expected at least 2 calls to MockExporter.Export(), got %d", len(exporter.endTimes))
+	}
+	for i, want := range []time.Time{windowStart.Add(time.Minute), windowStart.Add(2 * time.Minute)} {
+		if got := exporter.endTimes[i]; !got.Equal(want) {
+			t.Fatalf("Expected window %d to be exported with end time %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	const testPeriod = 10 * time.Millisecond
+
+	resetTime := time.Now().Add(-time.Minute)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+	c.EnableWindows(time.Hour, time.Hour)
+
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\"}\n", time.Now().Format(consumer.ISO8601)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	time.Sleep(testPeriod)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Consumer returned with error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Consumer did not terminate after context was cancelled")
+	}
+
+	// No polls should have occurred before cancellation, but the final read
+	// and flush should have been performed, and the open window exported
+	// with an end time no later than now.
+	if want, got := 1, tailer.callCount; want != got {
+		t.Fatalf("Expected %d calls to MockTailer.Next(), got %d", want, got)
+	}
+	if want, got := 1, exporter.flushCount; want != got {
+		t.Fatalf("Expected %d calls to MockExporter.Flush(), got %d", want, got)
+	}
+	if want, got := 1, len(exporter.endTimes); want != got {
+		t.Fatalf("Expected %d calls to MockExporter.Export(), got %d", want, got)
+	}
+	if end := exporter.endTimes[0]; end.After(time.Now()) {
+		t.Fatalf("Expected window to be exported with end time no later than now, got %v", end)
+	}
+	if got, want := exporter.statusCounts["200"], int64(1); got != want {
+		t.Fatalf("Exporter returned %v for 200 status count, wanted %v", got, want)
+	}
+}
+
+func TestShutdownFutureWindow(t *testing.T) {
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: time.Now().Add(-time.Minute)}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+	c.EnableWindows(time.Hour, time.Hour)
+
+	// A record timestamped in a window not yet started.
+	future := time.Now().Add(3 * time.Hour)
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\"}\n", future.Format(consumer.ISO8601)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	if want, got := 1, len(exporter.endTimes); want != got {
+		t.Fatalf("Expected %d calls to MockExporter.Export(), got %d", want, got)
+	}
+	if start, end := future.Truncate(time.Hour), exporter.endTimes[0]; end.Before(start) {
+		t.Errorf("Expected window to be exported with end time no earlier than its start %v, got %v", start, end)
+	}
+}
+
+func TestStats(t *testing.T) {
+	resetTime := time.Now().Add(-time.Minute)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	statsExporter := &MockExporter{}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+	r := stats.New()
+	c.SetStats(r, statsExporter)
+
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\"}\n{\"time\": \"%s\", \"status\": \"200\"}\n{\"status\": \"200\"}\n",
+		time.Now().Format(consumer.ISO8601),
+		resetTime.Add(-time.Minute).Format(consumer.ISO8601)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	// The final flush should export self metrics.
+	if want, got := 1, statsExporter.flushCount; want != got {
+		t.Fatalf("Expected %d calls to stats exporter Flush(), got %d", want, got)
+	}
+	values := statsExporter.values
+	if want, got := int64(3), values.Counters[stats.ConsumerLines][""]; want != got {
+		t.Errorf("Expected %d lines, got %d", want, got)
+	}
+	if want, got := int64(1), values.Counters[stats.ConsumerParseErrors][parser.ReasonMissingTime]; want != got {
+		t.Errorf("Expected %d parse errors, got %d", want, got)
+	}
+	if want, got := int64(1), values.Counters[stats.ConsumerFilteredLines][stats.FilteredBeforeReset]; want != got {
+		t.Errorf("Expected %d filtered lines, got %d", want, got)
+	}
+	if lag, ok := values.Gauges[stats.ConsumerEventLag][""]; !ok || lag < 0 || lag > 60 {
+		t.Errorf("Expected event lag under a minute, got %v", values.Gauges)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	resetTime := time.Now().Add(-time.Minute)
+
+	line := []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\"}\n", time.Now().Format(consumer.ISO8601)))
+
+	oldTailer := &MockTailer{content: line}
+	exporter := &MockExporter{resetTime: resetTime}
+	c := consumer.NewConsumer(time.Hour, oldTailer, exporter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	// Switching tailers consumes remaining content from the old one.
+	newTailer := &MockTailer{}
+	if err := c.Reconfigure(func() error {
+		c.Period = 10 * time.Millisecond
+		if err := c.SetTailer(newTailer); err != nil {
+			return err
+		}
+		if got, want := exporter.statusCounts["200"], int64(1); got != want {
+			t.Errorf("Exporter returned %v for 200 status count, wanted %v", got, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Reconfigure failed with %v", err)
+	}
+
+	// Errors are propagated.
+	if err := c.Reconfigure(func() error { return fmt.Errorf("Test error") }); err == nil {
+		t.Fatalf("Reconfigure should have failed, but did not")
+	}
+
+	// The new polling period takes effect.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	if want, got := 1, oldTailer.callCount; want != got {
+		t.Fatalf("Expected %d calls to old MockTailer.Next(), got %d", want, got)
+	}
+	if newTailer.callCount < 2 {
+		t.Fatalf("Expected new MockTailer to be polled, got %d calls to Next()", newTailer.callCount)
+	}
+
+	if err := c.Reconfigure(func() error { return nil }); err == nil {
+		t.Fatalf("Reconfigure should have failed after Run returned, but did not")
+	}
+}
+
+func TestParserAndSpecs(t *testing.T) {
+	resetTime := time.Now().Add(-time.Minute)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+
+	p, err := parser.New(parser.FormatJSON, map[string]string{"status": "code"}, parser.ISO8601)
+	if err != nil {
+		t.Fatalf("Could not create parser: %v", err)
+	}
+	c.SetParser(p)
+
+	latency := &metric.Spec{
+		Name:    "http_request_latency",
+		Kind:    metric.Distribution,
+		Field:   "request_time",
+		Buckets: []float64{0.1, 1},
+	}
+	c.SetSpecs([]*metric.Spec{metric.StatusCountSpec(), latency})
+
+	now := time.Now().Format(consumer.ISO8601)
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"code\": 200, \"request_time\": 0.5}\n{\"time\": \"%s\", \"code\": 404, \"request_time\": 0.05}\n", now, now))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	if want, got := map[string]int64{"200": 1, "404": 1}, exporter.statusCounts; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected status counts %v, got %v", want, got)
+	}
+	if want, got := []int64{1, 1, 0}, exporter.values.Distributions[latency.Name][""].BucketCounts; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected latency bucket counts %v, got %v", want, got)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	resetTime := time.Now().Add(-time.Minute)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+	r := stats.New()
+	c.SetStats(r, nil)
+
+	healthz := "/healthz"
+	s := metric.StatusCountSpec()
+	s.Filter = &metric.Filter{
+		Exclude: []metric.Rule{{{Field: "path", Equals: &healthz}}},
+	}
+	c.SetSpecs([]*metric.Spec{s})
+
+	now := time.Now().Format(consumer.ISO8601)
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": 200, \"path\": \"/healthz\"}\n{\"time\": \"%s\", \"status\": 200, \"path\": \"/\"}\n", now, now))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	if want, got := map[string]int64{"200": 1}, exporter.statusCounts; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected status counts %v, got %v", want, got)
+	}
+	if want, got := int64(1), r.Snapshot().Counters[stats.ConsumerFilterExclusions][s.Name]; want != got {
+		t.Errorf("Expected %d filter exclusions, got %d", want, got)
+	}
+}
+
+func TestSetFilters(t *testing.T) {
+	resetTime := time.Now().Add(-time.Minute)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+
+	s := metric.StatusCountSpec()
+	c.SetSpecs([]*metric.Spec{s})
+	if err := c.SetFilters(nil); err == nil {
+		t.Errorf("Expected SetFilters to fail with too few filters")
+	}
+
+	healthz := "/healthz"
+	if err := c.SetFilters([]*metric.Filter{{
+		Exclude: []metric.Rule{{{Field: "path", Equals: &healthz}}},
+	}}); err != nil {
+		t.Fatalf("SetFilters failed with %v", err)
+	}
+	if s.Filter != nil {
+		t.Errorf("Expected the supplied Spec not to be modified, got filter %+v", s.Filter)
+	}
+
+	now := time.Now().Format(consumer.ISO8601)
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": 200, \"path\": \"/healthz\"}\n{\"time\": \"%s\", \"status\": 200, \"path\": \"/\"}\n", now, now))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	if want, got := map[string]int64{"200": 1}, exporter.statusCounts; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected status counts %v, got %v", want, got)
+	}
+}
+
+func TestUnique(t *testing.T) {
+	resetTime := time.Now().Add(-time.Hour)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+	c.EnableWindows(time.Minute, 0)
+	c.SetSpecs([]*metric.Spec{{
+		Name:   "unique_clients",
+		Kind:   metric.Gauge,
+		Unique: &metric.Unique{Fields: []string{"remote_addr"}, Precision: metric.DefaultPrecision},
+	}})
+
+	windowStart := resetTime.Add(30 * time.Minute).Truncate(time.Minute)
+	var buffer bytes.Buffer
+	for _, line := range []struct {
+		offset time.Duration
+		addr   string
+	}{
+		{10 * time.Second, "192.0.2.1"},
+		{20 * time.Second, "192.0.2.2"},
+		{30 * time.Second, "192.0.2.1"},
+		{90 * time.Second, "192.0.2.1"},
+	} {
+		buffer.WriteString(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\", \"remote_addr\": \"%s\"}\n", windowStart.Add(line.offset).Format(consumer.ISO8601), line.addr))
+	}
+	tailer.content = buffer.Bytes()
+
+	var estimates []float64
+	exporter.onExport = func(values *metric.Values) {
+		estimates = append(estimates, values.Gauges["unique_clients"][""])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	// Distinct clients are counted per window.
+	if want, got := []float64{2, 1}, estimates; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected estimates %v, got %v", want, got)
+	}
+}
+
+func TestObjectives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consumer_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	resetTime := now.Add(-time.Hour)
+
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: resetTime}
+	statsExporter := &MockExporter{}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+	c.StatePath = filepath.Join(dir, "state.json")
+	c.SetStats(stats.New(), statsExporter)
+	o := &slo.Objective{
+		Name:    "availability",
+		Target:  0.9,
+		Good:    slo.DefaultGood(),
+		Windows: []time.Duration{time.Hour},
+		Period:  24 * time.Hour,
+	}
+	c.SetObjectives([]*slo.Objective{o})
+
+	ts := now.Add(-time.Minute).Format(consumer.ISO8601)
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\"}\n{\"time\": \"%s\", \"status\": \"503\"}\n", ts, ts))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	// Half of records failed, at 5 times the rate allowed.
+	burnRate := o.GaugeSpecs()[0].Name
+	if got := statsExporter.values.Gauges[burnRate]["1h"]; got < 4.99 || got > 5.01 {
+		t.Errorf("Expected burn rate of 5 over 1h, got %v", got)
+	}
+
+	s, err := checkpoint.Load(c.StatePath)
+	if err != nil {
+		t.Fatalf("Could not load checkpoint: %v", err)
+	}
+	restored := &slo.Objective{Name: o.Name, Target: o.Target, Period: o.Period}
+	restored.Restore(s.SLOs[o.Name])
+	if want, got := o.BurnRate(now, time.Hour), restored.BurnRate(now, time.Hour); want != got {
+		t.Errorf("Expected burn rate %v after restoring checkpoint, got %v", want, got)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	now := time.Now()
+	tailer := &MockTailer{}
+	exporter := &MockExporter{resetTime: now.Add(-time.Hour)}
+	c := consumer.NewConsumer(time.Hour, tailer, exporter)
+	rule := &alert.Rule{Name: "errors", Kind: alert.Ratio, Window: 5 * time.Minute, Match: alert.DefaultMatch(), Threshold: 0.05}
+	c.SetAlerts(&alert.Manager{Rules: []*alert.Rule{rule}})
+
+	ts := now.Add(-time.Minute).Format(consumer.ISO8601)
+	tailer.content = []byte(fmt.Sprintf("{\"time\": \"%s\", \"status\": \"200\"}\n{\"time\": \"%s\", \"status\": \"503\"}\n", ts, ts))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Consumer returned with error: %v", err)
+	}
+
+	if firing, summary := rule.Evaluate(now); !firing {
+		t.Errorf("Expected %s to fire for consumed records, got %s", rule.Name, summary)
+	}
+}
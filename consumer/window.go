@@ -0,0 +1,128 @@
+package consumer
+
+import (
+	"sort"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/checkpoint"
+	"github.com/swfrench/nginx-log-consumer/metric"
+)
+
+// windows accumulates metric values into aligned, fixed-size event-time
+// windows. Windows are closed (and their values released for export) once
+// the watermark passes their end.
+type windows struct {
+	size time.Duration
+	open map[time.Time]*metric.Values
+	// closedUntil is the end of the latest closed window. Records falling
+	// before it are late, and are attributed to the earliest open window.
+	closedUntil time.Time
+	late        int64
+}
+
+func newWindows(size time.Duration) *windows {
+	return &windows{
+		size: size,
+		open: make(map[time.Time]*metric.Values),
+	}
+}
+
+// values returns the values of the window to which a record with the supplied
+// event time is attributed.
+func (w *windows) values(t time.Time) *metric.Values {
+	start := t.Truncate(w.size)
+	if start.Before(w.closedUntil) {
+		start = w.closedUntil
+		w.late++
+	}
+	values, ok := w.open[start]
+	if !ok {
+		values = metric.NewValues()
+		w.open[start] = values
+	}
+	return values
+}
+
+// starts returns the start times of open windows, in increasing order.
+func (w *windows) starts() []time.Time {
+	var starts []time.Time
+	for start := range w.open {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].Before(starts[j])
+	})
+	return starts
+}
+
+// closeBefore closes all open windows ending at or before the supplied
+// watermark, returning them in increasing order of end time.
+func (w *windows) closeBefore(watermark time.Time) []checkpoint.Window {
+	var closed []checkpoint.Window
+	for _, start := range w.starts() {
+		end := start.Add(w.size)
+		if end.After(watermark) {
+			break
+		}
+		closed = append(closed, checkpoint.Window{
+			End:    end,
+			Values: w.open[start],
+		})
+		delete(w.open, start)
+		w.closedUntil = end
+	}
+	return closed
+}
+
+// closeAll closes all open windows (e.g. on shutdown), returning them in
+// increasing order of end time. End times are limited to the supplied current
+// time, as windows still in progress only account for records up to now, but
+// windows not yet started (holding records timestamped in the future) end at
+// their start.
+func (w *windows) closeAll(now time.Time) []checkpoint.Window {
+	var closed []checkpoint.Window
+	for _, start := range w.starts() {
+		end := start.Add(w.size)
+		if end.After(w.closedUntil) {
+			w.closedUntil = end
+		}
+		if end.After(now) {
+			end = now
+		}
+		if end.Before(start) {
+			end = start
+		}
+		closed = append(closed, checkpoint.Window{
+			End:    end,
+			Values: w.open[start],
+		})
+		delete(w.open, start)
+	}
+	return closed
+}
+
+// snapshot returns copies of all open windows, in increasing order of end
+// time.
+func (w *windows) snapshot() []checkpoint.Window {
+	var open []checkpoint.Window
+	for _, start := range w.starts() {
+		open = append(open, checkpoint.Window{
+			End:    start.Add(w.size),
+			Values: w.open[start].Copy(),
+		})
+	}
+	return open
+}
+
+// restore adds values from the supplied (e.g. checkpointed) windows.
+func (w *windows) restore(ws []checkpoint.Window) {
+	for _, cw := range ws {
+		start := cw.End.Add(-w.size).Truncate(w.size)
+		values, ok := w.open[start]
+		if !ok {
+			values = metric.NewValues()
+			w.open[start] = values
+		}
+		values.Merge(cw.Values)
+	}
+}
@@ -1,13 +1,140 @@
 package counter
 
 import (
+	"context"
+	"sort"
 	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/stats"
+
+	"google.golang.org/api/monitoring/v3"
 )
 
+// CumulativeMetricT provides an interface implemented by all metrics (including
+// gauges, for which the reset time is only nominal).
+type CumulativeMetricT interface {
+	Ensure(bool) error
+	Flush(context.Context) error
+	ResetTime() time.Time
+	SetService(*monitoring.Service)
+	SetStats(*stats.Registry)
+}
+
 // CounterMetricT provides an interface implemented by all cumulative counter
 // metrics. Can be used, for example, to implement mock counters for tests.
 type CounterMetricT interface {
-	Create() error
-	Increment(map[string]int64) error
-	ResetTime() time.Time
+	CumulativeMetricT
+	Increment(map[string]int64, time.Time) error
+	Snapshot() (time.Time, map[string]int64)
+	Restore(time.Time, map[string]int64)
+}
+
+// DistributionMetricT provides an interface implemented by all cumulative
+// distribution metrics.
+type DistributionMetricT interface {
+	CumulativeMetricT
+	Add(map[string]*metric.Histogram, time.Time) error
+	Snapshot() (time.Time, map[string]*metric.Histogram)
+	Restore(time.Time, map[string]*metric.Histogram)
+}
+
+// GaugeMetricT provides an interface implemented by all gauge metrics.
+type GaugeMetricT interface {
+	CumulativeMetricT
+	Set(map[string]float64, time.Time) error
+	Snapshot() (time.Time, map[string]float64)
+}
+
+// Counter implements CounterMetricT for counter metrics (e.g. HTTP response
+// status code counts), with counts keyed by label values (see metric.Key).
+type Counter struct {
+	writer
+	counts map[string]int64
+}
+
+// NewCounter creates a Counter for the supplied Spec associated with the
+// provided project and MonitoredResource, which will write timeseries values
+// for the supplied metric type via the provided service.
+func NewCounter(project string, metricType string, spec *metric.Spec, resource *monitoring.MonitoredResource, service *monitoring.Service) *Counter {
+	c := &Counter{
+		writer: newWriter(project, metricType, spec, resource, service),
+		counts: make(map[string]int64),
+	}
+	c.series = c.timeSeriesAt
+	return c
+}
+
+// NewStatusCounter creates a Counter for HTTP response status code counts (see
+// metric.StatusCountSpec).
+func NewStatusCounter(project string, metricType string, resource *monitoring.MonitoredResource, service *monitoring.Service) *Counter {
+	return NewCounter(project, metricType, metric.StatusCountSpec(), resource, service)
+}
+
+// Snapshot returns the reset time and a copy of the current cumulative counts.
+func (c *Counter) Snapshot() (time.Time, map[string]int64) {
+	counts := make(map[string]int64)
+	for key, count := range c.counts {
+		counts[key] = count
+	}
+	return c.resetTime, counts
+}
+
+// Restore replaces the reset time and cumulative counts with those supplied
+// (e.g. from a Snapshot taken by a previous process), so that the same
+// cumulative timeseries is continued.
+func (c *Counter) Restore(resetTime time.Time, counts map[string]int64) {
+	c.resetTime = resetTime
+	c.counts = make(map[string]int64)
+	for key, count := range counts {
+		c.counts[key] = count
+	}
+}
+
+// Descriptor returns the descriptor of the custom counter metric.
+func (c *Counter) Descriptor() *monitoring.MetricDescriptor {
+	return c.descriptor("CUMULATIVE", "INT64")
+}
+
+// Ensure will create the custom counter metric in Stackdriver if it does not
+// already exist. If it exists but does not match Descriptor, an error is
+// returned unless migrate is true, in which case the existing metric is
+// deleted (discarding its data) and recreated.
+func (c *Counter) Ensure(migrate bool) error {
+	return c.ensure(c.Descriptor(), migrate)
+}
+
+// timeSeriesAt returns timeseries for the current cumulative counts, sorted by
+// key.
+func (c *Counter) timeSeriesAt(endTime time.Time) []*monitoring.TimeSeries {
+	var keys []string
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var timeSeries []*monitoring.TimeSeries
+	for _, key := range keys {
+		count := c.counts[key]
+		timeSeries = append(timeSeries, c.timeSeries(key, endTime, &monitoring.TypedValue{
+			Int64Value: &count,
+		}))
+	}
+	return timeSeries
+}
+
+// Increment will accumulate count deltas from the supplied map, which account
+// for records up to the supplied end time. Updated values are written on the
+// next call to Flush.
+func (c *Counter) Increment(counts map[string]int64, endTime time.Time) error {
+	c.advance(endTime)
+
+	for key, count := range counts {
+		if count > 0 {
+			c.dirty = true
+		}
+		c.counts[key] += count
+	}
+
+	return nil
 }
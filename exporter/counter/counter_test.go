@@ -0,0 +1,608 @@
+package counter_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/counter"
+	"github.com/swfrench/nginx-log-consumer/metric"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/monitoring/v3"
+)
+
+const testMetricType = "custom.googleapis.com/nginx/http_response_count"
+
+func TestResetTime(t *testing.T) {
+	tMin := time.Now()
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	tMax := time.Now()
+
+	if tReset := c.ResetTime(); tReset.Before(tMin) || tReset.After(tMax) {
+		t.Errorf("Expected counter ResetTime to be between [%v, %v]; got %v", tMin, tMax, tReset)
+	}
+}
+
+func TestEnsureMetric(t *testing.T) {
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+
+	var existing *monitoring.MetricDescriptor
+	var getName, deleteName, projectSpec string
+	var descriptor *monitoring.MetricDescriptor
+
+	c.GetMetricCallback = func(name string) (*monitoring.MetricDescriptor, error) {
+		getName = name
+		if existing == nil {
+			return nil, &googleapi.Error{Code: 404}
+		}
+		return existing, nil
+	}
+	c.CreateMetricCallback = func(p string, d *monitoring.MetricDescriptor) error {
+		projectSpec = p
+		descriptor = d
+		existing = d
+		return nil
+	}
+	c.DeleteMetricCallback = func(name string) error {
+		deleteName = name
+		existing = nil
+		return nil
+	}
+
+	// Missing descriptors are created:
+
+	if err := c.Ensure(false); err != nil {
+		t.Errorf("Ensure failed with %v", err)
+	}
+
+	if want, got := "projects/foo/metricDescriptors/"+testMetricType, getName; got != want {
+		t.Errorf("Expected GetMetricCallback to be called with %s, got %s", want, got)
+	}
+
+	if want, got := "projects/foo", projectSpec; got != want {
+		t.Errorf("Expected CreateMetricCallback to be called with %s, got %s", want, got)
+	}
+
+	// Verify a handful of key descriptor fields:
+
+	if want, got := testMetricType, descriptor.Type; got != want {
+		t.Errorf("Expected descriptor passed to CreateMetricCallback for metric %s, got %s", want, got)
+	}
+
+	if want, got := "CUMULATIVE", descriptor.MetricKind; got != want {
+		t.Errorf("Expected descriptor passed to CreateMetricCallback for metric kind %s, got %s", want, got)
+	}
+
+	if want, got := "INT64", descriptor.ValueType; got != want {
+		t.Errorf("Expected descriptor passed to CreateMetricCallback for metric type %s, got %s", want, got)
+	}
+
+	// Matching descriptors are left alone:
+
+	descriptor = nil
+
+	if err := c.Ensure(false); err != nil {
+		t.Errorf("Ensure failed with %v", err)
+	}
+
+	if descriptor != nil {
+		t.Errorf("Expected CreateMetricCallback not to be called for existing descriptor")
+	}
+
+	// Drifted descriptors result in an error, unless migration is
+	// requested:
+
+	existing = c.Descriptor()
+	existing.MetricKind = "GAUGE"
+	existing.Labels = append(existing.Labels, &monitoring.LabelDescriptor{Key: "method"})
+
+	if err := c.Ensure(false); err == nil {
+		t.Errorf("Ensure should have failed for mismatched descriptor, but did not.")
+	}
+
+	if deleteName != "" || descriptor != nil {
+		t.Errorf("Expected mismatched descriptor not to be deleted or recreated without migration")
+	}
+
+	if err := c.Ensure(true); err != nil {
+		t.Errorf("Ensure failed with %v", err)
+	}
+
+	if want, got := "projects/foo/metricDescriptors/"+testMetricType, deleteName; got != want {
+		t.Errorf("Expected DeleteMetricCallback to be called with %s, got %s", want, got)
+	}
+
+	if descriptor == nil || descriptor.MetricKind != "CUMULATIVE" {
+		t.Errorf("Expected descriptor to be recreated following migration, got %v", descriptor)
+	}
+
+	// Now check that error propagation works as intended:
+
+	existing = nil
+	c.CreateMetricCallback = func(_ string, _ *monitoring.MetricDescriptor) error {
+		return fmt.Errorf("This is an error.")
+	}
+
+	if err := c.Ensure(false); err == nil {
+		t.Errorf("Ensure should have failed, but did not.")
+	}
+
+	c.GetMetricCallback = func(_ string) (*monitoring.MetricDescriptor, error) {
+		return nil, &googleapi.Error{Code: 403}
+	}
+
+	if err := c.Ensure(false); err == nil {
+		t.Errorf("Ensure should have failed, but did not.")
+	}
+}
+
+func TestIncrementMetric(t *testing.T) {
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	c.MinWriteInterval = 0
+
+	var projectSpec string
+	var timeseries *monitoring.CreateTimeSeriesRequest
+
+	// Check basic counter increments:
+
+	callCount := 0
+
+	c.CreateTimeSeriesCallback = func(_ context.Context, p string, ts *monitoring.CreateTimeSeriesRequest) error {
+		callCount++
+		projectSpec = p
+		timeseries = ts
+		return nil
+	}
+
+	newCounts := map[string]int64{
+		"200": 1,
+		"503": 2,
+	}
+
+	tEndMin := time.Now()
+	if err := c.Increment(newCounts, time.Now()); err != nil {
+		t.Errorf("Increment(%v) failed with: %v", newCounts, err)
+	}
+	tEndMax := time.Now()
+
+	if want, got := 0, callCount; want != got {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called %d times before Flush, got %d", want, got)
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	if want, got := 1, callCount; want != got {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called %d times, got %d", want, got)
+	}
+
+	if want, got := "projects/foo", projectSpec; got != want {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called with %s, got %s", want, got)
+	}
+
+	countsSeen := make(map[string]int64)
+	for _, ts := range timeseries.TimeSeries {
+		if want, got := ts.Metric.Type, testMetricType; got != want {
+			t.Errorf("Expected CreateTimeSeriesCallback called with timeseries data for metric %s, got %s", want, got)
+		}
+
+		response_code, ok := ts.Metric.Labels["response_code"]
+		if !ok {
+			t.Errorf("Expected CreateTimeSeriesCallback called with timeseries data labeled with response_code status: %v", ts.Metric.Labels)
+		}
+
+		for _, p := range ts.Points {
+			if _, exists := countsSeen[response_code]; exists {
+				t.Errorf("CreateTimeSeriesCallback called with duplicate points for response code %s", response_code)
+			}
+
+			countsSeen[response_code] = *p.Value.Int64Value
+			if want, got := c.ResetTime().UTC().Format(time.RFC3339Nano), p.Interval.StartTime; got != want {
+				t.Errorf("Expected CreateTimeSeriesCallback called with points covering interval starting at %v, got %v", want, got)
+			}
+
+			if minWant, maxWant, got := tEndMin.UTC().Format(time.RFC3339Nano), tEndMax.UTC().Format(time.RFC3339Nano), p.Interval.EndTime; got < minWant || got > maxWant {
+				t.Errorf("Expected CreateTimeSeriesCallback called with points covering interval ending between [%v, %v], got %v", minWant, maxWant, got)
+			}
+		}
+	}
+
+	for code, count := range newCounts {
+		seen, ok := countsSeen[code]
+		if !ok {
+			t.Errorf("Expected CreateTimeSeriesCallback called with increment for response code %s, but it is missing", code)
+		} else if want, got := count, seen; want != got {
+			t.Errorf("Expected CreateTimeSeriesCallback called with count of %d for repsonse code %s, got %d", want, code, got)
+		}
+	}
+
+	// Call again and make sure accumulation is working:
+
+	newCounts = map[string]int64{
+		"200": 2,
+		"503": 3,
+	}
+
+	callCount = 0
+
+	if err := c.Increment(newCounts, time.Now()); err != nil {
+		t.Errorf("Increment(%v) failed with: %v", newCounts, err)
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	if want, got := 1, callCount; want != got {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called %d times, got %d", want, got)
+	}
+
+	for _, ts := range timeseries.TimeSeries {
+		response_code, ok := ts.Metric.Labels["response_code"]
+		if !ok {
+			t.Errorf("Expected CreateTimeSeriesCallback called with timeseries data labeled with response_code status: %v", ts.Metric.Labels)
+		}
+
+		for _, p := range ts.Points {
+			countsSeen[response_code] = *p.Value.Int64Value
+		}
+	}
+
+	for code, wantCount := range map[string]int64{
+		"200": 3,
+		"503": 5,
+	} {
+		if want, got := wantCount, countsSeen[code]; got != want {
+			t.Errorf("Expected CreateTimeSeriesCallback called with accumulated count of %d for repsonse code %s, got %d", want, code, got)
+		}
+	}
+
+	// Ensure that calling with no delta results in no timeseries writes:
+
+	callCount = 0
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, _ *monitoring.CreateTimeSeriesRequest) error {
+		callCount++
+		return nil
+	}
+
+	if err := c.Increment(map[string]int64{}, time.Now()); err != nil {
+		t.Errorf("Increment({}) failed with: %v", err)
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	if want, got := 0, callCount; want != got {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called %d times, got %d", want, got)
+	}
+
+	// Now check that error propagation works as intended:
+
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, _ *monitoring.CreateTimeSeriesRequest) error {
+		return fmt.Errorf("This is an error.")
+	}
+
+	if err := c.Increment(map[string]int64{
+		"200": 1,
+		"500": 2,
+	}, time.Now()); err != nil {
+		t.Errorf("Increment() failed with: %v", err)
+	}
+
+	if err := c.Flush(context.Background()); err == nil {
+		t.Errorf("Flush() should have failed, but did not.")
+	}
+}
+
+func incrementAndFlush(c *counter.Counter, counts map[string]int64) error {
+	if err := c.Increment(counts, time.Now()); err != nil {
+		return err
+	}
+	return c.Flush(context.Background())
+}
+
+func TestFlushRetry(t *testing.T) {
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	c.MinWriteInterval = 0
+	c.Retry.Sleep = func(_ context.Context, _ time.Duration) {}
+	c.MaxPending = 2
+
+	var written []int64
+	fail := true
+	callCount := 0
+
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, ts *monitoring.CreateTimeSeriesRequest) error {
+		callCount++
+		if fail {
+			return &googleapi.Error{Code: 503}
+		}
+		written = append(written, *ts.TimeSeries[0].Points[0].Value.Int64Value)
+		return nil
+	}
+
+	// Transient failures are retried, then buffered without error:
+
+	if err := incrementAndFlush(c, map[string]int64{"200": 1}); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	if want, got := c.Retry.MaxAttempts, callCount; want != got {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called %d times, got %d", want, got)
+	}
+
+	if want, got := 1, c.Pending(); want != got {
+		t.Errorf("Expected %d pending writes, got %d", want, got)
+	}
+
+	// Overflowing the buffer discards the oldest write:
+
+	for _, delta := range []int64{2, 3} {
+		if err := incrementAndFlush(c, map[string]int64{"200": delta}); err != nil {
+			t.Errorf("Flush() failed with: %v", err)
+		}
+	}
+
+	if want, got := 2, c.Pending(); want != got {
+		t.Errorf("Expected %d pending writes, got %d", want, got)
+	}
+
+	if want, got := int64(1), c.Dropped(); want != got {
+		t.Errorf("Expected %d dropped writes, got %d", want, got)
+	}
+
+	// On recovery, buffered writes are flushed in order (the new write
+	// displacing the oldest buffered one):
+
+	fail = false
+
+	if err := incrementAndFlush(c, map[string]int64{"200": 4}); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	if want, got := []int64{6, 10}, written; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected cumulative values %v to be written, got %v", want, got)
+	}
+
+	if want, got := 0, c.Pending(); want != got {
+		t.Errorf("Expected %d pending writes, got %d", want, got)
+	}
+
+	// Non-retryable failures are not retried and are counted:
+
+	callCount = 0
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, _ *monitoring.CreateTimeSeriesRequest) error {
+		callCount++
+		return &googleapi.Error{Code: 400}
+	}
+
+	if err := incrementAndFlush(c, map[string]int64{"200": 1}); err == nil {
+		t.Errorf("Flush() should have failed, but did not.")
+	}
+
+	if want, got := 1, callCount; want != got {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called %d times, got %d", want, got)
+	}
+
+	if want, got := 0, c.Pending(); want != got {
+		t.Errorf("Expected %d pending writes, got %d", want, got)
+	}
+
+	if want, got := int64(3), c.Dropped(); want != got {
+		t.Errorf("Expected %d dropped writes, got %d", want, got)
+	}
+}
+
+func TestFlushMinWriteInterval(t *testing.T) {
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	c.MinWriteInterval = time.Hour
+
+	callCount := 0
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, _ *monitoring.CreateTimeSeriesRequest) error {
+		callCount++
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := incrementAndFlush(c, map[string]int64{"200": 1}); err != nil {
+			t.Errorf("Flush() failed with: %v", err)
+		}
+	}
+
+	// Only the first flush should result in a write, as the remainder fall
+	// within MinWriteInterval of the first.
+	if want, got := 1, callCount; want != got {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called %d times, got %d", want, got)
+	}
+}
+
+func TestFlushBatching(t *testing.T) {
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+
+	counts := make(map[string]int64)
+	for i := 0; i < 2*counter.MaxTimeSeriesPerRequest+1; i++ {
+		counts[fmt.Sprintf("%d", 1000+i)] = 1
+	}
+
+	var batchSizes []int
+	seen := make(map[string]bool)
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, r *monitoring.CreateTimeSeriesRequest) error {
+		batchSizes = append(batchSizes, len(r.TimeSeries))
+		for _, ts := range r.TimeSeries {
+			seen[ts.Metric.Labels["response_code"]] = true
+		}
+		return nil
+	}
+
+	if err := incrementAndFlush(c, counts); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	if want, got := []int{counter.MaxTimeSeriesPerRequest, counter.MaxTimeSeriesPerRequest, 1}, batchSizes; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called with batches of sizes %v, got %v", want, got)
+	}
+
+	if want, got := len(counts), len(seen); want != got {
+		t.Errorf("Expected %d distinct timeseries to be written, got %d", want, got)
+	}
+}
+
+func TestFlushPartialFailure(t *testing.T) {
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	c.Retry.Sleep = func(_ context.Context, _ time.Duration) {}
+
+	var requests [][]string
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, r *monitoring.CreateTimeSeriesRequest) error {
+		var codes []string
+		for _, ts := range r.TimeSeries {
+			codes = append(codes, ts.Metric.Labels["response_code"])
+		}
+		requests = append(requests, codes)
+		if len(requests) > 1 {
+			return nil
+		}
+		// Reject timeseries 1 and 3 (of 0-3) with a transient error.
+		return &googleapi.Error{
+			Code:    503,
+			Message: "One or more TimeSeries could not be written: The service is currently unavailable.: timeSeries[1,3]",
+			Details: []interface{}{
+				map[string]interface{}{
+					"@type":             "type.googleapis.com/google.monitoring.v3.CreateTimeSeriesSummary",
+					"totalPointCount":   float64(4),
+					"successPointCount": float64(2),
+				},
+			},
+		}
+	}
+
+	if err := incrementAndFlush(c, map[string]int64{
+		"200": 1,
+		"404": 1,
+		"500": 1,
+		"503": 1,
+	}); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	// Only the rejected timeseries should be retried.
+	if want, got := [][]string{{"200", "404", "500", "503"}, {"404", "503"}}, requests; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected CreateTimeSeriesCallback to be called with timeseries %v, got %v", want, got)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+
+	if err := c.Increment(map[string]int64{"200": 2}, time.Now()); err != nil {
+		t.Errorf("Increment() failed with: %v", err)
+	}
+
+	resetTime, counts := c.Snapshot()
+
+	r := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	r.Restore(resetTime, counts)
+
+	// Ensure the snapshot is not aliased by the restored counter.
+	counts["200"] = 100
+
+	if want, got := resetTime, r.ResetTime(); want != got {
+		t.Errorf("Expected restored ResetTime %v, got %v", want, got)
+	}
+
+	if err := r.Increment(map[string]int64{"200": 1}, time.Now()); err != nil {
+		t.Errorf("Increment() failed with: %v", err)
+	}
+
+	if _, got := r.Snapshot(); got["200"] != 3 {
+		t.Errorf("Expected restored count to continue accumulating to 3, got %d", got["200"])
+	}
+}
+
+func TestIncrementEventTime(t *testing.T) {
+	c := counter.NewStatusCounter("foo", testMetricType, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	c.MinWriteInterval = 10 * time.Second
+
+	var endTimes []string
+	var values []int64
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, r *monitoring.CreateTimeSeriesRequest) error {
+		p := r.TimeSeries[0].Points[0]
+		endTimes = append(endTimes, p.Interval.EndTime)
+		values = append(values, *p.Value.Int64Value)
+		return nil
+	}
+
+	base := c.ResetTime().Truncate(time.Minute)
+	ends := []time.Time{
+		base.Add(time.Minute),
+		base.Add(2 * time.Minute),
+		// Within MinWriteInterval of the previous end time; merged into
+		// the next point.
+		base.Add(2*time.Minute + time.Second),
+		base.Add(3 * time.Minute),
+	}
+
+	for _, end := range ends {
+		if err := c.Increment(map[string]int64{"200": 1}, end); err != nil {
+			t.Errorf("Increment() failed with: %v", err)
+		}
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	var wantEndTimes []string
+	for _, end := range []time.Time{ends[0], ends[1], ends[3]} {
+		wantEndTimes = append(wantEndTimes, end.UTC().Format(time.RFC3339Nano))
+	}
+
+	if want, got := wantEndTimes, endTimes; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected points with end times %v, got %v", want, got)
+	}
+
+	if want, got := []int64{1, 2, 4}, values; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected points with values %v, got %v", want, got)
+	}
+}
+
+func TestCounterLabels(t *testing.T) {
+	spec := &metric.Spec{
+		Name: "requests",
+		Kind: metric.Counter,
+		Labels: []metric.Label{
+			{Name: "method", Field: "method", Type: metric.StringLabel},
+			{Name: "response_code", Field: "status", Type: metric.Int64Label},
+		},
+	}
+	c := counter.NewCounter("foo", "custom.googleapis.com/requests", spec, &monitoring.MonitoredResource{}, &monitoring.Service{})
+
+	if want, got := []string{"STRING", "INT64"}, []string{c.Descriptor().Labels[0].ValueType, c.Descriptor().Labels[1].ValueType}; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected descriptor label value types %v, got %v", want, got)
+	}
+
+	var labels []map[string]string
+	c.CreateTimeSeriesCallback = func(_ context.Context, _ string, r *monitoring.CreateTimeSeriesRequest) error {
+		for _, ts := range r.TimeSeries {
+			labels = append(labels, ts.Metric.Labels)
+		}
+		return nil
+	}
+
+	if err := incrementAndFlush(c, map[string]int64{
+		metric.Key([]string{"GET", "200"}):  1,
+		metric.Key([]string{"POST", "503"}): 1,
+	}); err != nil {
+		t.Errorf("Flush() failed with: %v", err)
+	}
+
+	if want, got := []map[string]string{
+		{"method": "GET", "response_code": "200"},
+		{"method": "POST", "response_code": "503"},
+	}, labels; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected timeseries with labels %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,108 @@
+package counter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/monitoring/v3"
+)
+
+type GetMetricCallbackT func(string) (*monitoring.MetricDescriptor, error)
+type DeleteMetricCallbackT func(string) error
+
+// descriptorCallbacks groups the callbacks used to manage a metric descriptor.
+type descriptorCallbacks struct {
+	get    GetMetricCallbackT
+	create CreateMetricCallbackT
+	delete DeleteMetricCallbackT
+}
+
+// ensureDescriptor ensures that the metric descriptor want exists in the
+// project: If missing, it is created. If an existing descriptor differs in
+// kind, value type, unit, or labels, an error describing the differences is
+// returned, unless migrate is true, in which case the existing descriptor is
+// deleted and recreated (discarding its data).
+func ensureDescriptor(projectSpec string, want *monitoring.MetricDescriptor, migrate bool, cb descriptorCallbacks) error {
+	name := fmt.Sprintf("%s/metricDescriptors/%s", projectSpec, want.Type)
+
+	got, err := cb.get(name)
+	if isNotFound(err) {
+		log.Printf("Creating metric descriptor for %s", want.Type)
+		return cb.create(projectSpec, want)
+	} else if err != nil {
+		return fmt.Errorf("Could not fetch metric descriptor for %s: %v", want.Type, err)
+	}
+
+	diffs := descriptorDiff(want, got)
+	if len(diffs) == 0 {
+		return nil
+	}
+
+	if !migrate {
+		return fmt.Errorf("Existing metric descriptor for %s does not match the expected definition (%s); it must be migrated (deleted and recreated, discarding existing data) before use", want.Type, strings.Join(diffs, "; "))
+	}
+
+	log.Printf("Migrating metric descriptor for %s (%s)", want.Type, strings.Join(diffs, "; "))
+
+	if err := cb.delete(name); err != nil && !isNotFound(err) {
+		return fmt.Errorf("Could not delete metric descriptor for %s: %v", want.Type, err)
+	}
+
+	return cb.create(projectSpec, want)
+}
+
+// descriptorDiff returns a description of each difference between the desired
+// and existing metric descriptors (ignoring descriptions).
+func descriptorDiff(want, got *monitoring.MetricDescriptor) []string {
+	var diffs []string
+
+	if want.MetricKind != got.MetricKind {
+		diffs = append(diffs, fmt.Sprintf("metric kind is %s, expected %s", got.MetricKind, want.MetricKind))
+	}
+	if want.ValueType != got.ValueType {
+		diffs = append(diffs, fmt.Sprintf("value type is %s, expected %s", got.ValueType, want.ValueType))
+	}
+	if want.Unit != got.Unit {
+		diffs = append(diffs, fmt.Sprintf("unit is %q, expected %q", got.Unit, want.Unit))
+	}
+
+	gotLabels := make(map[string]string)
+	for _, l := range got.Labels {
+		gotLabels[l.Key] = labelValueType(l)
+	}
+	wantLabels := make(map[string]bool)
+	for _, l := range want.Labels {
+		wantLabels[l.Key] = true
+		if t, ok := gotLabels[l.Key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("label %s is missing", l.Key))
+		} else if t != labelValueType(l) {
+			diffs = append(diffs, fmt.Sprintf("label %s has value type %s, expected %s", l.Key, t, labelValueType(l)))
+		}
+	}
+	for _, l := range got.Labels {
+		if !wantLabels[l.Key] {
+			diffs = append(diffs, fmt.Sprintf("label %s is unexpected", l.Key))
+		}
+	}
+
+	return diffs
+}
+
+// labelValueType returns the value type of a label, which defaults to STRING
+// when unset.
+func labelValueType(l *monitoring.LabelDescriptor) string {
+	if l.ValueType == "" {
+		return "STRING"
+	}
+	return l.ValueType
+}
+
+// isNotFound returns true if err is an HTTP 404 API error.
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,119 @@
+package counter
+
+import (
+	"sort"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+
+	"google.golang.org/api/monitoring/v3"
+)
+
+// Distribution implements DistributionMetricT for distribution metrics (e.g.
+// request latency) with explicit bucket bounds, with histograms keyed by label
+// values (see metric.Key).
+type Distribution struct {
+	writer
+	histograms map[string]*metric.Histogram
+}
+
+// NewDistribution creates a Distribution for the supplied Spec associated with
+// the provided project and MonitoredResource, which will write timeseries
+// values for the supplied metric type via the provided service.
+func NewDistribution(project string, metricType string, spec *metric.Spec, resource *monitoring.MonitoredResource, service *monitoring.Service) *Distribution {
+	d := &Distribution{
+		writer:     newWriter(project, metricType, spec, resource, service),
+		histograms: make(map[string]*metric.Histogram),
+	}
+	d.series = d.timeSeriesAt
+	return d
+}
+
+// Snapshot returns the reset time and a copy of the current cumulative
+// histograms.
+func (d *Distribution) Snapshot() (time.Time, map[string]*metric.Histogram) {
+	histograms := make(map[string]*metric.Histogram)
+	for key, h := range d.histograms {
+		histograms[key] = h.Copy()
+	}
+	return d.resetTime, histograms
+}
+
+// Restore replaces the reset time and cumulative histograms with those
+// supplied (e.g. from a Snapshot taken by a previous process), so that the
+// same cumulative timeseries is continued. Histograms whose buckets do not
+// match the Spec are discarded.
+func (d *Distribution) Restore(resetTime time.Time, histograms map[string]*metric.Histogram) {
+	d.resetTime = resetTime
+	d.histograms = make(map[string]*metric.Histogram)
+	for key, h := range histograms {
+		if len(h.BucketCounts) == len(d.spec.Buckets)+1 {
+			d.histograms[key] = h.Copy()
+		}
+	}
+}
+
+// Descriptor returns the descriptor of the custom distribution metric.
+func (d *Distribution) Descriptor() *monitoring.MetricDescriptor {
+	return d.descriptor("CUMULATIVE", "DISTRIBUTION")
+}
+
+// Ensure will create the custom distribution metric in Stackdriver if it does
+// not already exist. If it exists but does not match Descriptor, an error is
+// returned unless migrate is true, in which case the existing metric is
+// deleted (discarding its data) and recreated.
+func (d *Distribution) Ensure(migrate bool) error {
+	return d.ensure(d.Descriptor(), migrate)
+}
+
+// timeSeriesAt returns timeseries for the current cumulative histograms,
+// sorted by key.
+func (d *Distribution) timeSeriesAt(endTime time.Time) []*monitoring.TimeSeries {
+	var keys []string
+	for key := range d.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var timeSeries []*monitoring.TimeSeries
+	for _, key := range keys {
+		h := d.histograms[key]
+		timeSeries = append(timeSeries, d.timeSeries(key, endTime, &monitoring.TypedValue{
+			DistributionValue: &monitoring.Distribution{
+				Count:                 h.Count,
+				Mean:                  h.Mean(),
+				SumOfSquaredDeviation: h.SumOfSquaredDeviation,
+				BucketOptions: &monitoring.BucketOptions{
+					ExplicitBuckets: &monitoring.Explicit{
+						Bounds: d.spec.Buckets,
+					},
+				},
+				BucketCounts: append([]int64(nil), h.BucketCounts...),
+			},
+		}))
+	}
+	return timeSeries
+}
+
+// Add will accumulate histogram deltas from the supplied map, which account
+// for records up to the supplied end time. Updated values are written on the
+// next call to Flush. Histograms whose buckets do not match the Spec are
+// ignored.
+func (d *Distribution) Add(histograms map[string]*metric.Histogram, endTime time.Time) error {
+	d.advance(endTime)
+
+	for key, h := range histograms {
+		if h.Count == 0 || len(h.BucketCounts) != len(d.spec.Buckets)+1 {
+			continue
+		}
+		d.dirty = true
+		curr, ok := d.histograms[key]
+		if !ok {
+			curr = metric.NewHistogram(d.spec.Buckets)
+			d.histograms[key] = curr
+		}
+		curr.Merge(h)
+	}
+
+	return nil
+}
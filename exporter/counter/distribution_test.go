@@ -0,0 +1,79 @@
+package counter_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/counter"
+	"github.com/swfrench/nginx-log-consumer/metric"
+
+	"google.golang.org/api/monitoring/v3"
+)
+
+func testLatencySpec() *metric.Spec {
+	return &metric.Spec{
+		Name:    "http_request_latency",
+		Kind:    metric.Distribution,
+		Unit:    "s",
+		Field:   "request_time",
+		Buckets: []float64{0.1, 1},
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	spec := testLatencySpec()
+	d := counter.NewDistribution("foo", "custom.googleapis.com/http_request_latency", spec, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	d.MinWriteInterval = 0
+
+	if want, got := "DISTRIBUTION", d.Descriptor().ValueType; want != got {
+		t.Errorf("Expected descriptor value type %s, got %s", want, got)
+	}
+
+	var written []*monitoring.Distribution
+	d.CreateTimeSeriesCallback = func(_ context.Context, _ string, r *monitoring.CreateTimeSeriesRequest) error {
+		for _, ts := range r.TimeSeries {
+			written = append(written, ts.Points[0].Value.DistributionValue)
+		}
+		return nil
+	}
+
+	for _, samples := range [][]float64{{0.05, 0.5}, {2}} {
+		h := metric.NewHistogram(spec.Buckets)
+		for _, x := range samples {
+			h.Add(x, spec.Buckets)
+		}
+		if err := d.Add(map[string]*metric.Histogram{"": h}, time.Now()); err != nil {
+			t.Errorf("Add() failed with: %v", err)
+		}
+		if err := d.Flush(context.Background()); err != nil {
+			t.Errorf("Flush() failed with: %v", err)
+		}
+	}
+
+	if want, got := 2, len(written); want != got {
+		t.Fatalf("Expected %d points to be written, got %d", want, got)
+	}
+
+	// Points are cumulative, and not modified by later samples.
+	for i, want := range [][]int64{{1, 1, 0}, {1, 1, 1}} {
+		if got := []int64(written[i].BucketCounts); !reflect.DeepEqual(want, got) {
+			t.Errorf("Expected point %d to have bucket counts %v, got %v", i, want, got)
+		}
+	}
+	if want, got := int64(3), written[1].Count; want != got {
+		t.Errorf("Expected cumulative count %d, got %d", want, got)
+	}
+	if want, got := spec.Buckets, written[1].BucketOptions.ExplicitBuckets.Bounds; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected bucket bounds %v, got %v", want, got)
+	}
+
+	// Snapshots restore to equivalent state.
+	resetTime, histograms := d.Snapshot()
+	r := counter.NewDistribution("foo", "custom.googleapis.com/http_request_latency", spec, &monitoring.MonitoredResource{}, &monitoring.Service{})
+	r.Restore(resetTime, histograms)
+	if _, got := r.Snapshot(); !reflect.DeepEqual(histograms, got) {
+		t.Errorf("Expected restored histograms %v, got %v", histograms, got)
+	}
+}
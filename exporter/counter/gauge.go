@@ -0,0 +1,91 @@
+package counter
+
+import (
+	"sort"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+
+	"google.golang.org/api/monitoring/v3"
+)
+
+// Gauge implements GaugeMetricT for gauge metrics (e.g. how far the tailer
+// lags behind the end of the log), with values keyed by label values (see
+// metric.Key).
+type Gauge struct {
+	writer
+	values map[string]float64
+}
+
+// NewGauge creates a Gauge for the supplied Spec associated with the provided
+// project and MonitoredResource, which will write timeseries values for the
+// supplied metric type via the provided service.
+func NewGauge(project string, metricType string, spec *metric.Spec, resource *monitoring.MonitoredResource, service *monitoring.Service) *Gauge {
+	g := &Gauge{
+		writer: newWriter(project, metricType, spec, resource, service),
+		values: make(map[string]float64),
+	}
+	g.series = g.timeSeriesAt
+	return g
+}
+
+// Snapshot returns the reset time and a copy of the current values.
+func (g *Gauge) Snapshot() (time.Time, map[string]float64) {
+	values := make(map[string]float64)
+	for key, x := range g.values {
+		values[key] = x
+	}
+	return g.resetTime, values
+}
+
+// Descriptor returns the descriptor of the custom gauge metric.
+func (g *Gauge) Descriptor() *monitoring.MetricDescriptor {
+	return g.descriptor("GAUGE", "DOUBLE")
+}
+
+// Ensure will create the custom gauge metric in Stackdriver if it does not
+// already exist. If it exists but does not match Descriptor, an error is
+// returned unless migrate is true, in which case the existing metric is
+// deleted (discarding its data) and recreated.
+func (g *Gauge) Ensure(migrate bool) error {
+	return g.ensure(g.Descriptor(), migrate)
+}
+
+// timeSeriesAt returns timeseries for the current values, sorted by key. Gauge
+// points cover only their end time.
+func (g *Gauge) timeSeriesAt(endTime time.Time) []*monitoring.TimeSeries {
+	var keys []string
+	for key := range g.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var timeSeries []*monitoring.TimeSeries
+	for _, key := range keys {
+		x := g.values[key]
+		ts := g.timeSeries(key, endTime, &monitoring.TypedValue{
+			DoubleValue: &x,
+		})
+		ts.Points[0].Interval.StartTime = ts.Points[0].Interval.EndTime
+		timeSeries = append(timeSeries, ts)
+	}
+	return timeSeries
+}
+
+// Set will update values from the supplied map, as of the supplied end time.
+// Values not supplied are retained, unless the Spec is Transient. Updated
+// values (or unchanged values, if any are supplied, so that the gauge is
+// written periodically) are written on the next call to Flush.
+func (g *Gauge) Set(values map[string]float64, endTime time.Time) error {
+	g.advance(endTime)
+	if g.spec.Transient {
+		g.values = make(map[string]float64)
+	}
+
+	for key, x := range values {
+		g.dirty = true
+		g.values[key] = x
+	}
+
+	return nil
+}
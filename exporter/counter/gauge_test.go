@@ -0,0 +1,41 @@
+package counter_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/counter"
+	"github.com/swfrench/nginx-log-consumer/metric"
+
+	"google.golang.org/api/monitoring/v3"
+)
+
+func TestGaugeTransient(t *testing.T) {
+	for _, tc := range []struct {
+		transient bool
+		want      map[string]float64
+	}{
+		{false, map[string]float64{"/": 3, "/a": 2, "/b": 1}},
+		{true, map[string]float64{"/": 3, "/b": 1}},
+	} {
+		spec := &metric.Spec{
+			Name:      "heavy_hitters/paths",
+			Kind:      metric.Gauge,
+			Labels:    []metric.Label{{Name: "value", Field: "path", Type: metric.StringLabel}},
+			Transient: tc.transient,
+		}
+		g := counter.NewGauge("foo", "custom.googleapis.com/heavy_hitters/paths", spec, &monitoring.MonitoredResource{}, &monitoring.Service{})
+
+		now := time.Now()
+		if err := g.Set(map[string]float64{"/": 1, "/a": 2}, now); err != nil {
+			t.Fatalf("Set failed with %v", err)
+		}
+		if err := g.Set(map[string]float64{"/": 3, "/b": 1}, now.Add(time.Minute)); err != nil {
+			t.Fatalf("Set failed with %v", err)
+		}
+		if _, got := g.Snapshot(); !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("Expected values %v with transient=%v, got %v", tc.want, tc.transient, got)
+		}
+	}
+}
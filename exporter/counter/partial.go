@@ -0,0 +1,86 @@
+package counter
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/monitoring/v3"
+)
+
+// summaryType is the type URL of the CreateTimeSeriesSummary error detail
+// attached by Stackdriver to failed CreateTimeSeries requests.
+const summaryType = "type.googleapis.com/google.monitoring.v3.CreateTimeSeriesSummary"
+
+// timeSeriesRefRE matches references to request timeseries by index (or index
+// range) in CreateTimeSeries error messages, e.g. "timeSeries[0-2,5]".
+var timeSeriesRefRE = regexp.MustCompile(`timeSeries\[([0-9,\-]+)\]`)
+
+// failedTimeSeries inspects an error returned by a CreateTimeSeries request
+// and, if it describes a partial failure (some points written successfully),
+// returns a request containing only the timeseries from r which were rejected.
+// Returns nil if err does not describe a partial failure, or the rejected
+// timeseries cannot be identified.
+func failedTimeSeries(err error, r *monitoring.CreateTimeSeriesRequest) *monitoring.CreateTimeSeriesRequest {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || !isPartialFailure(apiErr) {
+		return nil
+	}
+
+	indices := make(map[int]bool)
+	for _, match := range timeSeriesRefRE.FindAllStringSubmatch(apiErr.Message, -1) {
+		for _, ref := range strings.Split(match[1], ",") {
+			bounds := strings.SplitN(ref, "-", 2)
+			lo, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil
+			}
+			hi := lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil
+				}
+			}
+			for i := lo; i <= hi; i++ {
+				if i < 0 || i >= len(r.TimeSeries) {
+					return nil
+				}
+				indices[i] = true
+			}
+		}
+	}
+
+	if len(indices) == 0 || len(indices) == len(r.TimeSeries) {
+		return nil
+	}
+
+	var sorted []int
+	for i := range indices {
+		sorted = append(sorted, i)
+	}
+	sort.Ints(sorted)
+
+	failed := &monitoring.CreateTimeSeriesRequest{}
+	for _, i := range sorted {
+		failed.TimeSeries = append(failed.TimeSeries, r.TimeSeries[i])
+	}
+	return failed
+}
+
+// isPartialFailure returns true if the error carries a CreateTimeSeriesSummary
+// reporting at least one successfully written point.
+func isPartialFailure(apiErr *googleapi.Error) bool {
+	for _, detail := range apiErr.Details {
+		m, ok := detail.(map[string]interface{})
+		if !ok || m["@type"] != summaryType {
+			continue
+		}
+		if n, ok := m["successPointCount"].(float64); ok && n > 0 {
+			return true
+		}
+	}
+	return false
+}
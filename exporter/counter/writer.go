@@ -0,0 +1,306 @@
+package counter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/retry"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/stats"
+
+	"google.golang.org/api/monitoring/v3"
+)
+
+const (
+	// MaxTimeSeriesPerRequest is the maximum number of timeseries accepted
+	// by Stackdriver in a single CreateTimeSeries request.
+	MaxTimeSeriesPerRequest = 200
+
+	// DefaultMinWriteInterval is the default minimum interval between points
+	// written to a given timeseries. Stackdriver rejects points written
+	// more frequently than once every 5-10s.
+	DefaultMinWriteInterval = 10 * time.Second
+
+	// DefaultMaxPending is the default bound on the number of timeseries
+	// writes buffered while Stackdriver is unavailable.
+	DefaultMaxPending = 100
+)
+
+type CreateMetricCallbackT func(string, *monitoring.MetricDescriptor) error
+type CreateTimeSeriesCallbackT func(context.Context, string, *monitoring.CreateTimeSeriesRequest) error
+
+// writer implements the parts of a cumulative metric common to all value
+// types: Descriptor management, and rate-limited, batched writes of points
+// (built by the series callback), buffered and retried across transient
+// failures.
+type writer struct {
+	projectSpec string
+	metricType  string
+	spec        *metric.Spec
+	resource    *monitoring.MonitoredResource
+	resetTime   time.Time
+	endTime     time.Time
+	dirty       bool
+	lastWrite   time.Time
+	pending     []*monitoring.CreateTimeSeriesRequest
+	dropped     int64
+	stats       *stats.Registry
+	// series returns timeseries reflecting current cumulative values,
+	// with points ending at the supplied time.
+	series func(time.Time) []*monitoring.TimeSeries
+	// MinWriteInterval is the minimum interval between successive points
+	// written by Flush.
+	MinWriteInterval time.Duration
+	// MaxPending bounds the number of writes buffered after transient
+	// failures. When full, the oldest buffered write is discarded (since
+	// values are cumulative, later writes supersede it).
+	MaxPending int
+	// Retry determines how writes failing with transient errors are
+	// retried before being buffered.
+	Retry *retry.Policy
+	// Public for injection from unit tests:
+	GetMetricCallback        GetMetricCallbackT
+	CreateMetricCallback     CreateMetricCallbackT
+	DeleteMetricCallback     DeleteMetricCallbackT
+	CreateTimeSeriesCallback CreateTimeSeriesCallbackT
+}
+
+func newWriter(project string, metricType string, spec *metric.Spec, resource *monitoring.MonitoredResource, service *monitoring.Service) writer {
+	w := writer{
+		projectSpec:      projectResourceSpec(project),
+		metricType:       metricType,
+		spec:             spec,
+		resource:         resource,
+		resetTime:        time.Now(),
+		MinWriteInterval: DefaultMinWriteInterval,
+		MaxPending:       DefaultMaxPending,
+		Retry:            retry.DefaultPolicy(),
+	}
+	w.SetService(service)
+	return w
+}
+
+// SetService (re)binds the callbacks used to read and write metric data to the
+// provided service (e.g. one using a different API endpoint). Cumulative
+// values and buffered writes are retained.
+func (w *writer) SetService(service *monitoring.Service) {
+	w.GetMetricCallback = func(name string) (*monitoring.MetricDescriptor, error) {
+		return service.Projects.MetricDescriptors.Get(name).Do()
+	}
+	w.CreateMetricCallback = func(projectSpec string, desc *monitoring.MetricDescriptor) error {
+		_, err := service.Projects.MetricDescriptors.Create(projectSpec, desc).Do()
+		return err
+	}
+	w.DeleteMetricCallback = func(name string) error {
+		_, err := service.Projects.MetricDescriptors.Delete(name).Do()
+		return err
+	}
+	w.CreateTimeSeriesCallback = func(ctx context.Context, projectSpec string, req *monitoring.CreateTimeSeriesRequest) error {
+		_, err := service.Projects.TimeSeries.Create(projectSpec, req).Context(ctx).Do()
+		return err
+	}
+}
+
+// ResetTime returns the reset time of the cumulative metric (i.e. time since
+// which values have been accumulated).
+func (w *writer) ResetTime() time.Time {
+	return w.resetTime
+}
+
+// SetStats sets the Registry in which timeseries writes, failures, latency and
+// discarded writes are recorded.
+func (w *writer) SetStats(r *stats.Registry) {
+	w.stats = r
+}
+
+// Dropped returns the number of timeseries writes discarded so far, either
+// due to non-retryable errors or overflow of the pending write buffer.
+func (w *writer) Dropped() int64 {
+	return w.dropped
+}
+
+// Pending returns the number of timeseries writes currently buffered awaiting
+// retry.
+func (w *writer) Pending() int {
+	return len(w.pending)
+}
+
+// descriptor returns a descriptor for the metric with the supplied kind and
+// value type, built from its Spec.
+func (w *writer) descriptor(metricKind, valueType string) *monitoring.MetricDescriptor {
+	var labels []*monitoring.LabelDescriptor
+	for _, l := range w.spec.Labels {
+		vt := "STRING"
+		if l.Type == metric.Int64Label {
+			vt = "INT64"
+		}
+		labels = append(labels, &monitoring.LabelDescriptor{
+			Key:         l.Name,
+			ValueType:   vt,
+			Description: l.Description,
+		})
+	}
+	return &monitoring.MetricDescriptor{
+		Type:        w.metricType,
+		Labels:      labels,
+		MetricKind:  metricKind,
+		ValueType:   valueType,
+		Unit:        w.spec.Unit,
+		Description: w.spec.Description,
+	}
+}
+
+// ensure will create the supplied metric descriptor in Stackdriver if it does
+// not already exist. If it exists but does not match, an error is returned
+// unless migrate is true, in which case the existing metric is deleted
+// (discarding its data) and recreated.
+func (w *writer) ensure(want *monitoring.MetricDescriptor, migrate bool) error {
+	return ensureDescriptor(w.projectSpec, want, migrate, descriptorCallbacks{
+		get:    w.GetMetricCallback,
+		create: w.CreateMetricCallback,
+		delete: w.DeleteMetricCallback,
+	})
+}
+
+// timeSeries returns a timeseries for the metric with the supplied labels (see
+// metric.Key) and a single point with the supplied value, covering the
+// interval from the reset time to endTime.
+func (w *writer) timeSeries(key string, endTime time.Time, value *monitoring.TypedValue) *monitoring.TimeSeries {
+	return &monitoring.TimeSeries{
+		Metric: &monitoring.Metric{
+			Type:   w.metricType,
+			Labels: w.spec.LabelMap(key),
+		},
+		Resource: w.resource,
+		Points: []*monitoring.Point{
+			&monitoring.Point{
+				Interval: &monitoring.TimeInterval{
+					StartTime: w.resetTime.UTC().Format(time.RFC3339Nano),
+					EndTime:   endTime.UTC().Format(time.RFC3339Nano),
+				},
+				Value: value,
+			},
+		},
+	}
+}
+
+// write will build timeseries based on the current cumulative values, split
+// them into requests respecting MaxTimeSeriesPerRequest, and enqueue the
+// latter for writing to stackdriver.
+func (w *writer) write(endTime time.Time) {
+	timeSeries := w.series(endTime)
+	for len(timeSeries) > 0 {
+		n := len(timeSeries)
+		if n > MaxTimeSeriesPerRequest {
+			n = MaxTimeSeriesPerRequest
+		}
+		w.enqueue(&monitoring.CreateTimeSeriesRequest{
+			TimeSeries: timeSeries[:n],
+		})
+		timeSeries = timeSeries[n:]
+	}
+}
+
+// enqueue appends a write to the pending buffer, discarding the oldest
+// buffered write if the buffer is full.
+func (w *writer) enqueue(r *monitoring.CreateTimeSeriesRequest) {
+	if len(w.pending) >= w.MaxPending {
+		log.Printf("Pending write buffer full (%d writes); discarding oldest write", len(w.pending))
+		w.pending = w.pending[1:]
+		w.dropped++
+		w.stats.Add(stats.ExporterDroppedWrites, 1)
+	}
+	w.pending = append(w.pending, r)
+}
+
+// drain attempts to send all buffered writes to stackdriver in order. If a
+// write fails with a transient error (after retries), it and all later writes
+// are kept for the next attempt and nil is returned. Writes failing with a
+// non-retryable error are discarded and the error is returned. If only some
+// timeseries in a write are rejected, only those are retried or discarded. If
+// ctx is done, remaining writes are kept and its error is returned.
+func (w *writer) drain(ctx context.Context) error {
+	for len(w.pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("Deferring %d pending timeseries write(s): %v", len(w.pending), err)
+		}
+		r := w.pending[0]
+		err := w.Retry.Do(ctx, func() error {
+			start := time.Now()
+			err := w.CreateTimeSeriesCallback(ctx, w.projectSpec, r)
+			w.stats.Observe(stats.ExporterWriteLatency, time.Since(start).Seconds())
+			w.stats.Add(stats.ExporterWrites, 1)
+			if err == nil {
+				w.stats.Mark(stats.EventWrite)
+			} else {
+				w.stats.Mark(stats.EventWriteFailure)
+				kind := stats.FailurePermanent
+				if retry.IsRetryable(err) {
+					kind = stats.FailureTransient
+				}
+				w.stats.Add(stats.ExporterWriteFailures, 1, kind)
+			}
+			if failed := failedTimeSeries(err, r); failed != nil {
+				log.Printf("Partial timeseries write failure: %d of %d timeseries rejected", len(failed.TimeSeries), len(r.TimeSeries))
+				r = failed
+				w.pending[0] = r
+			}
+			return err
+		})
+		if err == nil {
+			w.pending = w.pending[1:]
+			continue
+		}
+		if retry.IsRetryable(err) || ctx.Err() != nil {
+			log.Printf("Deferring %d pending timeseries write(s) after transient error: %v", len(w.pending), err)
+			return nil
+		}
+		w.pending = w.pending[1:]
+		w.dropped++
+		w.stats.Add(stats.ExporterDroppedWrites, 1)
+		return fmt.Errorf("Discarded write of %d timeseries after non-retryable error: %v", len(r.TimeSeries), err)
+	}
+
+	return nil
+}
+
+// advance moves the end time of accumulated values to that supplied, if
+// later. If values accumulated up to the previous end time have not yet been
+// written (e.g. when consuming a backlog of event-time windows), a point for
+// the latter is first buffered, subject to MinWriteInterval, so that each is
+// reflected at the correct time.
+func (w *writer) advance(endTime time.Time) {
+	if endTime.After(w.endTime) {
+		w.snapshot()
+		w.endTime = endTime
+	}
+}
+
+// snapshot buffers a write of the current cumulative values, if they have
+// changed since the last write and at least MinWriteInterval separates the
+// end times of the two.
+func (w *writer) snapshot() {
+	if w.dirty && w.endTime.Sub(w.lastWrite) >= w.MinWriteInterval {
+		w.write(w.endTime)
+		w.dirty = false
+		w.lastWrite = w.endTime
+	}
+}
+
+// Flush will write new timeseries points reflecting the current cumulative
+// values if they have changed since the last write, and at least
+// MinWriteInterval separates the end times of the two. Any writes buffered
+// earlier (e.g. after failures) are sent first. Writes not completed before
+// ctx is done remain buffered.
+func (w *writer) Flush(ctx context.Context) error {
+	w.snapshot()
+
+	return w.drain(ctx)
+}
+
+// projectResourceSpec properly formats a project ID for use with the monitoring API.
+func projectResourceSpec(projectID string) string {
+	return fmt.Sprintf("projects/%s", projectID)
+}
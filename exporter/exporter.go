@@ -1,9 +1,14 @@
 package exporter
 
 import (
+	"context"
+	"sort"
 	"time"
 
 	"github.com/swfrench/nginx-log-consumer/exporter/counter"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/stats"
 
 	"google.golang.org/api/monitoring/v3"
 )
@@ -11,60 +16,230 @@ import (
 // ExporterT defines the interface implemented by CloudMonitoringExporter. For
 // use in mocks.
 type ExporterT interface {
-	IncrementStatusCounter(map[string]int64) error
-	StatusCounterResetTime() time.Time
+	Export(*metric.Values, time.Time) error
+	ResetTime() time.Time
+	Snapshot() (time.Time, *metric.Values)
+	Flush(context.Context) error
 }
 
 // CloudMonitoringExporter exports metrics collected from nginx access logs to
-// custom Stackdriver metrics. Only HTTP response code counts are currently
-// supported.
+// custom Stackdriver metrics: Counters (e.g. HTTP response code counts),
+// distributions (e.g. request latency) and gauges.
 type CloudMonitoringExporter struct {
-	statusCounter counter.CounterMetricT
+	counters      map[string]counter.CounterMetricT
+	distributions map[string]counter.DistributionMetricT
+	gauges        map[string]counter.GaugeMetricT
 }
 
 // NewCloudMonitoringExporter creates a new CloudMonitoringExporter configured
-// to export metrics for the provided project / resource.
-func NewCloudMonitoringExporter(project string, resourceLabels map[string]string, service *monitoring.Service) *CloudMonitoringExporter {
+// to export the metrics described by the supplied Specs for the provided
+// project / resource (e.g. gce_instance or k8s_container, with the labels
+// required by that type). Metric types are built using the provided Naming.
+func NewCloudMonitoringExporter(project string, resourceType string, resourceLabels map[string]string, n *naming.Naming, specs []*metric.Spec, service *monitoring.Service) *CloudMonitoringExporter {
 	resource := &monitoring.MonitoredResource{
 		Labels: resourceLabels,
-		Type:   "gce_instance",
+		Type:   resourceType,
 	}
-	return &CloudMonitoringExporter{
-		statusCounter: counter.NewStatusCounter(project, resource, service),
+	e := &CloudMonitoringExporter{
+		counters:      make(map[string]counter.CounterMetricT),
+		distributions: make(map[string]counter.DistributionMetricT),
+		gauges:        make(map[string]counter.GaugeMetricT),
+	}
+	for _, s := range specs {
+		switch s.Kind {
+		case metric.Counter:
+			e.counters[s.Name] = counter.NewCounter(project, n.Type(s.Name), s, resource, service)
+		case metric.Distribution:
+			e.distributions[s.Name] = counter.NewDistribution(project, n.Type(s.Name), s, resource, service)
+		case metric.Gauge:
+			e.gauges[s.Name] = counter.NewGauge(project, n.Type(s.Name), s, resource, service)
+		}
+	}
+	// Align the reset times of all metrics.
+	e.Restore(time.Now(), metric.NewValues())
+	return e
+}
+
+// metrics returns all metrics, ordered by name.
+func (e *CloudMonitoringExporter) metrics() []counter.CumulativeMetricT {
+	var names []string
+	byName := make(map[string]counter.CumulativeMetricT)
+	for name, c := range e.counters {
+		names = append(names, name)
+		byName[name] = c
+	}
+	for name, d := range e.distributions {
+		names = append(names, name)
+		byName[name] = d
+	}
+	for name, g := range e.gauges {
+		names = append(names, name)
+		byName[name] = g
+	}
+	sort.Strings(names)
+
+	var metrics []counter.CumulativeMetricT
+	for _, name := range names {
+		metrics = append(metrics, byName[name])
+	}
+	return metrics
+}
+
+// ResetTime returns the reset time of the exported cumulative metrics.
+func (e *CloudMonitoringExporter) ResetTime() time.Time {
+	var resetTime time.Time
+	for _, m := range e.metrics() {
+		if _, ok := m.(counter.GaugeMetricT); ok {
+			continue
+		}
+		if t := m.ResetTime(); resetTime.IsZero() || t.Before(resetTime) {
+			resetTime = t
+		}
+	}
+	return resetTime
+}
+
+// Snapshot returns the reset time and current cumulative values of all
+// metrics.
+func (e *CloudMonitoringExporter) Snapshot() (time.Time, *metric.Values) {
+	values := metric.NewValues()
+	for name, c := range e.counters {
+		_, counts := c.Snapshot()
+		values.Counters[name] = counts
+	}
+	for name, d := range e.distributions {
+		_, histograms := d.Snapshot()
+		values.Distributions[name] = histograms
+	}
+	for name, g := range e.gauges {
+		_, gauges := g.Snapshot()
+		for key, x := range gauges {
+			values.SetGauge(name, key, x)
+		}
+	}
+	return e.ResetTime(), values
+}
+
+// Restore restores the reset time and cumulative values of all metrics from
+// an earlier snapshot. Metrics absent from the snapshot are reset to zero
+// (with the same reset time). Gauges are not restored.
+func (e *CloudMonitoringExporter) Restore(resetTime time.Time, values *metric.Values) {
+	for name, c := range e.counters {
+		c.Restore(resetTime, values.Counters[name])
+	}
+	for name, d := range e.distributions {
+		d.Restore(resetTime, values.Distributions[name])
 	}
 }
 
-// StatusCounterResetTime returnes the reset time of the response status
-// counter metric.
-func (e *CloudMonitoringExporter) StatusCounterResetTime() time.Time {
-	return e.statusCounter.ResetTime()
+// ReplaceCounter replaces the existing CounterMetricT for the named counter
+// metric with a different one. For use in tests.
+func (e *CloudMonitoringExporter) ReplaceCounter(name string, c counter.CounterMetricT) {
+	e.counters[name] = c
 }
 
-// ReplaceStatusCounter replaces the existing CounterMetricT for the status
-// counter metric with a different one. For use in tests.
-func (e *CloudMonitoringExporter) ReplaceStatusCounter(c counter.CounterMetricT) {
-	e.statusCounter = c
+// ReplaceDistribution replaces the existing DistributionMetricT for the named
+// distribution metric with a different one. For use in tests.
+func (e *CloudMonitoringExporter) ReplaceDistribution(name string, d counter.DistributionMetricT) {
+	e.distributions[name] = d
 }
 
-// CreateMetrics creates the custom Stackdriver metrics written by
-// CloudMonitoringExporter. It is assumed that this will have been called at
-// least once before the exporter is actually used (e.g. by calling
-// IncrementStatusCounts).
-func (e *CloudMonitoringExporter) CreateMetrics() error {
-	if err := e.statusCounter.Create(); err != nil {
-		return err
+// SetStats sets the Registry in which writes by all metrics are recorded.
+func (e *CloudMonitoringExporter) SetStats(r *stats.Registry) {
+	for _, m := range e.metrics() {
+		m.SetStats(r)
+	}
+}
+
+// SetService switches the exporter to write via the provided service (e.g. one
+// using a different API endpoint), retaining cumulative values.
+func (e *CloudMonitoringExporter) SetService(service *monitoring.Service) {
+	for _, m := range e.metrics() {
+		m.SetService(service)
+	}
+}
+
+// EnsureMetrics ensures that the custom Stackdriver metrics written by
+// CloudMonitoringExporter exist, creating any that are missing. Existing metrics
+// whose definitions have drifted from those expected result in an error,
+// unless migrate is true, in which case they are deleted and recreated. It is
+// assumed that this will have been called at least once before the exporter is
+// actually used (e.g. by calling Export).
+func (e *CloudMonitoringExporter) EnsureMetrics(migrate bool) error {
+	for _, m := range e.metrics() {
+		if err := m.Ensure(migrate); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// IncrementStatusCounter increments internal HTTP response status counters by
-// the provided map of deltas and writes the updated cumulative values to
-// Stackdriver.
-func (e *CloudMonitoringExporter) IncrementStatusCounter(counts map[string]int64) error {
-	if err := e.statusCounter.Increment(counts); err != nil {
-		return err
+// Export accumulates the supplied metric deltas, which account for records up
+// to the provided end time, into the cumulative values of each metric.
+// Deltas for unknown metrics are ignored. Updated cumulative values are
+// written to Stackdriver on the next call to Flush.
+func (e *CloudMonitoringExporter) Export(values *metric.Values, end time.Time) error {
+	for name, c := range e.counters {
+		if err := c.Increment(values.Counters[name], end); err != nil {
+			return err
+		}
+	}
+	for name, d := range e.distributions {
+		if err := d.Add(values.Distributions[name], end); err != nil {
+			return err
+		}
+	}
+	for name, g := range e.gauges {
+		if err := g.Set(values.Gauges[name], end); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// buffered is implemented by metrics which buffer writes for retry.
+type buffered interface {
+	Pending() int
+	Dropped() int64
+}
+
+// Pending returns the number of timeseries writes buffered awaiting retry
+// (e.g. after transient errors) across all metrics.
+func (e *CloudMonitoringExporter) Pending() int {
+	n := 0
+	for _, m := range e.metrics() {
+		if b, ok := m.(buffered); ok {
+			n += b.Pending()
+		}
+	}
+	return n
+}
+
+// Dropped returns the number of timeseries writes discarded so far across
+// all metrics.
+func (e *CloudMonitoringExporter) Dropped() int64 {
+	var n int64
+	for _, m := range e.metrics() {
+		if b, ok := m.(buffered); ok {
+			n += b.Dropped()
+		}
+	}
+	return n
+}
+
+// Flush writes updated cumulative metric values to Stackdriver, subject to
+// per-metric limits on write frequency. Writes not completed before ctx is
+// done are retried on the next call. All metrics are flushed, even if some
+// fail, in which case the first error is returned.
+func (e *CloudMonitoringExporter) Flush(ctx context.Context) error {
+	var firstErr error
+	for _, m := range e.metrics() {
+		if err := m.Flush(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
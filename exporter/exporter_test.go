@@ -1,36 +1,73 @@
 package exporter_test
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/swfrench/nginx-log-consumer/exporter"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/stats"
 
 	"google.golang.org/api/monitoring/v3"
 )
 
 type MockCounter struct {
 	resetTime      time.Time
-	createCount    int64
+	ensureCount    int64
 	incrementCount int64
+	flushCount     int64
 	resetTimeCount int64
+	serviceCount   int64
 	counts         map[string]int64
 	err            error
+	pending        int
+	dropped        int64
 }
 
-func (c *MockCounter) Create() error {
-	c.createCount += 1
+func (c *MockCounter) Ensure(migrate bool) error {
+	c.ensureCount += 1
 	return c.err
 }
 
-func (c *MockCounter) Increment(counts map[string]int64) error {
+func (c *MockCounter) Increment(counts map[string]int64, end time.Time) error {
 	c.incrementCount += 1
 	c.counts = counts
 	return c.err
 }
 
+func (c *MockCounter) Snapshot() (time.Time, map[string]int64) {
+	return c.resetTime, c.counts
+}
+
+func (c *MockCounter) Restore(resetTime time.Time, counts map[string]int64) {
+	c.resetTime = resetTime
+	c.counts = counts
+}
+
+func (c *MockCounter) Flush(ctx context.Context) error {
+	c.flushCount += 1
+	return c.err
+}
+
+func (c *MockCounter) SetService(service *monitoring.Service) {
+	c.serviceCount += 1
+}
+
+func (c *MockCounter) SetStats(r *stats.Registry) {
+}
+
+func (c *MockCounter) Pending() int {
+	return c.pending
+}
+
+func (c *MockCounter) Dropped() int64 {
+	return c.dropped
+}
+
 func (c *MockCounter) ResetTime() time.Time {
 	c.resetTimeCount += 1
 	return c.resetTime
@@ -41,19 +78,19 @@ func TestBasic(t *testing.T) {
 		"instance_id": "foo",
 		"zone":        "us-central1-a",
 	}
-	e := exporter.NewCloudMonitoringExporter("foo", resource, &monitoring.Service{})
+	e := exporter.NewCloudMonitoringExporter("foo", "gce_instance", resource, naming.Default(), metric.DefaultSpecs(), &monitoring.Service{})
 
 	c := &MockCounter{
 		resetTime: time.Now(),
 	}
-	e.ReplaceStatusCounter(c)
+	e.ReplaceCounter(metric.StatusCountMetric, c)
 
-	if err := e.CreateMetrics(); err != nil {
-		t.Fatalf("CreateMetrics failed with %v", err)
+	if err := e.EnsureMetrics(false); err != nil {
+		t.Fatalf("EnsureMetrics failed with %v", err)
 	}
 
-	if got, want := c.createCount, int64(1); got != want {
-		t.Fatalf("Expected Create to be called %v time(s), got %v", want, got)
+	if got, want := c.ensureCount, int64(1); got != want {
+		t.Fatalf("Expected Ensure to be called %v time(s), got %v", want, got)
 	}
 
 	counts := map[string]int64{
@@ -61,25 +98,42 @@ func TestBasic(t *testing.T) {
 		"503": 2,
 	}
 
-	if err := e.IncrementStatusCounter(counts); err != nil {
-		t.Fatalf("IncrementStatusCounter failed with %v", err)
+	values := metric.NewValues()
+	values.Counters[metric.StatusCountMetric] = counts
+
+	if err := e.Export(values, time.Now()); err != nil {
+		t.Fatalf("Export failed with %v", err)
 	}
 
 	if got, want := c.counts, counts; !reflect.DeepEqual(got, want) {
-		t.Fatalf("Expected equality between status counts passed to IncrementStatusCounter and Increment: got %v vs. %v", got, want)
+		t.Fatalf("Expected equality between status counts passed to Export and Increment: got %v vs. %v", got, want)
 	}
 
 	if got, want := c.incrementCount, int64(1); got != want {
 		t.Fatalf("Expected Increment to be called %v time(s), got %v", want, got)
 	}
 
-	if got, want := e.StatusCounterResetTime(), c.resetTime; got != want {
-		t.Fatalf("Expected StatusCounterResetTime to return %v, got %v", want, got)
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed with %v", err)
+	}
+
+	if got, want := c.flushCount, int64(1); got != want {
+		t.Fatalf("Expected Flush to be called %v time(s), got %v", want, got)
+	}
+
+	if got, want := e.ResetTime(), c.resetTime; got != want {
+		t.Fatalf("Expected ResetTime to return %v, got %v", want, got)
 	}
 
 	if got, want := c.resetTimeCount, int64(1); got != want {
 		t.Fatalf("Expected ResetTime to be called %v time(s), got %v", want, got)
 	}
+
+	e.SetService(&monitoring.Service{})
+
+	if got, want := c.serviceCount, int64(1); got != want {
+		t.Fatalf("Expected SetService to be called %v time(s), got %v", want, got)
+	}
 }
 
 func TestErrorPropagation(t *testing.T) {
@@ -87,16 +141,16 @@ func TestErrorPropagation(t *testing.T) {
 		"instance_id": "foo",
 		"zone":        "us-central1-a",
 	}
-	e := exporter.NewCloudMonitoringExporter("foo", resource, &monitoring.Service{})
+	e := exporter.NewCloudMonitoringExporter("foo", "gce_instance", resource, naming.Default(), metric.DefaultSpecs(), &monitoring.Service{})
 
 	c := &MockCounter{
 		resetTime: time.Now(),
 		err:       fmt.Errorf("Test error"),
 	}
-	e.ReplaceStatusCounter(c)
+	e.ReplaceCounter(metric.StatusCountMetric, c)
 
-	if err := e.CreateMetrics(); err == nil {
-		t.Fatalf("CreateMetrics should have failed with %v, but it did not", c.err)
+	if err := e.EnsureMetrics(false); err == nil {
+		t.Fatalf("EnsureMetrics should have failed with %v, but it did not", c.err)
 	}
 
 	counts := map[string]int64{
@@ -104,7 +158,68 @@ func TestErrorPropagation(t *testing.T) {
 		"503": 2,
 	}
 
-	if err := e.IncrementStatusCounter(counts); err == nil {
-		t.Fatalf("IncrementStatusCounter should have failed with %v, but it did not", c.err)
+	values := metric.NewValues()
+	values.Counters[metric.StatusCountMetric] = counts
+
+	if err := e.Export(values, time.Now()); err == nil {
+		t.Fatalf("Export should have failed with %v, but it did not", c.err)
+	}
+
+	if err := e.Flush(context.Background()); err == nil {
+		t.Fatalf("Flush should have failed with %v, but it did not", c.err)
+	}
+}
+
+func TestPendingDropped(t *testing.T) {
+	e := exporter.NewCloudMonitoringExporter("foo", "gce_instance", nil, naming.Default(), metric.DefaultSpecs(), &monitoring.Service{})
+	if got := e.Pending(); got != 0 {
+		t.Errorf("Expected no pending writes, got %d", got)
+	}
+
+	e.ReplaceCounter(metric.StatusCountMetric, &MockCounter{pending: 2, dropped: 1})
+	if want, got := 2, e.Pending(); want != got {
+		t.Errorf("Expected %d pending writes, got %d", want, got)
+	}
+	if want, got := int64(1), e.Dropped(); want != got {
+		t.Errorf("Expected %d dropped writes, got %d", want, got)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	resource := map[string]string{
+		"instance_id": "foo",
+		"zone":        "us-central1-a",
+	}
+	latency := &metric.Spec{
+		Name:    "http_request_latency",
+		Kind:    metric.Distribution,
+		Field:   "request_time",
+		Buckets: []float64{0.1, 1},
+	}
+	specs := []*metric.Spec{metric.StatusCountSpec(), latency}
+
+	e := exporter.NewCloudMonitoringExporter("foo", "gce_instance", resource, naming.Default(), specs, &monitoring.Service{})
+
+	values := metric.NewValues()
+	values.AddCount(metric.StatusCountMetric, "200", 2)
+	values.AddSample(latency.Name, "", 0.5, latency.Buckets)
+
+	if err := e.Export(values, time.Now()); err != nil {
+		t.Fatalf("Export failed with %v", err)
+	}
+
+	resetTime, snapshot := e.Snapshot()
+	if !reflect.DeepEqual(values, snapshot) {
+		t.Fatalf("Expected snapshot %v, got %v", values, snapshot)
+	}
+
+	r := exporter.NewCloudMonitoringExporter("foo", "gce_instance", resource, naming.Default(), specs, &monitoring.Service{})
+	r.Restore(resetTime, snapshot)
+
+	if got, want := r.ResetTime(), resetTime; got != want {
+		t.Errorf("Expected restored ResetTime %v, got %v", want, got)
+	}
+	if _, got := r.Snapshot(); !reflect.DeepEqual(snapshot, got) {
+		t.Errorf("Expected restored values %v, got %v", snapshot, got)
 	}
 }
@@ -0,0 +1,139 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/metric"
+)
+
+// JSONExporter writes exported values as JSON lines (see JSONExport), for
+// debugging (e.g. comparing the values sent to a real backend with those
+// expected). It may be used alone, as a dry run, or alongside another exporter
+// via a MultiExporter.
+type JSONExporter struct {
+	w         io.Writer
+	naming    *naming.Naming
+	specs     []*metric.Spec
+	resetTime time.Time
+	values    *metric.Values
+}
+
+// JSONExport describes a single call to Export: The values of each timeseries
+// which changed, over the interval from the reset time to the end time.
+type JSONExport struct {
+	StartTime time.Time    `json:"start_time"`
+	EndTime   time.Time    `json:"end_time"`
+	Series    []JSONSeries `json:"series"`
+}
+
+// JSONSeries describes the change in a timeseries, and its new cumulative
+// value. For distribution metrics, Delta and Value are JSONHistograms. Gauge
+// metrics have only a Value.
+type JSONSeries struct {
+	Metric string            `json:"metric"`
+	Kind   metric.Kind       `json:"kind"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Delta  interface{}       `json:"delta,omitempty"`
+	Value  interface{}       `json:"value"`
+}
+
+// JSONHistogram describes a distribution value.
+type JSONHistogram struct {
+	Count        int64   `json:"count"`
+	Sum          float64 `json:"sum"`
+	BucketCounts []int64 `json:"bucket_counts"`
+}
+
+// NewJSONExporter creates a JSONExporter which will write the metrics
+// described by the supplied Specs to w, with metric types built using the
+// provided Naming.
+func NewJSONExporter(w io.Writer, n *naming.Naming, specs []*metric.Spec) *JSONExporter {
+	return &JSONExporter{
+		w:         w,
+		naming:    n,
+		specs:     specs,
+		resetTime: time.Now(),
+		values:    metric.NewValues(),
+	}
+}
+
+// ResetTime returns the reset time of the exported cumulative metrics.
+func (e *JSONExporter) ResetTime() time.Time {
+	return e.resetTime
+}
+
+// Snapshot returns the reset time and a copy of the current cumulative values.
+func (e *JSONExporter) Snapshot() (time.Time, *metric.Values) {
+	return e.resetTime, e.values.Copy()
+}
+
+// Restore replaces the reset time and cumulative values with those supplied
+// (e.g. those of another exporter, so that both report the same values).
+func (e *JSONExporter) Restore(resetTime time.Time, values *metric.Values) {
+	e.resetTime = resetTime
+	e.values = values.Copy()
+}
+
+// Export adds the supplied deltas to the cumulative values, and writes a
+// JSONExport describing them as a single line. Nothing is written if there are
+// no deltas.
+func (e *JSONExporter) Export(values *metric.Values, end time.Time) error {
+	e.values.Merge(values)
+	// Unique and mean metrics are computed per window, not cumulatively.
+	e.values.Sketches = nil
+	e.values.Means = nil
+	if values.Empty() {
+		return nil
+	}
+
+	x := &JSONExport{
+		StartTime: e.resetTime.UTC(),
+		EndTime:   end.UTC(),
+		Series:    []JSONSeries{},
+	}
+	for _, s := range e.specs {
+		for _, key := range seriesKeys(s, values) {
+			series := JSONSeries{
+				Metric: e.naming.Type(s.Name),
+				Kind:   s.Kind,
+				Labels: s.LabelMap(key),
+			}
+			switch s.Kind {
+			case metric.Counter:
+				series.Delta = values.Counters[s.Name][key]
+				series.Value = e.values.Counters[s.Name][key]
+			case metric.Distribution:
+				series.Delta = jsonHistogram(values.Distributions[s.Name][key])
+				series.Value = jsonHistogram(e.values.Distributions[s.Name][key])
+			case metric.Gauge:
+				series.Value = values.Gauges[s.Name][key]
+			}
+			x.Series = append(x.Series, series)
+		}
+	}
+
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+// Flush does nothing: Values are written by Export.
+func (e *JSONExporter) Flush(ctx context.Context) error {
+	return nil
+}
+
+// jsonHistogram returns a JSONHistogram describing h.
+func jsonHistogram(h *metric.Histogram) *JSONHistogram {
+	return &JSONHistogram{
+		Count:        h.Count,
+		Sum:          h.Sum,
+		BucketCounts: h.BucketCounts,
+	}
+}
@@ -0,0 +1,141 @@
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/metric"
+)
+
+func TestJSON(t *testing.T) {
+	latency := &metric.Spec{
+		Name:    "http_request_latency",
+		Kind:    metric.Distribution,
+		Field:   "request_time",
+		Buckets: []float64{0.1, 1},
+	}
+	specs := []*metric.Spec{metric.StatusCountSpec(), latency}
+
+	var b bytes.Buffer
+	e := exporter.NewJSONExporter(&b, naming.Default(), specs)
+
+	start := time.Date(2017, 3, 4, 5, 0, 0, 0, time.UTC)
+	initial := metric.NewValues()
+	initial.AddCount(metric.StatusCountMetric, "200", 10)
+	e.Restore(start, initial)
+
+	// No line is written for empty values.
+	if err := e.Export(metric.NewValues(), start.Add(time.Minute)); err != nil {
+		t.Fatalf("Export failed with %v", err)
+	}
+
+	values := metric.NewValues()
+	values.AddCount(metric.StatusCountMetric, "200", 2)
+	values.AddSample(latency.Name, "", 0.5, latency.Buckets)
+	end := start.Add(2 * time.Minute)
+	if err := e.Export(values, end); err != nil {
+		t.Fatalf("Export failed with %v", err)
+	}
+
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed with %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a single line, got %q", b.String())
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("Could not decode %q: %v", lines[0], err)
+	}
+	var want map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"start_time": "2017-03-04T05:00:00Z",
+		"end_time": "2017-03-04T05:02:00Z",
+		"series": [
+			{
+				"metric": "custom.googleapis.com/http_response_count",
+				"kind": "counter",
+				"labels": {"response_code": "200"},
+				"delta": 2,
+				"value": 12
+			},
+			{
+				"metric": "custom.googleapis.com/http_request_latency",
+				"kind": "distribution",
+				"delta": {"count": 1, "sum": 0.5, "bucket_counts": [0, 1, 0]},
+				"value": {"count": 1, "sum": 0.5, "bucket_counts": [0, 1, 0]}
+			}
+		]
+	}`), &want); err != nil {
+		t.Fatalf("Could not decode expected value: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if _, snapshot := e.Snapshot(); snapshot.Counters[metric.StatusCountMetric]["200"] != 12 {
+		t.Errorf("Expected cumulative count 12, got %v", snapshot.Counters)
+	}
+}
+
+type MockExporter struct {
+	resetTime   time.Time
+	exportCount int
+	flushCount  int
+	err         error
+}
+
+func (e *MockExporter) Export(values *metric.Values, end time.Time) error {
+	e.exportCount++
+	return e.err
+}
+
+func (e *MockExporter) ResetTime() time.Time {
+	return e.resetTime
+}
+
+func (e *MockExporter) Snapshot() (time.Time, *metric.Values) {
+	return e.resetTime, metric.NewValues()
+}
+
+func (e *MockExporter) Flush(ctx context.Context) error {
+	e.flushCount++
+	return e.err
+}
+
+func TestMulti(t *testing.T) {
+	primary := &MockExporter{resetTime: time.Now()}
+	other := &MockExporter{
+		resetTime: time.Now().Add(time.Hour),
+		err:       fmt.Errorf("Test error"),
+	}
+	e := exporter.NewMultiExporter(primary, other)
+
+	if got, want := e.ResetTime(), primary.resetTime; got != want {
+		t.Errorf("Expected ResetTime %v, got %v", want, got)
+	}
+
+	if err := e.Export(metric.NewValues(), time.Now()); err != other.err {
+		t.Errorf("Expected Export to fail with %v, got %v", other.err, err)
+	}
+	if err := e.Flush(context.Background()); err != other.err {
+		t.Errorf("Expected Flush to fail with %v, got %v", other.err, err)
+	}
+
+	for _, x := range []*MockExporter{primary, other} {
+		if x.exportCount != 1 || x.flushCount != 1 {
+			t.Errorf("Expected a single Export and Flush, got %d and %d", x.exportCount, x.flushCount)
+		}
+	}
+}
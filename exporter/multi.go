@@ -0,0 +1,58 @@
+package exporter
+
+import (
+	"context"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+)
+
+// MultiExporter exports values to each of several exporters (e.g. a
+// CloudMonitoringExporter and a JSONExporter). The first is primary: Its reset
+// time and cumulative values are those reported by ResetTime and Snapshot.
+type MultiExporter struct {
+	exporters []ExporterT
+}
+
+// NewMultiExporter creates a MultiExporter exporting to the supplied primary
+// and other exporters.
+func NewMultiExporter(primary ExporterT, others ...ExporterT) *MultiExporter {
+	return &MultiExporter{
+		exporters: append([]ExporterT{primary}, others...),
+	}
+}
+
+// ResetTime returns the reset time of the primary exporter.
+func (e *MultiExporter) ResetTime() time.Time {
+	return e.exporters[0].ResetTime()
+}
+
+// Snapshot returns the reset time and cumulative values of the primary
+// exporter.
+func (e *MultiExporter) Snapshot() (time.Time, *metric.Values) {
+	return e.exporters[0].Snapshot()
+}
+
+// Export exports the supplied values to all exporters, returning the first
+// error encountered (if any).
+func (e *MultiExporter) Export(values *metric.Values, end time.Time) error {
+	var firstErr error
+	for _, x := range e.exporters {
+		if err := x.Export(values, end); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Flush flushes all exporters, returning the first error encountered (if
+// any).
+func (e *MultiExporter) Flush(ctx context.Context) error {
+	var firstErr error
+	for _, x := range e.exporters {
+		if err := x.Flush(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,65 @@
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// CustomDomain is the domain for user-defined custom metrics.
+	CustomDomain = "custom.googleapis.com"
+
+	// WorkloadDomain is the domain for workload metrics (e.g. those written
+	// by the Ops Agent).
+	WorkloadDomain = "workload.googleapis.com"
+)
+
+// prefixRE matches valid metric prefixes: Path segments of letters, digits and
+// underscores, each terminated by a slash.
+var prefixRE = regexp.MustCompile(`^([a-zA-Z0-9_]+/)*$`)
+
+// Naming builds metric names from a domain (custom.googleapis.com or
+// workload.googleapis.com) and a prefix (e.g. "nginx/edge/"), so that metrics
+// written by differently configured consumers in the same project do not
+// collide.
+type Naming struct {
+	domain string
+	prefix string
+}
+
+// New returns a Naming for the supplied domain and prefix. A trailing slash is
+// appended to the prefix if missing.
+func New(domain, prefix string) (*Naming, error) {
+	if domain != CustomDomain && domain != WorkloadDomain {
+		return nil, fmt.Errorf("Unsupported metric domain %q: must be %s or %s", domain, CustomDomain, WorkloadDomain)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if !prefixRE.MatchString(prefix) {
+		return nil, fmt.Errorf("Invalid metric prefix %q: must consist of slash-separated letters, digits and underscores", prefix)
+	}
+	return &Naming{
+		domain: domain,
+		prefix: prefix,
+	}, nil
+}
+
+// Default returns the Naming with the custom metrics domain and no prefix.
+func Default() *Naming {
+	return &Naming{domain: CustomDomain}
+}
+
+// Type returns the Cloud Monitoring metric type for the named metric (e.g.
+// custom.googleapis.com/nginx/edge/http_response_count).
+func (n *Naming) Type(name string) string {
+	return n.domain + "/" + n.prefix + name
+}
+
+// FlatName returns the name of the named metric for backends with flat metric
+// namespaces (e.g. Prometheus): The prefix is included, and slashes in either
+// are replaced by underscores (e.g. nginx_edge_http_response_count).
+func (n *Naming) FlatName(name string) string {
+	return strings.Replace(n.prefix+name, "/", "_", -1)
+}
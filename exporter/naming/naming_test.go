@@ -0,0 +1,48 @@
+package naming_test
+
+import (
+	"testing"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+)
+
+func TestDefault(t *testing.T) {
+	n := naming.Default()
+
+	if want, got := "custom.googleapis.com/http_response_count", n.Type("http_response_count"); got != want {
+		t.Fatalf("Expected Type to return %s, got %s", want, got)
+	}
+
+	if want, got := "http_response_count", n.FlatName("http_response_count"); got != want {
+		t.Fatalf("Expected FlatName to return %s, got %s", want, got)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	for _, prefix := range []string{"nginx/edge", "nginx/edge/"} {
+		n, err := naming.New(naming.WorkloadDomain, prefix)
+		if err != nil {
+			t.Fatalf("New failed with %v", err)
+		}
+
+		if want, got := "workload.googleapis.com/nginx/edge/http_response_count", n.Type("http_response_count"); got != want {
+			t.Fatalf("Expected Type to return %s, got %s", want, got)
+		}
+
+		if want, got := "nginx_edge_http_response_count", n.FlatName("http_response_count"); got != want {
+			t.Fatalf("Expected FlatName to return %s, got %s", want, got)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := naming.New("example.com", ""); err == nil {
+		t.Fatalf("New should have failed for unsupported domain, but did not")
+	}
+
+	for _, prefix := range []string{"/nginx", "nginx//edge", "nginx edge"} {
+		if _, err := naming.New(naming.CustomDomain, prefix); err == nil {
+			t.Fatalf("New should have failed for invalid prefix %q, but did not", prefix)
+		}
+	}
+}
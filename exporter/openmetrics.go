@@ -0,0 +1,241 @@
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/metric"
+)
+
+// point holds cumulative values as of a given time.
+type point struct {
+	end    time.Time
+	values *metric.Values
+}
+
+// OpenMetricsExporter exports metrics as timestamped samples in the OpenMetrics
+// text format (as accepted, e.g., by `promtool tsdb create-blocks-from
+// openmetrics`), for offline replay of historical logs. Since samples must be
+// grouped by metric, points are buffered and written only by Close.
+type OpenMetricsExporter struct {
+	w         io.Writer
+	naming    *naming.Naming
+	specs     []*metric.Spec
+	resetTime time.Time
+	values    *metric.Values
+	points    []point
+}
+
+// NewOpenMetricsExporter creates an OpenMetricsExporter which will write the
+// metrics described by the supplied Specs to w. Metric names are built using
+// the provided Naming (see naming.FlatName).
+func NewOpenMetricsExporter(w io.Writer, n *naming.Naming, specs []*metric.Spec) *OpenMetricsExporter {
+	return &OpenMetricsExporter{
+		w:         w,
+		naming:    n,
+		specs:     specs,
+		resetTime: time.Now(),
+		values:    metric.NewValues(),
+	}
+}
+
+// ResetTime returns the reset time of the exported cumulative metrics.
+func (e *OpenMetricsExporter) ResetTime() time.Time {
+	return e.resetTime
+}
+
+// Snapshot returns the reset time and a copy of the current cumulative values.
+func (e *OpenMetricsExporter) Snapshot() (time.Time, *metric.Values) {
+	return e.resetTime, e.values.Copy()
+}
+
+// Restore replaces the reset time and cumulative values with those supplied.
+// Points buffered earlier are discarded.
+func (e *OpenMetricsExporter) Restore(resetTime time.Time, values *metric.Values) {
+	e.resetTime = resetTime
+	e.values = values.Copy()
+	e.points = nil
+}
+
+// Export adds the supplied deltas to the cumulative values, and buffers a point
+// for the latter at the supplied end time. Points must be exported in order of
+// end time.
+func (e *OpenMetricsExporter) Export(values *metric.Values, end time.Time) error {
+	if n := len(e.points); n > 0 && !end.After(e.points[n-1].end) {
+		return fmt.Errorf("Point at %v does not follow previous point at %v", end, e.points[n-1].end)
+	}
+	e.values.Merge(values)
+	// Unique and mean metrics are computed per window, not cumulatively.
+	e.values.Sketches = nil
+	e.values.Means = nil
+	e.points = append(e.points, point{
+		end:    end,
+		values: e.values.Copy(),
+	})
+	return nil
+}
+
+// Flush does nothing: Points are written by Close.
+func (e *OpenMetricsExporter) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close writes all buffered points.
+func (e *OpenMetricsExporter) Close() error {
+	w := bufio.NewWriter(e.w)
+	for _, s := range e.specs {
+		e.writeMetric(w, s)
+	}
+	fmt.Fprintf(w, "# EOF\n")
+	return w.Flush()
+}
+
+// WriteOpenMetrics writes the supplied cumulative values of the metrics
+// described by specs to w in the OpenMetrics text format, without timestamps
+// (e.g. to serve current values for scraping). Metric names are built using
+// the provided Naming (see naming.FlatName).
+func WriteOpenMetrics(w io.Writer, n *naming.Naming, specs []*metric.Spec, values *metric.Values) error {
+	e := NewOpenMetricsExporter(w, n, specs)
+	e.points = []point{{values: values}}
+	return e.Close()
+}
+
+// writeMetric writes the metric family for the supplied Spec.
+func (e *OpenMetricsExporter) writeMetric(w io.Writer, s *metric.Spec) {
+	name := e.naming.FlatName(s.Name)
+	switch s.Kind {
+	case metric.Counter:
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	case metric.Distribution:
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	case metric.Gauge:
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	}
+	if s.Description != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(s.Description))
+	}
+
+	// Samples are grouped by timeseries, in order of time.
+	for _, key := range e.keys(s) {
+		labels := s.LabelMap(key)
+		for _, p := range e.points {
+			// Points without an end time are current values, written
+			// without timestamps.
+			var ts string
+			if !p.end.IsZero() {
+				ts = " " + formatTimestamp(p.end)
+			}
+			switch s.Kind {
+			case metric.Counter:
+				count, ok := p.values.Counters[s.Name][key]
+				if !ok {
+					continue
+				}
+				fmt.Fprintf(w, "%s_total%s %d%s\n", name, formatLabels(labels, "", ""), count, ts)
+			case metric.Distribution:
+				h, ok := p.values.Distributions[s.Name][key]
+				if !ok {
+					continue
+				}
+				var cumulative int64
+				for i, count := range h.BucketCounts {
+					cumulative += count
+					le := "+Inf"
+					if i < len(s.Buckets) {
+						le = strconv.FormatFloat(s.Buckets[i], 'g', -1, 64)
+					}
+					fmt.Fprintf(w, "%s_bucket%s %d%s\n", name, formatLabels(labels, "le", le), cumulative, ts)
+				}
+				fmt.Fprintf(w, "%s_sum%s %s%s\n", name, formatLabels(labels, "", ""), strconv.FormatFloat(h.Sum, 'g', -1, 64), ts)
+				fmt.Fprintf(w, "%s_count%s %d%s\n", name, formatLabels(labels, "", ""), h.Count, ts)
+			case metric.Gauge:
+				x, ok := p.values.Gauges[s.Name][key]
+				if !ok {
+					continue
+				}
+				fmt.Fprintf(w, "%s%s %s%s\n", name, formatLabels(labels, "", ""), strconv.FormatFloat(x, 'g', -1, 64), ts)
+			}
+		}
+	}
+}
+
+// keys returns the sorted keys of all timeseries of the supplied metric. Since
+// values are cumulative, these are the keys present in the last point.
+func (e *OpenMetricsExporter) keys(s *metric.Spec) []string {
+	if len(e.points) == 0 {
+		return nil
+	}
+	return seriesKeys(s, e.points[len(e.points)-1].values)
+}
+
+// seriesKeys returns the sorted keys of the timeseries of the supplied metric
+// present in values.
+func seriesKeys(s *metric.Spec, values *metric.Values) []string {
+	var keys []string
+	switch s.Kind {
+	case metric.Counter:
+		for key := range values.Counters[s.Name] {
+			keys = append(keys, key)
+		}
+	case metric.Distribution:
+		for key := range values.Distributions[s.Name] {
+			keys = append(keys, key)
+		}
+	case metric.Gauge:
+		for key := range values.Gauges[s.Name] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels returns the supplied labels, and the extra label if its name is
+// not empty, in the form {name="value",...} (or the empty string if there are
+// none).
+func formatLabels(labels map[string]string, extraName, extraValue string) string {
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(labels[name])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, escapeLabelValue(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatTimestamp returns the supplied time as an OpenMetrics timestamp
+// (seconds since the epoch).
+func formatTimestamp(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes a label value for the OpenMetrics text format.
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// escapeHelp escapes HELP text for the OpenMetrics text format.
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
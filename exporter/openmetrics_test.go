@@ -0,0 +1,112 @@
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/metric"
+)
+
+func TestOpenMetrics(t *testing.T) {
+	n, err := naming.New(naming.CustomDomain, "nginx/")
+	if err != nil {
+		t.Fatalf("naming.New failed with %v", err)
+	}
+	latency := &metric.Spec{
+		Name:    "http_request_latency",
+		Kind:    metric.Distribution,
+		Field:   "request_time",
+		Buckets: []float64{0.1, 1},
+	}
+	specs := []*metric.Spec{metric.StatusCountSpec(), latency}
+
+	var b bytes.Buffer
+	e := exporter.NewOpenMetricsExporter(&b, n, specs)
+
+	start := time.Date(2017, 3, 4, 5, 0, 0, 0, time.UTC)
+	e.Restore(start, metric.NewValues())
+
+	first := metric.NewValues()
+	first.AddCount(metric.StatusCountMetric, "200", 2)
+	first.AddSample(latency.Name, "", 0.5, latency.Buckets)
+	if err := e.Export(first, start.Add(time.Minute)); err != nil {
+		t.Fatalf("Export failed with %v", err)
+	}
+
+	second := metric.NewValues()
+	second.AddCount(metric.StatusCountMetric, "200", 1)
+	second.AddCount(metric.StatusCountMetric, "503", 1)
+	second.AddSample(latency.Name, "", 2, latency.Buckets)
+	if err := e.Export(second, start.Add(2*time.Minute)); err != nil {
+		t.Fatalf("Export failed with %v", err)
+	}
+
+	if err := e.Export(second, start.Add(time.Minute)); err == nil {
+		t.Errorf("Export should have failed for an out of order point, but did not")
+	}
+
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed with %v", err)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("Expected nothing to be written before Close, got %q", b.String())
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+
+	want := `# TYPE nginx_http_response_count counter
+# HELP nginx_http_response_count Cumulative count of HTTP responses by status code.
+nginx_http_response_count_total{response_code="200"} 2 1488603660
+nginx_http_response_count_total{response_code="200"} 3 1488603720
+nginx_http_response_count_total{response_code="503"} 1 1488603720
+# TYPE nginx_http_request_latency histogram
+nginx_http_request_latency_bucket{le="0.1"} 0 1488603660
+nginx_http_request_latency_bucket{le="1"} 1 1488603660
+nginx_http_request_latency_bucket{le="+Inf"} 1 1488603660
+nginx_http_request_latency_sum 0.5 1488603660
+nginx_http_request_latency_count 1 1488603660
+nginx_http_request_latency_bucket{le="0.1"} 0 1488603720
+nginx_http_request_latency_bucket{le="1"} 1 1488603720
+nginx_http_request_latency_bucket{le="+Inf"} 2 1488603720
+nginx_http_request_latency_sum 2.5 1488603720
+nginx_http_request_latency_count 2 1488603720
+# EOF
+`
+	if got := b.String(); got != want {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	lag := &metric.Spec{
+		Name: "lag",
+		Kind: metric.Gauge,
+	}
+	specs := []*metric.Spec{metric.StatusCountSpec(), lag}
+
+	values := metric.NewValues()
+	values.AddCount(metric.StatusCountMetric, "200", 3)
+	values.SetGauge(lag.Name, "", 1.5)
+
+	var b bytes.Buffer
+	if err := exporter.WriteOpenMetrics(&b, naming.Default(), specs, values); err != nil {
+		t.Fatalf("WriteOpenMetrics failed with %v", err)
+	}
+
+	want := `# TYPE http_response_count counter
+# HELP http_response_count Cumulative count of HTTP responses by status code.
+http_response_count_total{response_code="200"} 3
+# TYPE lag gauge
+lag 1.5
+# EOF
+`
+	if got := b.String(); got != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, got)
+	}
+}
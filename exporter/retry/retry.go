@@ -0,0 +1,115 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// DefaultMaxAttempts is the default number of attempts (including the
+	// first) made by Do before giving up.
+	DefaultMaxAttempts = 4
+
+	// DefaultInitialBackoff is the default delay before the first retry.
+	DefaultInitialBackoff = 500 * time.Millisecond
+
+	// DefaultMaxBackoff is the default upper bound on the delay between
+	// attempts.
+	DefaultMaxBackoff = 8 * time.Second
+)
+
+// Policy describes how failed requests are retried: how many attempts are
+// made, and the exponential backoff (with jitter) applied between them.
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter is the fraction (in [0, 1]) of each backoff duration which is
+	// randomized, so that concurrent clients do not retry in lockstep.
+	Jitter float64
+	// Public for injection from unit tests:
+	Sleep func(context.Context, time.Duration)
+}
+
+// NewPolicy returns a Policy making at most maxAttempts attempts, with backoff
+// doubling from initial up to max.
+func NewPolicy(maxAttempts int, initial, max time.Duration) *Policy {
+	return &Policy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: initial,
+		MaxBackoff:     max,
+		Multiplier:     2,
+		Jitter:         0.5,
+		Sleep:          sleep,
+	}
+}
+
+// sleep waits for the supplied duration, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// DefaultPolicy returns a Policy with the default attempt count and backoff
+// bounds.
+func DefaultPolicy() *Policy {
+	return NewPolicy(DefaultMaxAttempts, DefaultInitialBackoff, DefaultMaxBackoff)
+}
+
+// Backoff returns the delay to apply after the specified (1-indexed) failed
+// attempt.
+func (p *Policy) Backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	d -= p.Jitter * d * rand.Float64()
+	return time.Duration(d)
+}
+
+// Do calls f until it succeeds, returns an error for which IsRetryable is
+// false, MaxAttempts attempts have been made, or ctx is done. The error from
+// the last attempt (if any) is returned.
+func (p *Policy) Do(ctx context.Context, f func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || !IsRetryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		p.Sleep(ctx, p.Backoff(attempt))
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// IsRetryable returns true if err is likely transient: Rate limiting (HTTP
+// 429), server errors (HTTP 5xx), or network failures.
+func IsRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 429 || apiErr.Code >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
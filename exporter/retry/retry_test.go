@@ -0,0 +1,140 @@
+package retry_test
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/exporter/retry"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 400}, false},
+		{&googleapi.Error{Code: 403}, false},
+		{&url.Error{Op: "Post", URL: "https://monitoring.googleapis.com", Err: fmt.Errorf("connection refused")}, true},
+		{fmt.Errorf("This is an error."), false},
+	} {
+		if got := retry.IsRetryable(tc.err); got != tc.want {
+			t.Errorf("Expected IsRetryable(%v) to return %v, got %v", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retry.NewPolicy(10, time.Second, 10*time.Second)
+	p.Jitter = 0
+
+	for attempt, want := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 8 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		if got := p.Backoff(attempt); got != want {
+			t.Errorf("Expected Backoff(%d) to return %v, got %v", attempt, want, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.Backoff(2); got < time.Second || got > 2*time.Second {
+			t.Fatalf("Expected jittered Backoff(2) to be between [%v, %v], got %v", time.Second, 2*time.Second, got)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	p := retry.NewPolicy(3, time.Second, 10*time.Second)
+
+	var sleeps []time.Duration
+	p.Sleep = func(_ context.Context, d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+
+	// Transient errors followed by success:
+
+	calls := 0
+	err := p.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return &googleapi.Error{Code: 503}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Do failed with %v", err)
+	}
+	if want, got := 3, calls; want != got {
+		t.Errorf("Expected %d calls, got %d", want, got)
+	}
+	if want, got := 2, len(sleeps); want != got {
+		t.Errorf("Expected %d sleeps between attempts, got %d", want, got)
+	}
+
+	// Attempts exhausted:
+
+	calls = 0
+	sleeps = nil
+	if err := p.Do(context.Background(), func() error {
+		calls++
+		return &googleapi.Error{Code: 429}
+	}); err == nil {
+		t.Errorf("Do should have failed, but did not.")
+	}
+	if want, got := 3, calls; want != got {
+		t.Errorf("Expected %d calls, got %d", want, got)
+	}
+
+	// Non-retryable errors are returned immediately:
+
+	calls = 0
+	sleeps = nil
+	if err := p.Do(context.Background(), func() error {
+		calls++
+		return &googleapi.Error{Code: 400}
+	}); err == nil {
+		t.Errorf("Do should have failed, but did not.")
+	}
+	if want, got := 1, calls; want != got {
+		t.Errorf("Expected %d calls, got %d", want, got)
+	}
+	if want, got := 0, len(sleeps); want != got {
+		t.Errorf("Expected %d sleeps, got %d", want, got)
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	p := retry.NewPolicy(10, time.Hour, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	if err := p.Do(ctx, func() error {
+		calls++
+		return &googleapi.Error{Code: 503}
+	}); err == nil {
+		t.Errorf("Do should have failed, but did not.")
+	}
+
+	if want, got := 1, calls; want != got {
+		t.Errorf("Expected %d calls, got %d", want, got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Do to return promptly once context was done, took %v", elapsed)
+	}
+}
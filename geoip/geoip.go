@@ -0,0 +1,290 @@
+// Package geoip derives the country and autonomous system of clients from
+// their addresses, using local MaxMind DB files (e.g. the GeoLite2 Country and
+// ASN databases).
+package geoip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+const (
+	// CountryField is the name of the record field to which the Locator
+	// writes the ISO 3166-1 country code of the client.
+	CountryField = "client_country"
+
+	// ASNField is the name of the record field to which the Locator writes
+	// the autonomous system number of the client.
+	ASNField = "client_asn"
+
+	// AddressField is the name of the record field holding the address
+	// of the peer (as in the log_format suggested in README.md).
+	AddressField = "remote_addr"
+
+	// ForwardedField is the name of the record field holding the
+	// X-Forwarded-For header.
+	ForwardedField = "http_x_forwarded_for"
+
+	// Unknown is the value of fields for clients which could not be
+	// located.
+	Unknown = "unknown"
+
+	// Other is the country (or autonomous system) of clients located
+	// outside the configured countries (or autonomous systems).
+	Other = "other"
+
+	// DefaultCheckPeriod is the default period between checks for changes
+	// to database files.
+	DefaultCheckPeriod = time.Minute
+)
+
+// DefaultCountries are the countries reported by default, those of the largest
+// online populations; clients elsewhere are reported as Other.
+var DefaultCountries = []string{
+	"AR", "AU", "BD", "BR", "CA", "CN", "DE", "EG", "ES", "FR",
+	"GB", "ID", "IN", "IT", "JP", "KR", "MX", "NG", "NL", "PH",
+	"PK", "PL", "RU", "TH", "TR", "UA", "US", "VN", "ZA",
+}
+
+// ParseNetworks parses the supplied CIDR networks or plain addresses (taken
+// as single-address networks).
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// watched is a Database read from a file, which is re-read when the file
+// changes.
+type watched struct {
+	path    string
+	db      *Database
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// open returns a watched Database for the file at the supplied path.
+func open(path string) (*watched, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &watched{
+		path:    path,
+		db:      db,
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		checked: time.Now(),
+	}, nil
+}
+
+// check re-reads the file if it has changed, unless it was checked within the
+// supplied period. If the changed file cannot be read, the existing Database
+// is retained.
+func (w *watched) check(now time.Time, period time.Duration) {
+	if now.Sub(w.checked) < period {
+		return
+	}
+	w.checked = now
+	fi, err := os.Stat(w.path)
+	if err != nil || (fi.ModTime().Equal(w.modTime) && fi.Size() == w.size) {
+		return
+	}
+	w.modTime, w.size = fi.ModTime(), fi.Size()
+	db, err := Open(w.path)
+	if err != nil {
+		log.Printf("Could not reload GeoIP database: %v", err)
+		return
+	}
+	w.db = db
+	log.Printf("Reloaded GeoIP database %s", w.path)
+}
+
+// Locator implements parser.Enricher, writing the country and autonomous
+// system of the client to CountryField and ASNField. The client address is
+// that in AddressField, unless it is that of a trusted proxy, in which case the
+// address added to ForwardedField by the last trusted proxy is used.
+type Locator struct {
+	// TrustedProxies are the networks of proxies whose X-Forwarded-For
+	// hops are trusted.
+	TrustedProxies []*net.IPNet
+
+	// CheckPeriod is the period between checks for changes to database
+	// files.
+	CheckPeriod time.Duration
+
+	country   *watched
+	asn       *watched
+	countries map[string]bool
+	// asns, if set, bounds the autonomous systems reported (see SetASNs).
+	asns map[string]bool
+}
+
+// NewLocator returns a Locator using the country and ASN databases at the
+// supplied paths, either of which may be empty (in which case the
+// corresponding field is Unknown), reporting DefaultCountries.
+func NewLocator(countryPath, asnPath string) (*Locator, error) {
+	l := &Locator{CheckPeriod: DefaultCheckPeriod}
+	var err error
+	if countryPath != "" {
+		if l.country, err = open(countryPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if l.asn, err = open(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	l.SetCountries(DefaultCountries)
+	return l, nil
+}
+
+// SetCountries sets the countries (ISO 3166-1 codes) reported in
+// CountryField, bounding its cardinality: Clients elsewhere are reported as
+// Other.
+func (l *Locator) SetCountries(countries []string) {
+	l.countries = make(map[string]bool)
+	for _, c := range countries {
+		l.countries[strings.ToUpper(c)] = true
+	}
+}
+
+// SetASNs sets the autonomous system numbers reported in ASNField, bounding
+// its cardinality (e.g. for use as a metric label): Clients of other
+// autonomous systems are reported as Other. If none are set, as by default,
+// all are reported.
+func (l *Locator) SetASNs(asns []string) {
+	l.asns = nil
+	for _, a := range asns {
+		if l.asns == nil {
+			l.asns = make(map[string]bool)
+		}
+		l.asns[strings.TrimPrefix(strings.ToUpper(a), "AS")] = true
+	}
+}
+
+// trusted returns true if the supplied address is that of a trusted proxy.
+func (l *Locator) trusted(ip net.IP) bool {
+	for _, n := range l.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the address of the client making the request described
+// by the supplied record, or nil if it has no valid address. X-Forwarded-For
+// hops are examined from the last (added by the peer) while the hop from which
+// each was received is trusted.
+func (l *Locator) ClientAddr(r parser.Record) net.IP {
+	ip := net.ParseIP(strings.TrimSpace(r[AddressField]))
+	if ip == nil || !l.trusted(ip) {
+		return ip
+	}
+	hops := strings.Split(r[ForwardedField], ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// Enrich sets the CountryField and ASNField of the supplied record.
+func (l *Locator) Enrich(r parser.Record) {
+	now := time.Now()
+	country, asn := Unknown, Unknown
+	ip := l.ClientAddr(r)
+	if l.country != nil {
+		l.country.check(now, l.CheckPeriod)
+		if code := countryCode(l.country.db, ip); code != "" {
+			country = Other
+			if l.countries[code] {
+				country = code
+			}
+		}
+	}
+	if l.asn != nil {
+		l.asn.check(now, l.CheckPeriod)
+		if n, ok := asNumber(l.asn.db, ip); ok {
+			asn = strconv.FormatUint(n, 10)
+			if l.asns != nil && !l.asns[asn] {
+				asn = Other
+			}
+		}
+	}
+	r[CountryField] = country
+	r[ASNField] = asn
+}
+
+// lookup returns the record for the supplied address as a map, or nil if there
+// is none.
+func lookup(db *Database, ip net.IP) map[string]interface{} {
+	if ip == nil {
+		return nil
+	}
+	v, err := db.Lookup(ip)
+	if err != nil {
+		return nil
+	}
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+// countryCode returns the ISO 3166-1 code of the country in which the supplied
+// address is located (or failing that, registered), or the empty string if it
+// is not known.
+func countryCode(db *Database, ip net.IP) string {
+	m := lookup(db, ip)
+	for _, key := range []string{"country", "registered_country"} {
+		c, _ := m[key].(map[string]interface{})
+		if code, _ := c["iso_code"].(string); code != "" {
+			return strings.ToUpper(code)
+		}
+	}
+	return ""
+}
+
+// asNumber returns the number of the autonomous system to which the supplied
+// address belongs, if known.
+func asNumber(db *Database, ip net.IP) (uint64, bool) {
+	n, ok := lookup(db, ip)["autonomous_system_number"].(uint64)
+	return n, ok
+}
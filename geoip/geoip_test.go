@@ -0,0 +1,202 @@
+package geoip_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/geoip"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{"country": map[string]interface{}{"iso_code": code}}
+}
+
+// writeDatabases writes country and ASN databases to dir, returning their
+// paths.
+func writeDatabases(t *testing.T, dir string) (string, string) {
+	countryPath := filepath.Join(dir, "country.mmdb")
+	if err := ioutil.WriteFile(countryPath, buildDatabase(t, "GeoLite2-Country", []network{
+		{"203.0.113.0/24", country("US")},
+		{"198.51.100.0/24", country("IS")},
+		{"2001:db8::/32", map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "de"}}},
+	}), 0644); err != nil {
+		t.Fatalf("Could not write %s: %v", countryPath, err)
+	}
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	if err := ioutil.WriteFile(asnPath, buildDatabase(t, "GeoLite2-ASN", []network{
+		{"203.0.113.0/24", map[string]interface{}{
+			"autonomous_system_number":       uint32(64496),
+			"autonomous_system_organization": "Example",
+		}},
+	}), 0644); err != nil {
+		t.Fatalf("Could not write %s: %v", asnPath, err)
+	}
+	return countryPath, asnPath
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := geoip.ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("ParseNetworks failed with %v", err)
+	}
+	var got []string
+	for _, n := range networks {
+		got = append(got, n.String())
+	}
+	if want := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected networks %v, got %v", want, got)
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "example.com"} {
+		if _, err := geoip.ParseNetworks([]string{s}); err == nil {
+			t.Errorf("Expected ParseNetworks to fail for %q", s)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	l, err := geoip.NewLocator("", "")
+	if err != nil {
+		t.Fatalf("NewLocator failed with %v", err)
+	}
+	l.TrustedProxies, _ = geoip.ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+
+	for _, tc := range []struct {
+		remote, forwarded string
+		want              string
+	}{
+		// Untrusted peers are the client, whatever they forward.
+		{"203.0.113.7", "198.51.100.1", "203.0.113.7"},
+		// The hop added by the last trusted proxy is the client.
+		{"10.0.0.1", "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{"10.0.0.1", "198.51.100.1, 203.0.113.7, 192.0.2.1", "203.0.113.7"},
+		// If all hops are trusted, the first is used.
+		{"10.0.0.1", "192.0.2.1, 10.1.1.1", "192.0.2.1"},
+		// Invalid hops are not followed.
+		{"10.0.0.1", "203.0.113.7, unknown", "10.0.0.1"},
+		{"10.0.0.1", "-", "10.0.0.1"},
+		{"-", "203.0.113.7", "<nil>"},
+	} {
+		ip := l.ClientAddr(parser.Record{
+			geoip.AddressField:   tc.remote,
+			geoip.ForwardedField: tc.forwarded,
+		})
+		if got := ip.String(); got != tc.want {
+			t.Errorf("Expected client address %s for %s forwarding %q, got %s", tc.want, tc.remote, tc.forwarded, got)
+		}
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := geoip.NewLocator(writeDatabases(t, dir))
+	if err != nil {
+		t.Fatalf("NewLocator failed with %v", err)
+	}
+	l.TrustedProxies = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+
+	for _, tc := range []struct {
+		r           parser.Record
+		country, as string
+	}{
+		{parser.Record{"remote_addr": "203.0.113.7"}, "US", "64496"},
+		{parser.Record{"remote_addr": "10.0.0.1", "http_x_forwarded_for": "203.0.113.7"}, "US", "64496"},
+		// Outside DefaultCountries.
+		{parser.Record{"remote_addr": "198.51.100.1"}, geoip.Other, geoip.Unknown},
+		{parser.Record{"remote_addr": "2001:db8::1"}, "DE", geoip.Unknown},
+		{parser.Record{"remote_addr": "192.0.2.1"}, geoip.Unknown, geoip.Unknown},
+		{parser.Record{}, geoip.Unknown, geoip.Unknown},
+	} {
+		l.Enrich(tc.r)
+		if got := tc.r[geoip.CountryField]; got != tc.country {
+			t.Errorf("Expected country %s for %v, got %s", tc.country, tc.r, got)
+		}
+		if got := tc.r[geoip.ASNField]; got != tc.as {
+			t.Errorf("Expected ASN %s for %v, got %s", tc.as, tc.r, got)
+		}
+	}
+
+	l.SetCountries([]string{"is"})
+	r := parser.Record{"remote_addr": "198.51.100.1"}
+	l.Enrich(r)
+	if want, got := "IS", r[geoip.CountryField]; got != want {
+		t.Errorf("Expected country %s after SetCountries, got %s", want, got)
+	}
+	r = parser.Record{"remote_addr": "203.0.113.7"}
+	l.Enrich(r)
+	if want, got := geoip.Other, r[geoip.CountryField]; got != want {
+		t.Errorf("Expected country %s after SetCountries, got %s", want, got)
+	}
+
+	for _, tc := range []struct {
+		asns []string
+		want string
+	}{
+		{[]string{"64500"}, geoip.Other},
+		{[]string{"64500", "AS64496"}, "64496"},
+		{nil, "64496"},
+	} {
+		l.SetASNs(tc.asns)
+		r = parser.Record{"remote_addr": "203.0.113.7"}
+		l.Enrich(r)
+		if got := r[geoip.ASNField]; got != tc.want {
+			t.Errorf("Expected ASN %s after SetASNs(%v), got %s", tc.want, tc.asns, got)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	countryPath, _ := writeDatabases(t, dir)
+	l, err := geoip.NewLocator(countryPath, "")
+	if err != nil {
+		t.Fatalf("NewLocator failed with %v", err)
+	}
+	l.CheckPeriod = 0
+
+	lookup := func() string {
+		r := parser.Record{"remote_addr": "192.0.2.1"}
+		l.Enrich(r)
+		return r[geoip.CountryField]
+	}
+	if want, got := geoip.Unknown, lookup(); got != want {
+		t.Fatalf("Expected country %s before reload, got %s", want, got)
+	}
+
+	// An invalid file is ignored.
+	if err := ioutil.WriteFile(countryPath, []byte("invalid"), 0644); err != nil {
+		t.Fatalf("Could not write %s: %v", countryPath, err)
+	}
+	if want, got := geoip.Unknown, lookup(); got != want {
+		t.Fatalf("Expected country %s with an invalid file, got %s", want, got)
+	}
+
+	if err := ioutil.WriteFile(countryPath, buildDatabase(t, "GeoLite2-Country", []network{
+		{"192.0.2.0/24", country("FR")},
+	}), 0644); err != nil {
+		t.Fatalf("Could not write %s: %v", countryPath, err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(countryPath, later, later); err != nil {
+		t.Fatalf("Could not set modification time of %s: %v", countryPath, err)
+	}
+	if want, got := "FR", lookup(); got != want {
+		t.Errorf("Expected country %s after reload, got %s", want, got)
+	}
+}
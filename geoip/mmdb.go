@@ -0,0 +1,328 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// metadataMarker precedes the metadata section at the end of an MMDB file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data types of the MMDB data section.
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEnd       = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+// Database reads records from a MaxMind DB (MMDB) file, such as the GeoLite2
+// Country and ASN databases.
+type Database struct {
+	// Type is the database_type from the metadata (e.g.
+	// GeoLite2-Country).
+	Type string
+
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	// ipv4Start is the node reached by the 96 zero bits preceding IPv4
+	// addresses in an IPv6 tree.
+	ipv4Start uint
+}
+
+// Open reads the MMDB file at the supplied path.
+func Open(path string) (*Database, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := NewDatabase(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+// NewDatabase returns a Database reading from the supplied MMDB contents.
+func NewDatabase(b []byte) (*Database, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file: no metadata found")
+	}
+	start := i + len(metadataMarker)
+	v, _, err := (&decoder{buf: b[start:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata: expected a map, got %T", v)
+	}
+
+	db := &Database{buf: b[:i]}
+	db.Type, _ = m["database_type"].(string)
+	for name, dst := range map[string]*uint{
+		"node_count":  &db.nodeCount,
+		"record_size": &db.recordSize,
+		"ip_version":  &db.ipVersion,
+	} {
+		x, ok := m[name].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("invalid metadata: missing %s", name)
+		}
+		*dst = uint(x)
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	db.treeSize = db.nodeCount * db.recordSize / 4
+	if db.treeSize+16 > uint(len(db.buf)) {
+		return nil, fmt.Errorf("search tree exceeds file size")
+	}
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			if node, err = db.record(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// Lookup returns the record for the network containing the supplied address,
+// decoded as nested map[string]interface{} and []interface{} values holding
+// strings, bools, float64s, int64s, uint64s and []bytes. It returns nil if the
+// address is not found.
+func (db *Database) Lookup(ip net.IP) (interface{}, error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	ip = ip[len(ip)-bits/8:]
+
+	var err error
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		if node, err = db.record(node, bit); err != nil {
+			return nil, err
+		}
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16
+	d := &decoder{buf: db.buf[db.treeSize+16:]}
+	if offset >= uint(len(d.buf)) {
+		return nil, fmt.Errorf("invalid data offset %d", offset)
+	}
+	v, _, err := d.decode(offset)
+	return v, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of the supplied
+// node.
+func (db *Database) record(node, bit uint) (uint, error) {
+	size := db.recordSize / 4
+	off := node * size
+	if off+size > db.treeSize {
+		return 0, fmt.Errorf("invalid node %d", node)
+	}
+	b := db.buf[off : off+size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// decoder decodes values from an MMDB data section.
+type decoder struct {
+	buf []byte
+}
+
+// bytes returns the n bytes at the supplied offset.
+func (d *decoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, fmt.Errorf("unexpected end of data at offset %d", offset)
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// uintValue returns the big-endian unsigned integer held by b.
+func uintValue(b []byte) uint64 {
+	var x uint64
+	for _, c := range b {
+		x = x<<8 | uint64(c)
+	}
+	return x
+}
+
+// decode returns the value at the supplied offset, and the offset following
+// it.
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == typePointer {
+		n := uint(ctrl>>3)&3 + 1
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var target uint
+		switch n {
+		case 1:
+			target = uint(ctrl&7)<<8 | uint(b[0])
+		case 2:
+			target = (uint(ctrl&7)<<16 | uint(uintValue(b))) + 2048
+		case 3:
+			target = (uint(ctrl&7)<<24 | uint(uintValue(b))) + 526336
+		default:
+			target = uint(uintValue(b))
+		}
+		// Pointers may not refer to other pointers.
+		if t, err := d.bytes(target, 1); err != nil {
+			return nil, 0, err
+		} else if t[0]>>5 == typePointer {
+			return nil, 0, fmt.Errorf("pointer to pointer at offset %d", offset)
+		}
+		v, _, err := d.decode(target)
+		return v, offset + n, err
+	}
+
+	if typ == typeExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + uint(uintValue(b))
+		default:
+			size = 65821 + uint(uintValue(b))
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("invalid map key of type %T at offset %d", k, offset)
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeContainer, typeEnd:
+		return nil, offset, nil
+	}
+
+	b, err = d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		return uintValue(b), offset, nil
+	case typeInt32:
+		return int64(int32(uint32(uintValue(b)))), offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d at offset %d", typ, offset)
+	}
+}
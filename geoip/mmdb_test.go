@@ -0,0 +1,183 @@
+package geoip_test
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/swfrench/nginx-log-consumer/geoip"
+)
+
+// pointer is encoded as a pointer to the supplied data section offset.
+type pointer int
+
+// network is an entry in a database built by buildDatabase.
+type network struct {
+	cidr string
+	data interface{}
+}
+
+// encode appends the MMDB encoding of v (a string, unsigned integer, pointer
+// or map) to buf.
+func encode(buf *bytes.Buffer, v interface{}) {
+	control := func(typ, size int) {
+		var extra []byte
+		if size >= 29 {
+			extra, size = []byte{byte(size - 29)}, 29
+		}
+		if typ > 7 {
+			buf.WriteByte(byte(size))
+			buf.WriteByte(byte(typ - 7))
+		} else {
+			buf.WriteByte(byte(typ<<5 | size))
+		}
+		buf.Write(extra)
+	}
+	unsigned := func(typ int, x uint64) {
+		var b []byte
+		for ; x > 0; x >>= 8 {
+			b = append([]byte{byte(x)}, b...)
+		}
+		control(typ, len(b))
+		buf.Write(b)
+	}
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		unsigned(5, uint64(v))
+	case uint32:
+		unsigned(6, uint64(v))
+	case uint64:
+		unsigned(9, v)
+	case pointer:
+		buf.WriteByte(byte(1<<5 | (int(v)>>8)&7))
+		buf.WriteByte(byte(v))
+	case map[string]interface{}:
+		control(7, len(v))
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, v[k])
+		}
+	default:
+		panic("unsupported type")
+	}
+}
+
+// buildDatabase returns an IPv6 MMDB database (with IPv4 addresses at ::/96)
+// with 24-bit records, holding the supplied non-overlapping networks.
+func buildDatabase(t *testing.T, dbType string, networks []network) []byte {
+	type child struct {
+		node, data int
+	}
+	nodes := [][2]child{{{-1, -1}, {-1, -1}}}
+	var data bytes.Buffer
+	for _, n := range networks {
+		ip, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatalf("Invalid network %s: %v", n.cidr, err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip = ip.To16()
+		if ip.To4() != nil {
+			ip = append(make(net.IP, 12), ip.To4()...)
+			ones += 96
+		}
+		offset := data.Len()
+		encode(&data, n.data)
+
+		cur := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[cur][bit] = child{-1, offset}
+				break
+			}
+			if nodes[cur][bit].node < 0 {
+				nodes = append(nodes, [2]child{{-1, -1}, {-1, -1}})
+				nodes[cur][bit] = child{len(nodes) - 1, -1}
+			}
+			cur = nodes[cur][bit].node
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		for _, c := range n {
+			record := len(nodes)
+			if c.node >= 0 {
+				record = c.node
+			} else if c.data >= 0 {
+				record = len(nodes) + 16 + c.data
+			}
+			buf.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	encode(&buf, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"database_type":               dbType,
+		"ip_version":                  uint16(6),
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	})
+	return buf.Bytes()
+}
+
+func TestLookup(t *testing.T) {
+	us := map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}}
+	db, err := geoip.NewDatabase(buildDatabase(t, "Test-Country", []network{
+		{"203.0.113.0/24", us},
+		{"198.51.100.0/24", pointer(0)},
+		{"2001:db8::/32", map[string]interface{}{"asn": uint64(1) << 40}},
+	}))
+	if err != nil {
+		t.Fatalf("NewDatabase failed with %v", err)
+	}
+	if want, got := "Test-Country", db.Type; got != want {
+		t.Errorf("Expected database type %q, got %q", want, got)
+	}
+
+	for _, tc := range []struct {
+		addr string
+		want interface{}
+	}{
+		{"203.0.113.7", us},
+		{"198.51.100.200", us},
+		{"2001:db8::1", map[string]interface{}{"asn": uint64(1) << 40}},
+		{"192.0.2.1", nil},
+		{"2001:db9::1", nil},
+	} {
+		got, err := db.Lookup(net.ParseIP(tc.addr))
+		if err != nil {
+			t.Errorf("Lookup(%s) failed with %v", tc.addr, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("Expected Lookup(%s) to return %v, got %v", tc.addr, tc.want, got)
+		}
+	}
+}
+
+func TestNewDatabaseErrors(t *testing.T) {
+	valid := buildDatabase(t, "Test", []network{{"192.0.2.0/24", "x"}})
+	for name, b := range map[string][]byte{
+		"empty":     nil,
+		"truncated": valid[:len(valid)-4],
+		"no tree":   valid[bytes.LastIndex(valid, []byte("MaxMind.com"))-3:],
+	} {
+		if _, err := geoip.NewDatabase(b); err == nil {
+			t.Errorf("Expected NewDatabase to fail for %s database", name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package health
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/stats"
+)
+
+// Checker determines whether the consumer is making progress, based on the
+// events recorded in a stats.Registry: It is ready if the access log has been
+// read within MaxReadAge and, if timeseries writes have been failing, the last
+// successful write was within MaxWriteAge. Before the first of either event,
+// the time at which the Checker was created is used instead, so that a newly
+// started consumer is given time to make progress.
+type Checker struct {
+	stats *stats.Registry
+	start time.Time
+	// MaxReadAge is the longest acceptable period since the access log was
+	// last read.
+	MaxReadAge time.Duration
+	// MaxWriteAge is the longest acceptable period since the last
+	// successful write, while writes are failing. If writes are not
+	// failing (including if there has been nothing to write), it does not
+	// apply.
+	MaxWriteAge time.Duration
+}
+
+// NewChecker returns a Checker based on events recorded in the supplied
+// Registry.
+func NewChecker(r *stats.Registry, maxReadAge, maxWriteAge time.Duration) *Checker {
+	return &Checker{
+		stats:       r,
+		start:       time.Now(),
+		MaxReadAge:  maxReadAge,
+		MaxWriteAge: maxWriteAge,
+	}
+}
+
+// since returns the time of the latest occurrence of the supplied event, or
+// the start time if there has been none.
+func (c *Checker) since(event string) time.Time {
+	if t := c.stats.Last(event); !t.IsZero() {
+		return t
+	}
+	return c.start
+}
+
+// Check returns an error describing why the consumer is not ready as of the
+// supplied time, or nil if it is.
+func (c *Checker) Check(now time.Time) error {
+	if age := now.Sub(c.since(stats.EventRead)); age > c.MaxReadAge {
+		return fmt.Errorf("access log not read for %v (limit %v)", age.Truncate(time.Second), c.MaxReadAge)
+	}
+	failed := c.stats.Last(stats.EventWriteFailure)
+	if failed.IsZero() {
+		return nil
+	}
+	written := c.since(stats.EventWrite)
+	if age := now.Sub(written); failed.After(written) && age > c.MaxWriteAge {
+		return fmt.Errorf("no successful timeseries write for %v (limit %v); last failure at %v", age.Truncate(time.Second), c.MaxWriteAge, failed.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package health_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/health"
+	"github.com/swfrench/nginx-log-consumer/stats"
+)
+
+func TestCheck(t *testing.T) {
+	r := stats.New()
+	c := health.NewChecker(r, time.Minute, time.Hour)
+
+	// A new consumer is given MaxReadAge to read the log.
+	now := time.Now()
+	if err := c.Check(now); err != nil {
+		t.Errorf("Expected new consumer to be ready, got %v", err)
+	}
+	if err := c.Check(now.Add(2 * time.Minute)); err == nil {
+		t.Errorf("Expected consumer to be unready without reads")
+	}
+
+	r.Mark(stats.EventRead)
+	now = time.Now()
+	if err := c.Check(now.Add(30 * time.Second)); err != nil {
+		t.Errorf("Expected consumer to be ready after read, got %v", err)
+	}
+
+	// Write failures are tolerated for up to MaxWriteAge.
+	r.Mark(stats.EventWriteFailure)
+	c.MaxReadAge = 24 * time.Hour
+	if err := c.Check(now.Add(30 * time.Minute)); err != nil {
+		t.Errorf("Expected consumer to be ready with recent write failures, got %v", err)
+	}
+	if err := c.Check(now.Add(2 * time.Hour)); err == nil {
+		t.Errorf("Expected consumer to be unready with persistent write failures")
+	}
+
+	// But not once writes succeed again.
+	time.Sleep(time.Millisecond)
+	r.Mark(stats.EventWrite)
+	if err := c.Check(now.Add(2 * time.Hour)); err != nil {
+		t.Errorf("Expected consumer to be ready after successful write, got %v", err)
+	}
+}
@@ -1,132 +1,395 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"log/syslog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/swfrench/nginx-log-consumer/checkpoint"
 	"github.com/swfrench/nginx-log-consumer/consumer"
 	"github.com/swfrench/nginx-log-consumer/exporter"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/health"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/resource"
+	"github.com/swfrench/nginx-log-consumer/sdnotify"
+	"github.com/swfrench/nginx-log-consumer/stats"
 	"github.com/swfrench/nginx-log-consumer/tailer"
 
-	"cloud.google.com/go/compute/metadata"
-
-	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/monitoring/v3"
 )
 
-var (
-	accessLogPath = flag.String("access_log_path", "", "Path to access log file.")
+// getMetadata returns the project ID and monitored resource labels determined
+// by the configured metadata providers, with the default_* options supplying
+// any not determined.
+func getMetadata(ctx context.Context, o *options) (string, map[string]string, error) {
+	d, err := o.detector()
+	if err != nil {
+		return "", nil, err
+	}
+	m := d.Detect(ctx)
+
+	projectID := m.ProjectID
+	if projectID == "" {
+		projectID = o.defaultProjectID
+	}
+	if projectID == "" {
+		return "", nil, fmt.Errorf("project ID not supplied by metadata providers, and default_project_id is not set")
+	}
 
-	logPollingPeriod = flag.Duration("log_polling_period", 30*time.Second, "Period between checks for new log lines.")
+	defaults := map[string]string{
+		"instance_id": o.defaultInstanceName,
+		"zone":        o.defaultZoneName,
+	}
+	return projectID, resource.Merge(defaults, m.Labels), nil
+}
 
-	rotationCheckPeriod = flag.Duration("rotation_check_period", time.Minute, "Idle period between log rotation checks.")
+// getResource builds the MonitoredResource to which metrics are attributed,
+// with labels drawn from (in increasing order of precedence) the metadata
+// service or defaults, files in the downward API directory, environment
+// variables, the config file, and the resource_labels flag.
+func getResource(o *options, projectID string, metadataLabels map[string]string) *resource.Resource {
+	var dirLabels map[string]string
+	if o.downwardAPIDir != "" {
+		labels, err := resource.LabelsFromDir(o.downwardAPIDir, o.resourceType)
+		if err != nil {
+			log.Fatalf("Could not read resource labels from %s: %v", o.downwardAPIDir, err)
+		}
+		dirLabels = labels
+	}
 
-	useSyslog = flag.Bool("use_syslog", false, "If true, emit info logs to syslog.")
+	flagLabels, err := resource.ParseLabels(o.resourceLabels)
+	if err != nil {
+		log.Fatalf("Could not parse resource_labels: %v", err)
+	}
 
-	useMetadataService = flag.Bool("use_metadata_service", true, "If true, use the GCE instance metadata service to fetch project id, instance name, and zone name.")
+	r, err := resource.New(o.resourceType, projectID, resource.Merge(metadataLabels, dirLabels, resource.LabelsFromEnv(os.Environ()), o.configResourceLabels(), flagLabels))
+	if err != nil {
+		log.Fatalf("Could not determine monitored resource: %v", err)
+	}
+	return r
+}
 
-	defaultProjectID = flag.String("default_project_id", "", "Project ID to use when metadata service is disabled or OnGCE() returns false.")
+// newClient returns an HTTP client authorized for Cloud Monitoring, using the
+// service account key in credentialsFile if set, or application default
+// credentials otherwise.
+func newClient(ctx context.Context, credentialsFile string) (*http.Client, error) {
+	if credentialsFile == "" {
+		return google.DefaultClient(ctx, monitoring.MonitoringScope)
+	}
+	b, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := google.CredentialsFromJSON(ctx, b, monitoring.MonitoringScope)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
 
-	defaultInstanceName = flag.String("default_instance_name", "", "Instance name to use when metadata service is disabled or OnGCE() returns false.")
+// newMonitoringService returns a Cloud Monitoring API client using the
+// supplied HTTP client, and the supplied endpoint (if not empty) in place of
+// the default.
+func newMonitoringService(client *http.Client, endpoint string) (*monitoring.Service, error) {
+	service, err := monitoring.New(client)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint != "" {
+		if !strings.HasSuffix(endpoint, "/") {
+			endpoint += "/"
+		}
+		service.BasePath = endpoint
+	}
+	return service, nil
+}
 
-	defaultZoneName = flag.String("default_zone_name", "", "Zone name to use when metadata service is disabled or OnGCE() returns false.")
+// runWatchdog notifies the systemd watchdog every period, provided that the
+// supplied Checker reports the consumer ready. Otherwise, notifications are
+// withheld so that a stalled consumer is restarted.
+func runWatchdog(period time.Duration, checker *health.Checker) {
+	for now := range time.Tick(period) {
+		if err := checker.Check(now); err != nil {
+			log.Printf("Withholding watchdog notification: Consumer not ready: %v", err)
+			continue
+		}
+		if _, err := sdnotify.Notify(sdnotify.Watchdog); err != nil {
+			log.Printf("Could not notify systemd watchdog: %v", err)
+		}
+	}
+}
 
-	createCustomMetrics = flag.Bool("create_custom_metrics", false, "If true, attempt to create custom metrics before starting logs consumption.")
-)
+func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
 
-func getMetadata() (string, map[string]string) {
-	var projectID string
-	var resourceLabels map[string]string
+	o, err := loadOptions(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-	if metadata.OnGCE() && *useMetadataService {
-		// Get project, instance, zone from metadata.
-		id, err := metadata.ProjectID()
+	if o.useSyslog {
+		w, err := syslog.New(syslog.LOG_INFO, "nginx_log_consumer")
 		if err != nil {
-			log.Fatalf("Could not retrieve project ID from metadata service: %v", err)
+			log.Fatalf("Could not create syslog writer: %v", err)
 		}
+		log.SetOutput(w)
+	}
 
-		instance, err := metadata.InstanceName()
+	var state *checkpoint.State
+	if o.stateFile != "" {
+		s, err := checkpoint.Load(o.stateFile)
 		if err != nil {
-			log.Fatalf("Could not retrieve instance name from metadata service: %v", err)
+			log.Fatalf("Could not load state from %s: %v", o.stateFile, err)
+		}
+		state = s
+	}
+
+	var t *tailer.Tailer
+	if state != nil {
+		log.Printf("Resuming %s from saved position %v", o.accessLogPath, state.Position)
+		t, err = tailer.NewTailerAt(o.accessLogPath, o.rotationCheckPeriod, state.Position)
+	} else {
+		t, err = tailer.NewTailer(o.accessLogPath, o.rotationCheckPeriod)
+	}
+	if err != nil {
+		log.Fatalf("Could not create tailer for %s: %v", o.accessLogPath, err)
+	}
+
+	reg := stats.New()
+	t.SetStats(reg)
+
+	ctx := context.Background()
+
+	n, err := naming.New(o.metricDomain, o.metricPrefix)
+	if err != nil {
+		log.Fatalf("Invalid metric naming: %v", err)
+	}
+
+	specs := o.specs()
+
+	var client *http.Client
+	// Metrics attributed to the time of collection rather than to log
+	// timestamps: Those describing the consumer itself, the top values of
+	// exported heavy hitters, and SLO burn rates.
+	trackers := o.trackers()
+	objectives := o.objectives()
+	var selfSpecs []*metric.Spec
+	if o.exportSelfMetrics {
+		selfSpecs = stats.Specs()
+	}
+	for _, tr := range trackers {
+		if tr.Export {
+			selfSpecs = append(selfSpecs, tr.Spec())
 		}
+	}
+	for _, obj := range objectives {
+		selfSpecs = append(selfSpecs, obj.GaugeSpecs()...)
+	}
 
-		zone, err := metadata.Zone()
+	// cm and selfCM export metrics computed from logs and those attributed
+	// to the time of collection, respectively, which are kept separate.
+	var cm, selfCM *exporter.CloudMonitoringExporter
+	if !o.dryRun {
+		client, err = newClient(ctx, o.credentialsFile)
 		if err != nil {
-			log.Fatalf("Could not retrieve zone name from metadata service: %v", err)
+			log.Fatalf("Could not create Google API client: %v", err)
 		}
 
-		projectID = id
-		resourceLabels = map[string]string{
-			"instance_id": instance,
-			"zone":        zone,
+		monitoringService, err := newMonitoringService(client, o.monitoringEndpoint)
+		if err != nil {
+			log.Fatalf("Could not create Cloud Monitoring client: %v", err)
 		}
-	} else {
-		if *defaultProjectID == "" {
-			log.Fatalf("Metadata service is disabled or not available, but default_project_id is not set.")
+
+		projectID, metadataLabels, err := getMetadata(ctx, o)
+		if err != nil {
+			log.Fatalf("Could not determine metadata: %v", err)
 		}
-		if *defaultInstanceName == "" {
-			log.Fatalf("Metadata service is disabled or not available, but default_instance_name is not set.")
+
+		r := getResource(o, projectID, metadataLabels)
+
+		log.Printf("Creating GCM exporter for project %s; resource: %s %v", projectID, r.Type, r.Labels)
+
+		cm = exporter.NewCloudMonitoringExporter(projectID, r.Type, r.Labels, n, specs, monitoringService)
+		cm.SetStats(reg)
+
+		if state != nil {
+			log.Printf("Restoring cumulative values since %v", state.ResetTime)
+			cm.Restore(state.ResetTime, state.Values)
 		}
-		if *defaultZoneName == "" {
-			log.Fatalf("Metadata service is disabled or not available, but default_zone_name is not set.")
+
+		if o.createCustomMetrics {
+			if err := cm.EnsureMetrics(o.migrateCustomMetrics); err != nil {
+				log.Fatalf("Failed to ensure custom metrics: %v", err)
+			}
 		}
 
-		projectID = *defaultProjectID
-		resourceLabels = map[string]string{
-			"instance_id": *defaultInstanceName,
-			"zone":        *defaultZoneName,
+		if len(selfSpecs) > 0 {
+			selfCM = exporter.NewCloudMonitoringExporter(projectID, r.Type, r.Labels, n, selfSpecs, monitoringService)
+			selfCM.SetStats(reg)
+			if o.createCustomMetrics {
+				if err := selfCM.EnsureMetrics(o.migrateCustomMetrics); err != nil {
+					log.Fatalf("Failed to ensure self metrics: %v", err)
+				}
+			}
 		}
 	}
-	return projectID, resourceLabels
-}
 
-func main() {
-	flag.Parse()
+	var e, self exporter.ExporterT
+	if cm != nil {
+		e = cm
+	}
+	if selfCM != nil {
+		self = selfCM
+	}
+	if o.dryRun || o.jsonExportFile != "" {
+		path := o.jsonExportFile
+		if path == "" {
+			path = "-"
+		}
+		w := os.Stdout
+		if path != "-" {
+			w, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatalf("Could not open %s: %v", path, err)
+			}
+		}
+		log.Printf("Writing exported values as JSON to %s", path)
 
-	if *useSyslog {
-		w, err := syslog.New(syslog.LOG_INFO, "nginx_log_consumer")
-		if err != nil {
-			log.Fatalf("Could not create syslog writer: %v", err)
+		j := exporter.NewJSONExporter(w, n, specs)
+		if cm != nil {
+			// Report the same cumulative values as Cloud
+			// Monitoring.
+			j.Restore(cm.Snapshot())
+			e = exporter.NewMultiExporter(cm, j)
+		} else {
+			if state != nil {
+				j.Restore(state.ResetTime, state.Values)
+			}
+			e = j
 		}
-		log.SetOutput(w)
-	}
 
-	t, err := tailer.NewTailer(*accessLogPath, *rotationCheckPeriod)
-	if err != nil {
-		log.Fatalf("Could not create tailer for %s: %v", *accessLogPath, err)
+		if len(selfSpecs) > 0 {
+			js := exporter.NewJSONExporter(w, n, selfSpecs)
+			if selfCM != nil {
+				self = exporter.NewMultiExporter(selfCM, js)
+			} else {
+				self = js
+			}
+		}
 	}
 
-	ctx := context.Background()
-	client, err := google.DefaultClient(ctx, monitoring.MonitoringScope)
+	p, err := o.parser()
 	if err != nil {
-		log.Fatalf("Could not create Google API client: %v", err)
+		log.Fatalf("Could not create parser: %v", err)
 	}
 
-	monitoringService, err := monitoring.New(client)
-	if err != nil {
-		log.Fatalf("Could not create Cloud Monitoring client: %v", err)
+	c := consumer.NewConsumer(o.logPollingPeriod, t, e)
+	c.FlushPeriod = o.flushPeriod
+	c.StatePath = o.stateFile
+	c.ShutdownTimeout = o.shutdownTimeout
+	c.SetParser(p)
+	c.SetSpecs(specs)
+	c.SetStats(reg, self)
+	c.SetTrackers(trackers)
+	c.SetObjectives(objectives)
+	alerts := o.alerts()
+	c.SetAlerts(alerts)
+	if state != nil {
+		for _, obj := range objectives {
+			obj.Restore(state.SLOs[obj.Name])
+		}
 	}
 
-	projectID, resourceLabels := getMetadata()
+	if o.aggregationWindow > 0 {
+		c.EnableWindows(o.aggregationWindow, o.aggregationLateness)
+		if state != nil {
+			c.RestoreWindows(state.Windows)
+		}
+	} else if state != nil {
+		// Windowing has since been disabled: Export values from any
+		// windows left open by the previous process directly.
+		for _, w := range state.Windows {
+			w.Values.UpdateGauges()
+			if err := e.Export(w.Values, w.End); err != nil {
+				log.Fatalf("Could not restore windowed values: %v", err)
+			}
+		}
+	}
 
-	log.Printf("Creating GCM exporter for project %s; resource: %v", projectID, resourceLabels)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v; shutting down", sig)
+		if _, err := sdnotify.Notify(sdnotify.Stopping); err != nil {
+			log.Printf("Could not notify service manager: %v", err)
+		}
+		c.Stop()
+	}()
 
-	e := exporter.NewCloudMonitoringExporter(projectID, resourceLabels, monitoringService)
+	checker := health.NewChecker(reg, o.readyMaxReadAge, o.readyMaxWriteAge)
 
-	if *createCustomMetrics {
-		if err := e.CreateMetrics(); err != nil {
-			log.Fatalf("Failed to create custom metrics: %v", err)
+	if o.adminAddress != "" {
+		if err := serveAdmin(o.adminAddress, n, reg, checker, trackers); err != nil {
+			log.Fatalf("Could not start admin server on %s: %v", o.adminAddress, err)
 		}
+		log.Printf("Serving admin endpoints on %s", o.adminAddress)
 	}
 
-	c := consumer.NewConsumer(*logPollingPeriod, t, e)
+	rl := &reloader{
+		args:     os.Args[1:],
+		initial:  o,
+		current:  o,
+		client:   client,
+		tailer:   t,
+		consumer: c,
+		exporter: cm,
+		self:     selfCM,
+		stats:    reg,
+	}
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			rl.reload()
+		}
+	}()
+
+	log.Printf("Starting consumer for %s", o.accessLogPath)
 
-	log.Printf("Starting consumer for %s", *accessLogPath)
+	if _, err := sdnotify.Notify(sdnotify.Ready); err != nil {
+		log.Printf("Could not notify service manager: %v", err)
+	}
+	watchdog, err := sdnotify.WatchdogInterval()
+	if err != nil {
+		log.Printf("Systemd watchdog disabled: %v", err)
+	} else if watchdog > 0 {
+		log.Printf("Notifying systemd watchdog every %v while ready", watchdog/2)
+		go runWatchdog(watchdog/2, checker)
+	}
 
-	if err := c.Run(); err != nil {
+	if alerts != nil {
+		log.Printf("Evaluating %d alert rules every %v", len(alerts.Rules), alerts.EvaluationPeriod)
+		go alerts.Run(ctx)
+	}
+
+	if err := c.Run(ctx); err != nil {
 		log.Fatalf("Failure consuming logs: %v", err)
 	}
+
+	log.Printf("Consumer stopped")
 }
@@ -0,0 +1,154 @@
+package metric
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+// Condition tests the value of a record field. All of the tests set must
+// pass, and none pass if the field is missing.
+type Condition struct {
+	Field string
+	// Networks, if set, must include the value, an IP address (e.g.
+	// remote_addr).
+	Networks []*net.IPNet
+	// Pattern, if set, must match the value (e.g. a path or user agent).
+	Pattern *regexp.Regexp
+	// Equals, if set, must equal the value.
+	Equals *string
+	// LT, LE, GT and GE, if set, are compared with the value, which must be
+	// numeric (e.g. status or request_time).
+	LT, LE, GT, GE *float64
+}
+
+// Matches returns true if the Condition holds for the supplied record.
+func (c *Condition) Matches(r parser.Record) bool {
+	v, ok := r[c.Field]
+	if !ok {
+		return false
+	}
+	if len(c.Networks) > 0 {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return false
+		}
+		found := false
+		for _, n := range c.Networks {
+			found = found || n.Contains(ip)
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.Pattern != nil && !c.Pattern.MatchString(v) {
+		return false
+	}
+	if c.Equals != nil && v != *c.Equals {
+		return false
+	}
+	if c.LT != nil || c.LE != nil || c.GT != nil || c.GE != nil {
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		if (c.LT != nil && !(x < *c.LT)) ||
+			(c.LE != nil && !(x <= *c.LE)) ||
+			(c.GT != nil && !(x > *c.GT)) ||
+			(c.GE != nil && !(x >= *c.GE)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rule matches records for which all of its Conditions hold.
+type Rule []Condition
+
+// Matches returns true if all Conditions of the Rule hold for the supplied
+// record.
+func (rule Rule) Matches(r parser.Record) bool {
+	for i := range rule {
+		if !rule[i].Matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter selects the records observed by a metric: Those matching any Include
+// Rule (or all records, if there are none), except those matching any Exclude
+// Rule.
+type Filter struct {
+	Include []Rule
+	Exclude []Rule
+}
+
+// Matches returns true if the supplied record is selected by the Filter. A nil
+// Filter selects all records.
+func (f *Filter) Matches(r parser.Record) bool {
+	if f == nil {
+		return true
+	}
+	included := len(f.Include) == 0
+	for _, rule := range f.Include {
+		if rule.Matches(r) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, rule := range f.Exclude {
+		if rule.Matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fields returns the names of the record fields tested by the Filter, which
+// may be nil.
+func (f *Filter) Fields() []string {
+	if f == nil {
+		return nil
+	}
+	var fields []string
+	for _, rules := range [][]Rule{f.Include, f.Exclude} {
+		for _, rule := range rules {
+			for _, c := range rule {
+				fields = append(fields, c.Field)
+			}
+		}
+	}
+	return fields
+}
+
+// And returns a Filter selecting the records selected by both supplied
+// Filters, either of which may be nil.
+func And(a, b *Filter) *Filter {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	f := &Filter{}
+	switch {
+	case len(a.Include) == 0:
+		f.Include = append(f.Include, b.Include...)
+	case len(b.Include) == 0:
+		f.Include = append(f.Include, a.Include...)
+	default:
+		for _, ra := range a.Include {
+			for _, rb := range b.Include {
+				f.Include = append(f.Include, append(append(Rule{}, ra...), rb...))
+			}
+		}
+	}
+	f.Exclude = append(append(f.Exclude, a.Exclude...), b.Exclude...)
+	return f
+}
@@ -0,0 +1,114 @@
+package metric_test
+
+import (
+	"net"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+func TestFilter(t *testing.T) {
+	_, lb, err := net.ParseCIDR("35.191.0.0/16")
+	if err != nil {
+		t.Fatalf("ParseCIDR failed with %v", err)
+	}
+	healthz := "/healthz"
+	status := 500.0
+
+	// Exclude health checks from the load balancer, and only include
+	// errors.
+	f := &metric.Filter{
+		Include: []metric.Rule{
+			{{Field: "status", GE: &status}},
+		},
+		Exclude: []metric.Rule{
+			{
+				{Field: "remote_addr", Networks: []*net.IPNet{lb}},
+				{Field: "path", Equals: &healthz},
+				{Field: "http_user_agent", Pattern: regexp.MustCompile(`^GoogleHC`)},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		record parser.Record
+		want   bool
+	}{
+		{parser.Record{"status": "200", "remote_addr": "10.0.0.1"}, false},
+		{parser.Record{"status": "503", "remote_addr": "10.0.0.1"}, true},
+		{parser.Record{"status": "503", "remote_addr": "35.191.1.2", "path": "/healthz", "http_user_agent": "GoogleHC/1.0"}, false},
+		// All conditions of a rule must hold.
+		{parser.Record{"status": "503", "remote_addr": "35.191.1.2", "path": "/", "http_user_agent": "GoogleHC/1.0"}, true},
+		{parser.Record{"status": "503", "remote_addr": "10.0.0.1", "path": "/healthz", "http_user_agent": "GoogleHC/1.0"}, true},
+		// Missing or invalid fields do not match.
+		{parser.Record{"remote_addr": "10.0.0.1"}, false},
+		{parser.Record{"status": "-", "remote_addr": "10.0.0.1"}, false},
+		{parser.Record{"status": "503", "remote_addr": "unix:", "path": "/healthz", "http_user_agent": "GoogleHC/1.0"}, true},
+	} {
+		if got := f.Matches(tc.record); got != tc.want {
+			t.Errorf("Expected Matches(%v) to return %v, got %v", tc.record, tc.want, got)
+		}
+	}
+
+	var none *metric.Filter
+	if !none.Matches(parser.Record{}) {
+		t.Errorf("Expected nil Filter to match all records")
+	}
+}
+
+func TestAnd(t *testing.T) {
+	get, post, healthz := "GET", "POST", "/healthz"
+	errors, slow := 500.0, 1.0
+	methods := &metric.Filter{
+		Include: []metric.Rule{
+			{{Field: "request_method", Equals: &get}},
+			{{Field: "request_method", Equals: &post}},
+		},
+		Exclude: []metric.Rule{{{Field: "path", Equals: &healthz}}},
+	}
+	bad := &metric.Filter{
+		Include: []metric.Rule{
+			{{Field: "status", GE: &errors}},
+			{{Field: "request_time", GT: &slow}},
+		},
+	}
+
+	if metric.And(nil, methods) != methods || metric.And(methods, nil) != methods {
+		t.Errorf("Expected And with a nil Filter to return the other")
+	}
+
+	f := metric.And(methods, bad)
+	for _, tc := range []struct {
+		record parser.Record
+		want   bool
+	}{
+		{parser.Record{"request_method": "GET", "path": "/", "status": "503"}, true},
+		{parser.Record{"request_method": "POST", "path": "/", "status": "200", "request_time": "2"}, true},
+		{parser.Record{"request_method": "GET", "path": "/", "status": "200", "request_time": "0.1"}, false},
+		{parser.Record{"request_method": "HEAD", "path": "/", "status": "503"}, false},
+		{parser.Record{"request_method": "GET", "path": "/healthz", "status": "503"}, false},
+	} {
+		if got := f.Matches(tc.record); got != tc.want {
+			t.Errorf("Expected Matches(%v) to return %v, got %v", tc.record, tc.want, got)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	get, healthz := "GET", "/healthz"
+	f := &metric.Filter{
+		Include: []metric.Rule{{{Field: "request_method", Equals: &get}}},
+		Exclude: []metric.Rule{{{Field: "path", Equals: &healthz}}},
+	}
+	if got, want := f.Fields(), []string{"request_method", "path"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected Fields() to return %v, got %v", want, got)
+	}
+
+	var none *metric.Filter
+	if got := none.Fields(); got != nil {
+		t.Errorf("Expected nil Filter to test no fields, got %v", got)
+	}
+}
@@ -0,0 +1,299 @@
+package metric
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+// Kind identifies how a metric aggregates records.
+type Kind string
+
+const (
+	// Counter metrics count records (or sum an integer field) per set of
+	// label values.
+	Counter Kind = "counter"
+
+	// Distribution metrics record the distribution of a numeric field
+	// across explicit buckets per set of label values.
+	Distribution Kind = "distribution"
+
+	// Gauge metrics record an instantaneous value per set of label values
+	// (e.g. as computed by the consumer over a window, or describing the
+	// consumer itself). They are only computed from records if Unique is
+	// set.
+	Gauge Kind = "gauge"
+)
+
+// UniqueType is the metric type (in configuration) of unique metrics: Gauge
+// metrics with Unique set.
+const UniqueType = "unique"
+
+const (
+	// StringLabel labels may take any value.
+	StringLabel = "string"
+
+	// Int64Label labels must take integer values.
+	Int64Label = "int64"
+)
+
+// StatusCountMetric is the name of the default metric, counting HTTP responses
+// by status code.
+const StatusCountMetric = "http_response_count"
+
+// keySeparator separates label values in keys (see Key).
+const keySeparator = "\x1f"
+
+var nameRE = regexp.MustCompile(`^[a-z][a-z0-9_]*(/[a-z][a-z0-9_]*)*$`)
+var labelRE = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Label describes a metric label, whose values are taken from the named
+// record field.
+type Label struct {
+	Name        string
+	Field       string
+	Type        string
+	Description string
+}
+
+// Spec describes a metric computed from log records.
+type Spec struct {
+	Name        string
+	Kind        Kind
+	Description string
+	Unit        string
+	// Field names the record field whose (numeric) value is recorded by
+	// Distribution metrics. Counter metrics count records if Field is
+	// empty, and otherwise sum its (integer) value.
+	Field  string
+	Labels []Label
+	// Buckets holds the strictly increasing bucket bounds of Distribution
+	// metrics.
+	Buckets []float64
+	// Filter, if set, selects the records observed (see Matches).
+	Filter *Filter
+	// Unique, if set, makes a Gauge metric estimate the number of
+	// distinct values of a combination of fields.
+	Unique *Unique
+	// Mean, if set, makes a Gauge metric the mean of the (numeric) value of
+	// Field among the records observed, per window (e.g. an Apdex score,
+	// the mean of per-record scores).
+	Mean bool
+	// Transient, for Gauge metrics, makes each export replace all earlier
+	// values, rather than only those with the same labels (e.g. for labels
+	// whose values change over time, which would otherwise accumulate).
+	Transient bool
+}
+
+// Unique describes a Gauge metric estimating the number of distinct
+// combinations of values of Fields (e.g. remote_addr, or remote_addr and
+// http_user_agent) among the records observed, per window. Values are counted
+// using Sketches of the given Precision, so are never themselves held.
+type Unique struct {
+	Fields    []string
+	Precision uint8
+}
+
+// StatusCountSpec returns the Spec of the default metric, counting HTTP
+// responses by status code.
+func StatusCountSpec() *Spec {
+	return &Spec{
+		Name:        StatusCountMetric,
+		Kind:        Counter,
+		Description: "Cumulative count of HTTP responses by status code.",
+		Labels: []Label{
+			{
+				Name:        "response_code",
+				Field:       parser.StatusField,
+				Type:        Int64Label,
+				Description: "HTTP status code",
+			},
+		},
+	}
+}
+
+// DefaultSpecs returns the metrics computed when none are configured.
+func DefaultSpecs() []*Spec {
+	return []*Spec{StatusCountSpec()}
+}
+
+// ValidateName checks that the supplied name, which is used in metric names
+// (e.g. of a heavy hitter), consists of lower case letters, digits and
+// underscores.
+func ValidateName(name string) error {
+	if !labelRE.MatchString(name) {
+		return fmt.Errorf("invalid name %q: must consist of lower case letters, digits and underscores", name)
+	}
+	return nil
+}
+
+// Validate checks that the Spec is well formed.
+func (s *Spec) Validate() error {
+	if !nameRE.MatchString(s.Name) {
+		return fmt.Errorf("invalid metric name %q: must consist of lower case letters, digits and underscores, optionally separated by /", s.Name)
+	}
+	switch s.Kind {
+	case Counter:
+		if len(s.Buckets) > 0 {
+			return fmt.Errorf("buckets may only be set for distribution metrics")
+		}
+	case Distribution:
+		if s.Field == "" {
+			return fmt.Errorf("distribution metrics require a field")
+		}
+		if len(s.Buckets) == 0 {
+			return fmt.Errorf("distribution metrics require buckets")
+		}
+		for i := 1; i < len(s.Buckets); i++ {
+			if s.Buckets[i] <= s.Buckets[i-1] {
+				return fmt.Errorf("buckets must be strictly increasing")
+			}
+		}
+	case Gauge:
+		if s.Mean {
+			if s.Unique != nil || s.Field == "" || len(s.Buckets) > 0 {
+				return fmt.Errorf("mean metrics require a field, and no buckets")
+			}
+			break
+		}
+		if s.Unique == nil {
+			return fmt.Errorf("gauge metrics may not be computed from records, except as %s metrics", UniqueType)
+		}
+		if len(s.Unique.Fields) == 0 {
+			return fmt.Errorf("%s metrics require fields", UniqueType)
+		}
+		if s.Unique.Precision < MinPrecision || s.Unique.Precision > MaxPrecision {
+			return fmt.Errorf("precision must be between %d and %d", MinPrecision, MaxPrecision)
+		}
+		if s.Field != "" || len(s.Buckets) > 0 {
+			return fmt.Errorf("field and buckets may not be set for %s metrics", UniqueType)
+		}
+	default:
+		return fmt.Errorf("unknown metric type %q: must be %s, %s or %s", s.Kind, Counter, Distribution, UniqueType)
+	}
+	seen := make(map[string]bool)
+	for _, l := range s.Labels {
+		if !labelRE.MatchString(l.Name) {
+			return fmt.Errorf("invalid label name %q", l.Name)
+		}
+		if seen[l.Name] {
+			return fmt.Errorf("duplicate label %q", l.Name)
+		}
+		seen[l.Name] = true
+		if l.Field == "" {
+			return fmt.Errorf("label %s has no field", l.Name)
+		}
+		if l.Type != StringLabel && l.Type != Int64Label {
+			return fmt.Errorf("label %s has unknown type %q: must be %s or %s", l.Name, l.Type, StringLabel, Int64Label)
+		}
+	}
+	return nil
+}
+
+// labelValues returns the values of the Spec's labels for the supplied record,
+// or false if the record lacks a required field or has an invalid value for
+// an Int64Label.
+func (s *Spec) labelValues(r parser.Record) ([]string, bool) {
+	values := make([]string, len(s.Labels))
+	for i, l := range s.Labels {
+		v, ok := r[l.Field]
+		if !ok {
+			return nil, false
+		}
+		if l.Type == Int64Label {
+			if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, false
+			}
+		}
+		values[i] = v
+	}
+	return values, true
+}
+
+// Matches returns true if the supplied record is selected by the Spec's
+// Filter (if any), and so should be observed.
+func (s *Spec) Matches(r parser.Record) bool {
+	return s.Filter.Matches(r)
+}
+
+// Observe adds the contribution of the supplied record to values. Returns
+// false if the record could not be attributed (e.g. due to a missing or
+// invalid field). The Spec's Filter is not consulted (see Matches).
+func (s *Spec) Observe(r parser.Record, values *Values) bool {
+	labels, ok := s.labelValues(r)
+	if !ok {
+		return false
+	}
+	key := Key(labels)
+
+	switch s.Kind {
+	case Counter:
+		n := int64(1)
+		if s.Field != "" {
+			v, err := strconv.ParseInt(r[s.Field], 10, 64)
+			if err != nil {
+				return false
+			}
+			n = v
+		}
+		values.AddCount(s.Name, key, n)
+	case Distribution:
+		v, err := strconv.ParseFloat(r[s.Field], 64)
+		if err != nil {
+			return false
+		}
+		values.AddSample(s.Name, key, v, s.Buckets)
+	case Gauge:
+		if s.Mean {
+			v, err := strconv.ParseFloat(r[s.Field], 64)
+			if err != nil {
+				return false
+			}
+			values.AddMean(s.Name, key, v)
+			break
+		}
+		if s.Unique == nil {
+			return false
+		}
+		fields := make([]string, len(s.Unique.Fields))
+		for i, field := range s.Unique.Fields {
+			v, ok := r[field]
+			if !ok {
+				return false
+			}
+			fields[i] = v
+		}
+		values.AddUnique(s.Name, key, s.Unique.Precision, fields)
+	default:
+		return false
+	}
+	return true
+}
+
+// Key returns the key under which values are held for the supplied label
+// values (in the order of the Spec's labels). The key for a single label is
+// its value.
+func Key(labels []string) string {
+	return strings.Join(labels, keySeparator)
+}
+
+// SplitKey returns the label values making up the supplied key, given the
+// number of labels.
+func SplitKey(key string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.SplitN(key, keySeparator, n)
+}
+
+// LabelMap returns the labels making up the supplied key, keyed by label name.
+func (s *Spec) LabelMap(key string) map[string]string {
+	labels := make(map[string]string)
+	for i, v := range SplitKey(key, len(s.Labels)) {
+		labels[s.Labels[i].Name] = v
+	}
+	return labels
+}
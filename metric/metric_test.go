@@ -0,0 +1,287 @@
+package metric_test
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+func TestValidate(t *testing.T) {
+	if err := metric.StatusCountSpec().Validate(); err != nil {
+		t.Errorf("Expected default Spec to be valid, got %v", err)
+	}
+
+	for _, s := range []*metric.Spec{
+		{Name: "Bad-Name", Kind: metric.Counter},
+		{Name: "latency", Kind: "gauge"},
+		{Name: "clients", Kind: metric.Gauge, Unique: &metric.Unique{Precision: metric.DefaultPrecision}},
+		{Name: "clients", Kind: metric.Gauge, Unique: &metric.Unique{Fields: []string{"remote_addr"}, Precision: 20}},
+		{Name: "clients", Kind: metric.Gauge, Field: "remote_addr", Unique: &metric.Unique{Fields: []string{"remote_addr"}, Precision: metric.DefaultPrecision}},
+		{Name: "score", Kind: metric.Gauge, Mean: true},
+		{Name: "score", Kind: metric.Gauge, Field: "score", Mean: true, Buckets: []float64{1}},
+		{Name: "latency", Kind: metric.Distribution, Buckets: []float64{1}},
+		{Name: "latency", Kind: metric.Distribution, Field: "request_time"},
+		{Name: "latency", Kind: metric.Distribution, Field: "request_time", Buckets: []float64{1, 1}},
+		{Name: "count", Kind: metric.Counter, Buckets: []float64{1}},
+		{Name: "count", Kind: metric.Counter, Labels: []metric.Label{{Name: "method", Type: metric.StringLabel}}},
+		{Name: "count", Kind: metric.Counter, Labels: []metric.Label{{Name: "method", Field: "method", Type: "float"}}},
+		{Name: "count", Kind: metric.Counter, Labels: []metric.Label{
+			{Name: "method", Field: "method", Type: metric.StringLabel},
+			{Name: "method", Field: "request_method", Type: metric.StringLabel},
+		}},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("Expected Validate to fail for %+v, but it did not", s)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	if err := metric.ValidateName("error_paths"); err != nil {
+		t.Errorf("Expected error_paths to be valid, got %v", err)
+	}
+	for _, name := range []string{"", "Paths", "1paths", "error-paths", "error/paths"} {
+		if err := metric.ValidateName(name); err == nil {
+			t.Errorf("Expected ValidateName(%q) to fail, but it did not", name)
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	counter := &metric.Spec{
+		Name: "requests",
+		Kind: metric.Counter,
+		Labels: []metric.Label{
+			{Name: "method", Field: "method", Type: metric.StringLabel},
+			{Name: "response_code", Field: "status", Type: metric.Int64Label},
+		},
+	}
+	bytes := &metric.Spec{
+		Name:  "bytes",
+		Kind:  metric.Counter,
+		Field: "body_bytes_sent",
+	}
+	latency := &metric.Spec{
+		Name:    "latency",
+		Kind:    metric.Distribution,
+		Field:   "request_time",
+		Buckets: []float64{0.1, 1},
+	}
+
+	v := metric.NewValues()
+	for _, r := range []parser.Record{
+		{"method": "GET", "status": "200", "body_bytes_sent": "100", "request_time": "0.05"},
+		{"method": "GET", "status": "200", "body_bytes_sent": "50", "request_time": "0.5"},
+		{"method": "POST", "status": "500", "body_bytes_sent": "0", "request_time": "2"},
+	} {
+		for _, s := range []*metric.Spec{counter, bytes, latency} {
+			if !s.Observe(r, v) {
+				t.Errorf("Expected %s to observe %v", s.Name, r)
+			}
+		}
+	}
+
+	// Records lacking fields, or with invalid values, are not observed.
+	for _, r := range []parser.Record{
+		{"status": "200"},
+		{"method": "GET", "status": "-"},
+	} {
+		if counter.Observe(r, v) {
+			t.Errorf("Expected %s not to observe %v", counter.Name, r)
+		}
+	}
+
+	if want, got := map[string]int64{
+		metric.Key([]string{"GET", "200"}):  2,
+		metric.Key([]string{"POST", "500"}): 1,
+	}, v.Counters["requests"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected counts %v, got %v", want, got)
+	}
+
+	if want, got := map[string]int64{"": 150}, v.Counters["bytes"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected counts %v, got %v", want, got)
+	}
+
+	h := v.Distributions["latency"][""]
+	if want, got := []int64{1, 1, 1}, h.BucketCounts; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected bucket counts %v, got %v", want, got)
+	}
+
+	if want, got := map[string]string{"method": "GET", "response_code": "200"}, counter.LabelMap(metric.Key([]string{"GET", "200"})); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected labels %v, got %v", want, got)
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	bounds := []float64{1, 2, 4}
+	samples := []float64{0.5, 1, 1.5, 3, 3, 8, 0.25}
+
+	all := metric.NewHistogram(bounds)
+	a := metric.NewHistogram(bounds)
+	b := metric.NewHistogram(bounds)
+	for i, x := range samples {
+		all.Add(x, bounds)
+		if i < 3 {
+			a.Add(x, bounds)
+		} else {
+			b.Add(x, bounds)
+		}
+	}
+	a.Merge(b)
+
+	if want, got := all.BucketCounts, a.BucketCounts; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected bucket counts %v, got %v", want, got)
+	}
+	if want, got := all.Count, a.Count; want != got {
+		t.Errorf("Expected count %d, got %d", want, got)
+	}
+	if want, got := all.SumOfSquaredDeviation, a.SumOfSquaredDeviation; math.Abs(want-got) > 1e-9 {
+		t.Errorf("Expected sum of squared deviation %v, got %v", want, got)
+	}
+	if want, got := []int64{2, 2, 2, 1}, all.BucketCounts; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected bucket counts %v, got %v", want, got)
+	}
+}
+
+func TestValuesMerge(t *testing.T) {
+	v := metric.NewValues()
+	v.AddCount("lines", "", 1)
+	v.SetGauge("lag", "", 10)
+
+	o := metric.NewValues()
+	o.AddCount("lines", "", 2)
+	o.SetGauge("lag", "", 5)
+	v.Merge(o)
+
+	if want, got := int64(3), v.Counters["lines"][""]; want != got {
+		t.Errorf("Expected merged count %d, got %d", want, got)
+	}
+	if want, got := 5.0, v.Gauges["lag"][""]; want != got {
+		t.Errorf("Expected merged gauge %v, got %v", want, got)
+	}
+	if v.Empty() || !metric.NewValues().Empty() {
+		t.Errorf("Expected only new Values to be empty")
+	}
+}
+
+func TestObserveUnique(t *testing.T) {
+	s := &metric.Spec{
+		Name:   "clients",
+		Kind:   metric.Gauge,
+		Labels: []metric.Label{{Name: "host", Field: "host", Type: metric.StringLabel}},
+		Unique: &metric.Unique{
+			Fields:    []string{"remote_addr", "http_user_agent"},
+			Precision: metric.DefaultPrecision,
+		},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Expected Spec to be valid, got %v", err)
+	}
+
+	a, b := metric.NewValues(), metric.NewValues()
+	for i, r := range []parser.Record{
+		{"host": "a", "remote_addr": "192.0.2.1", "http_user_agent": "curl/8.4.0"},
+		{"host": "a", "remote_addr": "192.0.2.1", "http_user_agent": "curl/8.4.0"},
+		{"host": "a", "remote_addr": "192.0.2.1", "http_user_agent": "Mozilla/5.0"},
+		{"host": "a", "remote_addr": "192.0.2.2", "http_user_agent": "curl/8.4.0"},
+		{"host": "b", "remote_addr": "192.0.2.1", "http_user_agent": "curl/8.4.0"},
+	} {
+		v := a
+		if i%2 == 1 {
+			v = b
+		}
+		if !s.Observe(r, v) {
+			t.Errorf("Expected %v to be observed", r)
+		}
+	}
+	if s.Observe(parser.Record{"host": "a", "remote_addr": "192.0.2.3"}, a) {
+		t.Errorf("Expected record lacking a field not to be observed")
+	}
+
+	if got := a.Gauges["clients"]; got != nil {
+		t.Errorf("Expected no estimates before UpdateGauges, got %v", got)
+	}
+	a.UpdateGauges()
+	if want, got := map[string]float64{"a": 2, "b": 1}, a.Gauges["clients"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected estimates %v, got %v", want, got)
+	}
+	// Merging sketches updates the estimates, which are not simply
+	// replaced.
+	a.Merge(b)
+	a.UpdateGauges()
+	if want, got := map[string]float64{"a": 3, "b": 1}, a.Gauges["clients"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected merged estimates %v, got %v", want, got)
+	}
+	if want, got := a, a.Copy(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected copy %v, got %v", want, got)
+	}
+}
+
+func TestObserveMean(t *testing.T) {
+	s := &metric.Spec{
+		Name:   "score",
+		Kind:   metric.Gauge,
+		Field:  "score",
+		Labels: []metric.Label{{Name: "host", Field: "host", Type: metric.StringLabel}},
+		Mean:   true,
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Expected Spec to be valid, got %v", err)
+	}
+
+	a, b := metric.NewValues(), metric.NewValues()
+	for _, tc := range []struct {
+		values *metric.Values
+		record parser.Record
+	}{
+		{a, parser.Record{"host": "a", "score": "1"}},
+		{a, parser.Record{"host": "a", "score": "0.5"}},
+		{a, parser.Record{"host": "b", "score": "0"}},
+		{b, parser.Record{"host": "a", "score": "0"}},
+	} {
+		if !s.Observe(tc.record, tc.values) {
+			t.Errorf("Expected %v to be observed", tc.record)
+		}
+	}
+	if s.Observe(parser.Record{"host": "a", "score": "high"}, a) {
+		t.Errorf("Expected record with a non-numeric field not to be observed")
+	}
+
+	a.UpdateGauges()
+	if want, got := map[string]float64{"a": 0.75, "b": 0}, a.Gauges["score"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected means %v, got %v", want, got)
+	}
+	// Merging samples updates the means, which are not simply replaced.
+	a.Merge(b)
+	a.UpdateGauges()
+	if want, got := map[string]float64{"a": 0.5, "b": 0}, a.Gauges["score"]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected merged means %v, got %v", want, got)
+	}
+	if want, got := a, a.Copy(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected copy %v, got %v", want, got)
+	}
+}
+
+func BenchmarkObserveUnique(b *testing.B) {
+	s := &metric.Spec{
+		Name: "clients",
+		Kind: metric.Gauge,
+		Unique: &metric.Unique{
+			Fields:    []string{"remote_addr"},
+			Precision: metric.DefaultPrecision,
+		},
+	}
+	records := make([]parser.Record, 1024)
+	for i := range records {
+		records[i] = parser.Record{"remote_addr": fmt.Sprintf("192.0.%d.%d", i/256, i%256)}
+	}
+	values := metric.NewValues()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Observe(records[i%len(records)], values)
+	}
+}
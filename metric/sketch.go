@@ -0,0 +1,120 @@
+package metric
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// MinPrecision and MaxPrecision bound the precision of Sketches.
+	MinPrecision = 4
+	MaxPrecision = 16
+
+	// DefaultPrecision is the default precision of Sketches, using 16KiB
+	// per Sketch for a standard error of about 0.8%.
+	DefaultPrecision = 14
+)
+
+// Sketch is a HyperLogLog sketch, estimating the number of distinct values
+// added to it. It holds only a register (the maximum observed run of leading
+// zeros) for each of 2^Precision buckets of hashed values, never the values
+// themselves, and Sketches of the same precision may be merged losslessly. The
+// relative standard error of estimates is about 1.04/sqrt(2^Precision).
+type Sketch struct {
+	Precision uint8  `json:"precision"`
+	Registers []byte `json:"registers"`
+}
+
+// NewSketch returns an empty Sketch of the supplied precision (between
+// MinPrecision and MaxPrecision).
+func NewSketch(precision uint8) *Sketch {
+	return &Sketch{
+		Precision: precision,
+		Registers: make([]byte, 1<<precision),
+	}
+}
+
+// hash returns a 64-bit hash of the supplied values.
+func hash(values []string) uint64 {
+	h := fnv.New64a()
+	for i, v := range values {
+		if i > 0 {
+			h.Write([]byte(keySeparator))
+		}
+		h.Write([]byte(v))
+	}
+	// FNV mixes its final bytes poorly; apply the SplitMix64 finalizer so
+	// that both the bucket and the run of zeros are well distributed.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Add adds the combination of the supplied values.
+func (s *Sketch) Add(values ...string) {
+	x := hash(values)
+	i := x >> (64 - s.Precision)
+	// The rank of the first set bit of the remaining bits, bounded by a
+	// sentinel bit.
+	rank := byte(bits.LeadingZeros64(x<<s.Precision|1<<(s.Precision-1)) + 1)
+	if rank > s.Registers[i] {
+		s.Registers[i] = rank
+	}
+}
+
+// Merge adds the values added to o, which must have the same precision as s.
+// Returns false (leaving s unchanged) if it does not.
+func (s *Sketch) Merge(o *Sketch) bool {
+	if o.Precision != s.Precision || len(o.Registers) != len(s.Registers) {
+		return false
+	}
+	for i, r := range o.Registers {
+		if r > s.Registers[i] {
+			s.Registers[i] = r
+		}
+	}
+	return true
+}
+
+// Copy returns a deep copy of the Sketch.
+func (s *Sketch) Copy() *Sketch {
+	return &Sketch{
+		Precision: s.Precision,
+		Registers: append([]byte(nil), s.Registers...),
+	}
+}
+
+// Estimate returns the estimated number of distinct values added.
+func (s *Sketch) Estimate() float64 {
+	m := float64(len(s.Registers))
+	if m == 0 {
+		return 0
+	}
+	var alpha float64
+	switch len(s.Registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	sum, zeros := 0.0, 0
+	for _, r := range s.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := alpha * m * m / sum
+	// Linear counting is more accurate for small cardinalities.
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return e
+}
@@ -0,0 +1,81 @@
+package metric_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+)
+
+func TestSketchEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 10000, 200000} {
+		s := metric.NewSketch(metric.DefaultPrecision)
+		for i := 0; i < n; i++ {
+			// Repeated values are counted once.
+			s.Add(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+			s.Add(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+		}
+		// Allow four standard errors.
+		if got := s.Estimate(); math.Abs(got-float64(n)) > 4*0.0081*float64(n)+1 {
+			t.Errorf("Expected estimate of about %d, got %v", n, got)
+		}
+	}
+}
+
+func TestSketchCombination(t *testing.T) {
+	s := metric.NewSketch(metric.DefaultPrecision)
+	s.Add("192.0.2.1", "curl/8.4.0")
+	s.Add("192.0.2.1", "Mozilla/5.0")
+	s.Add("192.0.2.1", "curl/8.4.0")
+	if want, got := 2.0, math.Round(s.Estimate()); got != want {
+		t.Errorf("Expected %v distinct combinations, got %v", want, got)
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a, b, union := metric.NewSketch(10), metric.NewSketch(10), metric.NewSketch(10)
+	for i := 0; i < 3000; i++ {
+		v := fmt.Sprint(i)
+		if i < 2000 {
+			a.Add(v)
+		}
+		if i >= 1000 {
+			b.Add(v)
+		}
+		union.Add(v)
+	}
+
+	merged := a.Copy()
+	if !merged.Merge(b) {
+		t.Fatalf("Expected Merge to succeed")
+	}
+	if !reflect.DeepEqual(union, merged) {
+		t.Errorf("Expected merged sketch to match that of the union")
+	}
+	if a.Estimate() == merged.Estimate() {
+		t.Errorf("Expected Copy to be independent of the merged sketch")
+	}
+
+	if metric.NewSketch(12).Merge(a) {
+		t.Errorf("Expected Merge of sketches of differing precision to fail")
+	}
+}
+
+func TestSketchJSON(t *testing.T) {
+	s := metric.NewSketch(metric.MinPrecision)
+	s.Add("192.0.2.1")
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Marshal failed with %v", err)
+	}
+	var got metric.Sketch
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshal failed with %v", err)
+	}
+	if !reflect.DeepEqual(s, &got) {
+		t.Errorf("Expected %v after round trip, got %v", s, got)
+	}
+}
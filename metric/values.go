@@ -0,0 +1,266 @@
+package metric
+
+import (
+	"math"
+	"sort"
+)
+
+// Histogram summarizes samples of a Distribution metric. BucketCounts has one
+// more entry than the bucket bounds: Bucket i counts samples in
+// [bounds[i-1], bounds[i]), with the first and last buckets unbounded below
+// and above, respectively.
+type Histogram struct {
+	Count                 int64   `json:"count"`
+	Sum                   float64 `json:"sum"`
+	SumOfSquaredDeviation float64 `json:"sum_of_squared_deviation"`
+	BucketCounts          []int64 `json:"bucket_counts"`
+}
+
+// NewHistogram returns an empty Histogram for the supplied bucket bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		BucketCounts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Mean returns the mean of the recorded samples.
+func (h *Histogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / float64(h.Count)
+}
+
+// Add records a sample.
+func (h *Histogram) Add(v float64, bounds []float64) {
+	i := sort.Search(len(bounds), func(i int) bool {
+		return bounds[i] > v
+	})
+	// Welford's online update of the sum of squared deviations.
+	mean := h.Mean()
+	h.Count++
+	h.Sum += v
+	h.SumOfSquaredDeviation += (v - mean) * (v - h.Mean())
+	h.BucketCounts[i]++
+}
+
+// Merge adds the samples recorded in o, which must share the same bucket
+// bounds.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.Count == 0 {
+		return
+	}
+	if h.Count == 0 {
+		h.SumOfSquaredDeviation = o.SumOfSquaredDeviation
+	} else {
+		// Chan et al.'s pairwise combination.
+		delta := o.Mean() - h.Mean()
+		n := float64(h.Count + o.Count)
+		h.SumOfSquaredDeviation += o.SumOfSquaredDeviation + delta*delta*float64(h.Count)*float64(o.Count)/n
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	if len(h.BucketCounts) < len(o.BucketCounts) {
+		counts := make([]int64, len(o.BucketCounts))
+		copy(counts, h.BucketCounts)
+		h.BucketCounts = counts
+	}
+	for i, c := range o.BucketCounts {
+		h.BucketCounts[i] += c
+	}
+}
+
+// Copy returns a deep copy of the Histogram.
+func (h *Histogram) Copy() *Histogram {
+	c := *h
+	c.BucketCounts = append([]int64(nil), h.BucketCounts...)
+	return &c
+}
+
+// Values holds the values of counter and distribution metrics, keyed by metric
+// name and then by label values (see Key). It is used both for deltas
+// (e.g. accumulated over an event-time window) and cumulative values.
+type Values struct {
+	Counters      map[string]map[string]int64      `json:"counters,omitempty"`
+	Distributions map[string]map[string]*Histogram `json:"distributions,omitempty"`
+	// Gauges hold the latest value of Gauge metrics, which replace (rather
+	// than add to) earlier values on Merge.
+	Gauges map[string]map[string]float64 `json:"gauges,omitempty"`
+	// Sketches hold the state of unique metrics (see Unique), from which
+	// their gauges are estimated by UpdateGauges. They are merged on Merge.
+	Sketches map[string]map[string]*Sketch `json:"sketches,omitempty"`
+	// Means hold the samples of mean metrics (see Spec.Mean), from which
+	// their gauges are computed by UpdateGauges. They are merged on Merge.
+	Means map[string]map[string]*Histogram `json:"means,omitempty"`
+}
+
+// NewValues returns empty Values.
+func NewValues() *Values {
+	return &Values{
+		Counters:      make(map[string]map[string]int64),
+		Distributions: make(map[string]map[string]*Histogram),
+	}
+}
+
+// AddCount adds n to the named counter for the supplied key.
+func (v *Values) AddCount(name, key string, n int64) {
+	if v.Counters == nil {
+		v.Counters = make(map[string]map[string]int64)
+	}
+	counts, ok := v.Counters[name]
+	if !ok {
+		counts = make(map[string]int64)
+		v.Counters[name] = counts
+	}
+	counts[key] += n
+}
+
+// AddSample records a sample in the named distribution for the supplied key.
+func (v *Values) AddSample(name, key string, x float64, bounds []float64) {
+	h := v.histogram(name, key, len(bounds))
+	h.Add(x, bounds)
+}
+
+// SetGauge sets the named gauge to x for the supplied key.
+func (v *Values) SetGauge(name, key string, x float64) {
+	if v.Gauges == nil {
+		v.Gauges = make(map[string]map[string]float64)
+	}
+	gauges, ok := v.Gauges[name]
+	if !ok {
+		gauges = make(map[string]float64)
+		v.Gauges[name] = gauges
+	}
+	gauges[key] = x
+}
+
+// AddUnique adds the combination of the supplied field values to the named
+// unique metric's Sketch (of the specified precision) for the supplied key.
+// Its gauge is not updated until UpdateGauges is called.
+func (v *Values) AddUnique(name, key string, precision uint8, values []string) {
+	v.sketch(name, key, precision).Add(values...)
+}
+
+// AddMean records a sample of the named mean metric for the supplied key. Its
+// gauge is not updated until UpdateGauges is called.
+func (v *Values) AddMean(name, key string, x float64) {
+	v.mean(name, key).Add(x, nil)
+}
+
+// UpdateGauges sets the gauges of unique and mean metrics from their Sketches
+// and Means. Estimating a gauge scans its whole Sketch, so this is done once
+// values are complete (e.g. when a window closes), rather than per record.
+func (v *Values) UpdateGauges() {
+	for name, sketches := range v.Sketches {
+		for key, s := range sketches {
+			v.SetGauge(name, key, math.Round(s.Estimate()))
+		}
+	}
+	for name, hs := range v.Means {
+		for key, h := range hs {
+			v.SetGauge(name, key, h.Mean())
+		}
+	}
+}
+
+// mean returns the Histogram (without buckets) holding the samples of the
+// named mean metric for the supplied key, creating it if missing.
+func (v *Values) mean(name, key string) *Histogram {
+	if v.Means == nil {
+		v.Means = make(map[string]map[string]*Histogram)
+	}
+	hs, ok := v.Means[name]
+	if !ok {
+		hs = make(map[string]*Histogram)
+		v.Means[name] = hs
+	}
+	h, ok := hs[key]
+	if !ok {
+		h = NewHistogram(nil)
+		hs[key] = h
+	}
+	return h
+}
+
+// sketch returns the named unique metric's Sketch for the supplied key,
+// creating it (with the specified precision) if missing. An existing Sketch
+// of a different precision (e.g. restored from a checkpoint written with
+// other settings) is replaced.
+func (v *Values) sketch(name, key string, precision uint8) *Sketch {
+	if v.Sketches == nil {
+		v.Sketches = make(map[string]map[string]*Sketch)
+	}
+	sketches, ok := v.Sketches[name]
+	if !ok {
+		sketches = make(map[string]*Sketch)
+		v.Sketches[name] = sketches
+	}
+	s, ok := sketches[key]
+	if !ok || s.Precision != precision {
+		s = NewSketch(precision)
+		sketches[key] = s
+	}
+	return s
+}
+
+// histogram returns the named distribution's Histogram for the supplied key,
+// creating it (with the specified number of bounds) if missing.
+func (v *Values) histogram(name, key string, bounds int) *Histogram {
+	if v.Distributions == nil {
+		v.Distributions = make(map[string]map[string]*Histogram)
+	}
+	hs, ok := v.Distributions[name]
+	if !ok {
+		hs = make(map[string]*Histogram)
+		v.Distributions[name] = hs
+	}
+	h, ok := hs[key]
+	if !ok {
+		h = &Histogram{BucketCounts: make([]int64, bounds+1)}
+		hs[key] = h
+	}
+	return h
+}
+
+// Merge adds o to v. Gauges in o replace those in v, including those of unique
+// and mean metrics, whose merged Sketches and Means are only reflected in
+// their gauges once UpdateGauges is called.
+func (v *Values) Merge(o *Values) {
+	for name, counts := range o.Counters {
+		for key, n := range counts {
+			v.AddCount(name, key, n)
+		}
+	}
+	for name, hs := range o.Distributions {
+		for key, h := range hs {
+			v.histogram(name, key, len(h.BucketCounts)-1).Merge(h)
+		}
+	}
+	for name, gauges := range o.Gauges {
+		for key, x := range gauges {
+			v.SetGauge(name, key, x)
+		}
+	}
+	for name, sketches := range o.Sketches {
+		for key, s := range sketches {
+			v.sketch(name, key, s.Precision).Merge(s)
+		}
+	}
+	for name, hs := range o.Means {
+		for key, h := range hs {
+			v.mean(name, key).Merge(h)
+		}
+	}
+}
+
+// Copy returns a deep copy of v.
+func (v *Values) Copy() *Values {
+	c := NewValues()
+	c.Merge(v)
+	return c
+}
+
+// Empty returns true if v holds no values.
+func (v *Values) Empty() bool {
+	return len(v.Counters) == 0 && len(v.Distributions) == 0 && len(v.Gauges) == 0 && len(v.Sketches) == 0 && len(v.Means) == 0
+}
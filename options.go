@@ -0,0 +1,522 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/alert"
+	"github.com/swfrench/nginx-log-consumer/apdex"
+	"github.com/swfrench/nginx-log-consumer/cache"
+	"github.com/swfrench/nginx-log-consumer/config"
+	"github.com/swfrench/nginx-log-consumer/consumer"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/geoip"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/resource"
+	"github.com/swfrench/nginx-log-consumer/resource/detect"
+	"github.com/swfrench/nginx-log-consumer/slo"
+	"github.com/swfrench/nginx-log-consumer/topk"
+	"github.com/swfrench/nginx-log-consumer/useragent"
+)
+
+// options holds all settings, supplied as command-line flags or read from the
+// config file.
+type options struct {
+	configFile string
+
+	// config holds settings read from configFile, if set.
+	config *config.Config
+
+	// flags holds the FlagSet from which options were parsed, reflecting
+	// the resolved value of each setting.
+	flags *flag.FlagSet
+
+	// args holds any arguments remaining after flags.
+	args []string
+
+	accessLogPath string
+
+	logPollingPeriod time.Duration
+
+	aggregationWindow time.Duration
+
+	aggregationLateness time.Duration
+
+	shutdownTimeout time.Duration
+
+	flushPeriod time.Duration
+
+	rotationCheckPeriod time.Duration
+
+	useSyslog bool
+
+	useMetadataService bool
+
+	metadataProviders string
+
+	metadataTimeout time.Duration
+
+	metadataFile string
+
+	metadataCacheFile string
+
+	defaultProjectID string
+
+	defaultInstanceName string
+
+	defaultZoneName string
+
+	resourceType string
+
+	resourceLabels string
+
+	downwardAPIDir string
+
+	stateFile string
+
+	metricDomain string
+
+	metricPrefix string
+
+	monitoringEndpoint string
+
+	credentialsFile string
+
+	createCustomMetrics bool
+
+	migrateCustomMetrics bool
+
+	jsonExportFile string
+
+	dryRun bool
+
+	exportSelfMetrics bool
+
+	adminAddress string
+
+	readyMaxReadAge time.Duration
+
+	readyMaxWriteAge time.Duration
+
+	userAgentField string
+
+	userAgentPatternsFile string
+
+	geoipCountryDatabase string
+
+	geoipASNDatabase string
+
+	geoipCountries string
+
+	geoipASNs string
+
+	trustedProxies string
+}
+
+// newFlagSet returns a FlagSet which will populate the supplied options.
+func newFlagSet(o *options, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+
+	fs.StringVar(&o.configFile, "config_file", "", "If set, path to a YAML configuration file (see README.md). Flags given on the command line take precedence over settings in the file. The file is re-read on SIGHUP.")
+
+	fs.StringVar(&o.accessLogPath, "access_log_path", "", "Path to access log file.")
+
+	fs.DurationVar(&o.logPollingPeriod, "log_polling_period", 30*time.Second, "Period between checks for new log lines.")
+
+	fs.DurationVar(&o.aggregationWindow, "aggregation_window", time.Minute, "Size of the aligned event-time windows into which log lines are aggregated by timestamp. If zero, counts are instead attributed to the time at which they are read.")
+
+	fs.DurationVar(&o.aggregationLateness, "aggregation_lateness", time.Minute, "Time after the end of an event-time window for which late log lines are accepted before the window is exported. Must exceed log_polling_period.")
+
+	fs.DurationVar(&o.shutdownTimeout, "shutdown_timeout", consumer.DefaultShutdownTimeout, "Deadline for the final flush of metrics on SIGTERM / SIGINT.")
+
+	fs.DurationVar(&o.flushPeriod, "flush_period", time.Minute, "Period between writes of accumulated metrics. Writes to Cloud Monitoring are additionally limited to at most one point per timeseries every 10s.")
+
+	fs.DurationVar(&o.rotationCheckPeriod, "rotation_check_period", time.Minute, "Idle period between log rotation checks.")
+
+	fs.BoolVar(&o.useSyslog, "use_syslog", false, "If true, emit info logs to syslog.")
+
+	fs.BoolVar(&o.useMetadataService, "use_metadata_service", true, "If false, metadata_providers are not consulted.")
+
+	fs.StringVar(&o.metadataProviders, "metadata_providers", "gce", "Comma-separated metadata providers from which the project ID and monitored resource labels are determined, in order of precedence: Any of gce, aws, azure, kubernetes and file (see README.md).")
+
+	fs.DurationVar(&o.metadataTimeout, "metadata_timeout", detect.DefaultTimeout, "Deadline for each metadata provider.")
+
+	fs.StringVar(&o.metadataFile, "metadata_file", "", "Path to a YAML file supplying project_id and labels, for the file metadata provider.")
+
+	fs.StringVar(&o.metadataCacheFile, "metadata_cache_file", "", "If set, path to a file in which metadata is saved once determined, and from which it is read if no metadata provider is available (e.g. if a metadata service is unavailable on restart).")
+
+	fs.StringVar(&o.defaultProjectID, "default_project_id", "", "Project ID to use when not supplied by metadata providers.")
+
+	fs.StringVar(&o.defaultInstanceName, "default_instance_name", "", "Instance name (instance_id label) to use when not supplied by metadata providers.")
+
+	fs.StringVar(&o.defaultZoneName, "default_zone_name", "", "Zone name (zone label) to use when not supplied by metadata providers.")
+
+	fs.StringVar(&o.resourceType, "resource_type", resource.DefaultType, "Monitored resource type to which metrics are attributed: One of gce_instance, k8s_container, k8s_pod, generic_node, or generic_task.")
+
+	fs.StringVar(&o.resourceLabels, "resource_labels", "", "Comma-separated key=value monitored resource labels (e.g. location=us-east1,namespace=edge). Overrides labels from the metadata service, downward_api_dir, NGINX_LOG_CONSUMER_<LABEL> environment variables, and the config file.")
+
+	fs.StringVar(&o.downwardAPIDir, "downward_api_dir", "", "If set, directory (e.g. a Kubernetes downward API volume) containing files named after monitored resource labels, whose contents supply label values.")
+
+	fs.StringVar(&o.stateFile, "state_file", "", "If set, path to a file in which cumulative metric values and the log read position are persisted, so that metrics are not reset on restart.")
+
+	fs.StringVar(&o.metricDomain, "metric_domain", naming.CustomDomain, "Domain of exported metric types: custom.googleapis.com or workload.googleapis.com.")
+
+	fs.StringVar(&o.metricPrefix, "metric_prefix", "", "Prefix for exported metric names (e.g. nginx/edge/), distinguishing metrics written by differently configured consumers in the same project.")
+
+	fs.StringVar(&o.monitoringEndpoint, "monitoring_endpoint", "", "If set, base URL of the Cloud Monitoring API (e.g. a regional or private endpoint) to use in place of the default.")
+
+	fs.StringVar(&o.credentialsFile, "credentials_file", "", "If set, path to a service account key file used to authenticate to Cloud Monitoring in place of application default credentials.")
+
+	fs.BoolVar(&o.createCustomMetrics, "create_custom_metrics", true, "If true, ensure custom metrics exist (creating any that are missing) and match their expected definitions before starting logs consumption.")
+
+	fs.BoolVar(&o.migrateCustomMetrics, "migrate_custom_metrics", false, "If true, custom metrics whose existing definitions do not match those expected are deleted and recreated, discarding existing data. Otherwise, such a mismatch is a fatal error.")
+
+	fs.StringVar(&o.jsonExportFile, "json_export_file", "", "If set, path to a file (or - for stdout) to which exported metric values are additionally written as JSON lines, for debugging.")
+
+	fs.BoolVar(&o.dryRun, "dry_run", false, "If true, do not write to Cloud Monitoring: Metric values are instead only written as JSON lines to json_export_file (stdout by default).")
+
+	fs.BoolVar(&o.exportSelfMetrics, "export_self_metrics", false, "If true, additionally export metrics describing the consumer itself (lines read, parse errors, write failures, etc.; see README.md) under agent/.")
+
+	fs.StringVar(&o.adminAddress, "admin_address", "", "If set, address (e.g. localhost:9145) on which to serve metrics describing the consumer itself at /metrics, in the OpenMetrics text format, and health checks at /healthz and /readyz.")
+
+	fs.DurationVar(&o.readyMaxReadAge, "ready_max_read_age", 5*time.Minute, "The consumer is reported unready (at /readyz, and to the systemd watchdog) if the access log has not been read for this long. Must exceed log_polling_period.")
+
+	fs.DurationVar(&o.readyMaxWriteAge, "ready_max_write_age", 15*time.Minute, "The consumer is reported unready (at /readyz, and to the systemd watchdog) if writes to Cloud Monitoring have been failing, and none has succeeded, for this long.")
+
+	fs.StringVar(&o.userAgentField, "user_agent_field", useragent.DefaultField, "Name of the field holding the user agent, from which the client_class field is derived when used by a metric (see README.md).")
+
+	fs.StringVar(&o.userAgentPatternsFile, "user_agent_patterns_file", "", "If set, path to a file of user agent patterns used to derive the client_class field, in place of the bundled patterns.")
+
+	fs.StringVar(&o.geoipCountryDatabase, "geoip_country_database", "", "Path to a MaxMind DB file (e.g. GeoLite2-Country.mmdb) from which the client_country field is derived when used by a metric (see README.md). The file is re-read when it changes.")
+
+	fs.StringVar(&o.geoipASNDatabase, "geoip_asn_database", "", "Path to a MaxMind DB file (e.g. GeoLite2-ASN.mmdb) from which the client_asn field is derived when used by a metric. The file is re-read when it changes.")
+
+	fs.StringVar(&o.geoipCountries, "geoip_countries", strings.Join(geoip.DefaultCountries, ","), "Comma-separated ISO 3166-1 codes of the countries reported in the client_country field, bounding its cardinality: Clients elsewhere are reported as other.")
+
+	fs.StringVar(&o.geoipASNs, "geoip_asns", "", "Comma-separated autonomous system numbers reported in the client_asn field, bounding its cardinality: Clients of others are reported as other. Must be set to use client_asn as a metric label; otherwise all are reported, for use in filter rules.")
+
+	fs.StringVar(&o.trustedProxies, "trusted_proxies", "", "Comma-separated networks (or addresses) of trusted proxies: For requests from these, the client address used to derive client_country and client_asn is taken from X-Forwarded-For (the http_x_forwarded_for field).")
+
+	return fs
+}
+
+// loadOptions parses options from the supplied command-line arguments (see
+// parseOptions) and validates them. Errors in options read from a config file
+// name the file.
+func loadOptions(args []string, errorHandling flag.ErrorHandling) (*options, error) {
+	o, err := parseOptions(args, errorHandling)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.validate(); err != nil {
+		if o.configFile != "" {
+			return nil, fmt.Errorf("%s: %v", o.configFile, err)
+		}
+		return nil, err
+	}
+	return o, nil
+}
+
+// parseOptions parses options from the supplied command-line arguments. If
+// config_file is set, settings are read from that file, with any flags given
+// on the command line taking precedence. Any extra functions are called to
+// register additional flags (e.g. those specific to a subcommand).
+func parseOptions(args []string, errorHandling flag.ErrorHandling, extra ...func(*flag.FlagSet)) (*options, error) {
+	o := &options{}
+	fs := newFlagSet(o, errorHandling)
+	for _, f := range extra {
+		f(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	o.flags = fs
+	o.args = fs.Args()
+
+	if path := o.configFile; path != "" {
+		c, err := config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		o.config = c
+
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+		for name, value := range c.Flags() {
+			if set[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return nil, fmt.Errorf("%s: invalid value %q for %s: %v", path, value, name, err)
+			}
+		}
+	}
+
+	return o, nil
+}
+
+// equal returns true if the settings held by o and other are equal.
+func (o *options) equal(other *options) bool {
+	a, b := *o, *other
+	a.flags, b.flags = nil, nil
+	a.args, b.args = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// usedFields returns the set of record fields used by the metrics computed
+// from log lines, by the heavy hitters tracked, by the SLOs, by alert rules and
+// by Apdex routes.
+func (o *options) usedFields() map[string]bool {
+	used := make(map[string]bool)
+	for _, field := range specFields(o.specs()) {
+		used[field] = true
+	}
+	for _, t := range o.trackers() {
+		used[t.Field] = true
+		for _, field := range t.Filter.Fields() {
+			used[field] = true
+		}
+	}
+	for _, obj := range o.objectives() {
+		for _, field := range append(obj.Filter.Fields(), obj.Good.Fields()...) {
+			used[field] = true
+		}
+	}
+	if m := o.alerts(); m != nil {
+		for _, r := range m.Rules {
+			if r.Field != "" {
+				used[r.Field] = true
+			}
+			for _, field := range append(r.Filter.Fields(), r.Match.Fields()...) {
+				used[field] = true
+			}
+		}
+	}
+	if o.config != nil {
+		if s := o.config.ApdexScorer(); s != nil {
+			for _, r := range s.Routes {
+				for _, field := range r.Filter.Fields() {
+					used[field] = true
+				}
+			}
+		}
+	}
+	return used
+}
+
+// parser returns the Parser for log lines, deriving the fields used by the
+// metrics computed (see newParser).
+func (o *options) parser() (*parser.Parser, error) {
+	return o.newParser(o.usedFields())
+}
+
+// newParser returns the Parser for log lines, which classifies user agents if
+// the client_class field is used, locates clients if the client_country or
+// client_asn fields are, classifies cache statuses if the cache_status or
+// cache_source fields are, and scores responses if the apdex_* fields are.
+func (o *options) newParser(used map[string]bool) (*parser.Parser, error) {
+	p := parser.Default()
+	if o.config != nil {
+		p = o.config.Parser()
+	}
+
+	if used[useragent.ClassField] {
+		c := useragent.Default()
+		if o.userAgentPatternsFile != "" {
+			var err error
+			if c, err = useragent.Load(o.userAgentPatternsFile); err != nil {
+				return nil, err
+			}
+		}
+		c.Field = o.userAgentField
+		p.AddEnricher(c)
+	}
+
+	if used[geoip.CountryField] || used[geoip.ASNField] {
+		if used[geoip.CountryField] && o.geoipCountryDatabase == "" {
+			return nil, fmt.Errorf("geoip_country_database must be set to use the %s field", geoip.CountryField)
+		}
+		if used[geoip.ASNField] && o.geoipASNDatabase == "" {
+			return nil, fmt.Errorf("geoip_asn_database must be set to use the %s field", geoip.ASNField)
+		}
+		proxies, err := geoip.ParseNetworks(splitList(o.trustedProxies))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies: %v", err)
+		}
+		l, err := geoip.NewLocator(o.geoipCountryDatabase, o.geoipASNDatabase)
+		if err != nil {
+			return nil, err
+		}
+		l.TrustedProxies = proxies
+		l.SetCountries(splitList(o.geoipCountries))
+		l.SetASNs(splitList(o.geoipASNs))
+		p.AddEnricher(l)
+	}
+
+	// Cache statuses are classified before responses are scored, so that
+	// Apdex routes may match them.
+	if used[cache.CacheStatusField] || used[cache.SourceField] {
+		p.AddEnricher(cache.Classifier{})
+	}
+
+	if used[apdex.RouteField] || used[apdex.LevelField] || used[apdex.ScoreField] {
+		var s *apdex.Scorer
+		if o.config != nil {
+			s = o.config.ApdexScorer()
+		}
+		if s == nil {
+			s = apdex.NewScorer(nil)
+		}
+		p.AddEnricher(s)
+	}
+
+	return p, nil
+}
+
+// splitList returns the non-empty elements of the supplied comma-separated
+// list.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// specs returns the Specs of metrics computed from log lines.
+func (o *options) specs() []*metric.Spec {
+	if o.config == nil {
+		return metric.DefaultSpecs()
+	}
+	return o.config.Specs()
+}
+
+// trackers returns Trackers for the heavy hitters set in the config file.
+func (o *options) trackers() []*topk.Tracker {
+	if o.config == nil {
+		return nil
+	}
+	return o.config.Trackers()
+}
+
+// objectives returns Objectives for the SLOs set in the config file.
+func (o *options) objectives() []*slo.Objective {
+	if o.config == nil {
+		return nil
+	}
+	return o.config.Objectives()
+}
+
+// alerts returns an alert.Manager for the alert rules set in the config file,
+// identifying the consumer by host name unless otherwise configured, or nil
+// if there are none.
+func (o *options) alerts() *alert.Manager {
+	if o.config == nil {
+		return nil
+	}
+	m := o.config.AlertManager()
+	if m != nil && m.Source == "" {
+		m.Source, _ = os.Hostname()
+	}
+	return m
+}
+
+// configResourceLabels returns monitored resource labels set in the config
+// file.
+func (o *options) configResourceLabels() map[string]string {
+	if o.config == nil {
+		return nil
+	}
+	return o.config.Resource.Labels
+}
+
+// detector returns a Detector using the configured metadata providers.
+func (o *options) detector() (*detect.Detector, error) {
+	d := &detect.Detector{
+		Timeout:   o.metadataTimeout,
+		CacheFile: o.metadataCacheFile,
+	}
+	if !o.useMetadataService {
+		return d, nil
+	}
+	for _, name := range splitList(o.metadataProviders) {
+		p, err := detect.New(name, o.metadataFile)
+		if err != nil {
+			return nil, err
+		}
+		d.Providers = append(d.Providers, p)
+	}
+	return d, nil
+}
+
+// validate checks options for consistency.
+func (o *options) validate() error {
+	if o.accessLogPath == "" {
+		return fmt.Errorf("access_log_path must be set")
+	}
+	for name, d := range map[string]time.Duration{
+		"log_polling_period":    o.logPollingPeriod,
+		"flush_period":          o.flushPeriod,
+		"rotation_check_period": o.rotationCheckPeriod,
+		"shutdown_timeout":      o.shutdownTimeout,
+		"ready_max_read_age":    o.readyMaxReadAge,
+		"ready_max_write_age":   o.readyMaxWriteAge,
+		"metadata_timeout":      o.metadataTimeout,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if o.readyMaxReadAge <= o.logPollingPeriod {
+		return fmt.Errorf("ready_max_read_age must exceed log_polling_period")
+	}
+	if o.aggregationWindow < 0 || o.aggregationLateness < 0 {
+		return fmt.Errorf("aggregation_window and aggregation_lateness must not be negative")
+	}
+	if o.aggregationWindow > 0 && o.aggregationLateness <= o.logPollingPeriod {
+		// Otherwise, lines read in the same poll as a window closes may be
+		// counted in the next.
+		return fmt.Errorf("aggregation_lateness must exceed log_polling_period")
+	}
+	if o.aggregationWindow == 0 {
+		for _, s := range o.specs() {
+			if s.Unique != nil || s.Mean {
+				return fmt.Errorf("aggregation_window must be positive for metric %s, which is computed per window", s.Name)
+			}
+		}
+	}
+	if _, err := naming.New(o.metricDomain, o.metricPrefix); err != nil {
+		return err
+	}
+	if _, err := resource.ParseLabels(o.resourceLabels); err != nil {
+		return err
+	}
+	if _, err := o.detector(); err != nil {
+		return err
+	}
+	if o.userAgentField == "" {
+		return fmt.Errorf("user_agent_field must be set")
+	}
+	if o.geoipASNs == "" {
+		for _, s := range o.specs() {
+			for _, l := range s.Labels {
+				if l.Field == geoip.ASNField {
+					return fmt.Errorf("geoip_asns must be set to label metric %s by %s, bounding its cardinality", s.Name, geoip.ASNField)
+				}
+			}
+		}
+	}
+	if _, err := o.parser(); err != nil {
+		return err
+	}
+	return nil
+}
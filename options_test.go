@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes the supplied content to a config file in a temporary
+// directory, returning its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "options_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Could not write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadOptionsErrors(t *testing.T) {
+	for _, content := range []string{
+		// Invalid in the file itself.
+		"inputs:\n  - path: /var/log/nginx/access.log\n    colour: blue\n",
+		// Invalid once resolved.
+		"inputs:\n  - path: /var/log/nginx/access.log\n    polling_period: 10m\n",
+		// Windows closing before late lines are read.
+		"inputs:\n  - path: /var/log/nginx/access.log\n    polling_period: 1m\naggregation:\n  lateness: 30s\n",
+		// Computed per window, without windows.
+		"inputs:\n  - path: /var/log/nginx/access.log\naggregation:\n  window: 0s\nmetrics:\n  - name: unique_clients\n    type: unique\n    field: remote_addr\n",
+		"inputs:\n  - path: /var/log/nginx/access.log\naggregation:\n  window: 0s\napdex:\n  threshold: 500ms\n",
+		// Labelled by unbounded autonomous system numbers.
+		"inputs:\n  - path: /var/log/nginx/access.log\nmetrics:\n  - name: http_response_count\n    labels:\n      - name: client_asn\n",
+	} {
+		path := writeConfig(t, content)
+		_, err := loadOptions([]string{"-config_file", path}, flag.ContinueOnError)
+		if err == nil || !strings.HasPrefix(err.Error(), path+":") {
+			t.Errorf("Expected loading %q to fail with an error naming %s, got %v", content, path, err)
+		}
+	}
+}
+
+func TestParserEnrichers(t *testing.T) {
+	line := []byte(`{"time": "2020-01-02T03:04:05+00:00", "status": "200", "request_time": "0.1", "http_user_agent": "curl/7.58.0", "upstream_cache_status": "HIT"}`)
+	for _, tc := range []struct {
+		content string
+		field   string
+		want    string
+	}{
+		// Counted by a heavy hitter.
+		{"heavy_hitters:\n  - name: clients\n    field: client_class\n", "client_class", "library"},
+		// Filtering a heavy hitter.
+		{"heavy_hitters:\n  - name: paths\n    field: path\n    include:\n      - cache_source: origin\n", "cache_source", "cache"},
+		// Selecting the good records of an SLO.
+		{"slos:\n  - name: availability\n    objective: 0.999\n    good:\n      - client_class: library\n", "client_class", "library"},
+		// Matched by an alert rule.
+		{"alerts:\n  rules:\n    - name: bots\n      type: ratio\n      threshold: 0.5\n      match:\n        - client_class: bot\n", "client_class", "library"},
+		// Matching an Apdex route.
+		{"apdex:\n  routes:\n    - name: cli\n      match:\n        - client_class: library\n", "apdex_route", "cli"},
+		{"apdex:\n  routes:\n    - name: cached\n      match:\n        - cache_source: cache\n", "apdex_route", "cached"},
+	} {
+		path := writeConfig(t, "inputs:\n  - path: /var/log/nginx/access.log\n"+tc.content)
+		o, err := loadOptions([]string{"-config_file", path}, flag.ContinueOnError)
+		if err != nil {
+			t.Fatalf("Failed to load options from %q: %v", tc.content, err)
+		}
+		p, err := o.parser()
+		if err != nil {
+			t.Fatalf("Failed to create parser for %q: %v", tc.content, err)
+		}
+		_, r, err := p.Parse(line)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", line, err)
+		}
+		if got := r[tc.field]; got != tc.want {
+			t.Errorf("Expected the parser for %q to derive %s %q, got %q", tc.content, tc.field, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// ISO8601 contains a time.Parse reference timestamp for ISO 8601 (as
+	// produced by nginx's $time_iso8601).
+	ISO8601 = "2006-01-02T15:04:05-07:00"
+
+	// FormatJSON identifies log lines formatted as JSON objects (e.g. using
+	// escape=json in nginx's log_format).
+	FormatJSON = "json"
+
+	// TimeField is the name of the field holding the request timestamp.
+	TimeField = "time"
+
+	// StatusField is the name of the field holding the response status
+	// code.
+	StatusField = "status"
+)
+
+// Reasons for which a log line may fail to parse.
+const (
+	ReasonInvalidJSON = "invalid_json"
+	ReasonMissingTime = "missing_time"
+	ReasonInvalidTime = "invalid_time"
+)
+
+// Record holds the fields parsed from a log line, keyed by field name.
+type Record map[string]string
+
+// Error describes why a log line could not be parsed.
+type Error struct {
+	// Reason is one of the Reason* constants.
+	Reason string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Enricher adds fields derived from others to parsed records (e.g. a
+// classification of the user agent).
+type Enricher interface {
+	Enrich(r Record)
+}
+
+// Parser extracts a timestamp and fields from log lines.
+type Parser struct {
+	format     string
+	fields     map[string]string
+	timeFormat string
+	enrichers  []Enricher
+}
+
+// New returns a Parser for log lines in the supplied format (currently only
+// FormatJSON). Fields maps field names (e.g. TimeField or StatusField) to the
+// keys in which they appear in log lines, where these differ; other keys are
+// used as field names unchanged. The TimeField is parsed using the supplied
+// time.Parse layout.
+func New(format string, fields map[string]string, timeFormat string) (*Parser, error) {
+	if format != FormatJSON {
+		return nil, fmt.Errorf("Unsupported log format: %q", format)
+	}
+	if timeFormat == "" {
+		return nil, fmt.Errorf("Time format must not be empty")
+	}
+	seen := make(map[string]string)
+	for name, key := range fields {
+		if other, ok := seen[key]; ok {
+			return nil, fmt.Errorf("Fields %s and %s are both mapped to key %q", other, name, key)
+		}
+		seen[key] = name
+	}
+	return &Parser{
+		format:     format,
+		fields:     fields,
+		timeFormat: timeFormat,
+	}, nil
+}
+
+// Default returns a Parser for JSON log lines with ISO 8601 timestamps and no
+// field mapping (see README.md for the expected log_format).
+func Default() *Parser {
+	p, _ := New(FormatJSON, nil, ISO8601)
+	return p
+}
+
+// Format returns the format of log lines (e.g. FormatJSON).
+func (p *Parser) Format() string {
+	return p.format
+}
+
+// Fields returns the mapping from field names to the keys in which they appear
+// in log lines (see New).
+func (p *Parser) Fields() map[string]string {
+	return p.fields
+}
+
+// TimeFormat returns the time.Parse layout of the TimeField.
+func (p *Parser) TimeFormat() string {
+	return p.timeFormat
+}
+
+// AddEnricher registers an Enricher to be applied to the records returned by
+// Parse, after any registered earlier.
+func (p *Parser) AddEnricher(e Enricher) {
+	p.enrichers = append(p.enrichers, e)
+}
+
+// Parse returns the timestamp and fields of the supplied log line, with any
+// fields added by Enrichers. If the line cannot be parsed, the returned error
+// is an *Error.
+func (p *Parser) Parse(line []byte) (time.Time, Record, error) {
+	var raw map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return time.Time{}, nil, &Error{
+			Reason: ReasonInvalidJSON,
+			Err:    fmt.Errorf("Error parsing log line: %v", err),
+		}
+	}
+
+	// Keys which are mapped to a field name take precedence over any key
+	// which happens to share that name.
+	r := make(Record)
+	mapped := make(map[string]bool)
+	for _, key := range p.fields {
+		mapped[key] = true
+	}
+	for key, value := range raw {
+		if !mapped[key] {
+			r[key] = stringValue(value)
+		}
+	}
+	for name, key := range p.fields {
+		if value, ok := raw[key]; ok {
+			r[name] = stringValue(value)
+		}
+	}
+
+	ts, ok := r[TimeField]
+	if !ok {
+		return time.Time{}, nil, &Error{
+			Reason: ReasonMissingTime,
+			Err:    fmt.Errorf("Log line has no %s field", TimeField),
+		}
+	}
+	t, err := time.Parse(p.timeFormat, ts)
+	if err != nil {
+		return time.Time{}, nil, &Error{
+			Reason: ReasonInvalidTime,
+			Err:    fmt.Errorf("Could not parse time %v: %v", ts, err),
+		}
+	}
+
+	for _, e := range p.enrichers {
+		e.Enrich(r)
+	}
+
+	return t, r, nil
+}
+
+// stringValue returns the string form of a decoded JSON value.
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
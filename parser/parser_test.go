@@ -0,0 +1,97 @@
+package parser_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+func TestParse(t *testing.T) {
+	p := parser.Default()
+
+	ts, r, err := p.Parse([]byte(`{"time": "2018-05-01T12:00:00+00:00", "status": "200", "request_time": 0.25, "cached": true}`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+	if want := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC); !ts.Equal(want) {
+		t.Errorf("Expected time %v, got %v", want, ts)
+	}
+	for name, want := range map[string]string{
+		"status":       "200",
+		"request_time": "0.25",
+		"cached":       "true",
+	} {
+		if got := r[name]; got != want {
+			t.Errorf("Expected field %s to be %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestParseFieldMapping(t *testing.T) {
+	p, err := parser.New(parser.FormatJSON, map[string]string{
+		"time":   "ts",
+		"status": "code",
+	}, time.RFC3339)
+	if err != nil {
+		t.Fatalf("New failed with %v", err)
+	}
+
+	_, r, err := p.Parse([]byte(`{"ts": "2018-05-01T12:00:00Z", "code": 404, "status": "ignored"}`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+	if want, got := "404", r["status"]; got != want {
+		t.Errorf("Expected mapped status field %q, got %q", want, got)
+	}
+	if _, ok := r["code"]; ok {
+		t.Errorf("Expected mapped key not to appear under its own name: %v", r)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	p := parser.Default()
+
+	for line, want := range map[string]string{
+		`{"time": "2018-05-01T12:00:00+00:00"`: parser.ReasonInvalidJSON,
+		`{"status": "200"}`:                    parser.ReasonMissingTime,
+		`{"time": "yesterday"}`:                parser.ReasonInvalidTime,
+	} {
+		_, _, err := p.Parse([]byte(line))
+		perr, ok := err.(*parser.Error)
+		if !ok {
+			t.Errorf("Expected Parse(%s) to fail with *parser.Error, got %v", line, err)
+		} else if perr.Reason != want {
+			t.Errorf("Expected Parse(%s) to fail with reason %s, got %s", line, want, perr.Reason)
+		}
+	}
+
+	if _, err := parser.New("csv", nil, parser.ISO8601); err == nil {
+		t.Errorf("New should have failed for unsupported format, but did not")
+	}
+}
+
+// lengthEnricher records the length of the status field.
+type lengthEnricher struct{}
+
+func (lengthEnricher) Enrich(r parser.Record) {
+	r["status_length"] = fmt.Sprint(len(r["status"]))
+}
+
+func TestParseEnrichers(t *testing.T) {
+	p := parser.Default()
+	p.AddEnricher(lengthEnricher{})
+
+	_, r, err := p.Parse([]byte(`{"time": "2018-05-01T12:00:00+00:00", "status": "200"}`))
+	if err != nil {
+		t.Fatalf("Parse failed with %v", err)
+	}
+	if want, got := "3", r["status_length"]; got != want {
+		t.Errorf("Expected enriched field %q, got %q", want, got)
+	}
+
+	if _, r, err := p.Parse([]byte(`{"status": "200"}`)); err == nil {
+		t.Errorf("Expected Parse to fail without a time, got %v", r)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"reflect"
+
+	"github.com/swfrench/nginx-log-consumer/consumer"
+	"github.com/swfrench/nginx-log-consumer/exporter"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/stats"
+	"github.com/swfrench/nginx-log-consumer/tailer"
+
+	"google.golang.org/api/monitoring/v3"
+)
+
+// reloader re-reads configuration (e.g. on SIGHUP) and applies changes to the
+// running consumer and exporter. Cumulative counts are retained.
+type reloader struct {
+	args []string
+	// initial holds the options in effect at startup, against which changes
+	// requiring a restart are detected.
+	initial  *options
+	current  *options
+	client   *http.Client
+	tailer   *tailer.Tailer
+	consumer *consumer.Consumer
+	// exporter is nil when not writing to Cloud Monitoring (see dry_run).
+	exporter *exporter.CloudMonitoringExporter
+	// self exports metrics describing the consumer itself to Cloud
+	// Monitoring, if enabled (see export_self_metrics).
+	self  *exporter.CloudMonitoringExporter
+	stats *stats.Registry
+}
+
+// restartOnly returns the names of options which differ between a and b, but
+// cannot be changed without a restart.
+func restartOnly(a, b *options) []string {
+	var names []string
+	for name, differs := range map[string]bool{
+		"aggregation_window":     a.aggregationWindow != b.aggregationWindow,
+		"use_syslog":             a.useSyslog != b.useSyslog,
+		"use_metadata_service":   a.useMetadataService != b.useMetadataService,
+		"metadata_providers":     a.metadataProviders != b.metadataProviders,
+		"metadata_timeout":       a.metadataTimeout != b.metadataTimeout,
+		"metadata_file":          a.metadataFile != b.metadataFile,
+		"metadata_cache_file":    a.metadataCacheFile != b.metadataCacheFile,
+		"default_project_id":     a.defaultProjectID != b.defaultProjectID,
+		"default_instance_name":  a.defaultInstanceName != b.defaultInstanceName,
+		"default_zone_name":      a.defaultZoneName != b.defaultZoneName,
+		"resource_type":          a.resourceType != b.resourceType,
+		"resource_labels":        a.resourceLabels != b.resourceLabels,
+		"downward_api_dir":       a.downwardAPIDir != b.downwardAPIDir,
+		"state_file":             a.stateFile != b.stateFile,
+		"metric_domain":          a.metricDomain != b.metricDomain,
+		"metric_prefix":          a.metricPrefix != b.metricPrefix,
+		"create_custom_metrics":  a.createCustomMetrics != b.createCustomMetrics,
+		"migrate_custom_metrics": a.migrateCustomMetrics != b.migrateCustomMetrics,
+		"credentials_file":       a.credentialsFile != b.credentialsFile,
+		"json_export_file":       a.jsonExportFile != b.jsonExportFile,
+		"dry_run":                a.dryRun != b.dryRun,
+		"export_self_metrics":    a.exportSelfMetrics != b.exportSelfMetrics,
+		"admin_address":          a.adminAddress != b.adminAddress,
+		"ready_max_read_age":     a.readyMaxReadAge != b.readyMaxReadAge,
+		"ready_max_write_age":    a.readyMaxWriteAge != b.readyMaxWriteAge,
+		"metrics":                !sameMetrics(a.specs(), b.specs()),
+		"resource.labels":        !reflect.DeepEqual(a.configResourceLabels(), b.configResourceLabels()),
+		"heavy_hitters":          !reflect.DeepEqual(a.trackers(), b.trackers()),
+		"slos":                   !reflect.DeepEqual(a.objectives(), b.objectives()),
+		"alerts":                 !reflect.DeepEqual(a.alerts(), b.alerts()),
+	} {
+		if differs {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// sameMetrics returns true if the supplied Specs describe the same metrics,
+// other than their Filters (which may be changed at runtime).
+func sameMetrics(a, b []*metric.Spec) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := *a[i], *b[i]
+		x.Filter, y.Filter = nil, nil
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// reload re-reads configuration and applies those changes which are safe at
+// runtime: The access log path, format and field mapping, rotation check
+// period, polling, flush and shutdown timing, window lateness, metric
+// filters, and the monitoring API endpoint. If the new configuration is
+// invalid, or cannot be applied, it is rejected and the existing
+// configuration remains in effect.
+func (r *reloader) reload() {
+	o, err := loadOptions(r.args, flag.ContinueOnError)
+	if err != nil {
+		log.Printf("Rejecting reloaded configuration: %v", err)
+		return
+	}
+
+	if o.equal(r.current) {
+		log.Printf("Configuration unchanged")
+		return
+	}
+
+	for _, name := range restartOnly(r.initial, o) {
+		log.Printf("Change to %s requires a restart; ignoring", name)
+	}
+
+	// Prepare replacements before touching the running consumer, so that a
+	// failure leaves the existing configuration intact.
+	var service *monitoring.Service
+	if r.exporter != nil && o.monitoringEndpoint != r.current.monitoringEndpoint {
+		s, err := newMonitoringService(r.client, o.monitoringEndpoint)
+		if err != nil {
+			log.Printf("Rejecting reloaded configuration: Could not create Cloud Monitoring client: %v", err)
+			return
+		}
+		service = s
+	}
+
+	// The metrics running (which may only change on restart) must continue
+	// to receive the derived fields they use, as must those reloaded.
+	used := r.initial.usedFields()
+	for field := range o.usedFields() {
+		used[field] = true
+	}
+	p, err := o.newParser(used)
+	if err != nil {
+		log.Printf("Rejecting reloaded configuration: Could not create parser: %v", err)
+		return
+	}
+
+	// Filters may be replaced, provided the metrics are otherwise unchanged.
+	var filters []*metric.Filter
+	if specs := o.specs(); sameMetrics(r.initial.specs(), specs) {
+		for _, s := range specs {
+			filters = append(filters, s.Filter)
+		}
+	}
+
+	var t *tailer.Tailer
+	if o.accessLogPath != r.current.accessLogPath {
+		t, err = tailer.NewTailer(o.accessLogPath, o.rotationCheckPeriod)
+		if err != nil {
+			log.Printf("Rejecting reloaded configuration: Could not create tailer for %s: %v", o.accessLogPath, err)
+			return
+		}
+		t.SetStats(r.stats)
+	}
+
+	if err := r.consumer.Reconfigure(func() error {
+		if t != nil {
+			if err := r.consumer.SetTailer(t); err != nil {
+				return err
+			}
+			r.tailer = t
+		} else {
+			r.tailer.SetIdleDuration(o.rotationCheckPeriod)
+		}
+		r.consumer.Period = o.logPollingPeriod
+		r.consumer.FlushPeriod = o.flushPeriod
+		r.consumer.ShutdownTimeout = o.shutdownTimeout
+		r.consumer.SetWindowLateness(o.aggregationLateness)
+		r.consumer.SetParser(p)
+		if filters != nil {
+			if err := r.consumer.SetFilters(filters); err != nil {
+				return err
+			}
+		}
+		if service != nil {
+			r.exporter.SetService(service)
+			if r.self != nil {
+				r.self.SetService(service)
+			}
+		}
+		return nil
+	}); err != nil {
+		if t != nil {
+			t.Close()
+		}
+		log.Printf("Could not apply reloaded configuration: %v", err)
+		return
+	}
+
+	r.current = o
+	log.Printf("Reloaded configuration")
+}
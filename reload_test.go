@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/consumer"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/tailer"
+)
+
+// testExporter accumulates the values exported by a Consumer.
+type testExporter struct {
+	values *metric.Values
+}
+
+func (e *testExporter) Export(values *metric.Values, end time.Time) error {
+	e.values.Merge(values)
+	return nil
+}
+
+func (e *testExporter) ResetTime() time.Time {
+	return time.Time{}
+}
+
+func (e *testExporter) Snapshot() (time.Time, *metric.Values) {
+	return time.Time{}, e.values.Copy()
+}
+
+func (e *testExporter) Flush(ctx context.Context) error {
+	return nil
+}
+
+// reloadTest runs a Consumer of an access log configured by the config file
+// with the supplied content, as main does, until stopped.
+type reloadTest struct {
+	t        *testing.T
+	dir      string
+	config   string
+	log      string
+	reloader *reloader
+	exporter *testExporter
+	cancel   func()
+	done     chan error
+}
+
+func newReloadTest(t *testing.T, content string) *reloadTest {
+	dir, err := ioutil.TempDir("", "reload_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	rt := &reloadTest{
+		t:        t,
+		dir:      dir,
+		config:   filepath.Join(dir, "config.yaml"),
+		log:      filepath.Join(dir, "access.log"),
+		exporter: &testExporter{values: metric.NewValues()},
+		done:     make(chan error, 1),
+	}
+	if err := ioutil.WriteFile(rt.log, nil, 0644); err != nil {
+		t.Fatalf("Could not create access log: %v", err)
+	}
+	rt.writeConfig(content)
+
+	args := []string{"-config_file", rt.config}
+	o, err := loadOptions(args, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Could not load options: %v", err)
+	}
+	tl, err := tailer.NewTailer(o.accessLogPath, o.rotationCheckPeriod)
+	if err != nil {
+		t.Fatalf("Could not create tailer: %v", err)
+	}
+	p, err := o.parser()
+	if err != nil {
+		t.Fatalf("Could not create parser: %v", err)
+	}
+	c := consumer.NewConsumer(time.Hour, tl, rt.exporter)
+	c.SetParser(p)
+	c.SetSpecs(o.specs())
+
+	rt.reloader = &reloader{
+		args:     args,
+		initial:  o,
+		current:  o,
+		tailer:   tl,
+		consumer: c,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rt.cancel = cancel
+	go func() {
+		rt.done <- c.Run(ctx)
+	}()
+	return rt
+}
+
+// writeConfig replaces the config file, reading the test access log, with
+// the supplied content.
+func (rt *reloadTest) writeConfig(content string) {
+	content = fmt.Sprintf("inputs:\n  - path: %s\n%s", rt.log, content)
+	if err := ioutil.WriteFile(rt.config, []byte(content), 0644); err != nil {
+		rt.t.Fatalf("Could not write config file: %v", err)
+	}
+}
+
+// appendLines appends the supplied log lines, each formatted with the current
+// time.
+func (rt *reloadTest) appendLines(lines ...string) {
+	f, err := os.OpenFile(rt.log, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		rt.t.Fatalf("Could not open access log: %v", err)
+	}
+	defer f.Close()
+	now := time.Now().Format(consumer.ISO8601)
+	for _, l := range lines {
+		fmt.Fprintf(f, l+"\n", now)
+	}
+}
+
+// stop stops the Consumer, which consumes any remaining lines, and returns
+// the values exported.
+func (rt *reloadTest) stop() *metric.Values {
+	rt.cancel()
+	if err := <-rt.done; err != nil {
+		rt.t.Fatalf("Consumer returned with error: %v", err)
+	}
+	os.RemoveAll(rt.dir)
+	return rt.exporter.values
+}
+
+func TestReloadFilters(t *testing.T) {
+	rt := newReloadTest(t, `
+metrics:
+  - name: http_response_count
+    labels:
+      - name: response_code
+        field: status
+        type: int64
+    exclude:
+      - path: /healthz
+`)
+	rt.writeConfig(`
+metrics:
+  - name: http_response_count
+    labels:
+      - name: response_code
+        field: status
+        type: int64
+    exclude:
+      - path: /readyz
+`)
+	if names := restartOnly(rt.reloader.initial, mustLoad(t, rt.reloader.args)); len(names) != 0 {
+		t.Errorf("Expected a filter change not to require a restart, got %v", names)
+	}
+	rt.reloader.reload()
+
+	rt.appendLines(
+		`{"time": "%s", "status": "200", "path": "/healthz"}`,
+		`{"time": "%s", "status": "503", "path": "/readyz"}`,
+	)
+	values := rt.stop()
+	if want, got := map[string]int64{"200": 1}, values.Counters[metric.StatusCountMetric]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected status counts %v with the reloaded filter, got %v", want, got)
+	}
+}
+
+func TestReloadDerivedFields(t *testing.T) {
+	rt := newReloadTest(t, `
+metrics:
+  - name: http_response_count
+    labels:
+      - name: client_class
+`)
+	// No longer using client_class, which the running metric still does.
+	rt.writeConfig(`
+metrics:
+  - name: http_response_count
+`)
+	rt.reloader.reload()
+
+	rt.appendLines(`{"time": "%s", "status": "200", "http_user_agent": "curl/7.58.0"}`)
+	values := rt.stop()
+	if want, got := map[string]int64{"library": 1}, values.Counters[metric.StatusCountMetric]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected counts %v by client class after reload, got %v", want, got)
+	}
+}
+
+// mustLoad loads options from the supplied arguments, failing the test on
+// error.
+func mustLoad(t *testing.T, args []string) *options {
+	t.Helper()
+	o, err := loadOptions(args, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Could not load options: %v", err)
+	}
+	return o
+}
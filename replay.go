@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/checkpoint"
+	"github.com/swfrench/nginx-log-consumer/exporter"
+	"github.com/swfrench/nginx-log-consumer/exporter/counter"
+	"github.com/swfrench/nginx-log-consumer/exporter/naming"
+	"github.com/swfrench/nginx-log-consumer/exporter/retry"
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+)
+
+const (
+	// replayCloudMonitoring selects output of replayed points to Cloud
+	// Monitoring.
+	replayCloudMonitoring = "cloud_monitoring"
+
+	// replayOpenMetrics selects output of replayed points to a file in the
+	// OpenMetrics text format.
+	replayOpenMetrics = "openmetrics"
+
+	// maxPointAge is the age beyond which Cloud Monitoring does not accept
+	// points.
+	maxPointAge = 25 * time.Hour
+
+	// replayFlushAttempts bounds the attempts made to send writes deferred
+	// after transient errors once all windows are exported.
+	replayFlushAttempts = 10
+)
+
+// replay aggregates log lines from the files named by the arguments (which may
+// be gzipped) into event-time windows, and writes a point for each window to
+// the selected output.
+func replay(args []string) error {
+	var output, outputFile string
+	o, err := parseOptions(args, flag.ExitOnError, func(fs *flag.FlagSet) {
+		fs.StringVar(&output, "output", replayCloudMonitoring, "Destination of replayed points: cloud_monitoring, or openmetrics (written to output_file).")
+		fs.StringVar(&outputFile, "output_file", "-", "Path of the file to which replayed points are written for output=openmetrics, or - for stdout.")
+	})
+	if err != nil {
+		return err
+	}
+	if len(o.args) == 0 {
+		return fmt.Errorf("expected one or more FILE arguments")
+	}
+	o.accessLogPath = o.args[0]
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if o.aggregationWindow <= 0 {
+		return fmt.Errorf("aggregation_window must be positive")
+	}
+	if output != replayCloudMonitoring && output != replayOpenMetrics {
+		return fmt.Errorf("unknown output %q: must be %s or %s", output, replayCloudMonitoring, replayOpenMetrics)
+	}
+	if output == replayCloudMonitoring && o.aggregationWindow < counter.DefaultMinWriteInterval {
+		// Points closer together than this would be merged on write.
+		return fmt.Errorf("aggregation_window must be at least %v for output=%s", counter.DefaultMinWriteInterval, replayCloudMonitoring)
+	}
+
+	p, err := o.parser()
+	if err != nil {
+		return err
+	}
+	specs := o.specs()
+	windows, err := readWindows(o.args, p, specs, o.aggregationWindow)
+	if err != nil {
+		return err
+	}
+	if len(windows) == 0 {
+		return fmt.Errorf("no log lines to replay")
+	}
+
+	n, err := naming.New(o.metricDomain, o.metricPrefix)
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case replayCloudMonitoring:
+		return replayToCloudMonitoring(o, n, specs, windows)
+	default:
+		return replayToOpenMetrics(outputFile, n, specs, windows, o.aggregationWindow)
+	}
+}
+
+// readWindows parses log lines from the named files and aggregates them into
+// aligned event-time windows of the supplied size, returned in order.
+func readWindows(paths []string, p *parser.Parser, specs []*metric.Spec, size time.Duration) ([]checkpoint.Window, error) {
+	open := make(map[time.Time]*metric.Values)
+	for _, path := range paths {
+		f, err := openLog(path)
+		if err != nil {
+			return nil, err
+		}
+
+		lines, failures := 0, 0
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+		for scanner.Scan() {
+			lines++
+			t, r, err := p.Parse(scanner.Bytes())
+			if err != nil {
+				failures++
+				continue
+			}
+			end := t.Truncate(size).Add(size)
+			v, ok := open[end]
+			if !ok {
+				v = metric.NewValues()
+				open[end] = v
+			}
+			for _, s := range specs {
+				if s.Matches(r) {
+					s.Observe(r, v)
+				}
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", path, err)
+		}
+		log.Printf("Read %d lines from %s (%d could not be parsed)", lines, path, failures)
+	}
+
+	var windows []checkpoint.Window
+	for end, v := range open {
+		v.UpdateGauges()
+		windows = append(windows, checkpoint.Window{
+			End:    end,
+			Values: v,
+		})
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].End.Before(windows[j].End)
+	})
+	return windows, nil
+}
+
+// replayToCloudMonitoring writes a point for each window to Cloud Monitoring,
+// as a cumulative timeseries starting at the first window. Windows too old to
+// be accepted are skipped (with a warning).
+func replayToCloudMonitoring(o *options, n *naming.Naming, specs []*metric.Spec, windows []checkpoint.Window) error {
+	now := time.Now()
+	cutoff := now.Add(-maxPointAge).Add(o.aggregationWindow)
+	skipped := 0
+	for skipped < len(windows) && windows[skipped].End.Before(cutoff) {
+		skipped++
+	}
+	if skipped > 0 {
+		log.Printf("WARNING: Skipping %d window(s) ending before %v, since Cloud Monitoring does not accept points older than %v; use -output=%s to replay these to a file", skipped, cutoff.Format(time.RFC3339), maxPointAge, replayOpenMetrics)
+	}
+	windows = windows[skipped:]
+	if len(windows) == 0 {
+		return fmt.Errorf("no windows recent enough to write to Cloud Monitoring")
+	}
+
+	ctx := context.Background()
+	client, err := newClient(ctx, o.credentialsFile)
+	if err != nil {
+		return fmt.Errorf("could not create Google API client: %v", err)
+	}
+	service, err := newMonitoringService(client, o.monitoringEndpoint)
+	if err != nil {
+		return fmt.Errorf("could not create Cloud Monitoring client: %v", err)
+	}
+
+	projectID, metadataLabels, err := getMetadata(ctx, o)
+	if err != nil {
+		return fmt.Errorf("could not determine metadata: %v", err)
+	}
+	r := getResource(o, projectID, metadataLabels)
+
+	e := exporter.NewCloudMonitoringExporter(projectID, r.Type, r.Labels, n, specs, service)
+	e.Restore(windows[0].End.Add(-o.aggregationWindow), metric.NewValues())
+
+	if o.createCustomMetrics {
+		if err := e.EnsureMetrics(o.migrateCustomMetrics); err != nil {
+			return fmt.Errorf("failed to ensure custom metrics: %v", err)
+		}
+	}
+
+	log.Printf("Replaying %d window(s) from %v to %v to project %s; resource: %s %v", len(windows), windows[0].End, windows[len(windows)-1].End, projectID, r.Type, r.Labels)
+
+	for _, w := range windows {
+		end := w.End
+		if end.After(now) {
+			// The last window may be incomplete.
+			end = now
+		}
+		if err := e.Export(w.Values, end); err != nil {
+			return err
+		}
+		if err := e.Flush(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Writes failing with transient errors are deferred by Flush, so retry
+	// until none remain.
+	p := retry.DefaultPolicy()
+	for attempt := 1; e.Pending() > 0 && attempt < replayFlushAttempts; attempt++ {
+		p.Sleep(ctx, p.Backoff(attempt))
+		if err := e.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	if n := e.Pending(); n > 0 {
+		return fmt.Errorf("%d timeseries write(s) not sent after %d attempts", n, replayFlushAttempts)
+	}
+	if n := e.Dropped(); n > 0 {
+		return fmt.Errorf("%d timeseries write(s) discarded", n)
+	}
+	return nil
+}
+
+// replayToOpenMetrics writes a point for each window to the named file (or
+// stdout, if "-") in the OpenMetrics text format.
+func replayToOpenMetrics(path string, n *naming.Naming, specs []*metric.Spec, windows []checkpoint.Window, size time.Duration) error {
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if path != "-" {
+		var err error
+		f, err = os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	e := exporter.NewOpenMetricsExporter(w, n, specs)
+	e.Restore(windows[0].End.Add(-size), metric.NewValues())
+	for _, w := range windows {
+		if err := e.Export(w.Values, w.End); err != nil {
+			return err
+		}
+	}
+	if err := e.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Replayed %d window(s) from %v to %v to %s", len(windows), windows[0].End, windows[len(windows)-1].End, path)
+	if f != nil {
+		return f.Close()
+	}
+	return nil
+}
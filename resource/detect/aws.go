@@ -0,0 +1,69 @@
+package detect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// DefaultAWSURL is the base URL of the EC2 instance metadata service.
+const DefaultAWSURL = "http://169.254.169.254/"
+
+// AWS is a Provider using the EC2 instance metadata service (IMDSv2, with
+// session tokens), which supplies the instance ID (as instance_id and node_id
+// labels), availability zone (as zone) and region (as location). It does not
+// supply a project ID.
+type AWS struct {
+	// BaseURL replaces DefaultAWSURL, if set.
+	BaseURL string
+	// Client replaces http.DefaultClient, if set.
+	Client *http.Client
+}
+
+// Name returns "aws".
+func (p *AWS) Name() string {
+	return "aws"
+}
+
+// identityDocument holds the fields used from the instance identity document.
+type identityDocument struct {
+	InstanceID       string `json:"instanceId"`
+	Region           string `json:"region"`
+	AvailabilityZone string `json:"availabilityZone"`
+}
+
+// Detect obtains a session token, then reads the instance identity document.
+func (p *AWS) Detect(ctx context.Context) (*Metadata, error) {
+	base := p.BaseURL
+	if base == "" {
+		base = DefaultAWSURL
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	token, _, err := fetch(ctx, p.Client, http.MethodPut, base+"/latest/api/token", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": "60",
+	})
+	if err != nil {
+		return nil, err
+	}
+	b, _, err := fetch(ctx, p.Client, http.MethodGet, base+"/latest/dynamic/instance-identity/document", map[string]string{
+		"X-aws-ec2-metadata-token": string(token),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var doc identityDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	return &Metadata{
+		Labels: map[string]string{
+			"instance_id": doc.InstanceID,
+			"node_id":     doc.InstanceID,
+			"zone":        doc.AvailabilityZone,
+			"location":    doc.Region,
+		},
+	}, nil
+}
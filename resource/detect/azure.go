@@ -0,0 +1,69 @@
+package detect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// DefaultAzureURL is the base URL of the Azure instance metadata service.
+const DefaultAzureURL = "http://169.254.169.254/"
+
+// Azure is a Provider using the Azure instance metadata service, which
+// supplies the VM ID (as the instance_id label), name (as node_id), zone (or
+// region if not zonal) and region (as location). It does not supply a project
+// ID.
+type Azure struct {
+	// BaseURL replaces DefaultAzureURL, if set.
+	BaseURL string
+	// Client replaces http.DefaultClient, if set.
+	Client *http.Client
+}
+
+// Name returns "azure".
+func (p *Azure) Name() string {
+	return "azure"
+}
+
+// azureInstance holds the fields used from the instance metadata.
+type azureInstance struct {
+	Compute struct {
+		VMID     string `json:"vmId"`
+		Name     string `json:"name"`
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+	} `json:"compute"`
+}
+
+// Detect reads the instance metadata.
+func (p *Azure) Detect(ctx context.Context) (*Metadata, error) {
+	base := p.BaseURL
+	if base == "" {
+		base = DefaultAzureURL
+	}
+	b, _, err := fetch(ctx, p.Client, http.MethodGet, strings.TrimSuffix(base, "/")+"/metadata/instance?api-version=2021-02-01", map[string]string{
+		"Metadata": "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var instance azureInstance
+	if err := json.Unmarshal(b, &instance); err != nil {
+		return nil, err
+	}
+
+	c := instance.Compute
+	zone := c.Location
+	if c.Zone != "" {
+		zone = c.Location + "-" + c.Zone
+	}
+	return &Metadata{
+		Labels: map[string]string{
+			"instance_id": c.VMID,
+			"node_id":     c.Name,
+			"zone":        zone,
+			"location":    c.Location,
+		},
+	}, nil
+}
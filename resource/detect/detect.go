@@ -0,0 +1,185 @@
+// Package detect determines the project and monitored resource labels of the
+// environment in which the consumer runs, using pluggable metadata providers
+// (e.g. cloud instance metadata services).
+package detect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/checkpoint"
+)
+
+// DefaultTimeout is the default deadline for each Provider.
+const DefaultTimeout = 5 * time.Second
+
+// Metadata describes the environment, as determined by a Provider.
+type Metadata struct {
+	// ProjectID is the Google Cloud project to which metrics are written,
+	// if known.
+	ProjectID string `json:"project_id,omitempty"`
+	// Labels holds monitored resource labels (see resource.New).
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Provider determines Metadata from a single source. Detect returns an error
+// if the source is unavailable (e.g. when not running on the corresponding
+// platform).
+type Provider interface {
+	Name() string
+	Detect(ctx context.Context) (*Metadata, error)
+}
+
+// Names returns the names of the Providers returned by New.
+func Names() []string {
+	return []string{"gce", "aws", "azure", "kubernetes", "file"}
+}
+
+// New returns the Provider with the supplied name (see Names), using the
+// default endpoint for instance metadata services. The file Provider reads
+// the supplied path.
+func New(name, path string) (Provider, error) {
+	switch name {
+	case "gce":
+		return &GCE{}, nil
+	case "aws":
+		return &AWS{}, nil
+	case "azure":
+		return &Azure{}, nil
+	case "kubernetes":
+		return &Kubernetes{}, nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("the file metadata provider requires a path")
+		}
+		return &File{Path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown metadata provider %q: must be one of %s", name, strings.Join(Names(), ", "))
+}
+
+// Detector determines Metadata using each of its Providers in turn, giving
+// each at most Timeout. Results are merged: The project ID is taken from the
+// first Provider supplying one, and labels from earlier Providers take
+// precedence over those from later ones. Providers which fail are skipped.
+//
+// The result is cached, so that later calls to Detect do not repeat
+// detection. If CacheFile is set, it is also saved there, and used in place
+// of detection if no Provider succeeds (e.g. if a metadata service is
+// temporarily unavailable on restart).
+type Detector struct {
+	Providers []Provider
+	Timeout   time.Duration
+	CacheFile string
+
+	mu     sync.Mutex
+	result *Metadata
+}
+
+// Detect returns the Metadata determined by the Detector's Providers (or the
+// cached result of an earlier call). If no Provider succeeds, the result
+// saved in CacheFile is used if available, or otherwise empty Metadata.
+func (d *Detector) Detect(ctx context.Context) *Metadata {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.result != nil {
+		return d.result
+	}
+
+	result := &Metadata{Labels: make(map[string]string)}
+	var detected bool
+	for _, p := range d.Providers {
+		m, err := d.detect(ctx, p)
+		if err != nil {
+			log.Printf("Metadata provider %s unavailable: %v", p.Name(), err)
+			continue
+		}
+		log.Printf("Metadata provider %s: project %q, labels %v", p.Name(), m.ProjectID, m.Labels)
+		detected = true
+		if result.ProjectID == "" {
+			result.ProjectID = m.ProjectID
+		}
+		for k, v := range m.Labels {
+			if _, ok := result.Labels[k]; !ok && v != "" {
+				result.Labels[k] = v
+			}
+		}
+	}
+
+	if d.CacheFile != "" {
+		if detected {
+			if err := checkpoint.WriteJSON(d.CacheFile, result); err != nil {
+				log.Printf("Could not save metadata to %s: %v", d.CacheFile, err)
+			}
+		} else if len(d.Providers) > 0 {
+			if cached, err := loadCache(d.CacheFile); err != nil {
+				log.Printf("Could not load cached metadata from %s: %v", d.CacheFile, err)
+			} else {
+				log.Printf("No metadata provider available; using cached metadata from %s", d.CacheFile)
+				result = cached
+			}
+		}
+	}
+
+	d.result = result
+	return result
+}
+
+// detect calls the supplied Provider, subject to Timeout.
+func (d *Detector) detect(ctx context.Context, p Provider) (*Metadata, error) {
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return p.Detect(ctx)
+}
+
+// loadCache reads Metadata saved by Detect.
+func loadCache(path string) (*Metadata, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fetch performs an HTTP request with the supplied method and headers using
+// client (or http.DefaultClient if nil), returning the response body. Returns
+// an error unless the response status is 200.
+func fetch(ctx context.Context, client *http.Client, method, url string, headers map[string]string) ([]byte, http.Header, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s %s returned %s", method, url, resp.Status)
+	}
+	return b, resp.Header, nil
+}
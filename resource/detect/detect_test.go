@@ -0,0 +1,294 @@
+package detect_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/resource/detect"
+)
+
+func testGCEServer(t *testing.T, values map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("Request for %s missing Metadata-Flavor header", r.URL.Path)
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		v, ok := values[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, v)
+	}))
+}
+
+func TestGCE(t *testing.T) {
+	s := testGCEServer(t, map[string]string{
+		"/computeMetadata/v1/project/project-id":                   "my-project",
+		"/computeMetadata/v1/instance/name":                        "web-1",
+		"/computeMetadata/v1/instance/zone":                        "projects/123/zones/us-east1-b",
+		"/computeMetadata/v1/instance/attributes/cluster-name":     "prod",
+		"/computeMetadata/v1/instance/attributes/cluster-location": "us-east1",
+	})
+	defer s.Close()
+
+	p := &detect.GCE{BaseURL: s.URL + "/computeMetadata/v1/"}
+	m, err := p.Detect(context.Background())
+	if err != nil {
+		t.Fatalf("Detect failed with %v", err)
+	}
+	want := &detect.Metadata{
+		ProjectID: "my-project",
+		Labels: map[string]string{
+			"instance_id":  "web-1",
+			"node_id":      "web-1",
+			"zone":         "us-east1-b",
+			"location":     "us-east1",
+			"cluster_name": "prod",
+		},
+	}
+	if !reflect.DeepEqual(want, m) {
+		t.Errorf("Expected %v, got %v", want, m)
+	}
+}
+
+func TestGCEWrongFlavor(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not gce")
+	}))
+	defer s.Close()
+
+	p := &detect.GCE{BaseURL: s.URL}
+	if _, err := p.Detect(context.Background()); err == nil {
+		t.Errorf("Expected Detect to fail without Metadata-Flavor response header")
+	}
+}
+
+func TestAWS(t *testing.T) {
+	const token = "test-token"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				http.Error(w, "bad token request", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, token)
+		case "/latest/dynamic/instance-identity/document":
+			if r.Header.Get("X-aws-ec2-metadata-token") != token {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"accountId": "1234", "instanceId": "i-0abc", "region": "us-east-1", "availabilityZone": "us-east-1a"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	p := &detect.AWS{BaseURL: s.URL}
+	m, err := p.Detect(context.Background())
+	if err != nil {
+		t.Fatalf("Detect failed with %v", err)
+	}
+	want := &detect.Metadata{
+		Labels: map[string]string{
+			"instance_id": "i-0abc",
+			"node_id":     "i-0abc",
+			"zone":        "us-east-1a",
+			"location":    "us-east-1",
+		},
+	}
+	if !reflect.DeepEqual(want, m) {
+		t.Errorf("Expected %v, got %v", want, m)
+	}
+}
+
+func TestAzure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata/instance" || r.Header.Get("Metadata") != "true" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"compute": {"vmId": "02aab8a4", "name": "web-1", "location": "eastus", "zone": "2"}}`)
+	}))
+	defer s.Close()
+
+	p := &detect.Azure{BaseURL: s.URL}
+	m, err := p.Detect(context.Background())
+	if err != nil {
+		t.Fatalf("Detect failed with %v", err)
+	}
+	want := &detect.Metadata{
+		Labels: map[string]string{
+			"instance_id": "02aab8a4",
+			"node_id":     "web-1",
+			"zone":        "eastus-2",
+			"location":    "eastus",
+		},
+	}
+	if !reflect.DeepEqual(want, m) {
+		t.Errorf("Expected %v, got %v", want, m)
+	}
+}
+
+func TestKubernetes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "detect_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	namespace := filepath.Join(dir, "namespace")
+	if err := ioutil.WriteFile(namespace, []byte("edge\n"), 0644); err != nil {
+		t.Fatalf("Could not write %s: %v", namespace, err)
+	}
+
+	p := &detect.Kubernetes{
+		Environ:       []string{"HOME=/"},
+		NamespaceFile: namespace,
+	}
+	if _, err := p.Detect(context.Background()); err == nil {
+		t.Errorf("Expected Detect to fail outside Kubernetes")
+	}
+
+	p.Environ = []string{
+		"KUBERNETES_SERVICE_HOST=10.0.0.1",
+		"HOSTNAME=nginx-abc123",
+		"CONTAINER_NAME=nginx",
+	}
+	m, err := p.Detect(context.Background())
+	if err != nil {
+		t.Fatalf("Detect failed with %v", err)
+	}
+	want := &detect.Metadata{
+		Labels: map[string]string{
+			"pod_name":       "nginx-abc123",
+			"namespace_name": "edge",
+			"container_name": "nginx",
+		},
+	}
+	if !reflect.DeepEqual(want, m) {
+		t.Errorf("Expected %v, got %v", want, m)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "detect_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.yaml")
+	if err := ioutil.WriteFile(path, []byte("project_id: my-project\nlabels:\n  location: us-east1\n"), 0644); err != nil {
+		t.Fatalf("Could not write %s: %v", path, err)
+	}
+
+	p := &detect.File{Path: path}
+	m, err := p.Detect(context.Background())
+	if err != nil {
+		t.Fatalf("Detect failed with %v", err)
+	}
+	want := &detect.Metadata{
+		ProjectID: "my-project",
+		Labels:    map[string]string{"location": "us-east1"},
+	}
+	if !reflect.DeepEqual(want, m) {
+		t.Errorf("Expected %v, got %v", want, m)
+	}
+}
+
+type MockProvider struct {
+	name      string
+	metadata  *detect.Metadata
+	err       error
+	delay     time.Duration
+	callCount int
+}
+
+func (p *MockProvider) Name() string {
+	return p.name
+}
+
+func (p *MockProvider) Detect(ctx context.Context) (*detect.Metadata, error) {
+	p.callCount++
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return p.metadata, p.err
+}
+
+func TestDetector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "detect_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "metadata.json")
+
+	slow := &MockProvider{
+		name:     "slow",
+		metadata: &detect.Metadata{ProjectID: "slow-project"},
+		delay:    time.Hour,
+	}
+	failing := &MockProvider{
+		name: "failing",
+		err:  fmt.Errorf("Test error"),
+	}
+	first := &MockProvider{
+		name: "first",
+		metadata: &detect.Metadata{
+			Labels: map[string]string{"pod_name": "nginx-abc123", "location": "us-east1"},
+		},
+	}
+	second := &MockProvider{
+		name: "second",
+		metadata: &detect.Metadata{
+			ProjectID: "my-project",
+			Labels:    map[string]string{"location": "us-east1-b", "node_id": "web-1"},
+		},
+	}
+	d := &detect.Detector{
+		Providers: []detect.Provider{slow, failing, first, second},
+		Timeout:   10 * time.Millisecond,
+		CacheFile: cache,
+	}
+
+	// Slow and failing providers are skipped, and results from earlier
+	// providers take precedence.
+	want := &detect.Metadata{
+		ProjectID: "my-project",
+		Labels: map[string]string{
+			"pod_name": "nginx-abc123",
+			"location": "us-east1",
+			"node_id":  "web-1",
+		},
+	}
+	if got := d.Detect(context.Background()); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// The result is cached.
+	d.Detect(context.Background())
+	if want, got := 1, first.callCount; want != got {
+		t.Errorf("Expected %d calls to Detect, got %d", want, got)
+	}
+
+	// If no provider succeeds, the result saved in CacheFile is used.
+	d = &detect.Detector{
+		Providers: []detect.Provider{failing},
+		CacheFile: cache,
+	}
+	if got := d.Detect(context.Background()); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected cached %v, got %v", want, got)
+	}
+}
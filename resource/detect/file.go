@@ -0,0 +1,43 @@
+package detect
+
+import (
+	"context"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is a Provider reading static metadata from a YAML (or JSON) file, of the
+// form:
+//
+//	project_id: my-project
+//	labels:
+//	  location: us-east1
+//	  node_id: web-1
+type File struct {
+	Path string
+}
+
+// Name returns "file".
+func (p *File) Name() string {
+	return "file"
+}
+
+// Detect reads the file.
+func (p *File) Detect(ctx context.Context) (*Metadata, error) {
+	b, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		ProjectID string            `yaml:"project_id"`
+		Labels    map[string]string `yaml:"labels"`
+	}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	return &Metadata{
+		ProjectID: f.ProjectID,
+		Labels:    f.Labels,
+	}, nil
+}
@@ -0,0 +1,87 @@
+package detect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// DefaultGCEURL is the base URL of the GCE metadata service.
+const DefaultGCEURL = "http://169.254.169.254/computeMetadata/v1/"
+
+// GCE is a Provider using the GCE (and GKE) instance metadata service, which
+// supplies the project ID, and the instance name and zone (as instance_id,
+// node_id, zone and location labels). On GKE nodes, the cluster_name and
+// location labels are taken from the cluster's instance attributes.
+type GCE struct {
+	// BaseURL replaces DefaultGCEURL, if set.
+	BaseURL string
+	// Client replaces http.DefaultClient, if set.
+	Client *http.Client
+}
+
+// Name returns "gce".
+func (p *GCE) Name() string {
+	return "gce"
+}
+
+// get returns the value of the supplied metadata key.
+func (p *GCE) get(ctx context.Context, key string) (string, error) {
+	base := p.BaseURL
+	if base == "" {
+		base = DefaultGCEURL
+	}
+	b, header, err := fetch(ctx, p.Client, http.MethodGet, strings.TrimSuffix(base, "/")+"/"+key, map[string]string{
+		"Metadata-Flavor": "Google",
+	})
+	if err != nil {
+		return "", err
+	}
+	// Distinguishes the GCE metadata service from others at the same
+	// address.
+	if header.Get("Metadata-Flavor") != "Google" {
+		return "", fmt.Errorf("not a GCE metadata service")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Detect queries the metadata service.
+func (p *GCE) Detect(ctx context.Context) (*Metadata, error) {
+	project, err := p.get(ctx, "project/project-id")
+	if err != nil {
+		return nil, err
+	}
+	instance, err := p.get(ctx, "instance/name")
+	if err != nil {
+		return nil, err
+	}
+	// Of the form projects/<number>/zones/<zone>.
+	zone, err := p.get(ctx, "instance/zone")
+	if err != nil {
+		return nil, err
+	}
+	zone = path.Base(zone)
+
+	labels := map[string]string{
+		"instance_id": instance,
+		"zone":        zone,
+		"node_id":     instance,
+		"location":    zone,
+	}
+
+	// GKE nodes additionally carry cluster metadata as instance attributes
+	// (these are absent elsewhere, hence errors are ignored).
+	if name, err := p.get(ctx, "instance/attributes/cluster-name"); err == nil {
+		labels["cluster_name"] = name
+	}
+	if location, err := p.get(ctx, "instance/attributes/cluster-location"); err == nil {
+		labels["location"] = location
+	}
+
+	return &Metadata{
+		ProjectID: project,
+		Labels:    labels,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package detect
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// DefaultNamespaceFile holds the namespace of a Kubernetes pod, as mounted
+// with its service account credentials.
+const DefaultNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// kubernetesEnv maps environment variables conventionally set from pod fields
+// via the downward API onto resource labels.
+var kubernetesEnv = map[string]string{
+	"POD_NAME":         "pod_name",
+	"POD_NAMESPACE":    "namespace_name",
+	"CONTAINER_NAME":   "container_name",
+	"NODE_NAME":        "node_id",
+	"CLUSTER_NAME":     "cluster_name",
+	"CLUSTER_LOCATION": "location",
+}
+
+// Kubernetes is a Provider for pods, using environment variables set via the
+// downward API (POD_NAME, POD_NAMESPACE, CONTAINER_NAME, NODE_NAME, and
+// CLUSTER_NAME and CLUSTER_LOCATION, which must be set explicitly). The pod
+// name defaults to the hostname, and its namespace to that of its service
+// account. It is unavailable outside Kubernetes (if KUBERNETES_SERVICE_HOST is
+// not set), and does not supply a project ID.
+type Kubernetes struct {
+	// Environ replaces os.Environ(), if set.
+	Environ []string
+	// NamespaceFile replaces DefaultNamespaceFile, if set.
+	NamespaceFile string
+}
+
+// Name returns "kubernetes".
+func (p *Kubernetes) Name() string {
+	return "kubernetes"
+}
+
+// Detect reads the environment and service account namespace.
+func (p *Kubernetes) Detect(ctx context.Context) (*Metadata, error) {
+	environ := p.Environ
+	if environ == nil {
+		environ = os.Environ()
+	}
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	if env["KUBERNETES_SERVICE_HOST"] == "" {
+		return nil, fmt.Errorf("not running in Kubernetes (KUBERNETES_SERVICE_HOST is not set)")
+	}
+
+	labels := make(map[string]string)
+	for name, label := range kubernetesEnv {
+		if v := env[name]; v != "" {
+			labels[label] = v
+		}
+	}
+	if labels["pod_name"] == "" {
+		labels["pod_name"] = env["HOSTNAME"]
+	}
+	if labels["namespace_name"] == "" {
+		path := p.NamespaceFile
+		if path == "" {
+			path = DefaultNamespaceFile
+		}
+		if b, err := ioutil.ReadFile(path); err == nil {
+			labels["namespace_name"] = strings.TrimSpace(string(b))
+		}
+	}
+
+	return &Metadata{Labels: labels}, nil
+}
@@ -0,0 +1,167 @@
+package resource
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultType is the MonitoredResource type used when none is
+	// specified.
+	DefaultType = "gce_instance"
+
+	// EnvPrefix is the prefix for environment variables supplying resource
+	// labels: e.g. NGINX_LOG_CONSUMER_POD_NAME supplies pod_name.
+	EnvPrefix = "NGINX_LOG_CONSUMER_"
+)
+
+// resourceLabels contains the labels required by each supported
+// MonitoredResource type. Labels not listed here for a given type are rejected
+// by Cloud Monitoring.
+var resourceLabels = map[string][]string{
+	"gce_instance":  {"instance_id", "zone"},
+	"k8s_container": {"project_id", "location", "cluster_name", "namespace_name", "pod_name", "container_name"},
+	"k8s_pod":       {"project_id", "location", "cluster_name", "namespace_name", "pod_name"},
+	"generic_node":  {"project_id", "location", "namespace", "node_id"},
+	"generic_task":  {"project_id", "location", "namespace", "job", "task_id"},
+}
+
+// downwardAPIAliases maps file names commonly used when projecting pod
+// metadata via the Kubernetes downward API onto the labels of k8s_* resource
+// types. Other types (e.g. generic_node) have labels of their own named
+// namespace, so are not aliased.
+var downwardAPIAliases = map[string]string{
+	"name":      "pod_name",
+	"namespace": "namespace_name",
+}
+
+// Resource describes the MonitoredResource (e.g. VM instance, container) to
+// which exported metrics are attributed.
+type Resource struct {
+	Type   string
+	Labels map[string]string
+}
+
+// Types returns the supported MonitoredResource types.
+func Types() []string {
+	var types []string
+	for t := range resourceLabels {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New returns a Resource of the specified type, with labels drawn from the
+// supplied map. The project_id label, if required by the type and not
+// supplied, is populated from projectID. Labels not applicable to the type are
+// ignored. Returns an error if the type is unsupported or required labels are
+// missing.
+func New(resourceType, projectID string, labels map[string]string) (*Resource, error) {
+	keys, ok := resourceLabels[resourceType]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported resource type %q (supported: %s)", resourceType, strings.Join(Types(), ", "))
+	}
+
+	r := &Resource{
+		Type:   resourceType,
+		Labels: make(map[string]string),
+	}
+
+	var missing []string
+	for _, key := range keys {
+		value := labels[key]
+		if value == "" && key == "project_id" {
+			value = projectID
+		}
+		if value == "" {
+			missing = append(missing, key)
+			continue
+		}
+		r.Labels[key] = value
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Resource type %s is missing required label(s): %s", resourceType, strings.Join(missing, ", "))
+	}
+
+	return r, nil
+}
+
+// ParseLabels parses a comma-separated list of key=value label pairs.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid label %q: expected key=value", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// LabelsFromEnv returns labels supplied by environment variables (in the
+// os.Environ format) named EnvPrefix followed by the upper-cased label key.
+func LabelsFromEnv(environ []string) map[string]string {
+	labels := make(map[string]string)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv, EnvPrefix), "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		labels[strings.ToLower(parts[0])] = parts[1]
+	}
+	return labels
+}
+
+// LabelsFromDir returns labels read from files in the supplied directory (e.g.
+// a Kubernetes downward API volume): Each file named after a label key (or,
+// for k8s_* resource types, a common downward API alias, such as "namespace")
+// supplies the value of that label.
+func LabelsFromDir(dir, resourceType string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string)
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key := f.Name()
+		if alias, ok := downwardAPIAliases[key]; ok && strings.HasPrefix(resourceType, "k8s_") {
+			key = alias
+		}
+		labels[key] = strings.TrimSpace(string(b))
+	}
+	return labels, nil
+}
+
+// Merge returns the union of the supplied label maps. Where a key is present
+// in more than one, the value from the latest map takes precedence.
+func Merge(labelSets ...map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for _, set := range labelSets {
+		for k, v := range set {
+			if v != "" {
+				labels[k] = v
+			}
+		}
+	}
+	return labels
+}
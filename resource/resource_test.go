@@ -0,0 +1,137 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/swfrench/nginx-log-consumer/resource"
+)
+
+func TestNew(t *testing.T) {
+	r, err := resource.New("k8s_container", "my-project", map[string]string{
+		"location":       "us-central1",
+		"cluster_name":   "prod",
+		"namespace_name": "default",
+		"pod_name":       "nginx-abc123",
+		"container_name": "nginx",
+		"instance_id":    "ignored",
+	})
+	if err != nil {
+		t.Fatalf("New failed with %v", err)
+	}
+
+	want := map[string]string{
+		"project_id":     "my-project",
+		"location":       "us-central1",
+		"cluster_name":   "prod",
+		"namespace_name": "default",
+		"pod_name":       "nginx-abc123",
+		"container_name": "nginx",
+	}
+	if got := r.Labels; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected resource labels %v, got %v", want, got)
+	}
+
+	if want, got := "k8s_container", r.Type; got != want {
+		t.Fatalf("Expected resource type %v, got %v", want, got)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := resource.New("aws_ec2_instance", "my-project", map[string]string{}); err == nil {
+		t.Fatalf("New should have failed for unsupported type, but did not")
+	}
+
+	if _, err := resource.New("generic_task", "my-project", map[string]string{
+		"location":  "us-central1",
+		"namespace": "edge",
+		"job":       "nginx",
+	}); err == nil {
+		t.Fatalf("New should have failed for missing task_id label, but did not")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := resource.ParseLabels("location=us-east1, node_id=web-1,")
+	if err != nil {
+		t.Fatalf("ParseLabels failed with %v", err)
+	}
+	if want, got := map[string]string{"location": "us-east1", "node_id": "web-1"}, labels; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected labels %v, got %v", want, got)
+	}
+
+	if _, err := resource.ParseLabels("location"); err == nil {
+		t.Fatalf("ParseLabels should have failed, but did not")
+	}
+}
+
+func TestLabelsFromEnv(t *testing.T) {
+	labels := resource.LabelsFromEnv([]string{
+		"HOME=/root",
+		"NGINX_LOG_CONSUMER_POD_NAME=nginx-abc123",
+		"NGINX_LOG_CONSUMER_CLUSTER_NAME=",
+	})
+	if want, got := map[string]string{"pod_name": "nginx-abc123"}, labels; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected labels %v, got %v", want, got)
+	}
+}
+
+func TestLabelsFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resource_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"name":           "nginx-abc123\n",
+		"namespace":      "default",
+		"container_name": "nginx",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Could not write test file: %v", err)
+		}
+	}
+
+	labels, err := resource.LabelsFromDir(dir, "k8s_container")
+	if err != nil {
+		t.Fatalf("LabelsFromDir failed with %v", err)
+	}
+
+	want := map[string]string{
+		"pod_name":       "nginx-abc123",
+		"namespace_name": "default",
+		"container_name": "nginx",
+	}
+	if got := labels; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected labels %v, got %v", want, got)
+	}
+
+	// Other resource types take files by their own label names.
+	labels, err = resource.LabelsFromDir(dir, "generic_node")
+	if err != nil {
+		t.Fatalf("LabelsFromDir failed with %v", err)
+	}
+
+	want = map[string]string{
+		"name":           "nginx-abc123",
+		"namespace":      "default",
+		"container_name": "nginx",
+	}
+	if got := labels; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected labels %v, got %v", want, got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	got := resource.Merge(
+		map[string]string{"zone": "us-central1-a", "instance_id": "a"},
+		map[string]string{"instance_id": "b", "zone": ""},
+	)
+	if want := map[string]string{"zone": "us-central1-a", "instance_id": "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected merged labels %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,61 @@
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States which may be reported by Notify (see sd_notify(3)).
+const (
+	// Ready indicates that startup is complete.
+	Ready = "READY=1"
+	// Stopping indicates that shutdown has begun.
+	Stopping = "STOPPING=1"
+	// Watchdog resets the watchdog timer (see WatchdogInterval).
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends the supplied state to the service manager over the socket named
+// by $NOTIFY_SOCKET. Returns false (and no error) if the latter is unset, i.e.
+// if not running under a service manager expecting notifications.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	// A leading @ denotes a socket in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which the service manager
+// expects Watchdog notifications from this process (given by $WATCHDOG_USEC),
+// or zero if the watchdog is not enabled for it.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	// If set, WATCHDOG_PID identifies the process expected to notify.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
@@ -0,0 +1,76 @@
+package sdnotify_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/sdnotify"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := sdnotify.Notify(sdnotify.Ready); sent || err != nil {
+		t.Errorf("Expected no notification without NOTIFY_SOCKET, got %v, %v", sent, err)
+	}
+
+	dir, err := ioutil.TempDir("", "sdnotify_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Could not listen on %s: %v", path, err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if sent, err := sdnotify.Notify(sdnotify.Ready); !sent || err != nil {
+		t.Fatalf("Expected notification to be sent, got %v, %v", sent, err)
+	}
+
+	b := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("Could not read notification: %v", err)
+	}
+	if want, got := sdnotify.Ready, string(b[:n]); want != got {
+		t.Errorf("Expected notification %q, got %q", want, got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	for _, test := range []struct {
+		usec, pid string
+		want      time.Duration
+		err       bool
+	}{
+		{"", "", 0, false},
+		{"30000000", "", 30 * time.Second, false},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second, false},
+		{"30000000", "1", 0, false},
+		{"soon", "", 0, true},
+	} {
+		os.Setenv("WATCHDOG_USEC", test.usec)
+		os.Setenv("WATCHDOG_PID", test.pid)
+		got, err := sdnotify.WatchdogInterval()
+		if (err != nil) != test.err {
+			t.Errorf("WatchdogInterval() with WATCHDOG_USEC=%q, WATCHDOG_PID=%q: unexpected error %v", test.usec, test.pid, err)
+		}
+		if got != test.want {
+			t.Errorf("WatchdogInterval() with WATCHDOG_USEC=%q, WATCHDOG_PID=%q: expected %v, got %v", test.usec, test.pid, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Package slo evaluates service level objectives: The proportion of eligible
+// records (the service level indicator's total) which are good, and the rate
+// at which the error budget allowed by the objective is being consumed over
+// rolling windows.
+package slo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/window"
+)
+
+const (
+	// DefaultPeriod is the default period over which the error budget is
+	// computed.
+	DefaultPeriod = 30 * 24 * time.Hour
+
+	// DefaultLatencyField is the default record field holding the latency
+	// (in seconds) compared with latency thresholds.
+	DefaultLatencyField = "request_time"
+
+	// Resolution is the granularity with which records are counted, and so
+	// with which windows roll.
+	Resolution = 5 * time.Minute
+
+	// metricPrefix precedes the names of exported metrics.
+	metricPrefix = "slo/"
+
+	// WindowLabel is the label of burn rate metrics holding the window
+	// (e.g. 1h).
+	WindowLabel = "window"
+)
+
+// DefaultWindows are the default windows over which burn rates are computed,
+// suitable for multi-window alerting (e.g. paging on fast burns over 1h and
+// 6h, and ticketing on slow burns over 3d).
+var DefaultWindows = []time.Duration{time.Hour, 6 * time.Hour, 72 * time.Hour}
+
+// DefaultGood returns the Filter selecting good records by default: Those
+// with a status below 500.
+func DefaultGood() *metric.Filter {
+	below := 500.0
+	return &metric.Filter{
+		Include: []metric.Rule{{{Field: parser.StatusField, LT: &below}}},
+	}
+}
+
+// LatencyFilter returns a Filter selecting records whose latency, in the
+// supplied field, is at most the supplied threshold.
+func LatencyFilter(field string, threshold time.Duration) *metric.Filter {
+	seconds := threshold.Seconds()
+	return &metric.Filter{
+		Include: []metric.Rule{{{Field: field, LE: &seconds}}},
+	}
+}
+
+// State holds the counts of an Objective, e.g. for saving in a checkpoint.
+// Good[i] and Total[i] are the counts over the Resolution ending
+// len(Total)-1-i steps before (and including) that starting at End.
+type State struct {
+	End   time.Time `json:"end"`
+	Good  []int64   `json:"good"`
+	Total []int64   `json:"total"`
+}
+
+// Objective describes a service level objective, and counts good and total
+// records over its Period, in steps of Resolution. It is safe for concurrent
+// use.
+type Objective struct {
+	// Name identifies the Objective (e.g. availability).
+	Name string
+	// Target is the objective: The proportion of records which should be
+	// good (e.g. 0.999).
+	Target float64
+	// Filter, if set, selects the records counted in the total (e.g.
+	// excluding health checks).
+	Filter *metric.Filter
+	// Good selects those records counted which are good.
+	Good *metric.Filter
+	// Windows are those over which burn rates are computed.
+	Windows []time.Duration
+	// Period is that over which the error budget is computed.
+	Period time.Duration
+
+	mu   sync.Mutex
+	ring *window.Ring[counts]
+}
+
+// counts holds the numbers of good and total records in a step.
+type counts struct {
+	good, total int64
+}
+
+// Validate checks that the Objective is well formed.
+func (o *Objective) Validate() error {
+	if err := metric.ValidateName(o.Name); err != nil {
+		return err
+	}
+	if !(o.Target > 0 && o.Target < 1) {
+		return fmt.Errorf("objective must be between 0 and 1 (exclusive)")
+	}
+	if o.Period < Resolution || o.Period%Resolution != 0 {
+		return fmt.Errorf("period must be a multiple of %v", Resolution)
+	}
+	for _, w := range o.Windows {
+		if w < Resolution || w > o.Period || w%Resolution != 0 {
+			return fmt.Errorf("invalid window %v: must be a multiple of %v, at most the period", w, Resolution)
+		}
+	}
+	return nil
+}
+
+// Specs returns the Specs of the counters of good and total records, computed
+// from log records like other metrics.
+func (o *Objective) Specs() []*metric.Spec {
+	return []*metric.Spec{
+		{
+			Name:        metricPrefix + o.Name + "/good_count",
+			Kind:        metric.Counter,
+			Description: fmt.Sprintf("Cumulative count of good records for the %s objective.", o.Name),
+			Filter:      metric.And(o.Filter, o.Good),
+		},
+		{
+			Name:        metricPrefix + o.Name + "/total_count",
+			Kind:        metric.Counter,
+			Description: fmt.Sprintf("Cumulative count of records eligible for the %s objective.", o.Name),
+			Filter:      o.Filter,
+		},
+	}
+}
+
+// GaugeSpecs returns the Specs of the gauges exported by Values.
+func (o *Objective) GaugeSpecs() []*metric.Spec {
+	return []*metric.Spec{
+		{
+			Name:        metricPrefix + o.Name + "/burn_rate",
+			Kind:        metric.Gauge,
+			Description: fmt.Sprintf("Rate at which the error budget of the %s objective (%v) is being consumed over each window, where 1 exhausts it at the end of the period.", o.Name, o.Target),
+			Labels: []metric.Label{
+				{
+					Name:        WindowLabel,
+					Field:       WindowLabel,
+					Type:        metric.StringLabel,
+					Description: "Window over which the burn rate is computed",
+				},
+			},
+		},
+		{
+			Name:        metricPrefix + o.Name + "/error_budget_remaining",
+			Kind:        metric.Gauge,
+			Description: fmt.Sprintf("Fraction of the error budget of the %s objective (%v) remaining over the preceding %s; negative once exceeded.", o.Name, o.Target, FormatWindow(o.Period)),
+		},
+	}
+}
+
+// steps returns the number of steps of Resolution in the Period.
+func (o *Objective) steps() int {
+	return int(o.Period / Resolution)
+}
+
+// add counts the supplied good and total records in the step containing ts.
+// Counts preceding the Period are ignored. Must be called with mu held.
+func (o *Objective) add(ts time.Time, good, total int64) {
+	if o.ring == nil {
+		o.ring = window.New[counts](Resolution, o.steps())
+	}
+	if c := o.ring.Add(ts); c != nil {
+		c.good += good
+		c.total += total
+	}
+}
+
+// Observe counts the supplied record, with the supplied timestamp, if it is
+// selected by the Filter.
+func (o *Objective) Observe(ts time.Time, r parser.Record) {
+	if !o.Filter.Matches(r) {
+		return
+	}
+	var good int64
+	if o.Good.Matches(r) {
+		good = 1
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.add(ts, good, 1)
+}
+
+// totals returns the numbers of good and total records counted over the
+// supplied window ending at the supplied time.
+func (o *Objective) totals(now time.Time, w time.Duration) (good, total int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ring == nil {
+		return 0, 0
+	}
+	o.ring.Each(now, w, func(c counts) {
+		good += c.good
+		total += c.total
+	})
+	return good, total
+}
+
+// BurnRate returns the rate at which the error budget is being consumed over
+// the supplied window ending at the supplied time: The proportion of records
+// which are not good, relative to that allowed by the Target. A burn rate of
+// 1 exhausts the budget at the end of the Period. With no records, the burn
+// rate is 0.
+func (o *Objective) BurnRate(now time.Time, window time.Duration) float64 {
+	good, total := o.totals(now, window)
+	if total == 0 {
+		return 0
+	}
+	return float64(total-good) / float64(total) / (1 - o.Target)
+}
+
+// BudgetRemaining returns the fraction of the error budget remaining over the
+// Period ending at the supplied time, which is negative once it is exceeded.
+func (o *Objective) BudgetRemaining(now time.Time) float64 {
+	return 1 - o.BurnRate(now, o.Period)
+}
+
+// Values returns the burn rates over each of the Windows, and the remaining
+// error budget, at the supplied time, as gauges of the metrics described by
+// GaugeSpecs.
+func (o *Objective) Values(now time.Time) *metric.Values {
+	values := metric.NewValues()
+	specs := o.GaugeSpecs()
+	for _, w := range o.Windows {
+		values.SetGauge(specs[0].Name, metric.Key([]string{FormatWindow(w)}), o.BurnRate(now, w))
+	}
+	values.SetGauge(specs[1].Name, metric.Key(nil), o.BudgetRemaining(now))
+	return values
+}
+
+// Snapshot returns the counts over the Period, or nil if there are none.
+func (o *Objective) Snapshot() *State {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ring == nil {
+		return nil
+	}
+	s := &State{End: o.ring.End()}
+	for i := o.steps() - 1; i >= 0; i-- {
+		c := o.ring.Get(s.End.Add(-time.Duration(i) * Resolution))
+		s.Good = append(s.Good, c.good)
+		s.Total = append(s.Total, c.total)
+	}
+	return s
+}
+
+// Restore adds the counts of the supplied State (e.g. from a checkpoint),
+// which may be nil.
+func (o *Objective) Restore(s *State) {
+	if s == nil || len(s.Good) != len(s.Total) {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range s.Total {
+		if s.Total[i] == 0 {
+			continue
+		}
+		o.add(s.End.Add(-time.Duration(len(s.Total)-1-i)*Resolution), s.Good[i], s.Total[i])
+	}
+}
+
+// FormatWindow formats the supplied duration compactly, in whole days, hours
+// or minutes where possible (e.g. 3d rather than 72h0m0s).
+func FormatWindow(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
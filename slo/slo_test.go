@@ -0,0 +1,162 @@
+package slo_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/slo"
+)
+
+// newObjective returns an Objective of 99% of non-health-check records
+// succeeding within 500ms.
+func newObjective() *slo.Objective {
+	healthz := "/healthz"
+	return &slo.Objective{
+		Name:    "availability",
+		Target:  0.99,
+		Filter:  &metric.Filter{Exclude: []metric.Rule{{{Field: "path", Equals: &healthz}}}},
+		Good:    metric.And(slo.DefaultGood(), slo.LatencyFilter(slo.DefaultLatencyField, 500*time.Millisecond)),
+		Windows: []time.Duration{time.Hour, 6 * time.Hour},
+		Period:  24 * time.Hour,
+	}
+}
+
+// observe adds n records with the supplied status and latency at ts.
+func observe(o *slo.Objective, ts time.Time, n int, status, latency string) {
+	for i := 0; i < n; i++ {
+		o.Observe(ts, parser.Record{"path": "/", "status": status, "request_time": latency})
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestObjective(t *testing.T) {
+	o := newObjective()
+	if err := o.Validate(); err != nil {
+		t.Fatalf("Expected Objective to be valid, got %v", err)
+	}
+
+	start := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	// 5 hours ago: 2% errors. In the last hour: 1% errors, 1% slow.
+	observe(o, start, 98, "200", "0.1")
+	observe(o, start, 2, "503", "0.1")
+	now := start.Add(5 * time.Hour)
+	observe(o, now.Add(-30*time.Minute), 98, "200", "0.1")
+	observe(o, now.Add(-30*time.Minute), 1, "500", "0.1")
+	observe(o, now.Add(-30*time.Minute), 1, "200", "0.75")
+	// Health checks are not counted.
+	o.Observe(now, parser.Record{"path": "/healthz", "status": "503", "request_time": "0.1"})
+
+	for _, tc := range []struct {
+		window time.Duration
+		want   float64
+	}{
+		{time.Hour, 2},
+		{6 * time.Hour, 2},
+		{time.Minute * 10, 0},
+	} {
+		if got := o.BurnRate(now, tc.window); !approxEqual(got, tc.want) {
+			t.Errorf("Expected burn rate %v over %v, got %v", tc.want, tc.window, got)
+		}
+	}
+	if got, want := o.BudgetRemaining(now), -1.0; !approxEqual(got, want) {
+		t.Errorf("Expected remaining budget %v, got %v", want, got)
+	}
+	// A day later, the earlier records have left the period.
+	if got, want := o.BudgetRemaining(now.Add(24*time.Hour)), 1.0; !approxEqual(got, want) {
+		t.Errorf("Expected remaining budget %v, got %v", want, got)
+	}
+
+	// Records preceding the period are ignored.
+	observe(o, now.Add(-48*time.Hour), 10, "503", "0.1")
+	if got, want := o.BurnRate(now, 6*time.Hour), 2.0; !approxEqual(got, want) {
+		t.Errorf("Expected burn rate %v after late records, got %v", want, got)
+	}
+}
+
+func TestObjectiveValues(t *testing.T) {
+	o := newObjective()
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	observe(o, now.Add(-2*time.Hour), 99, "200", "0.1")
+	observe(o, now.Add(-2*time.Hour), 1, "502", "0.1")
+
+	v := o.Values(now)
+	specs := o.GaugeSpecs()
+	got := v.Gauges[specs[0].Name]
+	if len(got) != 2 || !approxEqual(got["1h"], 0) || !approxEqual(got["6h"], 1) {
+		t.Errorf("Expected burn rates of 0 over 1h and 1 over 6h, got %v", got)
+	}
+	if got := v.Gauges[specs[1].Name][""]; !approxEqual(got, 0) {
+		t.Errorf("Expected no remaining budget, got %v", got)
+	}
+
+	counters := o.Specs()
+	for _, tc := range []struct {
+		record    parser.Record
+		good, all bool
+	}{
+		{parser.Record{"path": "/", "status": "200", "request_time": "0.5"}, true, true},
+		{parser.Record{"path": "/", "status": "200", "request_time": "0.6"}, false, true},
+		{parser.Record{"path": "/", "status": "500", "request_time": "0.1"}, false, true},
+		{parser.Record{"path": "/healthz", "status": "200", "request_time": "0.1"}, false, false},
+	} {
+		if got := counters[0].Matches(tc.record); got != tc.good {
+			t.Errorf("Expected %s Matches(%v) to return %v, got %v", counters[0].Name, tc.record, tc.good, got)
+		}
+		if got := counters[1].Matches(tc.record); got != tc.all {
+			t.Errorf("Expected %s Matches(%v) to return %v, got %v", counters[1].Name, tc.record, tc.all, got)
+		}
+	}
+}
+
+func TestObjectiveRestore(t *testing.T) {
+	o := newObjective()
+	if s := o.Snapshot(); s != nil {
+		t.Errorf("Expected no State before records are counted, got %+v", s)
+	}
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	observe(o, now.Add(-3*time.Hour), 95, "200", "0.1")
+	observe(o, now.Add(-3*time.Hour), 5, "500", "0.1")
+	observe(o, now.Add(-10*time.Minute), 10, "500", "0.1")
+
+	restored := newObjective()
+	restored.Restore(o.Snapshot())
+	for _, w := range []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour} {
+		if want, got := o.BurnRate(now, w), restored.BurnRate(now, w); !approxEqual(want, got) {
+			t.Errorf("Expected restored burn rate %v over %v, got %v", want, w, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, o := range []*slo.Objective{
+		{Name: "Availability", Target: 0.99, Period: time.Hour},
+		{Name: "availability", Target: 1, Period: time.Hour},
+		{Name: "availability", Target: 0.99, Period: time.Minute},
+		{Name: "availability", Target: 0.99, Period: time.Hour, Windows: []time.Duration{2 * time.Hour}},
+		{Name: "availability", Target: 0.99, Period: time.Hour, Windows: []time.Duration{7 * time.Minute}},
+	} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Expected Validate to fail for %+v", o)
+		}
+	}
+}
+
+func TestFormatWindow(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Hour:                       "1h",
+		6 * time.Hour:                   "6h",
+		72 * time.Hour:                  "3d",
+		90 * time.Minute:                "90m",
+		90*time.Minute + 30*time.Second: "1h30m30s",
+	} {
+		if got := slo.FormatWindow(d); got != want {
+			t.Errorf("Expected FormatWindow(%v) to return %q, got %q", d, want, got)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+)
+
+// Names of metrics describing the consumer itself.
+const (
+	TailerBytesRead   = "agent/tailer/bytes_read"
+	TailerRotations   = "agent/tailer/rotations"
+	TailerTruncations = "agent/tailer/truncations"
+	TailerLag         = "agent/tailer/lag_bytes"
+
+	ConsumerLines            = "agent/consumer/lines"
+	ConsumerParseErrors      = "agent/consumer/parse_errors"
+	ConsumerFilteredLines    = "agent/consumer/filtered_lines"
+	ConsumerFilterExclusions = "agent/consumer/filter_exclusions"
+	ConsumerLateLines        = "agent/consumer/late_lines"
+	ConsumerEventLag         = "agent/consumer/event_lag"
+
+	ExporterWrites        = "agent/exporter/writes"
+	ExporterWriteFailures = "agent/exporter/write_failures"
+	ExporterWriteLatency  = "agent/exporter/write_latency"
+	ExporterDroppedWrites = "agent/exporter/dropped_writes"
+)
+
+// Reasons for which log lines may be filtered (see ConsumerFilteredLines).
+const (
+	// FilteredBeforeReset lines precede the reset time of cumulative
+	// metrics (e.g. as they were consumed by a previous process).
+	FilteredBeforeReset = "before_reset"
+)
+
+// Kinds of write failure (see ExporterWriteFailures).
+const (
+	FailureTransient = "transient"
+	FailurePermanent = "permanent"
+)
+
+// Events whose latest occurrence is recorded (see Registry.Mark).
+const (
+	// EventRead is a successful read of the access log (whether or not
+	// there was new content).
+	EventRead = "read"
+	// EventWrite is a successful timeseries write request.
+	EventWrite = "write"
+	// EventWriteFailure is a failed timeseries write request.
+	EventWriteFailure = "write_failure"
+)
+
+// Specs returns the Specs of all metrics describing the consumer itself.
+func Specs() []*metric.Spec {
+	reason := []metric.Label{
+		{
+			Name:        "reason",
+			Field:       "reason",
+			Type:        metric.StringLabel,
+			Description: "Reason",
+		},
+	}
+	return []*metric.Spec{
+		{
+			Name:        TailerBytesRead,
+			Kind:        metric.Counter,
+			Description: "Cumulative bytes read from the access log.",
+			Unit:        "By",
+		},
+		{
+			Name:        TailerRotations,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of access log rotations detected.",
+		},
+		{
+			Name:        TailerTruncations,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of access log truncations detected.",
+		},
+		{
+			Name:        TailerLag,
+			Kind:        metric.Gauge,
+			Description: "Bytes of access log content not yet read when last polled.",
+			Unit:        "By",
+		},
+		{
+			Name:        ConsumerLines,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of log lines consumed.",
+		},
+		{
+			Name:        ConsumerParseErrors,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of log lines which could not be parsed, by reason.",
+			Labels:      reason,
+		},
+		{
+			Name:        ConsumerFilteredLines,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of parsed log lines excluded from metrics, by reason.",
+			Labels:      reason,
+		},
+		{
+			Name:        ConsumerFilterExclusions,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of log records excluded from each metric by its filter.",
+			Labels: []metric.Label{
+				{
+					Name:        "metric",
+					Field:       "metric",
+					Type:        metric.StringLabel,
+					Description: "Metric name",
+				},
+			},
+		},
+		{
+			Name:        ConsumerLateLines,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of log lines arriving after their event-time window was closed.",
+		},
+		{
+			Name:        ConsumerEventLag,
+			Kind:        metric.Gauge,
+			Description: "Time between the latest log timestamp consumed and when it was consumed.",
+			Unit:        "s",
+		},
+		{
+			Name:        ExporterWrites,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of timeseries write requests.",
+		},
+		{
+			Name:        ExporterWriteFailures,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of failed timeseries write requests, by kind of failure (transient or permanent).",
+			Labels: []metric.Label{
+				{
+					Name:        "kind",
+					Field:       "kind",
+					Type:        metric.StringLabel,
+					Description: "Kind of failure",
+				},
+			},
+		},
+		{
+			Name:        ExporterWriteLatency,
+			Kind:        metric.Distribution,
+			Description: "Latency of timeseries write requests.",
+			Unit:        "s",
+			Buckets:     []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		{
+			Name:        ExporterDroppedWrites,
+			Kind:        metric.Counter,
+			Description: "Cumulative count of timeseries writes discarded after permanent failures or overflow of the pending write buffer.",
+		},
+	}
+}
+
+// Registry records metrics describing the consumer itself. It is safe for
+// concurrent use. Methods of a nil *Registry do nothing, so that components
+// may record metrics unconditionally.
+type Registry struct {
+	mu    sync.Mutex
+	specs map[string]*metric.Spec
+	// values holds cumulative values, and pending those recorded since
+	// the last call to Collect.
+	values  *metric.Values
+	pending *metric.Values
+	// events holds the time of the latest occurrence of each event.
+	events map[string]time.Time
+}
+
+// New returns an empty Registry for the metrics described by Specs.
+func New() *Registry {
+	r := &Registry{
+		specs:   make(map[string]*metric.Spec),
+		values:  metric.NewValues(),
+		pending: metric.NewValues(),
+		events:  make(map[string]time.Time),
+	}
+	for _, s := range Specs() {
+		r.specs[s.Name] = s
+	}
+	return r
+}
+
+// Add adds n to the named counter, for the supplied label values. Zero values
+// are ignored, so that unchanged counters are not exported.
+func (r *Registry) Add(name string, n int64, labels ...string) {
+	if r == nil || n == 0 {
+		return
+	}
+	key := metric.Key(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values.AddCount(name, key, n)
+	r.pending.AddCount(name, key, n)
+}
+
+// Observe records a sample in the named distribution, for the supplied label
+// values.
+func (r *Registry) Observe(name string, x float64, labels ...string) {
+	if r == nil {
+		return
+	}
+	key := metric.Key(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buckets := r.specs[name].Buckets
+	r.values.AddSample(name, key, x, buckets)
+	r.pending.AddSample(name, key, x, buckets)
+}
+
+// Set sets the named gauge, for the supplied label values.
+func (r *Registry) Set(name string, x float64, labels ...string) {
+	if r == nil {
+		return
+	}
+	key := metric.Key(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values.SetGauge(name, key, x)
+	r.pending.SetGauge(name, key, x)
+}
+
+// Mark records an occurrence of the supplied event (one of the Event*
+// constants) at the current time.
+func (r *Registry) Mark(event string) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[event] = now
+}
+
+// Last returns the time of the latest occurrence of the supplied event, or the
+// zero time if none has been recorded.
+func (r *Registry) Last(event string) time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[event]
+}
+
+// Snapshot returns a copy of the cumulative values recorded (and the latest
+// values of gauges).
+func (r *Registry) Snapshot() *metric.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.values.Copy()
+}
+
+// Collect returns the values recorded since the last call to Collect, as
+// deltas suitable for export (see exporter.ExporterT). Gauges hold their
+// latest values.
+func (r *Registry) Collect() *metric.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deltas := r.pending
+	r.pending = metric.NewValues()
+	for name, gauges := range r.values.Gauges {
+		for key, x := range gauges {
+			deltas.SetGauge(name, key, x)
+		}
+	}
+	return deltas
+}
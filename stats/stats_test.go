@@ -0,0 +1,93 @@
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/stats"
+)
+
+func TestSpecs(t *testing.T) {
+	names := make(map[string]bool)
+	for _, s := range stats.Specs() {
+		if names[s.Name] {
+			t.Errorf("Duplicate spec %s", s.Name)
+		}
+		names[s.Name] = true
+		// Other kinds are not computed from records, so are not
+		// expected to validate.
+		if s.Kind != metric.Counter {
+			continue
+		}
+		if err := s.Validate(); err != nil {
+			t.Errorf("Invalid spec %s: %v", s.Name, err)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	r := stats.New()
+	r.Add(stats.ConsumerLines, 3)
+	r.Add(stats.ConsumerParseErrors, 1, "invalid_json")
+	r.Observe(stats.ExporterWriteLatency, 0.2)
+	r.Set(stats.TailerLag, 100)
+	r.Add(stats.TailerRotations, 0)
+
+	deltas := r.Collect()
+	if want, got := int64(3), deltas.Counters[stats.ConsumerLines][""]; want != got {
+		t.Errorf("Expected %d lines, got %d", want, got)
+	}
+	if want, got := int64(1), deltas.Counters[stats.ConsumerParseErrors]["invalid_json"]; want != got {
+		t.Errorf("Expected %d parse errors, got %d", want, got)
+	}
+	if want, got := int64(1), deltas.Distributions[stats.ExporterWriteLatency][""].Count; want != got {
+		t.Errorf("Expected %d latency samples, got %d", want, got)
+	}
+	if _, ok := deltas.Counters[stats.TailerRotations]; ok {
+		t.Errorf("Expected no rotations, got %v", deltas.Counters)
+	}
+
+	// Counters are reset between calls to Collect, but gauges are retained.
+	r.Add(stats.ConsumerLines, 2)
+	deltas = r.Collect()
+	if want, got := int64(2), deltas.Counters[stats.ConsumerLines][""]; want != got {
+		t.Errorf("Expected %d lines, got %d", want, got)
+	}
+	if _, ok := deltas.Distributions[stats.ExporterWriteLatency]; ok {
+		t.Errorf("Expected no latency samples, got %v", deltas.Distributions)
+	}
+	if want, got := 100.0, deltas.Gauges[stats.TailerLag][""]; want != got {
+		t.Errorf("Expected lag %v, got %v", want, got)
+	}
+
+	if want, got := int64(5), r.Snapshot().Counters[stats.ConsumerLines][""]; want != got {
+		t.Errorf("Expected cumulative %d lines, got %d", want, got)
+	}
+}
+
+func TestMark(t *testing.T) {
+	r := stats.New()
+	if last := r.Last(stats.EventRead); !last.IsZero() {
+		t.Errorf("Expected no reads, got %v", last)
+	}
+	before := time.Now()
+	r.Mark(stats.EventRead)
+	if last := r.Last(stats.EventRead); last.Before(before) {
+		t.Errorf("Expected read no earlier than %v, got %v", before, last)
+	}
+	if last := r.Last(stats.EventWrite); !last.IsZero() {
+		t.Errorf("Expected no writes, got %v", last)
+	}
+}
+
+func TestNil(t *testing.T) {
+	var r *stats.Registry
+	r.Add(stats.ConsumerLines, 1)
+	r.Observe(stats.ExporterWriteLatency, 1)
+	r.Set(stats.TailerLag, 1)
+	r.Mark(stats.EventRead)
+	if last := r.Last(stats.EventRead); !last.IsZero() {
+		t.Errorf("Expected no reads, got %v", last)
+	}
+}
@@ -1,13 +1,26 @@
 package tailer
 
 import (
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"syscall"
 	"time"
+
+	"github.com/swfrench/nginx-log-consumer/stats"
 )
 
 type TailerT interface {
 	Next() ([]byte, error)
+	Position() (Position, error)
+}
+
+// Position identifies the read position of a Tailer: The file being read (by
+// inode number) and the offset within it.
+type Position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
 }
 
 type Tailer struct {
@@ -16,6 +29,7 @@ type Tailer struct {
 	fileInfo     os.FileInfo
 	lastContent  time.Time
 	idleDuration time.Duration
+	stats        *stats.Registry
 }
 
 // NewTailer creates a new Tailer object configured to read data from the file
@@ -33,6 +47,38 @@ func NewTailer(path string, idleDuration time.Duration) (*Tailer, error) {
 	return t, nil
 }
 
+// NewTailerAt creates a new Tailer as in NewTailer, but resumes reading at the
+// supplied Position (e.g. one saved by a previous process) if it refers to the
+// file currently at path. Otherwise, reading starts from the beginning of the
+// file.
+func NewTailerAt(path string, idleDuration time.Duration, pos Position) (*Tailer, error) {
+	t, err := NewTailer(path, idleDuration)
+	if err != nil {
+		return nil, err
+	}
+	if inode(t.fileInfo) != pos.Inode {
+		log.Printf("Log file %s has been rotated since position %v was saved; reading from start", path, pos)
+		return t, nil
+	}
+	if t.fileInfo.Size() < pos.Offset {
+		log.Printf("Log file %s has been truncated since position %v was saved; reading from start", path, pos)
+		return t, nil
+	}
+	if _, err := t.file.Seek(pos.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// inode returns the inode number for the supplied file, or zero if not
+// available on this platform.
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
 func (t *Tailer) openOrRotate() error {
 	file, err := os.Open(t.path)
 	if err != nil {
@@ -53,6 +99,8 @@ func (t *Tailer) openOrRotate() error {
 		file.Close()
 	} else {
 		// Later check, rotation detected.
+		log.Printf("Log file %s has been rotated; reading from start of new file", t.path)
+		t.stats.Add(stats.TailerRotations, 1)
 		t.file.Close()
 		t.file = file
 		t.fileInfo = info
@@ -62,12 +110,28 @@ func (t *Tailer) openOrRotate() error {
 
 // Next will return content newly read from the log file. If no new content is
 // available, and this condition has persisted for at least the idleDuration, a
-// rotation check will be performed.
+// rotation check will be performed. If the file has been truncated (e.g. by
+// copytruncate rotation), reading resumes from its start.
 func (t *Tailer) Next() ([]byte, error) {
+	if info, err := t.file.Stat(); err == nil {
+		if offset, err := t.file.Seek(0, io.SeekCurrent); err == nil {
+			if info.Size() < offset {
+				log.Printf("Log file %s has been truncated; reading from start", t.path)
+				t.stats.Add(stats.TailerTruncations, 1)
+				if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+					return nil, err
+				}
+				offset = 0
+			}
+			t.stats.Set(stats.TailerLag, float64(info.Size()-offset))
+		}
+	}
+
 	bytes, err := ioutil.ReadAll(t.file)
 	if err != nil {
 		return nil, err
 	}
+	t.stats.Add(stats.TailerBytesRead, int64(len(bytes)))
 
 	now := time.Now()
 
@@ -79,3 +143,34 @@ func (t *Tailer) Next() ([]byte, error) {
 
 	return bytes, nil
 }
+
+// Position returns the current read position: Content up to Position has been
+// returned by Next.
+func (t *Tailer) Position() (Position, error) {
+	offset, err := t.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return Position{}, err
+	}
+	return Position{
+		Inode:  inode(t.fileInfo),
+		Offset: offset,
+	}, nil
+}
+
+// SetIdleDuration changes the period of file inactivity after which calls to
+// Next() invoke a rotation check.
+func (t *Tailer) SetIdleDuration(idleDuration time.Duration) {
+	t.idleDuration = idleDuration
+}
+
+// SetStats sets the Registry in which bytes read, rotations, truncations and
+// lag are recorded.
+func (t *Tailer) SetStats(r *stats.Registry) {
+	t.stats = r
+}
+
+// Close closes the file currently being read. The Tailer may not be used
+// afterward.
+func (t *Tailer) Close() error {
+	return t.file.Close()
+}
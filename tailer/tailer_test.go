@@ -3,11 +3,13 @@ package tailer_test
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/swfrench/nginx-log-consumer/stats"
 	"github.com/swfrench/nginx-log-consumer/tailer"
 )
 
@@ -180,3 +182,125 @@ func TestReadRotate(t *testing.T) {
 		}
 	}
 }
+
+func TestResume(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "test_log_file")
+	if err != nil {
+		t.Fatalf("Could not open test log file: %v", logFile)
+	}
+	defer os.Remove(logFile.Name())
+
+	tail, err := tailer.NewTailer(logFile.Name(), time.Second)
+	if err != nil {
+		t.Fatalf("Could not create tailer: %v", err)
+	}
+
+	if err := syncWrite(logFile, []byte("foo")); err != nil {
+		t.Fatalf("Could not durably write to log file: %v", err)
+	}
+
+	if _, err := tail.Next(); err != nil {
+		t.Fatalf("Error fetching next byte slice: %v", err)
+	}
+
+	pos, err := tail.Position()
+	if err != nil {
+		t.Fatalf("Error fetching position: %v", err)
+	}
+	if want, got := int64(3), pos.Offset; want != got {
+		t.Fatalf("Expected position offset %v, got %v", want, got)
+	}
+
+	if err := syncWrite(logFile, []byte("bar")); err != nil {
+		t.Fatalf("Could not durably write to log file: %v", err)
+	}
+
+	// A new tailer resuming at the saved position should only see new
+	// content.
+
+	resumed, err := tailer.NewTailerAt(logFile.Name(), time.Second, pos)
+	if err != nil {
+		t.Fatalf("Could not create tailer: %v", err)
+	}
+
+	b, err := resumed.Next()
+	if err != nil {
+		t.Fatalf("Error fetching next byte slice: %v", err)
+	}
+	if want, got := []byte("bar"), b; bytes.Compare(want, got) != 0 {
+		t.Fatalf("Expected to read %v, got %v", want, got)
+	}
+
+	// A position referring to a different file should be ignored.
+
+	pos.Inode += 1
+	other, err := tailer.NewTailerAt(logFile.Name(), time.Second, pos)
+	if err != nil {
+		t.Fatalf("Could not create tailer: %v", err)
+	}
+
+	b, err = other.Next()
+	if err != nil {
+		t.Fatalf("Error fetching next byte slice: %v", err)
+	}
+	if want, got := []byte("foobar"), b; bytes.Compare(want, got) != 0 {
+		t.Fatalf("Expected to read %v, got %v", want, got)
+	}
+
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Could not close log file")
+	}
+}
+
+func TestReadTruncate(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "test_log_file")
+	if err != nil {
+		t.Fatalf("Could not open test log file: %v", logFile)
+	}
+	defer os.Remove(logFile.Name())
+
+	tail, err := tailer.NewTailer(logFile.Name(), time.Second)
+	if err != nil {
+		t.Fatalf("Could not create tailer: %v", err)
+	}
+	r := stats.New()
+	tail.SetStats(r)
+
+	if err := syncWrite(logFile, []byte("foobar")); err != nil {
+		t.Fatalf("Could not durably write to log file: %v", err)
+	}
+	if _, err := tail.Next(); err != nil {
+		t.Fatalf("Error fetching next byte slice: %v", err)
+	}
+
+	// Truncate (as in copytruncate rotation) and write less content than
+	// was read previously.
+	if err := logFile.Truncate(0); err != nil {
+		t.Fatalf("Could not truncate log file: %v", err)
+	}
+	if _, err := logFile.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Could not seek log file: %v", err)
+	}
+	if err := syncWrite(logFile, []byte("baz")); err != nil {
+		t.Fatalf("Could not durably write to log file: %v", err)
+	}
+
+	b, err := tail.Next()
+	if err != nil {
+		t.Fatalf("Error fetching next byte slice: %v", err)
+	}
+	if want, got := []byte("baz"), b; bytes.Compare(want, got) != 0 {
+		t.Fatalf("Expected to read %s, got %s", want, got)
+	}
+
+	values := r.Snapshot()
+	if want, got := int64(1), values.Counters[stats.TailerTruncations][""]; want != got {
+		t.Errorf("Expected %d truncations, got %d", want, got)
+	}
+	if want, got := int64(9), values.Counters[stats.TailerBytesRead][""]; want != got {
+		t.Errorf("Expected %d bytes read, got %d", want, got)
+	}
+	if want, got := 3.0, values.Gauges[stats.TailerLag][""]; want != got {
+		t.Errorf("Expected lag of %v bytes, got %v", want, got)
+	}
+}
@@ -0,0 +1,255 @@
+// Package topk tracks the most frequent values of record fields (heavy
+// hitters, e.g. the paths or client addresses dominating traffic) over sliding
+// windows, in bounded memory.
+package topk
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/window"
+)
+
+const (
+	// DefaultCapacity is the default number of values counted by each
+	// Summary.
+	DefaultCapacity = 100
+
+	// DefaultTop is the default number of values reported.
+	DefaultTop = 10
+
+	// DefaultWindow is the default period over which values are counted.
+	DefaultWindow = 5 * time.Minute
+
+	// maxValueLength is the maximum length, in bytes, of exported values
+	// (Cloud Monitoring's limit on label values).
+	maxValueLength = 1024
+
+	// buckets is the number of Summaries into which each window is divided,
+	// determining the granularity with which it slides.
+	buckets = 10
+
+	// metricPrefix precedes the names of exported metrics (see Spec).
+	metricPrefix = "heavy_hitters/"
+
+	// ValueLabel is the label of exported metrics holding the value
+	// counted.
+	ValueLabel = "value"
+)
+
+// Count is the estimated count of a value. The true count is at least
+// Count-Error, and at most Count.
+type Count struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+	Error int64  `json:"error"`
+}
+
+// Summary counts the most frequent values added, using the Space-Saving
+// algorithm: At most capacity values are counted, and a value not counted
+// replaces that with the lowest count, inheriting it as its Error. Values
+// occurring more than 1/capacity of the time are guaranteed to be counted.
+type Summary struct {
+	capacity int
+	counts   map[string]*Count
+}
+
+// NewSummary returns an empty Summary counting at most capacity values.
+func NewSummary(capacity int) *Summary {
+	return &Summary{
+		capacity: capacity,
+		counts:   make(map[string]*Count),
+	}
+}
+
+// Add adds n occurrences of the supplied value.
+func (s *Summary) Add(value string, n int64) {
+	if c, ok := s.counts[value]; ok {
+		c.Count += n
+		return
+	}
+	if len(s.counts) < s.capacity {
+		s.counts[value] = &Count{Value: value, Count: n}
+		return
+	}
+	var min *Count
+	for _, c := range s.counts {
+		if min == nil || c.Count < min.Count || (c.Count == min.Count && c.Value > min.Value) {
+			min = c
+		}
+	}
+	delete(s.counts, min.Value)
+	s.counts[value] = &Count{Value: value, Count: min.Count + n, Error: min.Count}
+}
+
+// Merge adds the counts of o, retaining the capacity values with the highest
+// combined counts.
+func (s *Summary) Merge(o *Summary) {
+	for value, c := range o.counts {
+		if sc, ok := s.counts[value]; ok {
+			sc.Count += c.Count
+			sc.Error += c.Error
+		} else {
+			x := *c
+			s.counts[value] = &x
+		}
+	}
+	if len(s.counts) > s.capacity {
+		for _, c := range s.Top(len(s.counts))[s.capacity:] {
+			delete(s.counts, c.Value)
+		}
+	}
+}
+
+// Top returns (copies of) the counts of the n most frequent values, in
+// decreasing order of count.
+func (s *Summary) Top(n int) []Count {
+	var counts []Count
+	for _, c := range s.counts {
+		counts = append(counts, *c)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Value < counts[j].Value
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// Tracker counts the most frequent values of a record field over a sliding
+// window, divided into buckets each holding a Summary. It is safe for
+// concurrent use.
+type Tracker struct {
+	// Name identifies the Tracker (e.g. paths).
+	Name string
+	// Field names the record field whose values are counted.
+	Field string
+	// Filter, if set, selects the records counted (e.g. only errors).
+	Filter *metric.Filter
+	// Window is the period over which values are counted.
+	Window time.Duration
+	// Capacity is the number of values counted by each bucket.
+	Capacity int
+	// N is the number of values reported by Top.
+	N int
+	// Export enables export of the top values as a metric (see Spec).
+	Export bool
+
+	mu      sync.Mutex
+	buckets *window.Ring[*Summary]
+}
+
+// Validate checks that the Tracker is well formed.
+func (t *Tracker) Validate() error {
+	if err := metric.ValidateName(t.Name); err != nil {
+		return err
+	}
+	if t.Field == "" {
+		return fmt.Errorf("field must be set")
+	}
+	if t.Window < buckets*time.Second {
+		return fmt.Errorf("window must be at least %v", buckets*time.Second)
+	}
+	if t.N <= 0 || t.Capacity < t.N {
+		return fmt.Errorf("top must be positive, and capacity at least top")
+	}
+	return nil
+}
+
+// Observe counts the value of the Field of the supplied record, with the
+// supplied timestamp, if it is selected by the Filter. Records lacking the
+// Field, or preceding the window, are ignored.
+func (t *Tracker) Observe(ts time.Time, r parser.Record) {
+	value, ok := r[t.Field]
+	if !ok || !t.Filter.Matches(r) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buckets == nil {
+		t.buckets = window.New[*Summary](t.Window/buckets, buckets)
+	}
+	s := t.buckets.Add(ts)
+	if s == nil {
+		return
+	}
+	if *s == nil {
+		*s = NewSummary(t.Capacity)
+	}
+	(*s).Add(value, 1)
+}
+
+// Top returns the counts of the N most frequent values over the window ending
+// at the supplied time.
+func (t *Tracker) Top(now time.Time) []Count {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	merged := NewSummary(t.Capacity)
+	if t.buckets != nil {
+		t.buckets.Each(now, t.Window, func(s *Summary) {
+			if s != nil {
+				merged.Merge(s)
+			}
+		})
+	}
+	return merged.Top(t.N)
+}
+
+// Spec returns the Spec of the metric to which the top values are exported: A
+// Transient gauge, labelled by value.
+func (t *Tracker) Spec() *metric.Spec {
+	return &metric.Spec{
+		Name:        metricPrefix + t.Name,
+		Kind:        metric.Gauge,
+		Description: fmt.Sprintf("Estimated count of records with each of the %d most frequent values of %s, over the preceding %v.", t.N, t.Field, t.Window),
+		Labels: []metric.Label{
+			{
+				Name:        ValueLabel,
+				Field:       t.Field,
+				Type:        metric.StringLabel,
+				Description: fmt.Sprintf("Value of %s", t.Field),
+			},
+		},
+		Transient: true,
+	}
+}
+
+// Values returns the top values over the window ending at the supplied time,
+// as gauges of the metric described by Spec. Values too long to export are
+// truncated (see truncate).
+func (t *Tracker) Values(now time.Time) *metric.Values {
+	values := metric.NewValues()
+	name := t.Spec().Name
+	for _, c := range t.Top(now) {
+		values.SetGauge(name, metric.Key([]string{truncate(c.Value)}), float64(c.Count))
+	}
+	return values
+}
+
+// truncate returns the supplied value if no longer than maxValueLength, or
+// else its longest prefix (of whole UTF-8 characters) which fits when
+// followed by "..." and a hash of the whole value, keeping distinct values
+// distinct.
+func truncate(value string) string {
+	if len(value) <= maxValueLength {
+		return value
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	suffix := fmt.Sprintf("...%08x", h.Sum32())
+	n := maxValueLength - len(suffix)
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return value[:n] + suffix
+}
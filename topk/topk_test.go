@@ -0,0 +1,166 @@
+package topk_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/swfrench/nginx-log-consumer/metric"
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/topk"
+)
+
+func TestSummary(t *testing.T) {
+	s := topk.NewSummary(3)
+	for _, v := range []string{"a", "b", "a", "c", "a", "b"} {
+		s.Add(v, 1)
+	}
+	if want, got := []topk.Count{{"a", 3, 0}, {"b", 2, 0}}, s.Top(2); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected exact counts %v below capacity, got %v", want, got)
+	}
+
+	// A new value replaces that with the lowest count, inheriting it as
+	// its error.
+	s.Add("d", 1)
+	if want, got := []topk.Count{{"a", 3, 0}, {"b", 2, 0}, {"d", 2, 1}}, s.Top(10); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected counts %v, got %v", want, got)
+	}
+}
+
+func TestSummaryHeavyHitters(t *testing.T) {
+	// Values occurring more than 1/capacity of the time are always
+	// counted, despite many infrequent values.
+	s := topk.NewSummary(20)
+	for i := 0; i < 10000; i++ {
+		switch {
+		case i%5 == 0:
+			s.Add("/popular", 1)
+		case i%10 == 1:
+			s.Add("/common", 1)
+		default:
+			s.Add(fmt.Sprintf("/rare/%d", i), 1)
+		}
+	}
+	top := s.Top(2)
+	if top[0].Value != "/popular" || top[1].Value != "/common" {
+		t.Fatalf("Expected /popular and /common to be the top values, got %v", top)
+	}
+	for _, c := range top {
+		want := int64(2000)
+		if c.Value == "/common" {
+			want = 1000
+		}
+		if c.Count-c.Error > want || c.Count < want {
+			t.Errorf("Expected count of %s to bound %d, got %+v", c.Value, want, c)
+		}
+	}
+}
+
+func TestSummaryMerge(t *testing.T) {
+	a, b := topk.NewSummary(2), topk.NewSummary(2)
+	a.Add("x", 5)
+	a.Add("y", 1)
+	b.Add("y", 3)
+	b.Add("z", 2)
+	a.Merge(b)
+	if want, got := []topk.Count{{"x", 5, 0}, {"y", 4, 0}}, a.Top(10); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected merged counts %v, got %v", want, got)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	five := "500"
+	tr := &topk.Tracker{
+		Name:     "error_paths",
+		Field:    "path",
+		Filter:   &metric.Filter{Include: []metric.Rule{{{Field: "status", Equals: &five}}}},
+		Window:   time.Minute,
+		Capacity: 10,
+		N:        2,
+	}
+	if err := tr.Validate(); err != nil {
+		t.Fatalf("Expected Tracker to be valid, got %v", err)
+	}
+
+	start := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, r := range []struct {
+		offset time.Duration
+		path   string
+		status string
+	}{
+		{0, "/old", "500"},
+		{0, "/old", "500"},
+		{0, "/old", "500"},
+		{50 * time.Second, "/a", "500"},
+		{55 * time.Second, "/b", "500"},
+		{65 * time.Second, "/a", "500"},
+		{70 * time.Second, "/ok", "200"},
+		{70 * time.Second, "/ok", "200"},
+	} {
+		tr.Observe(start.Add(r.offset), parser.Record{"path": r.path, "status": r.status})
+	}
+	// Records lacking the field are ignored.
+	tr.Observe(start.Add(70*time.Second), parser.Record{"status": "500"})
+
+	now := start.Add(75 * time.Second)
+	if want, got := []topk.Count{{"/a", 2, 0}, {"/b", 1, 0}}, tr.Top(now); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected top values %v over the last minute, got %v", want, got)
+	}
+	if want, got := map[string]float64{"/a": 2, "/b": 1}, tr.Values(now).Gauges[tr.Spec().Name]; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected gauges %v, got %v", want, got)
+	}
+	if got := tr.Top(now.Add(time.Hour)); len(got) != 0 {
+		t.Errorf("Expected no top values after the window, got %v", got)
+	}
+
+	// Records preceding the window are ignored.
+	tr.Observe(start, parser.Record{"path": "/old", "status": "500"})
+	if want, got := []topk.Count{{"/a", 2, 0}, {"/b", 1, 0}}, tr.Top(now); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected top values %v after a late record, got %v", want, got)
+	}
+}
+
+func TestTrackerValuesTruncated(t *testing.T) {
+	tr := &topk.Tracker{
+		Name:     "paths",
+		Field:    "path",
+		Window:   time.Minute,
+		Capacity: 10,
+		N:        10,
+	}
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	long := "/" + strings.Repeat("é", 1024)
+	for _, path := range []string{"/", long + "a", long + "b"} {
+		tr.Observe(now, parser.Record{"path": path})
+	}
+
+	gauges := tr.Values(now).Gauges[tr.Spec().Name]
+	if len(gauges) != 3 {
+		t.Fatalf("Expected 3 distinct values, got %v", gauges)
+	}
+	for value := range gauges {
+		if len(value) > 1024 || !utf8.ValidString(value) {
+			t.Errorf("Expected values of at most 1024 bytes of valid UTF-8, got %q", value)
+		}
+	}
+	if _, ok := gauges["/"]; !ok {
+		t.Errorf("Expected short values not to be truncated, got %v", gauges)
+	}
+}
+
+func TestTrackerValidate(t *testing.T) {
+	for _, tr := range []*topk.Tracker{
+		{Name: "Paths", Field: "path", Window: time.Minute, Capacity: 10, N: 5},
+		{Name: "paths", Window: time.Minute, Capacity: 10, N: 5},
+		{Name: "paths", Field: "path", Window: time.Second, Capacity: 10, N: 5},
+		{Name: "paths", Field: "path", Window: time.Minute, Capacity: 4, N: 5},
+		{Name: "paths", Field: "path", Window: time.Minute, Capacity: 10},
+	} {
+		if err := tr.Validate(); err == nil {
+			t.Errorf("Expected Validate to fail for %+v", tr)
+		}
+	}
+}
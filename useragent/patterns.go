@@ -0,0 +1,66 @@
+package useragent
+
+// DefaultPatterns is the bundled pattern database (see Parse). Monitors and
+// bots are matched first, as many identify themselves with browser-like user
+// agents; a file in the same format may be supplied in its place.
+const DefaultPatterns = `
+- class: monitor
+  patterns:
+    - '^GoogleHC/'
+    - '^ELB-HealthChecker/'
+    - '^kube-probe/'
+    - '^Consul Health Check'
+    - '(?i)uptimerobot'
+    - '(?i)pingdom'
+    - '(?i)statuscake'
+    - '(?i)site24x7'
+    - '(?i)newrelicpinger'
+    - '(?i)datadog.*synthetics|^Datadog Agent/'
+    - '(?i)better ?uptime'
+    - '(?i)checkly'
+    - '(?i)freshping'
+    - '(?i)nagios|check_http'
+    - '(?i)zabbix'
+    - '^Blackbox Exporter/'
+    - '^Prometheus/'
+    - '(?i)GoogleStackdriverMonitoring-UptimeChecks'
+
+- class: bot
+  patterns:
+    - '(?i)googlebot|google-inspectiontool|adsbot-google|mediapartners-google|storebot-google|googleother'
+    - '(?i)bingbot|bingpreview|msnbot|adidxbot'
+    - '(?i)yandex(bot|images|metrika)'
+    - '(?i)baiduspider'
+    - '(?i)duckduckbot|duckassistbot'
+    - '(?i)slurp'
+    - '(?i)applebot'
+    - '(?i)facebookexternalhit|facebookcatalog|meta-externalagent'
+    - '(?i)twitterbot|linkedinbot|slackbot|discordbot|telegrambot|whatsapp'
+    - '(?i)ahrefs|semrush|mj12bot|dotbot|petalbot|bytespider|dataforseo'
+    - '(?i)gptbot|chatgpt-user|oai-searchbot|claudebot|claude-web|anthropic-ai|ccbot|perplexitybot|amazonbot'
+    - '(?i)scrapy'
+    - '(?i)(bot|crawler|spider|crawl)\b'
+
+- class: library
+  patterns:
+    - '^curl/'
+    - '^Wget/'
+    - '^python-requests/|^Python-urllib/|^python-httpx/|^aiohttp/'
+    - '^Go-http-client/'
+    - '^Java/|^Apache-HttpClient/|^okhttp/'
+    - '^libwww-perl/|^LWP::'
+    - '^axios/|^node-fetch/|^undici|^got '
+    - '^Ruby|^Faraday '
+    - '^GuzzleHttp/'
+    - '^Dart/'
+    - '^reqwest/'
+    - '^PostmanRuntime/|^insomnia/|^HTTPie/'
+    - '^HTTrack'
+    - '^Microsoft-CryptoAPI/|^WinHttp'
+
+- class: browser
+  patterns:
+    - '^Mozilla/5\.0 .*(Chrome|Chromium|CriOS|Firefox|FxiOS|Safari|Edg|OPR|SamsungBrowser)/'
+    - '^Mozilla/5\.0 \(compatible; MSIE |Trident/'
+    - '^Opera/'
+`
@@ -0,0 +1,133 @@
+// Package useragent classifies HTTP clients by user agent (e.g. as browsers,
+// bots or uptime monitors), using a database of patterns.
+package useragent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/swfrench/nginx-log-consumer/parser"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ClassField is the name of the record field to which the Classifier
+	// writes the client class.
+	ClassField = "client_class"
+
+	// DefaultField is the name of the record field holding the user agent
+	// (as in the log_format suggested in README.md).
+	DefaultField = "http_user_agent"
+)
+
+// Client classes.
+const (
+	Browser = "browser"
+	Bot     = "bot"
+	Monitor = "monitor"
+	Library = "library"
+	Unknown = "unknown"
+)
+
+// Classes returns the classes which patterns may assign, in addition to
+// Unknown.
+func Classes() []string {
+	return []string{Browser, Bot, Monitor, Library}
+}
+
+// entry describes the patterns of a class, as read from a database.
+type entry struct {
+	Class    string   `yaml:"class"`
+	Patterns []string `yaml:"patterns"`
+}
+
+// pattern is a compiled pattern.
+type pattern struct {
+	class string
+	re    *regexp.Regexp
+}
+
+// Classifier assigns user agents to the class of the first pattern matching
+// them, or Unknown if none does (or the user agent is empty). It implements
+// parser.Enricher, writing the class of the user agent in Field to ClassField.
+type Classifier struct {
+	// Field names the record field holding the user agent.
+	Field    string
+	patterns []pattern
+}
+
+// Parse returns a Classifier using the supplied database: A YAML list of
+// entries, each with a class (see Classes) and a list of patterns (regular
+// expressions), tried in order. See Default for an example.
+func Parse(b []byte) (*Classifier, error) {
+	var entries []entry
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(&entries); err != nil {
+		return nil, err
+	}
+	c := &Classifier{Field: DefaultField}
+	for i, e := range entries {
+		known := false
+		for _, class := range Classes() {
+			known = known || class == e.Class
+		}
+		if !known {
+			return nil, fmt.Errorf("entry %d: unknown class %q", i, e.Class)
+		}
+		for _, p := range e.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("entry %d (%s): invalid pattern: %v", i, e.Class, err)
+			}
+			c.patterns = append(c.patterns, pattern{class: e.Class, re: re})
+		}
+	}
+	return c, nil
+}
+
+// Load returns a Classifier using the database in the file at the supplied
+// path (see Parse).
+func Load(path string) (*Classifier, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Default returns a Classifier using the bundled database (see
+// DefaultPatterns).
+func Default() *Classifier {
+	c, err := Parse([]byte(DefaultPatterns))
+	if err != nil {
+		panic(fmt.Sprintf("invalid bundled user agent patterns: %v", err))
+	}
+	return c
+}
+
+// Classify returns the class of the supplied user agent.
+func (c *Classifier) Classify(ua string) string {
+	if ua == "" || ua == "-" {
+		return Unknown
+	}
+	for _, p := range c.patterns {
+		if p.re.MatchString(ua) {
+			return p.class
+		}
+	}
+	return Unknown
+}
+
+// Enrich sets the ClassField of the supplied record to the class of its user
+// agent.
+func (c *Classifier) Enrich(r parser.Record) {
+	r[ClassField] = c.Classify(r[c.Field])
+}
@@ -0,0 +1,96 @@
+package useragent_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/swfrench/nginx-log-consumer/parser"
+	"github.com/swfrench/nginx-log-consumer/useragent"
+)
+
+func TestClassify(t *testing.T) {
+	c := useragent.Default()
+	for _, tc := range []struct {
+		ua   string
+		want string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", useragent.Browser},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", useragent.Browser},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", useragent.Bot},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", useragent.Bot},
+		{"GoogleHC/1.0", useragent.Monitor},
+		{"kube-probe/1.27", useragent.Monitor},
+		{"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", useragent.Monitor},
+		{"curl/8.4.0", useragent.Library},
+		{"python-requests/2.31.0", useragent.Library},
+		{"Go-http-client/1.1", useragent.Library},
+		{"", useragent.Unknown},
+		{"-", useragent.Unknown},
+		{"SomethingElse", useragent.Unknown},
+	} {
+		if got := c.Classify(tc.ua); got != tc.want {
+			t.Errorf("Expected %q to be classified as %s, got %s", tc.ua, tc.want, got)
+		}
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	c := useragent.Default()
+	c.Field = "ua"
+	r := parser.Record{"ua": "curl/8.4.0"}
+	c.Enrich(r)
+	if want, got := useragent.Library, r[useragent.ClassField]; got != want {
+		t.Errorf("Expected %s to be %q, got %q", useragent.ClassField, want, got)
+	}
+
+	r = parser.Record{}
+	c.Enrich(r)
+	if want, got := useragent.Unknown, r[useragent.ClassField]; got != want {
+		t.Errorf("Expected %s to be %q without a user agent, got %q", useragent.ClassField, want, got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, db := range []string{
+		"- class: robot\n  patterns: ['x']\n",
+		"- class: bot\n  patterns: ['(']\n",
+		"- class: bot\n  regex: ['x']\n",
+		"class: bot\n",
+	} {
+		if _, err := useragent.Parse([]byte(db)); err == nil {
+			t.Errorf("Expected Parse to fail for %q", db)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "useragent_test")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "patterns.yaml")
+	if err := ioutil.WriteFile(path, []byte("- class: monitor\n  patterns: ['^internal-probe/']\n- class: browser\n  patterns: ['^Mozilla/']\n"), 0644); err != nil {
+		t.Fatalf("Could not write %s: %v", path, err)
+	}
+	c, err := useragent.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed with %v", err)
+	}
+	for ua, want := range map[string]string{
+		"internal-probe/1.0": useragent.Monitor,
+		"Mozilla/5.0":        useragent.Browser,
+		"curl/8.4.0":         useragent.Unknown,
+	} {
+		if got := c.Classify(ua); got != want {
+			t.Errorf("Expected %q to be classified as %s, got %s", ua, want, got)
+		}
+	}
+
+	if _, err := useragent.Load(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("Expected Load to fail for a missing file")
+	}
+}
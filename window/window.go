@@ -0,0 +1,90 @@
+// Package window accumulates values over sliding windows of event time (e.g.
+// record timestamps), divided into fixed steps, in bounded memory.
+package window
+
+import "time"
+
+// Ring holds a value (e.g. counts) for each of the N steps of Step ending at
+// (and including) the latest step added to, so covering a window of N*Step.
+// Steps are identified by their start time. It is not safe for concurrent
+// use.
+type Ring[T any] struct {
+	step  time.Duration
+	slots []T
+	// end is the start of the latest step added to.
+	end time.Time
+}
+
+// New returns an empty Ring of n steps of the supplied duration.
+func New[T any](step time.Duration, n int) *Ring[T] {
+	return &Ring[T]{
+		step:  step,
+		slots: make([]T, n),
+	}
+}
+
+// Window returns the period covered by the Ring.
+func (r *Ring[T]) Window() time.Duration {
+	return time.Duration(len(r.slots)) * r.step
+}
+
+// End returns the start of the latest step added to, which is zero if the
+// Ring is empty.
+func (r *Ring[T]) End() time.Time {
+	return r.end
+}
+
+// slot returns the index of the step starting at the supplied time.
+func (r *Ring[T]) slot(start time.Time) int {
+	n := int64(len(r.slots))
+	return int((start.UnixNano()/int64(r.step)%n + n) % n)
+}
+
+// contains returns true if the step starting at the supplied time is held.
+func (r *Ring[T]) contains(start time.Time) bool {
+	return !r.end.IsZero() && !start.After(r.end) && start.After(r.end.Add(-r.Window()))
+}
+
+// Add returns the value of the step containing ts, to be updated in place. If
+// the step is later than the latest, those falling out of the window are first
+// cleared (to the zero value). It returns nil if the step precedes the window.
+func (r *Ring[T]) Add(ts time.Time) *T {
+	start := ts.Truncate(r.step)
+	switch {
+	case r.end.IsZero():
+		r.end = start
+	case start.After(r.end):
+		var zero T
+		for s, n := r.end.Add(r.step), 0; !s.After(start) && n < len(r.slots); s, n = s.Add(r.step), n+1 {
+			r.slots[r.slot(s)] = zero
+		}
+		r.end = start
+	case !r.contains(start):
+		return nil
+	}
+	return &r.slots[r.slot(start)]
+}
+
+// Get returns the value of the step starting at the supplied time, or the
+// zero value if it is not held.
+func (r *Ring[T]) Get(start time.Time) T {
+	if !r.contains(start) {
+		var zero T
+		return zero
+	}
+	return r.slots[r.slot(start)]
+}
+
+// Each calls f with the value of each step held starting within the supplied
+// window ending at now (i.e. after now-window, and not after now).
+func (r *Ring[T]) Each(now time.Time, window time.Duration, f func(T)) {
+	last := now.Truncate(r.step)
+	if last.After(r.end) {
+		last = r.end
+	}
+	for s, n := last, 0; s.After(now.Add(-window)) && n < len(r.slots); s, n = s.Add(-r.step), n+1 {
+		if r.contains(s) {
+			f(r.slots[r.slot(s)])
+		}
+	}
+}
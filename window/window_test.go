@@ -0,0 +1,64 @@
+package window_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swfrench/nginx-log-consumer/window"
+)
+
+// sum returns the sum of the values of r over the supplied window ending at
+// now.
+func sum(r *window.Ring[int], now time.Time, w time.Duration) int {
+	total := 0
+	r.Each(now, w, func(n int) { total += n })
+	return total
+}
+
+func TestRing(t *testing.T) {
+	r := window.New[int](time.Minute, 5)
+	if !r.End().IsZero() {
+		t.Errorf("Expected an empty Ring to have no end, got %v", r.End())
+	}
+
+	start := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, 30 * time.Second, 2 * time.Minute, 4 * time.Minute} {
+		*r.Add(start.Add(offset))++
+	}
+	if want, got := start.Add(4*time.Minute), r.End(); !want.Equal(got) {
+		t.Errorf("Expected end %v, got %v", want, got)
+	}
+	now := start.Add(4*time.Minute + 30*time.Second)
+	if want, got := 4, sum(r, now, 5*time.Minute); want != got {
+		t.Errorf("Expected %d over the window, got %d", want, got)
+	}
+	if want, got := 2, sum(r, now, 3*time.Minute); want != got {
+		t.Errorf("Expected %d over the last 3m, got %d", want, got)
+	}
+
+	// Steps falling out of the window are cleared.
+	*r.Add(start.Add(6 * time.Minute))++
+	var got []int
+	for i := 0; i < 7; i++ {
+		got = append(got, r.Get(start.Add(time.Duration(i)*time.Minute)))
+	}
+	if want := []int{0, 0, 1, 0, 1, 0, 1}; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected values %v by step, got %v", want, got)
+	}
+
+	// Steps preceding the window are ignored.
+	if p := r.Add(start.Add(time.Minute)); p != nil {
+		t.Errorf("Expected no value for a step preceding the window, got %d", *p)
+	}
+	*r.Add(start.Add(5 * time.Minute))++
+	if want, got := 4, sum(r, start.Add(time.Hour), 2*time.Hour); want != got {
+		t.Errorf("Expected %d over a window beyond the latest step, got %d", want, got)
+	}
+
+	// Adding well beyond the window clears every step.
+	*r.Add(start.Add(time.Hour))++
+	if want, got := 1, sum(r, start.Add(time.Hour), time.Hour); want != got {
+		t.Errorf("Expected %d after the window passed, got %d", want, got)
+	}
+}